@@ -0,0 +1,75 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package json
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// versionMagic is the first byte of the VersionedJSON header. JSON text
+// can't start with a NUL byte, so versioned and unversioned encodings can't
+// be mistaken for each other.
+const versionMagic byte = 0x00
+
+var (
+	// ErrMissingVersion is returned by VersionedJSON.Decode when the input
+	// doesn't start with a version header.
+	ErrMissingVersion = errors.New("json: missing version header")
+	// ErrUnknownVersion is returned by VersionedJSON.Decode when the input
+	// was encoded with a version newer than the decoder's.
+	ErrUnknownVersion = errors.New("json: unknown version")
+)
+
+// VersionedJSON encodes events as JSON prefixed with a two byte header,
+// holding a magic byte followed by Version. It allows evolving the wire
+// format: Decode accepts the inputs encoded with Version or an older
+// version, and refuses the inputs encoded with a newer version.
+type VersionedJSON struct {
+	// Version is written in the header of the encoded events, and is the
+	// newest version accepted by Decode.
+	Version uint8
+}
+
+// Encode accepts a model.APMEvent and returns its versioned JSON
+// representation.
+func (v VersionedJSON) Encode(in model.APMEvent) ([]byte, error) {
+	encoded, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{versionMagic, v.Version}, encoded...), nil
+}
+
+// Decode decodes a versioned JSON encoded model.APMEvent into its struct
+// form. It returns an error wrapping ErrMissingVersion or ErrUnknownVersion
+// when the header is missing or holds a newer version than Version.
+func (v VersionedJSON) Decode(in []byte, out *model.APMEvent) error {
+	if len(in) < 2 || in[0] != versionMagic {
+		return ErrMissingVersion
+	}
+	if version := in[1]; version > v.Version {
+		return fmt.Errorf("%w %d: newest supported version is %d",
+			ErrUnknownVersion, version, v.Version,
+		)
+	}
+	return json.Unmarshal(in[2:], out)
+}
@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package json
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestVersionedJSON(t *testing.T) {
+	event := model.APMEvent{Message: "message"}
+	encode := func(t *testing.T, version uint8) []byte {
+		encoded, err := VersionedJSON{Version: version}.Encode(event)
+		require.NoError(t, err)
+		return encoded
+	}
+
+	t.Run("header", func(t *testing.T) {
+		encoded := encode(t, 3)
+		plain, err := JSON{}.Encode(event)
+		require.NoError(t, err)
+		assert.Equal(t, append([]byte{0x00, 3}, plain...), encoded)
+	})
+	t.Run("same version", func(t *testing.T) {
+		var out model.APMEvent
+		require.NoError(t, VersionedJSON{Version: 2}.Decode(encode(t, 2), &out))
+		assert.Equal(t, event.Message, out.Message)
+	})
+	t.Run("backward", func(t *testing.T) {
+		// Events encoded with an older version are decoded.
+		var out model.APMEvent
+		require.NoError(t, VersionedJSON{Version: 2}.Decode(encode(t, 1), &out))
+		assert.Equal(t, event.Message, out.Message)
+	})
+	t.Run("forward", func(t *testing.T) {
+		// Events encoded with a newer version are refused.
+		var out model.APMEvent
+		err := VersionedJSON{Version: 1}.Decode(encode(t, 2), &out)
+		assert.ErrorIs(t, err, ErrUnknownVersion)
+		assert.EqualError(t, err, "json: unknown version 2: newest supported version is 1")
+		assert.Zero(t, out)
+	})
+	t.Run("missing version", func(t *testing.T) {
+		plain, err := JSON{}.Encode(event)
+		require.NoError(t, err)
+		var out model.APMEvent
+		for _, in := range [][]byte{plain, nil, {0x00}} {
+			assert.ErrorIs(t, VersionedJSON{Version: 1}.Decode(in, &out), ErrMissingVersion)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package zstd provides an encoder/decoder which compresses the output of
+// another codec with zstd, optionally using a precomputed dictionary.
+package zstd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// uncompressedHeader prefixes the values stored uncompressed because they're
+// smaller than the MinCompressSize. zstd frames never start with it.
+const uncompressedHeader = 0x00
+
+// ErrDictionaryMismatch is returned by Decode when the input was compressed
+// with a dictionary other than the configured one.
+var ErrDictionaryMismatch = errors.New("zstd: dictionary mismatch")
+
+// Codec encodes and decodes the events before they're compressed and after
+// they're decompressed.
+type Codec interface {
+	// Encode accepts a model.APMEvent and returns the encoded representation.
+	Encode(model.APMEvent) ([]byte, error)
+	// Decode decodes an encoded model.APMEvent into its struct form.
+	Decode([]byte, *model.APMEvent) error
+}
+
+// Config holds the configuration of a Zstd codec.
+type Config struct {
+	// Codec encodes the events which are then compressed, and decodes the
+	// decompressed events.
+	Codec Codec
+	// Dictionary is a precomputed zstd dictionary, for example trained with
+	// `zstd --train` on representative events, used both to compress and to
+	// decompress. Dictionaries improve the compression ratio of small and
+	// repetitive events. Both the producer and the consumer must use the
+	// same dictionary. Events are compressed with the better compression
+	// level when a dictionary is set, since the default level makes little
+	// use of it.
+	Dictionary []byte
+	// MinCompressSize, when set, is the size of the encoded events below
+	// which they're stored uncompressed, since compressing tiny events
+	// wastes CPU and can inflate them. Uncompressed events are prefixed
+	// with a one byte header. Decode handles both compressed and
+	// uncompressed events, regardless of MinCompressSize.
+	MinCompressSize int
+}
+
+// Zstd compresses the events encoded by the configured Codec.
+type Zstd struct {
+	codec           Codec
+	encoder         *zstd.Encoder
+	decoder         *zstd.Decoder
+	minCompressSize int
+}
+
+// New returns a new Zstd codec with the given config.
+func New(cfg Config) (*Zstd, error) {
+	if cfg.Codec == nil {
+		return nil, errors.New("zstd: codec must be set")
+	}
+	var eopts []zstd.EOption
+	var dopts []zstd.DOption
+	if len(cfg.Dictionary) > 0 {
+		eopts = append(eopts,
+			zstd.WithEncoderDict(cfg.Dictionary),
+			zstd.WithEncoderLevel(zstd.SpeedBetterCompression),
+		)
+		dopts = append(dopts, zstd.WithDecoderDicts(cfg.Dictionary))
+	}
+	encoder, err := zstd.NewWriter(nil, eopts...)
+	if err != nil {
+		return nil, fmt.Errorf("zstd: failed to create encoder: %w", err)
+	}
+	decoder, err := zstd.NewReader(nil, dopts...)
+	if err != nil {
+		encoder.Close()
+		return nil, fmt.Errorf("zstd: failed to create decoder: %w", err)
+	}
+	return &Zstd{
+		codec:           cfg.Codec,
+		encoder:         encoder,
+		decoder:         decoder,
+		minCompressSize: cfg.MinCompressSize,
+	}, nil
+}
+
+// Encode encodes the event with the configured Codec and compresses it,
+// unless it's smaller than the MinCompressSize.
+func (z *Zstd) Encode(in model.APMEvent) ([]byte, error) {
+	encoded, err := z.codec.Encode(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) < z.minCompressSize {
+		out := make([]byte, 0, len(encoded)+1)
+		out = append(out, uncompressedHeader)
+		return append(out, encoded...), nil
+	}
+	return z.encoder.EncodeAll(encoded, nil), nil
+}
+
+// Decode decompresses in, unless it was stored uncompressed, and decodes it
+// with the configured Codec. It returns
+// an error wrapping ErrDictionaryMismatch when in was compressed with a
+// different dictionary.
+func (z *Zstd) Decode(in []byte, out *model.APMEvent) error {
+	if len(in) > 0 && in[0] == uncompressedHeader {
+		return z.codec.Decode(in[1:], out)
+	}
+	decompressed, err := z.decoder.DecodeAll(in, nil)
+	if err != nil {
+		if errors.Is(err, zstd.ErrUnknownDictionary) {
+			return fmt.Errorf("%w: %s", ErrDictionaryMismatch, err)
+		}
+		return err
+	}
+	return z.codec.Decode(decompressed, out)
+}
+
+// Close releases the resources held by the codec.
+func (z *Zstd) Close() error {
+	z.decoder.Close()
+	return z.encoder.Close()
+}
@@ -0,0 +1,142 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// event is a small JSON document similar to the ones the testdata dictionary
+// was trained on with `zstd --train --maxdict=4096 --dictID=1`: 2000
+// transaction events with random services, environments, names, durations,
+// outcomes and trace IDs.
+const event = `{"service":{"name":"opbeans-go","environment":"production"},` +
+	`"transaction":{"name":"GET /api/orders","type":"request",` +
+	`"duration":{"us":4213},"outcome":"success"},` +
+	`"trace":{"id":"4bf92f3577b34da6a3ce929d0e0e4736"},"event":{"outcome":"success"}}`
+
+func TestZstdRoundTrip(t *testing.T) {
+	dict := readDictionary(t)
+	for name, dict := range map[string][]byte{"no_dictionary": nil, "dictionary": dict} {
+		t.Run(name, func(t *testing.T) {
+			z := newZstd(t, dict)
+			encoded, err := z.Encode(model.APMEvent{Message: event})
+			require.NoError(t, err)
+
+			var decoded model.APMEvent
+			require.NoError(t, z.Decode(encoded, &decoded))
+			assert.Equal(t, event, decoded.Message)
+		})
+	}
+}
+
+func TestZstdDictionaryRatio(t *testing.T) {
+	withoutDict, err := newZstd(t, nil).Encode(model.APMEvent{Message: event})
+	require.NoError(t, err)
+	withDict, err := newZstd(t, readDictionary(t)).Encode(model.APMEvent{Message: event})
+	require.NoError(t, err)
+
+	t.Logf("original: %d, without dictionary: %d, with dictionary: %d",
+		len(event), len(withoutDict), len(withDict),
+	)
+	assert.Less(t, len(withDict), len(withoutDict))
+	assert.Less(t, len(withDict), len(event)/2)
+}
+
+func TestZstdDictionaryMismatch(t *testing.T) {
+	dict := readDictionary(t)
+	// Same dictionary content with a different dictionary ID.
+	other := append([]byte(nil), dict...)
+	binary.LittleEndian.PutUint32(other[4:], 2)
+
+	encoded, err := newZstd(t, dict).Encode(model.APMEvent{Message: event})
+	require.NoError(t, err)
+
+	for name, dict := range map[string][]byte{"no_dictionary": nil, "other_dictionary": other} {
+		t.Run(name, func(t *testing.T) {
+			var decoded model.APMEvent
+			err := newZstd(t, dict).Decode(encoded, &decoded)
+			assert.ErrorIs(t, err, ErrDictionaryMismatch)
+		})
+	}
+}
+
+func TestZstdMinCompressSize(t *testing.T) {
+	z, err := New(Config{Codec: messageCodec{}, MinCompressSize: 64})
+	require.NoError(t, err)
+	t.Cleanup(func() { z.Close() })
+
+	small, err := z.Encode(model.APMEvent{Message: "small"})
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{uncompressedHeader}, "small"...), small)
+
+	large, err := z.Encode(model.APMEvent{Message: event})
+	require.NoError(t, err)
+	assert.Less(t, len(large), len(event))
+	assert.Equal(t, []byte{0x28, 0xb5, 0x2f, 0xfd}, large[:4], "zstd frame magic")
+
+	// Both are decoded, as are the events compressed without the option.
+	compressed, err := newZstd(t, nil).Encode(model.APMEvent{Message: "small"})
+	require.NoError(t, err)
+	for in, want := range map[string]string{
+		string(small):      "small",
+		string(large):      event,
+		string(compressed): "small",
+	} {
+		var decoded model.APMEvent
+		require.NoError(t, z.Decode([]byte(in), &decoded))
+		assert.Equal(t, want, decoded.Message)
+	}
+}
+
+func TestNewZstd(t *testing.T) {
+	_, err := New(Config{})
+	assert.EqualError(t, err, "zstd: codec must be set")
+}
+
+func readDictionary(t testing.TB) []byte {
+	dict, err := os.ReadFile("testdata/events.dict")
+	require.NoError(t, err)
+	return dict
+}
+
+func newZstd(t testing.TB, dict []byte) *Zstd {
+	z, err := New(Config{Codec: messageCodec{}, Dictionary: dict})
+	require.NoError(t, err)
+	t.Cleanup(func() { z.Close() })
+	return z
+}
+
+// messageCodec encodes and decodes the event message as is.
+type messageCodec struct{}
+
+func (messageCodec) Encode(event model.APMEvent) ([]byte, error) {
+	return []byte(event.Message), nil
+}
+
+func (messageCodec) Decode(in []byte, event *model.APMEvent) error {
+	event.Message = string(in)
+	return nil
+}
@@ -0,0 +1,151 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+// RecordAcker acknowledges the records passed to an AckProcessor. It is safe
+// for concurrent use. Records which are neither acknowledged nor rejected
+// when the AckProcessor returns are handled as rejected.
+type RecordAcker struct {
+	mu   sync.Mutex
+	acks map[*kgo.Record]error
+}
+
+func newRecordAcker() *RecordAcker {
+	return &RecordAcker{acks: make(map[*kgo.Record]error)}
+}
+
+// Ack acknowledges that record was processed, so its offset can be committed.
+func (a *RecordAcker) Ack(record *kgo.Record) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acks[record] = nil
+}
+
+// Nack rejects record, which failed to be processed with err. Neither its
+// offset nor the offsets of the records after it in the same partition are
+// committed, and the records are fetched again.
+func (a *RecordAcker) Nack(record *kgo.Record, err error) {
+	if err == nil {
+		err = errUnacknowledged
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acks[record] = err
+}
+
+// result returns whether record was acknowledged, or the error it was
+// rejected with.
+func (a *RecordAcker) result(record *kgo.Record) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err, ok := a.acks[record]
+	if !ok {
+		return false, errUnacknowledged
+	}
+	return err == nil, err
+}
+
+// errUnacknowledged is the error of the records which were rejected without
+// an error, or not acknowledged at all.
+var errUnacknowledged = errors.New("kafka: record not acknowledged")
+
+// processAcknowledged passes the records of the fetches to AckProcessor, and
+// returns the last record of each partition up to which all the records were
+// acknowledged. The partitions with records which weren't acknowledged are
+// rewound to the first of them, so they're fetched again.
+func (c *Consumer) processAcknowledged(fetches kgo.Fetches) []*kgo.Record {
+	acker := newRecordAcker()
+	var records []*kgo.Record
+	fetches.EachRecord(func(r *kgo.Record) {
+		if c.skip(r) {
+			// Skipped records don't hold back the partition.
+			acker.Ack(r)
+			return
+		}
+		records = append(records, r)
+	})
+	if len(records) > 0 {
+		c.cfg.AckProcessor(context.Background(), records, acker)
+	}
+	for _, r := range records {
+		if ok, _ := acker.result(r); ok {
+			c.processed.Add(1)
+		}
+	}
+
+	var acked []*kgo.Record
+	rewind := make(map[string]map[int32]kgo.EpochOffset)
+	fetches.EachPartition(func(fp kgo.FetchTopicPartition) {
+		var last *kgo.Record
+		for _, r := range fp.Records {
+			ok, err := acker.result(r)
+			if !ok {
+				c.cfg.Logger.Error("record was not acknowledged, rewinding partition",
+					zap.Error(err),
+					zap.String("topic", r.Topic),
+					zap.Int64("offset", r.Offset),
+					zap.Int32("partition", r.Partition),
+				)
+				if rewind[fp.Topic] == nil {
+					rewind[fp.Topic] = make(map[int32]kgo.EpochOffset)
+				}
+				rewind[fp.Topic][fp.Partition] = kgo.EpochOffset{
+					Epoch:  r.LeaderEpoch,
+					Offset: r.Offset,
+				}
+				break
+			}
+			last = r
+		}
+		if last != nil {
+			acked = append(acked, last)
+		}
+	})
+	if len(rewind) > 0 {
+		c.setOffsets(rewind)
+	}
+	return acked
+}
+
+// recordOffsets returns the offsets to commit for records, which is the
+// offset of the next record to consume from each of their partitions.
+func recordOffsets(records []*kgo.Record) map[string]map[int32]kgo.EpochOffset {
+	offsets := make(map[string]map[int32]kgo.EpochOffset)
+	for _, r := range records {
+		if offsets[r.Topic] == nil {
+			offsets[r.Topic] = make(map[int32]kgo.EpochOffset)
+		}
+		if current, ok := offsets[r.Topic][r.Partition]; ok && current.Offset > r.Offset {
+			continue
+		}
+		offsets[r.Topic][r.Partition] = kgo.EpochOffset{
+			Epoch:  r.LeaderEpoch,
+			Offset: r.Offset + 1,
+		}
+	}
+	return offsets
+}
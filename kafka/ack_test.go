@@ -0,0 +1,155 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerAckProcessor(t *testing.T) {
+	newRecords := func(partition int32, n int) []*kgo.Record {
+		records := make([]*kgo.Record, n)
+		for i := range records {
+			records[i] = &kgo.Record{Topic: "topic", Partition: partition, Offset: int64(i)}
+		}
+		return records
+	}
+	p0, p1 := newRecords(0, 4), newRecords(1, 2)
+	fetches := kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic: "topic",
+		Partitions: []kgo.FetchPartition{
+			{Partition: 0, Records: p0},
+			{Partition: 1, Records: p1},
+		},
+	}}}}
+
+	var received []*kgo.Record
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Delivery: apmqueue.AtLeastOnceDeliveryType,
+		AckProcessor: func(_ context.Context, records []*kgo.Record, acker *RecordAcker) {
+			received = records
+			acker.Ack(p0[0])
+			acker.Ack(p0[1])
+			acker.Nack(p0[2], errors.New("processing failed"))
+			acker.Ack(p0[3])
+			acker.Ack(p1[0])
+			acker.Ack(p1[1])
+		},
+	})
+	var committed []*kgo.Record
+	consumer.commitRecords = func(_ context.Context, records ...*kgo.Record) error {
+		committed = append(committed, records...)
+		return nil
+	}
+	var rewound map[string]map[int32]kgo.EpochOffset
+	consumer.setOffsets = func(offsets map[string]map[int32]kgo.EpochOffset) {
+		rewound = offsets
+	}
+	consumer.consume(context.Background(), fetches)
+
+	assert.Equal(t, append(append([]*kgo.Record(nil), p0...), p1...), received)
+	// Partition 0 only advances up to the record before the rejected one,
+	// and is rewound to it, even though the record after it was acked.
+	assert.Equal(t, []*kgo.Record{p0[1], p1[1]}, committed)
+	assert.Equal(t, map[string]map[int32]kgo.EpochOffset{
+		"topic": {0: {Offset: 2}},
+	}, rewound)
+	assert.Equal(t, int64(5), consumer.Stats().Processed)
+}
+
+func TestConsumerAckProcessorOffsetStore(t *testing.T) {
+	store := newMemoryOffsetStore()
+	records := []*kgo.Record{
+		{Topic: "topic", Offset: 10},
+		{Topic: "topic", Offset: 11},
+		{Topic: "topic", Offset: 12},
+	}
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Delivery:    apmqueue.AtLeastOnceDeliveryType,
+		OffsetStore: store,
+		AckProcessor: func(_ context.Context, records []*kgo.Record, acker *RecordAcker) {
+			// The last record is neither acked nor nacked.
+			acker.Ack(records[0])
+			acker.Ack(records[1])
+		},
+	})
+	consumer.setOffsets = func(map[string]map[int32]kgo.EpochOffset) {}
+	consumer.consume(context.Background(), kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic:      "topic",
+		Partitions: []kgo.FetchPartition{{Records: records}},
+	}}}})
+	offset, err := store.Load("groupid", "topic", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), offset)
+}
+
+func TestConsumerAckProcessorValidate(t *testing.T) {
+	ackProcessor := func(context.Context, []*kgo.Record, *RecordAcker) {}
+	valid := ConsumerConfig{
+		Brokers:      []string{"localhost:9092"},
+		Topics:       []string{"topic"},
+		GroupID:      "groupid",
+		Logger:       zap.NewNop(),
+		Delivery:     apmqueue.AtLeastOnceDeliveryType,
+		AckProcessor: ackProcessor,
+	}
+	assert.NoError(t, valid.Validate())
+
+	for name, tc := range map[string]struct {
+		mutate      func(*ConsumerConfig)
+		expectedErr string
+	}{
+		"processor": {
+			mutate: func(cfg *ConsumerConfig) {
+				cfg.Decoder = messageDecoder{}
+				cfg.Processor = model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+					return nil
+				})
+			},
+			expectedErr: "kafka: ack processor cannot be used with processor or raw bytes processor",
+		},
+		"at_most_once": {
+			mutate:      func(cfg *ConsumerConfig) { cfg.Delivery = apmqueue.AtMostOnceDeliveryType },
+			expectedErr: "kafka: ack processor requires at least once delivery",
+		},
+		"concurrency": {
+			mutate:      func(cfg *ConsumerConfig) { cfg.Concurrency = 2 },
+			expectedErr: "kafka: ack processor cannot be used with concurrency",
+		},
+		"no_commit": {
+			mutate:      func(cfg *ConsumerConfig) { cfg.NoCommit = true },
+			expectedErr: "kafka: ack processor cannot be used with no commit",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid
+			tc.mutate(&cfg)
+			assert.EqualError(t, cfg.Validate(), tc.expectedErr)
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// adaptiveMinLinger and adaptiveMaxLinger bound how long records are
+	// buffered before being flushed with AdaptiveBatching.
+	adaptiveMinLinger = time.Millisecond
+	adaptiveMaxLinger = time.Second
+	// adaptiveMinBatchBytes and adaptiveMaxBatchBytes bound how many bytes
+	// are buffered before being flushed with AdaptiveBatching.
+	adaptiveMinBatchBytes = 16 << 10
+	adaptiveMaxBatchBytes = 1 << 20
+	// defaultMaxBufferedRecords is the Kafka client's default for
+	// MaxBufferedRecords.
+	defaultMaxBufferedRecords = 10000
+)
+
+// adaptiveBatching adjusts how long records are buffered before they're
+// flushed, and how many bytes are buffered at most, to the throttling
+// reported by the brokers. Throttled requests grow both, so that fewer and
+// larger requests are issued, while they shrink back after every flush which
+// wasn't throttled.
+type adaptiveBatching struct {
+	mu         sync.Mutex
+	linger     time.Duration
+	batchBytes int64
+	throttled  bool
+
+	// slots limits the number of buffered records, since the client buffer
+	// isn't bounded when flushing manually.
+	slots *semaphore.Weighted
+	// buffered is signaled when records are buffered, and full when the
+	// buffered bytes reach batchBytes.
+	buffered chan struct{}
+	full     chan struct{}
+}
+
+func newAdaptiveBatching(maxBufferedRecords int) *adaptiveBatching {
+	if maxBufferedRecords <= 0 {
+		maxBufferedRecords = defaultMaxBufferedRecords
+	}
+	return &adaptiveBatching{
+		linger:     adaptiveMinLinger,
+		batchBytes: adaptiveMinBatchBytes,
+		slots:      semaphore.NewWeighted(int64(maxBufferedRecords)),
+		buffered:   make(chan struct{}, 1),
+		full:       make(chan struct{}, 1),
+	}
+}
+
+// OnBrokerThrottle implements kgo.HookBrokerThrottle, doubling the linger,
+// up to at least the throttle interval, and the batch bytes.
+func (a *adaptiveBatching) OnBrokerThrottle(_ kgo.BrokerMetadata, interval time.Duration, _ bool) {
+	if interval <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.throttled = true
+	linger := 2 * a.linger
+	if linger < interval {
+		linger = interval
+	}
+	a.linger = clampDuration(linger, adaptiveMinLinger, adaptiveMaxLinger)
+	a.batchBytes = clampInt64(2*a.batchBytes, adaptiveMinBatchBytes, adaptiveMaxBatchBytes)
+}
+
+// flushed shrinks the linger and the batch bytes by a quarter, unless the
+// brokers throttled requests since the previous flush.
+func (a *adaptiveBatching) flushed() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.throttled {
+		a.throttled = false
+		return
+	}
+	a.linger = clampDuration(a.linger-a.linger/4, adaptiveMinLinger, adaptiveMaxLinger)
+	a.batchBytes = clampInt64(a.batchBytes-a.batchBytes/4, adaptiveMinBatchBytes, adaptiveMaxBatchBytes)
+}
+
+// params returns the current linger and batch bytes.
+func (a *adaptiveBatching) params() (time.Duration, int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.linger, a.batchBytes
+}
+
+// recordBuffered notifies the flusher that records are buffered, and whether
+// the buffered bytes reached the batch bytes.
+func (a *adaptiveBatching) recordBuffered(bytes int64) {
+	select {
+	case a.buffered <- struct{}{}:
+	default:
+	}
+	if _, batchBytes := a.params(); bytes >= batchBytes {
+		select {
+		case a.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run flushes the buffered records once they've been buffered for the linger,
+// or once their size reaches the batch bytes, until ctx is done.
+func (a *adaptiveBatching) run(ctx context.Context, flush func(context.Context) error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.buffered:
+		}
+		linger, _ := a.params()
+		t := time.NewTimer(linger)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		case <-a.full:
+			t.Stop()
+		}
+		// Flush only fails when ctx is done.
+		flush(ctx)
+		a.flushed()
+		// The records which filled the batch have been flushed.
+		select {
+		case <-a.full:
+		default:
+		}
+	}
+}
+
+// adaptiveProduce wraps produce, blocking while MaxBufferedRecords records
+// are buffered and notifying the flusher of the buffered records.
+func (p *Producer) adaptiveProduce(
+	produce func(context.Context, *kgo.Record, func(*kgo.Record, error)),
+) func(context.Context, *kgo.Record, func(*kgo.Record, error)) {
+	return func(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		if err := p.adaptive.slots.Acquire(ctx, 1); err != nil {
+			promise(r, err)
+			return
+		}
+		produce(ctx, r, func(r *kgo.Record, err error) {
+			p.adaptive.slots.Release(1)
+			promise(r, err)
+		})
+		p.adaptive.recordBuffered(p.bufferedBytes.Load())
+	}
+}
+
+func clampDuration(d, min, max time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+func clampInt64(v, min, max int64) int64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,112 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestAdaptiveBatchingThrottle(t *testing.T) {
+	a := newAdaptiveBatching(0)
+	assertParams := func(linger time.Duration, batchBytes int64) {
+		t.Helper()
+		l, b := a.params()
+		assert.Equal(t, linger, l)
+		assert.Equal(t, batchBytes, b)
+	}
+	assertParams(adaptiveMinLinger, adaptiveMinBatchBytes)
+
+	// Throttling grows the linger to at least the throttle interval.
+	a.OnBrokerThrottle(kgo.BrokerMetadata{}, 50*time.Millisecond, true)
+	assertParams(50*time.Millisecond, 2*adaptiveMinBatchBytes)
+	a.OnBrokerThrottle(kgo.BrokerMetadata{}, 10*time.Millisecond, false)
+	assertParams(100*time.Millisecond, 4*adaptiveMinBatchBytes)
+	// No throttling leaves the parameters untouched.
+	a.OnBrokerThrottle(kgo.BrokerMetadata{}, 0, true)
+	assertParams(100*time.Millisecond, 4*adaptiveMinBatchBytes)
+
+	// The flush which observed throttling doesn't shrink the parameters,
+	// the next ones do.
+	a.flushed()
+	assertParams(100*time.Millisecond, 4*adaptiveMinBatchBytes)
+	a.flushed()
+	assertParams(75*time.Millisecond, 3*adaptiveMinBatchBytes)
+
+	// The parameters are bounded.
+	for i := 0; i < 20; i++ {
+		a.OnBrokerThrottle(kgo.BrokerMetadata{}, time.Second, true)
+	}
+	assertParams(adaptiveMaxLinger, adaptiveMaxBatchBytes)
+	for i := 0; i < 100; i++ {
+		a.flushed()
+	}
+	assertParams(adaptiveMinLinger, adaptiveMinBatchBytes)
+}
+
+func TestAdaptiveBatchingFlush(t *testing.T) {
+	a := newAdaptiveBatching(0)
+	flushed := make(chan time.Time, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.run(ctx, func(context.Context) error {
+			flushed <- time.Now()
+			return nil
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitFlush := func() time.Time {
+		t.Helper()
+		select {
+		case ts := <-flushed:
+			return ts
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for flush")
+		}
+		return time.Time{}
+	}
+
+	// Under throttling, buffered records are held for the longer linger.
+	a.OnBrokerThrottle(kgo.BrokerMetadata{}, 100*time.Millisecond, true)
+	start := time.Now()
+	a.recordBuffered(1)
+	assert.GreaterOrEqual(t, waitFlush().Sub(start), 100*time.Millisecond)
+
+	// Once the batch bytes are reached, records are flushed right away.
+	start = time.Now()
+	a.recordBuffered(adaptiveMaxBatchBytes)
+	assert.Less(t, waitFlush().Sub(start), 100*time.Millisecond)
+}
+
+func TestProducerAdaptiveBatching(t *testing.T) {
+	producer := newTestProducer(t, ProducerConfig{AdaptiveBatching: true})
+	assert.NotNil(t, producer.adaptive)
+	assert.NoError(t, producer.Close())
+
+	err := ProducerConfig{AdaptiveBatching: true, SpillDir: t.TempDir()}.Validate()
+	assert.ErrorContains(t, err, "kafka: adaptive batching cannot be used with spill dir")
+}
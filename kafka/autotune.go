@@ -0,0 +1,138 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// autoTuneMinInFlight is the lowest limit of records in flight with AutoTune.
+const autoTuneMinInFlight = 16
+
+// autoTune limits the number of records in flight, and adapts the limit to
+// the acknowledgement latency: the limit shrinks by a quarter, at most once
+// per round trip, when the latency is above twice the lowest latency
+// observed, and grows by one record for every record acknowledged below it.
+type autoTune struct {
+	max int
+
+	mu           sync.Mutex
+	limit        int
+	inFlight     int
+	minLatency   time.Duration
+	lastDecrease time.Time
+	// released is closed when a record is released, to wake up the
+	// producers waiting for the limit, nil when none are.
+	released chan struct{}
+}
+
+func newAutoTune(maxBufferedRecords int) *autoTune {
+	if maxBufferedRecords <= 0 {
+		maxBufferedRecords = defaultMaxBufferedRecords
+	}
+	max := maxBufferedRecords
+	if max < autoTuneMinInFlight {
+		max = autoTuneMinInFlight
+	}
+	return &autoTune{max: max, limit: max}
+}
+
+// acquire blocks until a record can be put in flight, or ctx is done.
+func (a *autoTune) acquire(ctx context.Context) error {
+	for {
+		a.mu.Lock()
+		if a.inFlight < a.limit {
+			a.inFlight++
+			a.mu.Unlock()
+			return nil
+		}
+		if a.released == nil {
+			a.released = make(chan struct{})
+		}
+		released := a.released
+		a.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// release takes a record out of flight once it has been acknowledged after
+// latency, or has failed, and adapts the limit to the latency of the
+// acknowledged records.
+func (a *autoTune) release(latency time.Duration, acked bool, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inFlight--
+	if a.released != nil {
+		close(a.released)
+		a.released = nil
+	}
+	if !acked {
+		return
+	}
+	if a.minLatency == 0 || latency < a.minLatency {
+		a.minLatency = latency
+	}
+	if latency <= 2*a.minLatency {
+		if a.limit < a.max {
+			a.limit++
+		}
+		return
+	}
+	if now.Sub(a.lastDecrease) < latency {
+		return
+	}
+	a.lastDecrease = now
+	a.limit -= a.limit / 4
+	if a.limit < autoTuneMinInFlight {
+		a.limit = autoTuneMinInFlight
+	}
+}
+
+// currentLimit returns the current limit of records in flight.
+func (a *autoTune) currentLimit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit
+}
+
+// autoTuneProduce wraps produce, blocking while the AutoTune limit of records
+// in flight is reached and measuring the acknowledgement latency.
+func (p *Producer) autoTuneProduce(
+	produce func(context.Context, *kgo.Record, func(*kgo.Record, error)),
+) func(context.Context, *kgo.Record, func(*kgo.Record, error)) {
+	return func(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		if err := p.autoTune.acquire(ctx); err != nil {
+			promise(r, err)
+			return
+		}
+		start := time.Now()
+		produce(ctx, r, func(r *kgo.Record, err error) {
+			now := time.Now()
+			p.autoTune.release(now.Sub(start), err == nil, now)
+			promise(r, err)
+		})
+	}
+}
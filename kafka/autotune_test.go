@@ -0,0 +1,155 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestAutoTuneLatency(t *testing.T) {
+	a := newAutoTune(100)
+	assert.Equal(t, 100, a.currentLimit())
+	now := time.Now()
+	observe := func(latency time.Duration) {
+		t.Helper()
+		require.NoError(t, a.acquire(context.Background()))
+		now = now.Add(latency)
+		a.release(latency, true, now)
+	}
+
+	// Low latency establishes the baseline, the limit is already maximal.
+	observe(10 * time.Millisecond)
+	assert.Equal(t, 100, a.currentLimit())
+
+	// Rising latency shrinks the limit by a quarter, at most once per round
+	// trip.
+	observe(50 * time.Millisecond)
+	assert.Equal(t, 75, a.currentLimit())
+	a.acquire(context.Background())
+	a.release(50*time.Millisecond, true, now.Add(time.Millisecond))
+	assert.Equal(t, 75, a.currentLimit())
+	observe(50 * time.Millisecond)
+	assert.Equal(t, 57, a.currentLimit())
+
+	// Failed records don't adapt the limit.
+	a.acquire(context.Background())
+	a.release(time.Second, false, now.Add(time.Second))
+	assert.Equal(t, 57, a.currentLimit())
+
+	// The limit is bounded.
+	for i := 0; i < 20; i++ {
+		observe(time.Second)
+	}
+	assert.Equal(t, autoTuneMinInFlight, a.currentLimit())
+
+	// Low latency grows the limit back, one record at a time.
+	observe(15 * time.Millisecond)
+	assert.Equal(t, autoTuneMinInFlight+1, a.currentLimit())
+	for i := 0; i < 200; i++ {
+		observe(15 * time.Millisecond)
+	}
+	assert.Equal(t, 100, a.currentLimit())
+}
+
+func TestAutoTuneAcquire(t *testing.T) {
+	a := newAutoTune(1)
+	for i := 0; i < autoTuneMinInFlight; i++ {
+		require.NoError(t, a.acquire(context.Background()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, a.acquire(ctx), context.DeadlineExceeded)
+
+	acquired := make(chan error)
+	go func() { acquired <- a.acquire(context.Background()) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquired above the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	a.release(time.Millisecond, true, time.Now())
+	select {
+	case err := <-acquired:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("not acquired after release")
+	}
+}
+
+func TestProducerAutoTune(t *testing.T) {
+	p := &Producer{autoTune: newAutoTune(64)}
+	var mu sync.Mutex
+	latency := 10 * time.Millisecond
+	var inFlight, maxInFlight int
+	produce := p.autoTuneProduce(func(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		d := latency
+		mu.Unlock()
+		time.AfterFunc(d, func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			promise(r, nil)
+		})
+	})
+	produceRecords := func(n int) {
+		var wg sync.WaitGroup
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			produce(context.Background(), &kgo.Record{}, func(*kgo.Record, error) { wg.Done() })
+		}
+		wg.Wait()
+	}
+
+	produceRecords(64)
+
+	// The brokers slow down: the in-flight limit backs off.
+	mu.Lock()
+	latency = 100 * time.Millisecond
+	mu.Unlock()
+	produceRecords(256)
+	limit := p.autoTune.currentLimit()
+	assert.Less(t, limit, 64)
+	mu.Lock()
+	assert.LessOrEqual(t, maxInFlight, 64)
+	maxInFlight = 0
+	mu.Unlock()
+	produceRecords(64)
+	mu.Lock()
+	assert.LessOrEqual(t, maxInFlight, limit)
+	mu.Unlock()
+
+	// The brokers recover: the in-flight limit grows back.
+	mu.Lock()
+	latency = 10 * time.Millisecond
+	mu.Unlock()
+	produceRecords(256)
+	assert.Greater(t, p.autoTune.currentLimit(), limit)
+}
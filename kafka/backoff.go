@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff determines how long to wait before retrying a failed operation.
+type Backoff interface {
+	// NextBackoff returns the duration to wait before the retry attempt.
+	// attempt starts at 1 for the first retry.
+	NextBackoff(attempt int) time.Duration
+}
+
+// ConstantBackoff waits the same duration before every attempt.
+type ConstantBackoff time.Duration
+
+// NextBackoff returns the constant backoff duration.
+func (b ConstantBackoff) NextBackoff(int) time.Duration {
+	return time.Duration(b)
+}
+
+// ExponentialBackoff multiplies the backoff duration on every attempt, up to
+// a maximum duration.
+type ExponentialBackoff struct {
+	// Initial is the duration to wait before the first attempt.
+	Initial time.Duration
+	// Max caps the backoff duration. Zero means no cap.
+	Max time.Duration
+	// Multiplier applied to the duration on every attempt. Defaults to 2.
+	Multiplier float64
+}
+
+// NextBackoff returns Initial * Multiplier^(attempt-1), capped to Max.
+func (b ExponentialBackoff) NextBackoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	multiplier := b.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	d := float64(b.Initial) * math.Pow(multiplier, float64(attempt-1))
+	if b.Max > 0 && d > float64(b.Max) {
+		return b.Max
+	}
+	if d > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// JitterBackoff randomizes the durations returned by another Backoff to avoid
+// synchronized retries across clients.
+type JitterBackoff struct {
+	backoff Backoff
+	factor  float64
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewJitterBackoff returns a Backoff which subtracts a random amount, of up to
+// factor (between 0 and 1) times the duration, from the durations returned by
+// backoff. The seed makes the sequence deterministic.
+func NewJitterBackoff(backoff Backoff, factor float64, seed int64) *JitterBackoff {
+	return &JitterBackoff{
+		backoff: backoff,
+		factor:  math.Max(0, math.Min(1, factor)),
+		rand:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// NextBackoff returns the jittered backoff duration.
+func (b *JitterBackoff) NextBackoff(attempt int) time.Duration {
+	d := b.backoff.NextBackoff(attempt)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return d - time.Duration(b.rand.Float64()*b.factor*float64(d))
+}
@@ -0,0 +1,98 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConstantBackoff(t *testing.T) {
+	b := ConstantBackoff(time.Second)
+	for attempt := 1; attempt <= 5; attempt++ {
+		assert.Equal(t, time.Second, b.NextBackoff(attempt))
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff ExponentialBackoff
+		want    []time.Duration
+	}{
+		{
+			name:    "default multiplier",
+			backoff: ExponentialBackoff{Initial: 100 * time.Millisecond},
+			want: []time.Duration{
+				100 * time.Millisecond,
+				200 * time.Millisecond,
+				400 * time.Millisecond,
+				800 * time.Millisecond,
+				1600 * time.Millisecond,
+			},
+		},
+		{
+			name: "capped",
+			backoff: ExponentialBackoff{
+				Initial:    100 * time.Millisecond,
+				Max:        time.Second,
+				Multiplier: 3,
+			},
+			want: []time.Duration{
+				100 * time.Millisecond,
+				300 * time.Millisecond,
+				900 * time.Millisecond,
+				time.Second,
+				time.Second,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]time.Duration, 0, len(tt.want))
+			for attempt := 1; attempt <= len(tt.want); attempt++ {
+				got = append(got, tt.backoff.NextBackoff(attempt))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestJitterBackoff(t *testing.T) {
+	sequence := func(seed int64) []time.Duration {
+		b := NewJitterBackoff(ConstantBackoff(time.Second), 0.5, seed)
+		durations := make([]time.Duration, 10)
+		for i := range durations {
+			durations[i] = b.NextBackoff(i + 1)
+		}
+		return durations
+	}
+	first := sequence(42)
+	assert.Equal(t, first, sequence(42), "same seed must be deterministic")
+	assert.NotEqual(t, first, sequence(43))
+	for _, d := range first {
+		assert.LessOrEqual(t, d, time.Second)
+		assert.GreaterOrEqual(t, d, 500*time.Millisecond)
+	}
+
+	// A zero factor doesn't alter the wrapped backoff.
+	b := NewJitterBackoff(ConstantBackoff(time.Second), 0, 42)
+	assert.Equal(t, time.Second, b.NextBackoff(1))
+}
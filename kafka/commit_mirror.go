@@ -0,0 +1,118 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap"
+)
+
+// mirrorCommitted mirrors the offsets committed by the consumer group to the
+// MirrorCommitGroup, when set.
+func (c *Consumer) mirrorCommitted(ctx context.Context) {
+	if c.cfg.MirrorCommitGroup == "" {
+		return
+	}
+	c.mirrorCommits(ctx, c.committedOffsets())
+}
+
+// autoCommitted is called by the client after committing offsets in the
+// background, to mirror the committed offsets to the MirrorCommitGroup.
+func (c *Consumer) autoCommitted(_ *kgo.Client, req *kmsg.OffsetCommitRequest, resp *kmsg.OffsetCommitResponse, err error) {
+	if err != nil {
+		return
+	}
+	committed := make(map[string]map[int32]bool)
+	for _, topic := range resp.Topics {
+		for _, partition := range topic.Partitions {
+			if committed[topic.Topic] == nil {
+				committed[topic.Topic] = make(map[int32]bool)
+			}
+			committed[topic.Topic][partition.Partition] = partition.ErrorCode == 0
+		}
+	}
+	offsets := make(map[string]map[int32]kgo.EpochOffset)
+	for _, topic := range req.Topics {
+		for _, partition := range topic.Partitions {
+			if !committed[topic.Topic][partition.Partition] {
+				continue
+			}
+			if offsets[topic.Topic] == nil {
+				offsets[topic.Topic] = make(map[int32]kgo.EpochOffset)
+			}
+			offsets[topic.Topic][partition.Partition] = kgo.EpochOffset{
+				Epoch:  partition.LeaderEpoch,
+				Offset: partition.Offset,
+			}
+		}
+	}
+	c.mirrorCommits(context.Background(), offsets)
+}
+
+// mirrorCommits commits offsets to the MirrorCommitGroup. Failures are only
+// logged.
+func (c *Consumer) mirrorCommits(ctx context.Context, offsets map[string]map[int32]kgo.EpochOffset) {
+	if len(offsets) == 0 {
+		return
+	}
+	if err := c.mirrorOffsets(ctx, offsets); err != nil {
+		c.cfg.Logger.Error("consumer failed to mirror committed offsets",
+			zap.Error(err),
+			zap.String("group", c.cfg.MirrorCommitGroup),
+		)
+	}
+}
+
+// commitMirrorGroup commits offsets to the MirrorCommitGroup, which has no
+// members, so they're committed outside of any group generation.
+func (c *Consumer) commitMirrorGroup(ctx context.Context, offsets map[string]map[int32]kgo.EpochOffset) error {
+	req := kmsg.NewPtrOffsetCommitRequest()
+	req.Group = c.cfg.MirrorCommitGroup
+	req.Generation = -1
+	for topic, partitions := range offsets {
+		t := kmsg.NewOffsetCommitRequestTopic()
+		t.Topic = topic
+		for partition, offset := range partitions {
+			p := kmsg.NewOffsetCommitRequestTopicPartition()
+			p.Partition = partition
+			p.Offset = offset.Offset
+			p.LeaderEpoch = offset.Epoch
+			t.Partitions = append(t.Partitions, p)
+		}
+		req.Topics = append(req.Topics, t)
+	}
+	resp, err := req.RequestWith(ctx, c.client)
+	if err != nil {
+		return err
+	}
+	for _, topic := range resp.Topics {
+		for _, partition := range topic.Partitions {
+			if err := kerr.ErrorForCode(partition.ErrorCode); err != nil {
+				return fmt.Errorf("topic %s partition %d: %w",
+					topic.Topic, partition.Partition, err,
+				)
+			}
+		}
+	}
+	return nil
+}
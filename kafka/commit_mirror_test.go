@@ -0,0 +1,137 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerMirrorCommitGroup(t *testing.T) {
+	var commitErr error
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Delivery:          apmqueue.AtLeastOnceDeliveryType,
+		MirrorCommitGroup: "audit",
+		OnCommitError:     func(err error) { commitErr = err },
+	})
+	var offset int64
+	consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+		records := []*kgo.Record{
+			{Topic: "topic", Partition: 0, Offset: offset, Value: []byte("a")},
+			{Topic: "topic", Partition: 0, Offset: offset + 1, Value: []byte("b")},
+		}
+		offset += 2
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic:      "topic",
+			Partitions: []kgo.FetchPartition{{Partition: 0, Records: records}},
+		}}}}
+	}
+	primary := map[string]map[int32]kgo.EpochOffset{}
+	consumer.commitOffsets = func(context.Context) error {
+		primary["topic"] = map[int32]kgo.EpochOffset{0: {Epoch: -1, Offset: offset}}
+		return nil
+	}
+	consumer.committedOffsets = func() map[string]map[int32]kgo.EpochOffset {
+		return primary
+	}
+	var mirrored map[string]map[int32]kgo.EpochOffset
+	var mirrorErr error
+	consumer.mirrorOffsets = func(_ context.Context, offsets map[string]map[int32]kgo.EpochOffset) error {
+		if mirrorErr != nil {
+			return mirrorErr
+		}
+		mirrored = make(map[string]map[int32]kgo.EpochOffset)
+		for topic, partitions := range offsets {
+			mirrored[topic] = make(map[int32]kgo.EpochOffset)
+			for partition, offset := range partitions {
+				mirrored[topic][partition] = offset
+			}
+		}
+		return nil
+	}
+
+	// The mirror group tracks the offsets committed by the primary group.
+	for i := 0; i < 3; i++ {
+		_, err := consumer.fetch(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, primary, mirrored)
+	}
+	assert.Equal(t, int64(6), mirrored["topic"][0].Offset)
+
+	// Failures to mirror the offsets don't fail the commits.
+	mirrorErr = errors.New("coordinator unavailable")
+	_, err := consumer.fetch(context.Background())
+	require.NoError(t, err)
+	assert.NoError(t, commitErr)
+	assert.Equal(t, int64(8), primary["topic"][0].Offset)
+	assert.Equal(t, int64(6), mirrored["topic"][0].Offset)
+}
+
+func TestConsumerMirrorAutoCommitted(t *testing.T) {
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Delivery:           apmqueue.AtLeastOnceDeliveryType,
+		AutoCommitInterval: time.Second,
+		MirrorCommitGroup:  "audit",
+	})
+	var mirrored map[string]map[int32]kgo.EpochOffset
+	consumer.mirrorOffsets = func(_ context.Context, offsets map[string]map[int32]kgo.EpochOffset) error {
+		mirrored = offsets
+		return nil
+	}
+
+	reqTopic := kmsg.NewOffsetCommitRequestTopic()
+	reqTopic.Topic = "topic"
+	respTopic := kmsg.NewOffsetCommitResponseTopic()
+	respTopic.Topic = "topic"
+	for partition, offset := range []int64{10, 20} {
+		reqPartition := kmsg.NewOffsetCommitRequestTopicPartition()
+		reqPartition.Partition = int32(partition)
+		reqPartition.Offset = offset
+		reqPartition.LeaderEpoch = 1
+		reqTopic.Partitions = append(reqTopic.Partitions, reqPartition)
+		respPartition := kmsg.NewOffsetCommitResponseTopicPartition()
+		respPartition.Partition = int32(partition)
+		respTopic.Partitions = append(respTopic.Partitions, respPartition)
+	}
+	respTopic.Partitions[1].ErrorCode = kerr.RebalanceInProgress.Code
+	req := kmsg.NewPtrOffsetCommitRequest()
+	req.Topics = append(req.Topics, reqTopic)
+	resp := kmsg.NewPtrOffsetCommitResponse()
+	resp.Topics = append(resp.Topics, respTopic)
+
+	// Only the offsets which were committed successfully are mirrored.
+	consumer.autoCommitted(nil, req, resp, nil)
+	assert.Equal(t, map[string]map[int32]kgo.EpochOffset{
+		"topic": {0: {Epoch: 1, Offset: 10}},
+	}, mirrored)
+
+	// Nothing is mirrored when the commit fails.
+	mirrored = nil
+	consumer.autoCommitted(nil, req, resp, errors.New("commit failed"))
+	assert.Nil(t, mirrored)
+}
@@ -18,25 +18,137 @@
 package kafka
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kversion"
 	"github.com/twmb/franz-go/plugin/kzap"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
 	"github.com/elastic/apm-queue/queuecontext"
 )
 
+// AttemptsHeader is the header key holding the number of times a record was
+// attempted to be processed before the consumer gave up on it.
+const AttemptsHeader = "attempts"
+
+// RetriesHeader is the header key holding the number of times a record was
+// republished to the RetryTopic.
+const RetriesHeader = "retries"
+
+// RetryAtHeader is the header key holding the time, in milliseconds since
+// the Unix epoch, after which a record republished to the RetryTopic is
+// processed again.
+const RetryAtHeader = "retry-at"
+
+// ErrMissingHeader is wrapped by the error the records lacking one of the
+// ConsumerConfig.RequiredHeaders are dead lettered with, when the
+// MissingHeaderPolicy is MissingHeaderDeadLetter.
+var ErrMissingHeader = errors.New("kafka: missing required header")
+
 // Decoder decodes a []byte into a model.APMEvent
+//
+// Record batches compressed by the producer (gzip, snappy, lz4 or zstd) are
+// decompressed by the Kafka client when they're fetched, so the bytes passed
+// to the Decoder are always the uncompressed record value. Decoders must not
+// attempt to decompress the values themselves.
 type Decoder interface {
 	// Decode decodes an encoded model.APM Event into its struct form.
 	Decode([]byte, *model.APMEvent) error
 }
 
+// DecodeAction is how the consumer responds to a record which fails to be
+// decoded, as returned by ConsumerConfig.ClassifyDecodeError.
+type DecodeAction int
+
+const (
+	// DecodeSkip gives up on the record, which is dead lettered when an
+	// ErrorTopicRouter is set, and carries on with the next records.
+	DecodeSkip DecodeAction = iota
+	// DecodeRetry retries decoding the record up to MaxAttempts, waiting
+	// for the Backoff between attempts, before it's republished to the
+	// RetryTopic, if any, or given up on.
+	DecodeRetry
+	// DecodeFail stops the consumer: the next records aren't processed, the
+	// offsets of the fetched records aren't committed, and Run returns an
+	// error wrapping the decoding error.
+	DecodeFail
+)
+
+// MissingHeaderPolicy is how the consumer handles the records lacking one of
+// the ConsumerConfig.RequiredHeaders.
+type MissingHeaderPolicy int
+
+const (
+	// MissingHeaderSkip skips the records, which aren't processed. It is the
+	// default.
+	MissingHeaderSkip MissingHeaderPolicy = iota
+	// MissingHeaderDeadLetter quarantines the records, which aren't
+	// processed, producing them to the topic the ErrorTopicRouter returns
+	// for an error wrapping ErrMissingHeader.
+	MissingHeaderDeadLetter
+)
+
+// fetchErrorsBuffer is the number of fetch errors buffered by the channel
+// returned by Consumer.Errors, the next ones are dropped until it's drained.
+const fetchErrorsBuffer = 64
+
+// FetchError is delivered by Consumer.Errors when records fail to be fetched
+// from a topic partition.
+type FetchError struct {
+	// Topic is the topic the records failed to be fetched from.
+	Topic apmqueue.Topic
+	// Partition is the partition the records failed to be fetched from, or
+	// -1 when the error isn't specific to a partition.
+	Partition int32
+	// Err is the fetch error.
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("kafka: failed to fetch topic %s partition %d: %s",
+		e.Topic, e.Partition, e.Err,
+	)
+}
+
+// Unwrap returns the fetch error.
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// OffsetStore stores the offsets of a consumer group outside of Kafka, for
+// example in the database the processed events are written to, so that the
+// offsets can be stored transactionally with the processing results.
+type OffsetStore interface {
+	// Load returns the offset of the next record to consume from the topic
+	// partition, or a negative offset if none has been stored.
+	Load(group string, topic apmqueue.Topic, partition int32) (int64, error)
+	// Store stores the offset of the next record to consume from the topic
+	// partition.
+	Store(group string, topic apmqueue.Topic, partition int32, offset int64) error
+}
+
 // ConsumerConfig defines the configuration for the Kafka consumer.
 type ConsumerConfig struct {
 	// Brokers is the list of kafka brokers used to seed the Kafka client.
@@ -51,13 +163,278 @@ type ConsumerConfig struct {
 	// Version is the software version to use in the Kafka client. This is
 	// useful since it shows up in Kafka metrics and logs.
 	Version string
+	// MinKafkaVersion, when set, is the minimum Kafka version the brokers
+	// must support, for example kversion.V2_8_0(). NewConsumer fails when a
+	// broker supports older request versions, and requests are never
+	// downgraded below it, rather than silently losing features.
+	MinKafkaVersion *kversion.Versions
 	// Decoder holds an encoding.Decoder for decoding events.
 	Decoder Decoder
+	// Decoders holds fallback decoders, tried in order when the record
+	// can't be decoded by Decoder, which is useful when a topic holds
+	// records encoded with different codecs. Either Decoder or Decoders
+	// must be set, unless RawBytesProcessor is used.
+	Decoders []Decoder
+	// ClassifyDecodeError, when set, is called with the error of the records
+	// which fail to be decoded, to choose how the consumer responds to them,
+	// for example failing when the schema is gone, or retrying a transient
+	// failure. Defaults to DecodeSkip for every error.
+	ClassifyDecodeError func(error) DecodeAction
 
 	// Logger to use for any errors.
 	Logger *zap.Logger
 	// Processor that will be used to process each event individually.
+	// Processor may be called from multiple goroutines when Concurrency is
+	// greater than 1 and needs to be safe for concurrent use. The ID of the
+	// record, which is stable across retries, is available in the context
+	// through queuecontext.RecordID, and its topic, partition, offset,
+	// timestamp and the high watermark of its partition through
+	// queuecontext.RecordMetadataFromContext. Neither is
+	// set when BatchMaxRecords processes multiple records as a single batch.
 	Processor model.BatchProcessor
+	// Processors, when set, holds the processors of the records of each
+	// topic, taking precedence over Processor, for consumers subscribing
+	// to topics which need different processing. The records of topics
+	// without a processor, including the RetryTopic, are processed by
+	// Processor, which must then be set. With BatchMaxRecords, the records
+	// are batched per topic. They have the same concurrency requirements as
+	// Processor.
+	Processors map[apmqueue.Topic]model.BatchProcessor
+	// EnrichFunc, when set, is called with every decoded event before it's
+	// processed, to enrich it, for example with deployment metadata, with
+	// the context passed to the Processor. When it returns an error, the
+	// record is given up on with AtMostOnceDeliveryType, while it's called
+	// again up to MaxAttempts, before the record is republished to the
+	// RetryTopic or given up on, with AtLeastOnceDeliveryType. It needs to
+	// be safe for concurrent use when Concurrency is greater than 1.
+	EnrichFunc func(context.Context, *model.APMEvent) error
+	// RawBytesProcessor, when set, is called with the raw value and headers
+	// of each record instead of decoding it and calling Processor, which
+	// avoids a decoding round trip for processors which re-serialize the
+	// events. It is mutually exclusive with Processor, and has the same
+	// concurrency requirements. The metadata stored in the record headers
+	// and the record ID and Kafka metadata are available in ctx through
+	// queuecontext.
+	RawBytesProcessor func(ctx context.Context, topic apmqueue.Topic, value []byte, headers []kgo.RecordHeader) error
+	// AckProcessor, when set, is called with all the records of each fetch
+	// instead of decoding them and calling Processor, and acknowledges each
+	// record individually through acker. Only the offsets of the acknowledged
+	// records are committed, up to the first record of each partition which
+	// wasn't acknowledged, and the partition is rewound so the records from
+	// that one onwards are fetched again. It is mutually exclusive with
+	// Processor and RawBytesProcessor, and requires AtLeastOnceDeliveryType.
+	// MaxAttempts, OnGiveUp and ErrorTopicRouter don't apply to it.
+	AckProcessor func(ctx context.Context, records []*kgo.Record, acker *RecordAcker)
+	// FetchProcessor, when set, is called with the raw fetches as they're
+	// polled instead of decoding their records and calling Processor, for
+	// extreme throughput processors which avoid the per record overhead.
+	// Their offsets are committed according to the Delivery type once it
+	// returns, as with Processor. When it returns an error, it's called
+	// again up to MaxAttempts, before all the records of the fetches are
+	// given up on. Records aren't skipped nor checked for the
+	// RequiredHeaders, and Concurrency doesn't apply to it. It is mutually
+	// exclusive with the other processors.
+	FetchProcessor func(ctx context.Context, fetches kgo.Fetches) error
+	// Delivery mechanism to use to acknowledge the messages.
+	// AtMostOnceDeliveryType and AtLeastOnceDeliveryType are supported.
+	// AtMostOnceDeliveryType commits the fetched offsets before the records
+	// are processed, AtLeastOnceDeliveryType commits them afterwards.
+	Delivery apmqueue.DeliveryType
+	// Concurrency is the number of goroutines used to process the records of
+	// each fetch. Records with the same key are always processed by the same
+	// goroutine in offset order, records without a key are routed by their
+	// partition. Defaults to 1, processing all records sequentially.
+	Concurrency int
+	// PartitionAffinity, when set, routes all the records to the Concurrency
+	// goroutines by their partition, rather than by their key, so all the
+	// records of a partition are processed sequentially by the same worker,
+	// in offset order. Stateful processors can then keep per partition state
+	// without locking. Consumer.PartitionWorkers returns the worker of each
+	// assigned partition.
+	PartitionAffinity bool
+	// MaxInFlightBatches limits the number of decoded records being
+	// processed at any time across all the Concurrency goroutines, bounding
+	// the memory used by decoded events during spikes. Each record weighs
+	// one, so a batch of BatchMaxRecords weighs its number of records,
+	// capped at MaxInFlightBatches so that larger batches are processed
+	// alone rather than never. Defaults to no limit.
+	MaxInFlightBatches int
+	// Backoff determines how long to wait between retries of failed
+	// requests, between processing attempts and between commit attempts.
+	// Defaults to the Kafka client's backoff for requests, and no wait
+	// between attempts.
+	Backoff Backoff
+	// MaxAttempts is the number of times the Processor is called with a
+	// record before giving up on it. Defaults to 1, not retrying.
+	MaxAttempts int
+	// OnGiveUp, when set, is called with the records which failed to be
+	// decoded or processed after MaxAttempts, and the last error, before
+	// they are dead lettered or dropped. The number of attempts is recorded
+	// in the AttemptsHeader header of the records.
+	OnGiveUp func(records []*kgo.Record, err error)
+	// MaxCommitAttempts is the number of times committing the offsets of
+	// the processed records is attempted, waiting for the configured Backoff
+	// between attempts. Defaults to 3.
+	MaxCommitAttempts int
+	// OnCommitError, when set, is called with the last error when the
+	// offsets couldn't be committed after MaxCommitAttempts. The records
+	// whose offsets weren't committed may be processed again if the
+	// partitions are reassigned before the next successful commit.
+	OnCommitError func(err error)
+	// OffsetStore, when set, replaces the offsets committed to Kafka. The
+	// offsets of the consumed records are stored instead of committed, and
+	// the offsets of the assigned partitions are loaded from it; partitions
+	// without a stored offset start from the offset committed to Kafka, if
+	// any. It can't be used with AutoCommitInterval.
+	OffsetStore OffsetStore
+	// MirrorCommitGroup, when set, is a second consumer group the offsets
+	// committed by the consumer group are mirrored to after every commit,
+	// so that dashboards can monitor the progress of the consumer from a
+	// stable place. The mirror group has no members, and failures to mirror
+	// the offsets are only logged. It can't be used with an OffsetStore.
+	MirrorCommitGroup string
+	// MaxEventAge, when set, skips the records whose Kafka timestamp is older
+	// than MaxEventAge without decoding nor processing them. Their offsets
+	// are committed with the rest of the fetched records.
+	MaxEventAge time.Duration
+	// EnforceRecordTTL skips the records whose expiry time, set by
+	// ProducerConfig.RecordTTLFunc, has passed, without decoding nor
+	// processing them. Their offsets are committed with the rest of the
+	// fetched records.
+	EnforceRecordTTL bool
+	// DedupWindow, when set, skips the records whose key was already seen
+	// within DedupWindow, without decoding nor processing them, for sinks
+	// which can't deduplicate the events themselves. Their offsets are
+	// committed with the rest of the fetched records. Records without a key
+	// and records consumed from the RetryTopic are never skipped. The keys
+	// are only tracked in memory, so duplicates consumed by other consumers
+	// of the group, or after a restart, aren't skipped.
+	DedupWindow time.Duration
+	// DedupCapacity is the maximum number of keys tracked within the
+	// DedupWindow, forgetting the oldest keys first. Defaults to 10000.
+	DedupCapacity int
+	// AutoCommitInterval, when set, commits the offsets of the processed
+	// records periodically in the background, rather than synchronously
+	// after each fetch has been processed. Increasing the interval reduces
+	// the number of commits at the expense of a larger window of duplicates
+	// if the consumer crashes. Requires AtLeastOnceDeliveryType.
+	AutoCommitInterval time.Duration
+	// PrefetchBytes, when set, makes Run poll the next records while the
+	// previously polled ones are processed, to smooth processing. Polling
+	// pauses while the polled records which haven't been processed yet
+	// hold PrefetchBytes or more, and each fetch is limited to
+	// PrefetchBytes unless its first record batch is larger, so they hold
+	// about twice as much at most. Only the offsets
+	// of the processed records are committed, and the prefetched records
+	// of the partitions revoked in the meantime are dropped, to be fetched
+	// again by their new owner. It can't be used with AutoCommitInterval
+	// nor AckProcessor.
+	PrefetchBytes int
+	// ErrorTopicRouter, when set, is called with the records which fail to
+	// be decoded or processed, and the error. The record is produced to the
+	// returned dead letter topic, or dropped if the returned topic is empty.
+	ErrorTopicRouter func(record *kgo.Record, err error) apmqueue.Topic
+	// RequiredHeaders holds the header keys every record must have, for
+	// example a tenant header, for strict pipelines. The records lacking
+	// any of them aren't processed, and are handled according to the
+	// MissingHeaderPolicy instead. They aren't checked for the records
+	// passed to AckProcessor.
+	RequiredHeaders []string
+	// MissingHeaderPolicy configures how the records lacking any of the
+	// RequiredHeaders are handled. Defaults to MissingHeaderSkip.
+	// MissingHeaderDeadLetter requires an ErrorTopicRouter.
+	MissingHeaderPolicy MissingHeaderPolicy
+	// RetryTopic, when set, is the topic the records which fail to be
+	// processed after MaxAttempts are republished to, instead of being given
+	// up on, so they're processed again after RetryDelay without blocking
+	// the records which follow them. The consumer also consumes RetryTopic.
+	// When a record consumed from it isn't due yet, according to its
+	// RetryAtHeader, fetching its partition is paused and rewound to it
+	// until it's due, while the other partitions keep being processed.
+	// Records which fail to be decoded are only retried when
+	// ClassifyDecodeError returns DecodeRetry.
+	RetryTopic apmqueue.Topic
+	// RetryDelay is how long records republished to RetryTopic wait before
+	// they're processed again. Defaults to 0, processing them as soon as
+	// they're consumed.
+	RetryDelay time.Duration
+	// MaxRetries is the number of times a record is republished to
+	// RetryTopic before the consumer gives up on it. Defaults to 1.
+	MaxRetries int
+	// OnPartitionsAssigned, when set, is called with the partitions assigned
+	// to the consumer before any of their records are fetched, for example
+	// to warm up per partition caches. If it returns an error, the consumer
+	// is closed, leaving the group, and Run returns the error.
+	OnPartitionsAssigned func(ctx context.Context, partitions map[apmqueue.Topic][]int32) error
+	// Dialer is used to open the connections to the Kafka brokers, for
+	// example to connect through a proxy. Defaults to a TCP dialer.
+	Dialer func(ctx context.Context, network, host string) (net.Conn, error)
+	// Rack is the rack, or availability zone, of the consumer. When set and
+	// the brokers have a replica selector configured, records are fetched
+	// from the closest replica rather than the partition leader, reducing
+	// cross zone traffic.
+	Rack string
+	// BatchMaxRecords, when set, accumulates the records of multiple fetches
+	// into a single batch of up to BatchMaxRecords events, which is passed
+	// to Processor in a single call once full or once BatchFlushInterval has
+	// elapsed. The offsets are committed after the batch has been processed
+	// and rebalances are blocked while the records are accumulated. The
+	// Processor context doesn't hold the records metadata nor their IDs. It
+	// can't be used with RawBytesProcessor nor with a Concurrency greater
+	// than 1.
+	BatchMaxRecords int
+	// BatchFlushInterval is the maximum duration records are accumulated
+	// for, since the first record of the batch was fetched, when
+	// BatchMaxRecords is set. Defaults to 1s.
+	BatchFlushInterval time.Duration
+	// PoolDecodeTargets reuses the events records are decoded into, and the
+	// batches passed to Processor, across records to reduce allocations.
+	// When set, Processor must not retain the batch nor its events beyond
+	// the ProcessBatch call, copying them if needed. It only applies to
+	// records processed individually by Processor.
+	PoolDecodeTargets bool
+	// VerifyChecksum verifies the checksum of the records produced with
+	// ProducerConfig.AddChecksum before decoding them. Records whose value
+	// doesn't match their checksum are handled as records which fail to be
+	// decoded. Records without a checksum aren't verified, nor are the
+	// records passed to RawBytesProcessor or AckProcessor.
+	VerifyChecksum bool
+	// MetadataMode must match the ProducerConfig.MetadataMode the records
+	// were produced with. With MetadataEnvelope, the metadata and the value
+	// of the records are unwrapped from their envelope before processing,
+	// as if the metadata had been propagated as headers. Records whose value
+	// isn't an envelope are processed as is.
+	MetadataMode MetadataMode
+	// MeterProvider allows specifying a custom otel meter provider.
+	// Defaults to the global one.
+	MeterProvider metric.MeterProvider
+	// TracerProvider allows specifying a custom otel tracer provider.
+	// Defaults to the global one. A consumer.Process span is created for
+	// each record processed individually, as a child of the trace context
+	// propagated in the record headers.
+	TracerProvider trace.TracerProvider
+	// DebugHeader, when set, is the header key of the records whose
+	// consumer.Process span is sampled even when the upstream trace wasn't.
+	// The sampling decision is overridden by marking the parent trace
+	// context as sampled, so it's only honored by parent based samplers.
+	// Since unsampled trace contexts aren't propagated, the span of a record
+	// without one starts a new trace under a generated remote parent.
+	DebugHeader string
+	// NoCommit disables committing offsets, so the consumer group offsets
+	// aren't affected by this consumer, which is useful to tap into topics
+	// for auditing purposes. Records are still delivered to the Processor.
+	// Since no offsets are committed, the consumer resumes from the group's
+	// committed offsets every time it starts. Delivery is ignored, and
+	// options which only affect committing, such as OffsetStore, can't be
+	// set.
+	NoCommit bool
+	// Shadow processes the records without side effects, for example to
+	// load test the Processor against production traffic. The result of
+	// processing is ignored, as if it succeeded: records are neither
+	// retried, republished to the RetryTopic nor dead lettered. Like with
+	// NoCommit, offsets are never committed and options which only affect
+	// committing can't be set.
+	Shadow bool
 }
 
 // Validate ensures the configuration is valid, otherwise, returns an error.
@@ -72,23 +449,372 @@ func (cfg ConsumerConfig) Validate() error {
 	if cfg.GroupID == "" {
 		errs = append(errs, errors.New("kafka: consumer GroupID must be set"))
 	}
-	if cfg.Decoder == nil {
+	if cfg.Decoder == nil && len(cfg.Decoders) == 0 && cfg.RawBytesProcessor == nil &&
+		cfg.AckProcessor == nil && cfg.FetchProcessor == nil {
 		errs = append(errs, errors.New("kafka: decoder must be set"))
 	}
 	if cfg.Logger == nil {
 		errs = append(errs, errors.New("kafka: logger must be set"))
 	}
-	if cfg.Processor == nil {
+	if err := cfg.MetadataMode.valid(); err != nil {
+		errs = append(errs, err)
+	}
+	switch cfg.MissingHeaderPolicy {
+	case MissingHeaderSkip:
+	case MissingHeaderDeadLetter:
+		if cfg.ErrorTopicRouter == nil {
+			errs = append(errs, errors.New(
+				"kafka: missing header dead letter policy requires an error topic router",
+			))
+		}
+	default:
+		errs = append(errs, errors.New("kafka: missing header policy is not valid"))
+	}
+	processor := cfg.Processor != nil || len(cfg.Processors) > 0
+	if !processor && cfg.RawBytesProcessor == nil && cfg.AckProcessor == nil &&
+		cfg.FetchProcessor == nil {
 		errs = append(errs, errors.New("kafka: processor must be set"))
 	}
+	if cfg.FetchProcessor != nil &&
+		(processor || cfg.RawBytesProcessor != nil || cfg.AckProcessor != nil) {
+		errs = append(errs, errors.New(
+			"kafka: fetch processor cannot be used with another processor",
+		))
+	}
+	if len(cfg.Processors) > 0 && cfg.Processor == nil {
+		topics := cfg.Topics
+		if cfg.RetryTopic != "" {
+			topics = append(topics[:len(topics):len(topics)], string(cfg.RetryTopic))
+		}
+		for _, topic := range topics {
+			if _, ok := cfg.Processors[apmqueue.Topic(topic)]; !ok {
+				errs = append(errs, fmt.Errorf("kafka: processor must be set for topic %s", topic))
+			}
+		}
+	}
+	if processor && cfg.RawBytesProcessor != nil {
+		errs = append(errs, errors.New(
+			"kafka: processor and raw bytes processor are mutually exclusive",
+		))
+	}
+	if cfg.AckProcessor != nil {
+		if processor || cfg.RawBytesProcessor != nil {
+			errs = append(errs, errors.New(
+				"kafka: ack processor cannot be used with processor or raw bytes processor",
+			))
+		}
+		if cfg.Delivery != apmqueue.AtLeastOnceDeliveryType {
+			errs = append(errs, errors.New(
+				"kafka: ack processor requires at least once delivery",
+			))
+		}
+		if cfg.AutoCommitInterval > 0 {
+			errs = append(errs, errors.New(
+				"kafka: ack processor cannot be used with auto commit interval",
+			))
+		}
+		if cfg.Concurrency > 1 {
+			errs = append(errs, errors.New(
+				"kafka: ack processor cannot be used with concurrency",
+			))
+		}
+	}
+	switch cfg.Delivery {
+	case apmqueue.AtLeastOnceDeliveryType:
+	case apmqueue.AtMostOnceDeliveryType:
+	default:
+		errs = append(errs, errors.New("kafka: delivery is not valid"))
+	}
+	if cfg.Concurrency < 0 {
+		errs = append(errs, errors.New("kafka: concurrency cannot be negative"))
+	}
+	if cfg.OffsetStore != nil && cfg.AutoCommitInterval > 0 {
+		errs = append(errs, errors.New(
+			"kafka: auto commit interval cannot be set with an offset store",
+		))
+	}
+	if cfg.MirrorCommitGroup != "" && cfg.MirrorCommitGroup == cfg.GroupID {
+		errs = append(errs, errors.New(
+			"kafka: mirror commit group must differ from group id",
+		))
+	}
+	if cfg.MirrorCommitGroup != "" && cfg.OffsetStore != nil {
+		errs = append(errs, errors.New(
+			"kafka: mirror commit group cannot be used with an offset store",
+		))
+	}
+	if cfg.Rack != "" && strings.TrimSpace(cfg.Rack) == "" {
+		errs = append(errs, errors.New("kafka: rack cannot be blank"))
+	}
+	if cfg.BatchMaxRecords < 0 {
+		errs = append(errs, errors.New("kafka: batch max records cannot be negative"))
+	}
+	if cfg.BatchFlushInterval < 0 {
+		errs = append(errs, errors.New("kafka: batch flush interval cannot be negative"))
+	}
+	if cfg.BatchFlushInterval > 0 && cfg.BatchMaxRecords == 0 {
+		errs = append(errs, errors.New(
+			"kafka: batch flush interval requires batch max records",
+		))
+	}
+	if cfg.BatchMaxRecords > 0 && cfg.RawBytesProcessor != nil {
+		errs = append(errs, errors.New(
+			"kafka: batch max records cannot be used with raw bytes processor",
+		))
+	}
+	if cfg.BatchMaxRecords > 0 && cfg.Concurrency > 1 {
+		errs = append(errs, errors.New(
+			"kafka: batch max records cannot be used with concurrency",
+		))
+	}
+	if cfg.MaxInFlightBatches < 0 {
+		errs = append(errs, errors.New("kafka: max in flight batches cannot be negative"))
+	}
+	if cfg.MaxAttempts < 0 {
+		errs = append(errs, errors.New("kafka: max attempts cannot be negative"))
+	}
+	if cfg.MaxCommitAttempts < 0 {
+		errs = append(errs, errors.New("kafka: max commit attempts cannot be negative"))
+	}
+	if cfg.RetryDelay < 0 {
+		errs = append(errs, errors.New("kafka: retry delay cannot be negative"))
+	}
+	if cfg.MaxRetries < 0 {
+		errs = append(errs, errors.New("kafka: max retries cannot be negative"))
+	}
+	if (cfg.RetryDelay > 0 || cfg.MaxRetries > 0) && cfg.RetryTopic == "" {
+		errs = append(errs, errors.New(
+			"kafka: retry delay and max retries require retry topic",
+		))
+	}
+	if cfg.RetryTopic != "" && cfg.AckProcessor != nil {
+		errs = append(errs, errors.New(
+			"kafka: retry topic cannot be used with ack processor",
+		))
+	}
+	if cfg.MaxEventAge < 0 {
+		errs = append(errs, errors.New("kafka: max event age cannot be negative"))
+	}
+	if cfg.DedupWindow < 0 {
+		errs = append(errs, errors.New("kafka: dedup window cannot be negative"))
+	}
+	if cfg.DedupCapacity < 0 {
+		errs = append(errs, errors.New("kafka: dedup capacity cannot be negative"))
+	}
+	if cfg.DedupCapacity > 0 && cfg.DedupWindow == 0 {
+		errs = append(errs, errors.New("kafka: dedup capacity requires dedup window"))
+	}
+	if cfg.PrefetchBytes < 0 {
+		errs = append(errs, errors.New("kafka: prefetch bytes cannot be negative"))
+	}
+	if cfg.PrefetchBytes > 0 && cfg.AutoCommitInterval > 0 {
+		errs = append(errs, errors.New(
+			"kafka: prefetch bytes cannot be used with auto commit interval",
+		))
+	}
+	if cfg.PrefetchBytes > 0 && cfg.AckProcessor != nil {
+		errs = append(errs, errors.New(
+			"kafka: prefetch bytes cannot be used with ack processor",
+		))
+	}
+	if cfg.AutoCommitInterval < 0 {
+		errs = append(errs, errors.New("kafka: auto commit interval cannot be negative"))
+	}
+	noCommit := "no commit"
+	if cfg.Shadow {
+		noCommit = "shadow"
+	}
+	if cfg.AutoCommitInterval > 0 && cfg.noCommit() {
+		errs = append(errs, fmt.Errorf(
+			"kafka: auto commit interval cannot be set with %s", noCommit,
+		))
+	}
+	if cfg.AutoCommitInterval > 0 && cfg.Delivery != apmqueue.AtLeastOnceDeliveryType {
+		errs = append(errs, errors.New(
+			"kafka: auto commit interval requires at least once delivery",
+		))
+	}
+	if cfg.noCommit() {
+		// Options which only affect committing are misconfigurations.
+		if cfg.OffsetStore != nil {
+			errs = append(errs, fmt.Errorf(
+				"kafka: offset store cannot be used with %s", noCommit,
+			))
+		}
+		if cfg.MaxCommitAttempts > 0 {
+			errs = append(errs, fmt.Errorf(
+				"kafka: max commit attempts cannot be set with %s", noCommit,
+			))
+		}
+		if cfg.OnCommitError != nil {
+			errs = append(errs, fmt.Errorf(
+				"kafka: on commit error cannot be set with %s", noCommit,
+			))
+		}
+		if cfg.AckProcessor != nil {
+			errs = append(errs, fmt.Errorf(
+				"kafka: ack processor cannot be used with %s", noCommit,
+			))
+		}
+		if cfg.MirrorCommitGroup != "" {
+			errs = append(errs, fmt.Errorf(
+				"kafka: mirror commit group cannot be used with %s", noCommit,
+			))
+		}
+	}
 	return errors.Join(errs...)
 }
 
+// noCommit returns true if offsets are never committed, with NoCommit or
+// Shadow.
+func (cfg ConsumerConfig) noCommit() bool {
+	return cfg.NoCommit || cfg.Shadow
+}
+
+// commitMode defines when the consumer commits the offsets of the records.
+type commitMode uint8
+
+const (
+	// commitBeforeProcessing commits the offsets of the fetched records
+	// before they are processed, so they are processed at most once.
+	commitBeforeProcessing commitMode = iota
+	// commitAfterProcessing commits the offsets of the fetched records
+	// after they have been processed, so they are processed at least once.
+	commitAfterProcessing
+	// commitInBackground periodically commits the offsets of the processed
+	// records in the background, so they are processed at least once.
+	commitInBackground
+	// commitDisabled never commits offsets.
+	commitDisabled
+	// commitAcknowledged commits the offsets of the records acknowledged by
+	// the AckProcessor once it returns.
+	commitAcknowledged
+)
+
+// commitMode returns the commit mode resulting from cfg, which is assumed to
+// be valid.
+func (cfg ConsumerConfig) commitMode() commitMode {
+	switch {
+	case cfg.noCommit():
+		return commitDisabled
+	case cfg.Delivery == apmqueue.AtMostOnceDeliveryType:
+		return commitBeforeProcessing
+	case cfg.AckProcessor != nil:
+		return commitAcknowledged
+	case cfg.AutoCommitInterval > 0:
+		return commitInBackground
+	}
+	return commitAfterProcessing
+}
+
+// ConsumerStats holds a point in time snapshot of the consumer state.
+type ConsumerStats struct {
+	// Processed is the number of records which have been processed
+	// successfully since the consumer was created.
+	Processed int64
+	// Committed holds the last committed offset for each of the topic
+	// partitions known to the consumer group, or the offsets last stored
+	// in the OffsetStore when it's set.
+	Committed map[apmqueue.Topic]map[int32]int64
+	// Assignment holds the partitions currently assigned to the consumer.
+	Assignment map[apmqueue.Topic][]int32
+}
+
 // Consumer wraps a Kafka consumer and the consumption implementation details.
 type Consumer struct {
 	mu     sync.RWMutex
 	client *kgo.Client
 	cfg    ConsumerConfig
+	tracer trace.Tracer
+
+	processed atomic.Int64
+	// decoders holds Decoder followed by the fallback Decoders.
+	decoders []Decoder
+	// decodeTargets pools the decode targets when PoolDecodeTargets is set.
+	decodeTargets sync.Pool
+	// decoded counts the decoded records by the codec which decoded them.
+	decoded instrument.Int64Counter
+	// rebalances counts the completed rebalances, and rebalanceDuration
+	// records the time between partitions being revoked or lost and new
+	// partitions being assigned.
+	rebalances        instrument.Int64Counter
+	rebalanceDuration instrument.Int64Histogram
+	// inFlight limits the number of batches in flight, nil when unlimited.
+	inFlight *semaphore.Weighted
+	// dedup tracks the keys seen within the DedupWindow, nil when not set.
+	dedup *dedupCache
+	// produce synchronously produces a record, used for dead lettering.
+	produce func(context.Context, *kgo.Record) error
+	// commitOffsets synchronously commits the offsets of the polled records.
+	commitOffsets func(context.Context) error
+	// commitRecords synchronously commits the offsets of the records, used
+	// with AckProcessor and PrefetchBytes.
+	commitRecords func(context.Context, ...*kgo.Record) error
+	// setOffsets rewinds the partitions to the given offsets, used with
+	// AckProcessor, RunRange and RetryTopic.
+	setOffsets func(map[string]map[int32]kgo.EpochOffset)
+	// pausePartitions and resumePartitions pause and resume fetching the
+	// partitions, used with RetryTopic.
+	pausePartitions  func(map[string][]int32)
+	resumePartitions func(map[string][]int32)
+	// committedOffsets returns the offsets committed by the consumer group,
+	// and mirrorOffsets commits offsets to the MirrorCommitGroup.
+	committedOffsets func() map[string]map[int32]kgo.EpochOffset
+	mirrorOffsets    func(context.Context, map[string]map[int32]kgo.EpochOffset) error
+	// listOffsets lists the offsets of the consumer topics partitions at a
+	// timestamp, as offsetsAt.
+	listOffsets func(ctx context.Context, timestamp int64) (map[string]map[int32]int64, error)
+	// pollRecords polls up to max records, or all the buffered records when
+	// max is not positive.
+	pollRecords func(ctx context.Context, max int) kgo.Fetches
+	// leaveGroup leaves the consumer group, used by DrainAndLeave.
+	leaveGroup func()
+
+	// deferredMu guards deferred, which holds the RetryTopic partitions
+	// paused until their next record is due.
+	deferredMu sync.Mutex
+	deferred   map[int32]struct{}
+
+	// stored holds the offsets last stored in the OffsetStore, so that only
+	// the offsets of the partitions with new records are stored, and Stats
+	// reports them as committed.
+	storedMu sync.Mutex
+	stored   map[string]map[int32]int64
+
+	// assignmentMu guards the assigned partitions, the timestamp of the
+	// last record consumed from each of them, and the errors stopping the
+	// consumer.
+	assignmentMu sync.RWMutex
+	assignment   map[string][]int32
+	lastConsumed map[string]map[int32]time.Time
+	// assignErr holds the error returned by OnPartitionsAssigned, if any.
+	assignErr error
+	// decodeErr holds the error of the record which failed to be decoded
+	// with DecodeFail, if any.
+	decodeErr error
+	// rebalanceStart holds the time partitions were first revoked or lost in
+	// the ongoing rebalance, zero when there's none.
+	rebalanceStart time.Time
+	// prefetchMu is read locked while the prefetched records are processed
+	// and committed, and locked while partitions are revoked or lost, so
+	// the records of revoked partitions are never processed nor committed
+	// after they have been revoked. Since pending writers block readers,
+	// revocations take priority over the next prefetched records.
+	prefetchMu sync.RWMutex
+	// seeks holds the offsets the partitions which weren't assigned yet
+	// are sought to once assigned, while RunRange runs.
+	seeks map[string]map[int32]int64
+
+	// backfill holds the range of the records processed by RunRange, nil
+	// otherwise. It's guarded by mu.
+	backfill *backfillRange
+	// fetchErrors delivers the fetch errors returned by Errors. It's closed
+	// by Close, once closed is set, both guarded by mu.
+	fetchErrors chan error
+	closed      bool
+	// draining is closed by DrainAndLeave, which stops Run.
+	draining  chan struct{}
+	drainOnce sync.Once
 }
 
 // NewConsumer creates a new instance of a Consumer.
@@ -96,12 +822,121 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
+	mp := cfg.MeterProvider
+	if mp == nil {
+		mp = global.MeterProvider()
+	}
+	decoded, err := mp.Meter("kafka").Int64Counter("consumer.decoded",
+		instrument.WithDescription("The number of records decoded by each codec, by event type"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	rebalances, err := mp.Meter("kafka").Int64Counter("consumer.rebalance.count",
+		instrument.WithDescription("The number of rebalances which assigned partitions to the consumer"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	rebalanceDuration, err := mp.Meter("kafka").Int64Histogram("consumer.rebalance.duration",
+		instrument.WithDescription(
+			"The time elapsed between partitions being revoked or lost and new partitions being assigned",
+		),
+		instrument.WithUnit("ms"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tp := cfg.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	consumer := Consumer{
+		cfg:               cfg,
+		tracer:            tp.Tracer("kafka"),
+		decoded:           decoded,
+		rebalances:        rebalances,
+		rebalanceDuration: rebalanceDuration,
+		assignment:        make(map[string][]int32),
+		lastConsumed:      make(map[string]map[int32]time.Time),
+		stored:            make(map[string]map[int32]int64),
+		deferred:          make(map[int32]struct{}),
+		fetchErrors:       make(chan error, fetchErrorsBuffer),
+		draining:          make(chan struct{}),
+	}
+	consumer.decodeTargets.New = func() any {
+		return &decodeTarget{batch: make(model.Batch, 0, 1)}
+	}
+	if _, err := mp.Meter("kafka").Int64ObservableGauge("consumer.time.behind",
+		instrument.WithDescription(
+			"The time elapsed since the timestamp of the last record consumed from each partition",
+		),
+		instrument.WithUnit("ms"),
+		instrument.WithInt64Callback(consumer.observeTimeBehind),
+	); err != nil {
+		return nil, err
+	}
+	if cfg.MaxInFlightBatches > 0 {
+		consumer.inFlight = semaphore.NewWeighted(int64(cfg.MaxInFlightBatches))
+	}
+	if cfg.DedupWindow > 0 {
+		consumer.dedup = newDedupCache(cfg.DedupWindow, cfg.DedupCapacity)
+	}
+	if cfg.Decoder != nil {
+		consumer.decoders = append(consumer.decoders, cfg.Decoder)
+	}
+	consumer.decoders = append(consumer.decoders, cfg.Decoders...)
+	topics := cfg.Topics
+	if cfg.RetryTopic != "" && !containsString(topics, string(cfg.RetryTopic)) {
+		topics = append(topics[:len(topics):len(topics)], string(cfg.RetryTopic))
+	}
 	opts := []kgo.Opt{
 		kgo.SeedBrokers(cfg.Brokers...),
 		kgo.ConsumerGroup(cfg.GroupID),
-		kgo.ConsumeTopics(cfg.Topics...),
+		kgo.ConsumeTopics(topics...),
 		kgo.WithLogger(kzap.New(cfg.Logger)),
+		// If a rebalance happens while the client is polling, the consumed
+		// records may belong to a partition which has been reassigned to a
+		// different consumer in the group. Block rebalances until the fetched
+		// records have been processed and committed.
+		kgo.BlockRebalanceOnPoll(),
+		kgo.OnPartitionsAssigned(consumer.assigned),
+		kgo.OnPartitionsRevoked(consumer.revoked),
+		kgo.OnPartitionsLost(consumer.lost),
+	}
+	if cfg.commitMode() == commitInBackground {
+		// Since rebalances are blocked while polling, the client only ever
+		// commits the offsets of the records which have been processed.
+		opts = append(opts, kgo.AutoCommitInterval(cfg.AutoCommitInterval))
+		if cfg.MirrorCommitGroup != "" {
+			opts = append(opts, kgo.AutoCommitCallback(consumer.autoCommitted))
+		}
+	} else {
+		// Offsets are committed explicitly depending on the delivery type.
+		opts = append(opts, kgo.DisableAutoCommit())
+	}
+	if cfg.Backoff != nil {
+		opts = append(opts, kgo.RetryBackoffFn(cfg.Backoff.NextBackoff))
+	}
+	if cfg.Dialer != nil {
+		opts = append(opts, kgo.Dialer(cfg.Dialer))
+	}
+	if cfg.Rack != "" {
+		opts = append(opts, kgo.Rack(cfg.Rack))
+	}
+	if cfg.PrefetchBytes > 0 {
+		maxBytes := int32(math.MaxInt32)
+		if cfg.PrefetchBytes < math.MaxInt32 {
+			maxBytes = int32(cfg.PrefetchBytes)
+		}
+		opts = append(opts, kgo.FetchMaxBytes(maxBytes))
+	}
+	if cfg.MinKafkaVersion != nil {
+		opts = append(opts, kgo.MinVersions(cfg.MinKafkaVersion))
 	}
+	// The fetch offsets of the assigned partitions are adjusted to the
+	// OffsetStore and to the start of the RunRange range.
+	opts = append(opts, kgo.AdjustFetchOffsetsFn(consumer.adjustOffsets))
 	if cfg.ClientID != "" {
 		opts = append(opts, kgo.ClientID(cfg.ClientID))
 		if cfg.Version != "" {
@@ -118,79 +953,1305 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	// Issue a metadata refresh request on construction, so the broker list is
 	// populated.
 	client.ForceMetadataRefresh()
-	consumer := Consumer{
-		cfg:    cfg,
-		client: client,
+	if cfg.MinKafkaVersion != nil {
+		if err := checkMinVersion(context.Background(), client, cfg.MinKafkaVersion); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	consumer.client = client
+	consumer.produce = func(ctx context.Context, r *kgo.Record) error {
+		return client.ProduceSync(ctx, r).FirstErr()
+	}
+	consumer.commitOffsets = client.CommitUncommittedOffsets
+	consumer.commitRecords = client.CommitRecords
+	if cfg.OffsetStore != nil {
+		consumer.commitOffsets = func(context.Context) error {
+			return consumer.storeOffsets(client.UncommittedOffsets())
+		}
+		consumer.commitRecords = func(_ context.Context, records ...*kgo.Record) error {
+			return consumer.storeOffsets(recordOffsets(records))
+		}
+	}
+	consumer.setOffsets = client.SetOffsets
+	consumer.pausePartitions = func(partitions map[string][]int32) {
+		client.PauseFetchPartitions(partitions)
 	}
+	consumer.resumePartitions = client.ResumeFetchPartitions
+	consumer.listOffsets = consumer.offsetsAt
+	consumer.committedOffsets = client.CommittedOffsets
+	consumer.mirrorOffsets = consumer.commitMirrorGroup
+	consumer.pollRecords = client.PollRecords
+	consumer.leaveGroup = client.LeaveGroup
 	return &consumer, nil
 }
 
-// Close closes the consumer.
+// Close closes the consumer, and the channel returned by Errors.
 func (c *Consumer) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.client.Close()
+	if !c.closed {
+		c.closed = true
+		close(c.fetchErrors)
+	}
 	return nil
 }
 
-// Run executes the consumer in a blocking manner.
+// Errors returns a channel delivering the non-fatal errors which occur while
+// fetching records, as *FetchError, so that the health of the brokers can
+// be monitored. The errors are still logged. Errors are dropped while the
+// channel buffer is full, so it never blocks the consumer. The channel is
+// closed by Close.
+func (c *Consumer) Errors() <-chan error {
+	return c.fetchErrors
+}
+
+// Run executes the consumer in a blocking manner. It returns nil once the
+// consumer is drained by DrainAndLeave.
 func (c *Consumer) Run(ctx context.Context) error {
+	stop, cancel := c.untilDrained(ctx)
+	defer cancel()
+	if c.cfg.PrefetchBytes > 0 {
+		return c.runPrefetch(stop, ctx)
+	}
 	for {
-		if err := c.fetch(ctx); err != nil {
-			return err
+		select {
+		case <-c.draining:
+			return nil
+		default:
 		}
+		if _, err := c.fetchUntil(stop, ctx); err != nil {
+			return runError(stop, ctx, err)
+		}
+	}
+}
+
+// runError returns the error Run returns for err, nil when polling stopped
+// because the consumer was drained.
+func runError(stop, ctx context.Context, err error) error {
+	if errors.Is(err, context.Canceled) && ctx.Err() == nil && stop.Err() != nil {
+		return nil // Drained.
 	}
+	return err
 }
 
-func (c *Consumer) fetch(ctx context.Context) error {
+// fetch polls, processes and commits a set of fetches, which are returned.
+func (c *Consumer) fetch(ctx context.Context) (kgo.Fetches, error) {
+	return c.fetchUntil(ctx, ctx)
+}
+
+// fetchUntil is like fetch, but polling stops once stop is done, while the
+// polled records are still processed and committed with ctx.
+func (c *Consumer) fetchUntil(stop, ctx context.Context) (kgo.Fetches, error) {
 	// NOTE(marclop) this is pretty naive consuming, to maximize throughput,
 	// it's best to use one goroutine per partition, but that requires more
 	// state management and blocking when rebalances happen.
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	fetches := c.client.PollFetches(ctx)
-	if fetches.IsClientClosed() || errors.Is(fetches.Err0(), context.Canceled) {
-		return context.Canceled // Client closed or context cancelled.
+	fetches, err := c.pollChecked(stop)
+	if err != nil {
+		return nil, err
+	}
+	// Allow rebalancing once the fetched records have been processed.
+	defer c.client.AllowRebalance()
+	if err := c.processPolled(ctx, fetches); err != nil {
+		return nil, err
+	}
+	return fetches, nil
+}
+
+// pollChecked polls the next fetches, returning an error instead when the
+// consumer can't process them.
+func (c *Consumer) pollChecked(ctx context.Context) (kgo.Fetches, error) {
+	fetches, err := c.poll(ctx)
+	if assignErr := c.assignError(); assignErr != nil {
+		// The consumer was closed, the fetched records aren't processed.
+		return nil, assignErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if decodeErr := c.decodeError(); decodeErr != nil {
+		// A record failed to be decoded with DecodeFail.
+		return nil, decodeErr
+	}
+	return fetches, nil
+}
+
+// processPolled processes and commits the polled fetches.
+func (c *Consumer) processPolled(ctx context.Context, fetches kgo.Fetches) error {
+	if c.cfg.MetadataMode == MetadataEnvelope {
+		unwrapEnvelopes(fetches)
+	}
+	fetches = c.deferRetries(fetches)
+	c.consume(ctx, fetches)
+	if decodeErr := c.decodeError(); decodeErr != nil {
+		return decodeErr
+	}
+	c.updateLastConsumed(fetches)
+	return nil
+}
+
+// poll polls the next fetches. When BatchMaxRecords is set, the records of
+// multiple fetches are accumulated until BatchMaxRecords is reached or
+// BatchFlushInterval has elapsed since the first record was polled.
+// Rebalances stay blocked until the accumulated records are processed.
+func (c *Consumer) poll(ctx context.Context) (kgo.Fetches, error) {
+	var polled kgo.Fetches
+	var records int
+	var flushAt time.Time
+	for {
+		pollCtx, cancel := ctx, context.CancelFunc(func() {})
+		if records > 0 {
+			pollCtx, cancel = context.WithDeadline(ctx, flushAt)
+		}
+		fetches := c.pollRecords(pollCtx, c.cfg.BatchMaxRecords-records)
+		cancel()
+		if fetches.IsClientClosed() || ctx.Err() != nil ||
+			errors.Is(fetches.Err0(), context.Canceled) {
+			return nil, context.Canceled // Client closed or context cancelled.
+		}
+		fetches.EachError(func(t string, p int32, err error) {
+			if errors.Is(err, context.DeadlineExceeded) && pollCtx.Err() != nil {
+				return // Flush interval elapsed.
+			}
+			c.cfg.Logger.Error("consumer fetches returned error",
+				zap.Error(err), zap.String("topic", t), zap.Int32("partition", p),
+			)
+			c.fetchError(&FetchError{Topic: apmqueue.Topic(t), Partition: p, Err: err})
+		})
+		polled = append(polled, fetches...)
+		if c.cfg.BatchMaxRecords <= 0 {
+			return polled, nil
+		}
+		if n := fetches.NumRecords(); n > 0 && records == 0 {
+			interval := c.cfg.BatchFlushInterval
+			if interval <= 0 {
+				interval = time.Second
+			}
+			flushAt = time.Now().Add(interval)
+		}
+		records += fetches.NumRecords()
+		if records >= c.cfg.BatchMaxRecords ||
+			(records > 0 && !time.Now().Before(flushAt)) {
+			return polled, nil
+		}
+	}
+}
+
+// fetchError delivers err to the channel returned by Errors, unless its
+// buffer is full. It must be called with mu held, so it's never called once
+// the channel is closed.
+func (c *Consumer) fetchError(err error) {
+	select {
+	case c.fetchErrors <- err:
+	default:
 	}
-	fetches.EachError(func(t string, p int32, err error) {
-		c.cfg.Logger.Error("consumer fetches returned error",
-			zap.Error(err), zap.String("topic", t), zap.Int32("partition", p),
+}
+
+// consume processes the polled fetches, committing their offsets before or
+// after processing them depending on the commit mode.
+func (c *Consumer) consume(ctx context.Context, fetches kgo.Fetches) {
+	switch c.cfg.commitMode() {
+	case commitBeforeProcessing:
+		// Commit the fetched record offsets as soon as they've been polled.
+		c.commitFetched(ctx, fetches)
+		c.processFetches(ctx, fetches)
+	case commitAfterProcessing:
+		// Commit the fetched record offsets once they've been processed,
+		// unless a record failed to be decoded with DecodeFail.
+		c.processFetches(ctx, fetches)
+		if c.decodeError() != nil {
+			return
+		}
+		c.commitFetched(ctx, fetches)
+	case commitInBackground, commitDisabled:
+		// The client commits the offsets of the processed records, or the
+		// offsets are never committed.
+		c.processFetches(ctx, fetches)
+	case commitAcknowledged:
+		// Commit the offsets of the acknowledged records once they've been
+		// processed.
+		if acked := c.processAcknowledged(fetches); len(acked) > 0 {
+			c.commitWith(ctx, func(ctx context.Context) error {
+				return c.commitRecords(ctx, acked...)
+			})
+		}
+	}
+}
+
+// commit synchronously commits the offsets of the polled records, unless
+// NoCommit or Shadow is set, retrying up to MaxCommitAttempts.
+func (c *Consumer) commit(ctx context.Context) {
+	c.commitWith(ctx, c.commitOffsets)
+}
+
+// commitFetched is like commit, but only commits the offsets of the fetched
+// records with PrefetchBytes, since the records prefetched after them are
+// uncommitted too.
+func (c *Consumer) commitFetched(ctx context.Context, fetches kgo.Fetches) {
+	if c.cfg.PrefetchBytes <= 0 {
+		c.commit(ctx)
+		return
+	}
+	records := fetches.Records()
+	if len(records) == 0 {
+		return
+	}
+	c.commitWith(ctx, func(ctx context.Context) error {
+		return c.commitRecords(ctx, records...)
+	})
+}
+
+// commitWith is like commit, committing the offsets with commitOffsets.
+func (c *Consumer) commitWith(ctx context.Context, commitOffsets func(context.Context) error) {
+	if c.cfg.noCommit() {
+		return
+	}
+	maxAttempts := c.cfg.MaxCommitAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 3
+	}
+	for attempt := 1; ; attempt++ {
+		err := commitOffsets(ctx)
+		if err == nil {
+			c.mirrorCommitted(ctx)
+			return
+		}
+		c.cfg.Logger.Error("consumer failed to commit offsets",
+			zap.Error(err),
+			zap.Int("attempt", attempt),
+		)
+		if attempt >= maxAttempts || !c.wait(ctx, attempt) {
+			if c.cfg.OnCommitError != nil {
+				c.cfg.OnCommitError(err)
+			}
+			return
+		}
+	}
+}
+
+// adjustOffsets adjusts the fetch offsets of the assigned partitions to the
+// offsets loaded from the OffsetStore, when set, and to the start of the
+// RunRange range.
+func (c *Consumer) adjustOffsets(ctx context.Context, offsets map[string]map[int32]kgo.Offset) (map[string]map[int32]kgo.Offset, error) {
+	if c.cfg.OffsetStore != nil {
+		var err error
+		if offsets, err = c.loadOffsets(ctx, offsets); err != nil {
+			return nil, err
+		}
+	}
+	return c.seekAssigned(offsets), nil
+}
+
+// loadOffsets replaces the fetch offsets of the assigned partitions with the
+// offsets loaded from the OffsetStore, when stored.
+func (c *Consumer) loadOffsets(_ context.Context, offsets map[string]map[int32]kgo.Offset) (map[string]map[int32]kgo.Offset, error) {
+	for topic, partitions := range offsets {
+		for partition := range partitions {
+			offset, err := c.cfg.OffsetStore.Load(c.cfg.GroupID, apmqueue.Topic(topic), partition)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load offset of topic %s partition %d: %w",
+					topic, partition, err,
+				)
+			}
+			if offset >= 0 {
+				partitions[partition] = kgo.NewOffset().At(offset)
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// storeOffsets stores the offsets which changed since they were last stored
+// in the OffsetStore.
+func (c *Consumer) storeOffsets(offsets map[string]map[int32]kgo.EpochOffset) error {
+	c.storedMu.Lock()
+	defer c.storedMu.Unlock()
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			if stored, ok := c.stored[topic][partition]; ok && stored == offset.Offset {
+				continue
+			}
+			if err := c.cfg.OffsetStore.Store(c.cfg.GroupID,
+				apmqueue.Topic(topic), partition, offset.Offset,
+			); err != nil {
+				return fmt.Errorf("failed to store offset of topic %s partition %d: %w",
+					topic, partition, err,
+				)
+			}
+			if c.stored[topic] == nil {
+				c.stored[topic] = make(map[int32]int64)
+			}
+			c.stored[topic][partition] = offset.Offset
+		}
+	}
+	return nil
+}
+
+// processRawFetches passes the fetches to FetchProcessor, retrying up to
+// MaxAttempts, before giving up on all their records.
+func (c *Consumer) processRawFetches(ctx context.Context, fetches kgo.Fetches) {
+	records := fetches.NumRecords()
+	if records == 0 {
+		return
+	}
+	maxAttempts := c.cfg.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		err := c.cfg.FetchProcessor(ctx, fetches)
+		if err == nil || c.cfg.Shadow {
+			c.processed.Add(int64(records))
+			return
+		}
+		c.cfg.Logger.Error("unable to process fetches",
+			zap.Error(err),
+			zap.Int("records", records),
+			zap.Int("attempt", attempt),
 		)
+		if attempt >= maxAttempts || !c.wait(ctx, attempt) {
+			c.giveUp(ctx, fetches.Records(), attempt, err)
+			return
+		}
+	}
+}
+
+// processFetches processes all the records in fetches. When Concurrency is
+// greater than 1, records are distributed across goroutines, routed by their
+// key so that records with the same key are processed in offset order. When
+// BatchMaxRecords is set, all the records are processed as a single batch,
+// or as a batch per topic with Processors. With MaxInFlightBatches, records
+// are only handed to the goroutines once their weight is acquired, so the
+// records of a fetch stop being dispatched, and the consumer stops polling,
+// while the limit is reached.
+func (c *Consumer) processFetches(ctx context.Context, fetches kgo.Fetches) {
+	if c.cfg.FetchProcessor != nil {
+		c.processRawFetches(ctx, fetches)
+		return
+	}
+	if c.cfg.BatchMaxRecords > 0 {
+		for _, msgs := range c.topicBatches(fetches.Records()) {
+			c.processRecords(ctx, msgs)
+		}
+		return
+	}
+	ctx = withHighWatermarks(ctx, fetches)
+	if c.cfg.Concurrency <= 1 {
+		fetches.EachRecord(func(r *kgo.Record) {
+			release, ok := c.acquireInFlight(ctx, 1)
+			if !ok {
+				// The consumer is stopping, the record isn't processed.
+				return
+			}
+			defer release()
+			c.processRecord(ctx, r)
+		})
+		return
+	}
+	workers := make([][]*kgo.Record, c.cfg.Concurrency)
+	fetches.EachRecord(func(r *kgo.Record) {
+		i := c.worker(r)
+		workers[i] = append(workers[i], r)
+	})
+	var wg sync.WaitGroup
+	for _, records := range workers {
+		if len(records) == 0 {
+			continue
+		}
+		release, ok := c.acquireInFlight(ctx, len(records))
+		if !ok {
+			// The consumer is stopping, the records aren't processed.
+			break
+		}
+		wg.Add(1)
+		go func(records []*kgo.Record) {
+			defer wg.Done()
+			defer release()
+			for _, r := range records {
+				c.processRecord(ctx, r)
+			}
+		}(records)
+	}
+	wg.Wait()
+}
+
+type highWatermarksKey struct{}
+
+// withHighWatermarks returns a context holding the high watermarks of the
+// fetched partitions, reported in the metadata of their records.
+func withHighWatermarks(ctx context.Context, fetches kgo.Fetches) context.Context {
+	watermarks := make(map[string]map[int32]int64)
+	fetches.EachPartition(func(p kgo.FetchTopicPartition) {
+		if watermarks[p.Topic] == nil {
+			watermarks[p.Topic] = make(map[int32]int64)
+		}
+		watermarks[p.Topic][p.Partition] = p.HighWatermark
+	})
+	return context.WithValue(ctx, highWatermarksKey{}, watermarks)
+}
+
+// highWatermark returns the high watermark of the partition of msg when it
+// was fetched, or zero when unknown.
+func highWatermark(ctx context.Context, msg *kgo.Record) int64 {
+	watermarks, _ := ctx.Value(highWatermarksKey{}).(map[string]map[int32]int64)
+	return watermarks[msg.Topic][msg.Partition]
+}
+
+// worker returns the index of the worker which processes the record. The
+// index is stable for a given key, or partition when the record has no key
+// or PartitionAffinity is set.
+func (c *Consumer) worker(r *kgo.Record) int {
+	if len(r.Key) == 0 || c.cfg.PartitionAffinity {
+		return c.partitionWorker(r.Topic, r.Partition)
+	}
+	h := fnv.New32a()
+	h.Write(r.Key)
+	return int(h.Sum32() % uint32(c.cfg.Concurrency))
+}
+
+// partitionWorker returns the index of the worker which processes the
+// records of a partition without a key.
+func (c *Consumer) partitionWorker(topic string, partition int32) int {
+	if c.cfg.Concurrency <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	binary.Write(h, binary.BigEndian, partition)
+	return int(h.Sum32() % uint32(c.cfg.Concurrency))
+}
+
+// processRecord decodes and processes a single record, or passes its raw
+// value to RawBytesProcessor, retrying processing up to MaxAttempts. Any
+// errors are logged and the record is then republished to the RetryTopic, if
+// any. Once the consumer gives up on the record, it is dead lettered when an
+// ErrorTopicRouter is configured. Batch marker records are skipped. The
+// processing context holds the record metadata and ID.
+func (c *Consumer) processRecord(ctx context.Context, msg *kgo.Record) {
+	if c.skip(msg) || c.decodeError() != nil || c.quarantine(ctx, msg) {
+		return
+	}
+	pctx := queuecontext.FromHeaders(context.Background(), msg.Headers, "")
+	meta, _ := queuecontext.MetadataFromContext(pctx)
+	pctx = queuecontext.WithRecordID(pctx, recordID(msg))
+	pctx = queuecontext.WithRecordMetadata(pctx, queuecontext.RecordMetadata{
+		Topic:         msg.Topic,
+		Partition:     msg.Partition,
+		Offset:        msg.Offset,
+		Timestamp:     msg.Timestamp,
+		HighWatermark: highWatermark(ctx, msg),
 	})
-	fetches.EachRecord(func(msg *kgo.Record) {
+	pctx, span := c.startSpan(pctx, msg)
+	defer span.End()
+	var process func() error
+	if c.cfg.RawBytesProcessor != nil {
+		topic := apmqueue.Topic(msg.Topic)
+		process = func() error {
+			return c.cfg.RawBytesProcessor(pctx, topic, msg.Value, msg.Headers)
+		}
+	} else {
+		target := c.decodeTarget()
+		defer c.releaseDecodeTarget(target)
+		event := &target.event
+		if !c.decodeOrHandle(ctx, msg, event, zap.Any("headers", meta)) {
+			return
+		}
+		if !c.enrichOrHandle(ctx, pctx, msg, event) {
+			return
+		}
+		process = func() error {
+			// Reset the batch since the processor may modify it.
+			target.batch = append(target.batch[:0], *event)
+			return c.processor(msg.Topic).ProcessBatch(pctx, &target.batch)
+		}
+	}
+	maxAttempts := c.cfg.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		err := process()
+		if err == nil || c.cfg.Shadow {
+			c.processed.Add(1)
+			return
+		}
+		c.cfg.Logger.Error("unable to process event",
+			zap.Error(err),
+			zap.String("topic", msg.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", msg.Partition),
+			zap.Int("attempt", attempt),
+			zap.Any("headers", meta),
+		)
+		if attempt >= maxAttempts || !c.wait(ctx, attempt) {
+			spanError(span, err)
+			c.retryLater(ctx, []*kgo.Record{msg}, attempt, err)
+			return
+		}
+	}
+}
+
+// decodeTarget holds the event a record is decoded into, and the batch it's
+// processed in.
+type decodeTarget struct {
+	event model.APMEvent
+	batch model.Batch
+}
+
+// decodeTarget returns a decode target from the pool when PoolDecodeTargets
+// is set, or a new one otherwise.
+func (c *Consumer) decodeTarget() *decodeTarget {
+	if c.cfg.PoolDecodeTargets {
+		return c.decodeTargets.Get().(*decodeTarget)
+	}
+	return c.decodeTargets.New().(*decodeTarget)
+}
+
+// releaseDecodeTarget returns target to the pool when PoolDecodeTargets is
+// set, once it has been reset so no decoded fields leak into the next record.
+func (c *Consumer) releaseDecodeTarget(target *decodeTarget) {
+	if !c.cfg.PoolDecodeTargets {
+		return
+	}
+	target.event = model.APMEvent{}
+	for i := range target.batch {
+		target.batch[i] = model.APMEvent{}
+	}
+	target.batch = target.batch[:0]
+	c.decodeTargets.Put(target)
+}
+
+// acquireInFlight acquires the weight of n records in the MaxInFlightBatches
+// semaphore, capped at its size so it can't block forever, and returns the
+// function releasing it. It returns false if the context is done first.
+func (c *Consumer) acquireInFlight(ctx context.Context, n int) (func(), bool) {
+	if c.inFlight == nil {
+		return func() {}, true
+	}
+	if n > c.cfg.MaxInFlightBatches {
+		n = c.cfg.MaxInFlightBatches
+	}
+	weight := int64(n)
+	if err := c.inFlight.Acquire(ctx, weight); err != nil {
+		return nil, false
+	}
+	return func() { c.inFlight.Release(weight) }, true
+}
+
+// recordID returns the ID of the record, made of its topic, partition and
+// offset, which uniquely identify it.
+func recordID(msg *kgo.Record) string {
+	return fmt.Sprintf("%s-%d-%d", msg.Topic, msg.Partition, msg.Offset)
+}
+
+// processRecords decodes the records into a single batch which is processed
+// at once, retrying processing up to MaxAttempts. Records which fail to be
+// decoded are given up on individually, while all the records are given up
+// on together when the batch fails to be processed.
+func (c *Consumer) processRecords(ctx context.Context, msgs []*kgo.Record) {
+	release, ok := c.acquireInFlight(ctx, len(msgs))
+	if !ok {
+		// The consumer is stopping, the records aren't processed.
+		return
+	}
+	defer release()
+	batch := make(model.Batch, 0, len(msgs))
+	records := make([]*kgo.Record, 0, len(msgs))
+	for _, msg := range msgs {
+		if c.skip(msg) || c.quarantine(ctx, msg) {
+			continue
+		}
 		var event model.APMEvent
-		meta := make(map[string]string)
-		for _, h := range msg.Headers {
-			meta[h.Key] = string(h.Value)
+		if !c.decodeOrHandle(ctx, msg, &event) {
+			if c.decodeError() != nil {
+				// The records aren't processed nor committed.
+				return
+			}
+			continue
+		}
+		if !c.enrichOrHandle(ctx, context.Background(), msg, &event) {
+			continue
+		}
+		batch = append(batch, event)
+		records = append(records, msg)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	processor := c.processor(records[0].Topic)
+	maxAttempts := c.cfg.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		// Copy the batch since the processor may modify it.
+		b := append(model.Batch(nil), batch...)
+		err := processor.ProcessBatch(context.Background(), &b)
+		if err == nil || c.cfg.Shadow {
+			c.processed.Add(int64(len(batch)))
+			return
 		}
-		if err := c.cfg.Decoder.Decode(msg.Value, &event); err != nil {
-			// TODO(marclop) DLQ?
-			c.cfg.Logger.Error("unable to decode message.Value into model.APMEvent",
+		c.cfg.Logger.Error("unable to process batch",
+			zap.Error(err),
+			zap.Int("batch.size", len(batch)),
+			zap.Int("attempt", attempt),
+		)
+		if attempt >= maxAttempts || !c.wait(ctx, attempt) {
+			c.retryLater(ctx, records, attempt, err)
+			return
+		}
+	}
+}
+
+// processor returns the processor of the records of topic.
+func (c *Consumer) processor(topic string) model.BatchProcessor {
+	if p, ok := c.cfg.Processors[apmqueue.Topic(topic)]; ok {
+		return p
+	}
+	return c.cfg.Processor
+}
+
+// topicBatches splits msgs in a batch per topic, in the order the topics
+// first appear, when Processors is set. Otherwise, msgs is a single batch.
+func (c *Consumer) topicBatches(msgs []*kgo.Record) [][]*kgo.Record {
+	if len(c.cfg.Processors) == 0 {
+		return [][]*kgo.Record{msgs}
+	}
+	var batches [][]*kgo.Record
+	index := make(map[string]int)
+	for _, msg := range msgs {
+		i, ok := index[msg.Topic]
+		if !ok {
+			i = len(batches)
+			index[msg.Topic] = i
+			batches = append(batches, nil)
+		}
+		batches[i] = append(batches[i], msg)
+	}
+	return batches
+}
+
+// skip returns true if msg shouldn't be processed, because it's a batch
+// marker, it's outside of the RunRange range, it's older than MaxEventAge,
+// it has expired or its key is a duplicate within the DedupWindow.
+func (c *Consumer) skip(msg *kgo.Record) bool {
+	if isBatchMarker(msg) || c.backfill.skip(msg) {
+		return true
+	}
+	if c.cfg.EnforceRecordTTL && isExpired(msg, time.Now()) {
+		return true
+	}
+	if c.cfg.MaxEventAge > 0 && time.Since(msg.Timestamp) > c.cfg.MaxEventAge {
+		return true
+	}
+	return c.dedup != nil && len(msg.Key) > 0 &&
+		(c.cfg.RetryTopic == "" || msg.Topic != string(c.cfg.RetryTopic)) &&
+		c.dedup.duplicate(string(msg.Key), time.Now())
+}
+
+// quarantine returns true if msg lacks any of the RequiredHeaders, once it
+// has been handled according to the MissingHeaderPolicy.
+func (c *Consumer) quarantine(ctx context.Context, msg *kgo.Record) bool {
+	for _, key := range c.cfg.RequiredHeaders {
+		if hasHeader(msg, key) {
+			continue
+		}
+		c.cfg.Logger.Warn("record missing required header",
+			zap.String("header", key),
+			zap.String("topic", msg.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", msg.Partition),
+		)
+		if c.cfg.MissingHeaderPolicy == MissingHeaderDeadLetter {
+			c.deadLetter(ctx, msg, fmt.Errorf("%w %s", ErrMissingHeader, key))
+		}
+		return true
+	}
+	return false
+}
+
+// hasHeader returns true if msg has a header with the given key.
+func hasHeader(msg *kgo.Record, key string) bool {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// isExpired returns true if msg has an expiry time which is before now.
+// Records with an invalid expiry time aren't considered expired.
+func isExpired(msg *kgo.Record, now time.Time) bool {
+	for _, h := range msg.Headers {
+		if h.Key != ExpiresHeader {
+			continue
+		}
+		expires, err := strconv.ParseInt(string(h.Value), 10, 64)
+		return err == nil && now.UnixMilli() > expires
+	}
+	return false
+}
+
+// decodeOrHandle decodes msg into event, and returns false when it fails to
+// be decoded once the failure has been handled according to the DecodeAction
+// returned by ClassifyDecodeError.
+func (c *Consumer) decodeOrHandle(ctx context.Context, msg *kgo.Record, event *model.APMEvent, fields ...zap.Field) bool {
+	maxAttempts := c.cfg.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		err := c.decodeRecord(ctx, msg, event)
+		if err == nil {
+			return true
+		}
+		c.cfg.Logger.Error("unable to decode message.Value into model.APMEvent",
+			append([]zap.Field{
 				zap.Error(err),
 				zap.String("topic", msg.Topic),
 				zap.ByteString("message.value", msg.Value),
 				zap.Int64("offset", msg.Offset),
 				zap.Int32("partition", msg.Partition),
-				zap.Any("headers", meta),
+				zap.Int("attempt", attempt),
+			}, fields...)...,
+		)
+		action := DecodeSkip
+		if c.cfg.ClassifyDecodeError != nil {
+			action = c.cfg.ClassifyDecodeError(err)
+		}
+		switch action {
+		case DecodeRetry:
+			if attempt < maxAttempts && c.wait(ctx, attempt) {
+				continue
+			}
+			c.retryLater(ctx, []*kgo.Record{msg}, attempt, err)
+		case DecodeFail:
+			c.failDecode(fmt.Errorf(
+				"kafka: failed to decode record %s: %w", recordID(msg), err,
+			))
+		default:
+			c.giveUp(ctx, []*kgo.Record{msg}, attempt, err)
+		}
+		return false
+	}
+}
+
+// enrichOrHandle enriches event with EnrichFunc, when set, and returns false
+// when it fails, once the record has been given up on with
+// AtMostOnceDeliveryType, or retried up to MaxAttempts otherwise. The event
+// is enriched with pctx.
+func (c *Consumer) enrichOrHandle(ctx, pctx context.Context, msg *kgo.Record, event *model.APMEvent) bool {
+	if c.cfg.EnrichFunc == nil {
+		return true
+	}
+	maxAttempts := c.cfg.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		err := c.cfg.EnrichFunc(pctx, event)
+		if err == nil {
+			return true
+		}
+		c.cfg.Logger.Error("unable to enrich event",
+			zap.Error(err),
+			zap.String("topic", msg.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", msg.Partition),
+			zap.Int("attempt", attempt),
+		)
+		if c.cfg.Delivery == apmqueue.AtMostOnceDeliveryType {
+			c.giveUp(ctx, []*kgo.Record{msg}, attempt, err)
+			return false
+		}
+		if attempt >= maxAttempts || !c.wait(ctx, attempt) {
+			c.retryLater(ctx, []*kgo.Record{msg}, attempt, err)
+			return false
+		}
+	}
+}
+
+// failDecode stops the consumer with err, unless it was already stopped by
+// a previous record which failed to be decoded.
+func (c *Consumer) failDecode(err error) {
+	c.assignmentMu.Lock()
+	defer c.assignmentMu.Unlock()
+	if c.decodeErr == nil {
+		c.decodeErr = err
+	}
+}
+
+// decodeError returns the error of the record which failed to be decoded
+// with DecodeFail, if any.
+func (c *Consumer) decodeError() error {
+	c.assignmentMu.RLock()
+	defer c.assignmentMu.RUnlock()
+	return c.decodeErr
+}
+
+// decodeRecord verifies the checksum of msg when VerifyChecksum is set, and
+// decodes its value into event.
+func (c *Consumer) decodeRecord(ctx context.Context, msg *kgo.Record, event *model.APMEvent) error {
+	if c.cfg.VerifyChecksum {
+		if err := verifyChecksum(msg); err != nil {
+			return err
+		}
+	}
+	return c.decode(ctx, msg.Value, event)
+}
+
+// verifyChecksum returns an error if msg has a checksum header which doesn't
+// match its value.
+func verifyChecksum(msg *kgo.Record) error {
+	for _, h := range msg.Headers {
+		if h.Key != ChecksumHeader {
+			continue
+		}
+		if sum := checksum(msg.Value); !bytes.Equal(sum, h.Value) {
+			return fmt.Errorf("kafka: checksum mismatch: expected %s, got %s", h.Value, sum)
+		}
+		return nil
+	}
+	return nil
+}
+
+// decode decodes value into event with the first decoder which succeeds,
+// recording which codec decoded it and the event type. An error joining the
+// errors of every decoder is returned if none succeeds.
+func (c *Consumer) decode(ctx context.Context, value []byte, event *model.APMEvent) error {
+	var errs []error
+	for _, d := range c.decoders {
+		err := d.Decode(value, event)
+		if err == nil {
+			c.decoded.Add(ctx, 1,
+				attribute.String("codec", fmt.Sprintf("%T", d)),
+				attribute.String("event.type", EventType(*event)),
 			)
-			return
+			return nil
+		}
+		errs = append(errs, err)
+		// Discard any fields set by the failed decoder.
+		*event = model.APMEvent{}
+	}
+	return errors.Join(errs...)
+}
+
+// wait waits for the configured backoff before the next processing or commit
+// attempt.
+// It returns false if ctx is done before then.
+func (c *Consumer) wait(ctx context.Context, attempt int) bool {
+	if c.cfg.Backoff == nil {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(c.cfg.Backoff.NextBackoff(attempt))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// deferRetries returns the fetches without the records of the RetryTopic
+// partitions which aren't due yet. Rather than waiting for them while
+// processing, which would block the other partitions and rebalances, the
+// partition of the first record which isn't due is paused and rewound to
+// it, and resumed once it's due.
+func (c *Consumer) deferRetries(fetches kgo.Fetches) kgo.Fetches {
+	if c.cfg.RetryTopic == "" {
+		return fetches
+	}
+	topic := string(c.cfg.RetryTopic)
+	now := time.Now()
+	c.deferredMu.Lock()
+	defer c.deferredMu.Unlock()
+	deferred := make(kgo.Fetches, 0, len(fetches))
+	for _, fetch := range fetches {
+		topics := make([]kgo.FetchTopic, 0, len(fetch.Topics))
+		for _, ft := range fetch.Topics {
+			if ft.Topic == topic {
+				partitions := make([]kgo.FetchPartition, len(ft.Partitions))
+				for i, fp := range ft.Partitions {
+					fp.Records = c.deferPartition(now, topic, fp.Partition, fp.Records)
+					partitions[i] = fp
+				}
+				ft.Partitions = partitions
+			}
+			topics = append(topics, ft)
+		}
+		fetch.Topics = topics
+		deferred = append(deferred, fetch)
+	}
+	return deferred
+}
+
+// deferPartition returns the records of the RetryTopic partition which are
+// due, up to the first one which isn't, pausing and rewinding the partition
+// to it until it's due. The records of the partitions already paused, which
+// were buffered before they were paused, are all deferred. It must be called
+// with deferredMu held.
+func (c *Consumer) deferPartition(now time.Time, topic string, partition int32, records []*kgo.Record) []*kgo.Record {
+	if _, ok := c.deferred[partition]; ok {
+		return nil
+	}
+	for i, r := range records {
+		at := retryAt(r)
+		if !now.Before(at) {
+			continue
 		}
-		ctx = queuecontext.WithMetadata(context.Background(), meta)
-		batch := model.Batch{event}
-		if err := c.cfg.Processor.ProcessBatch(ctx, &batch); err != nil {
-			c.cfg.Logger.Error("unable to process event",
+		c.deferred[partition] = struct{}{}
+		c.pausePartitions(map[string][]int32{topic: {partition}})
+		c.setOffsets(map[string]map[int32]kgo.EpochOffset{topic: {partition: {
+			Epoch:  r.LeaderEpoch,
+			Offset: r.Offset,
+		}}})
+		c.cfg.Logger.Debug("pausing retry partition until its next record is due",
+			zap.String("topic", topic),
+			zap.Int32("partition", partition),
+			zap.Int64("offset", r.Offset),
+			zap.Time("retry_at", at),
+		)
+		time.AfterFunc(at.Sub(now), func() {
+			c.deferredMu.Lock()
+			delete(c.deferred, partition)
+			c.deferredMu.Unlock()
+			c.resumePartitions(map[string][]int32{topic: {partition}})
+		})
+		return records[:i]
+	}
+	return records
+}
+
+// retryAt returns the time in the RetryAtHeader of msg, or the zero time
+// when it has none.
+func retryAt(msg *kgo.Record) time.Time {
+	for _, h := range msg.Headers {
+		if h.Key != RetryAtHeader {
+			continue
+		}
+		ms, err := strconv.ParseInt(string(h.Value), 10, 64)
+		if err != nil {
+			return time.Time{}
+		}
+		return time.UnixMilli(ms)
+	}
+	return time.Time{}
+}
+
+// retryLater republishes the records which failed to be processed to the
+// RetryTopic, and gives up on the records which were already retried
+// MaxRetries times or which couldn't be republished. It gives up on all the
+// records when RetryTopic isn't set, or with Shadow.
+func (c *Consumer) retryLater(ctx context.Context, msgs []*kgo.Record, attempts int, err error) {
+	if c.cfg.RetryTopic == "" || c.cfg.Shadow {
+		c.giveUp(ctx, msgs, attempts, err)
+		return
+	}
+	maxRetries := c.cfg.MaxRetries
+	if maxRetries < 1 {
+		maxRetries = 1
+	}
+	retryAt := []byte(strconv.FormatInt(time.Now().Add(c.cfg.RetryDelay).UnixMilli(), 10))
+	var exhausted []*kgo.Record
+	for _, msg := range msgs {
+		headers := make([]kgo.RecordHeader, 0, len(msg.Headers)+2)
+		var retries int
+		for _, h := range msg.Headers {
+			switch h.Key {
+			case RetriesHeader:
+				retries, _ = strconv.Atoi(string(h.Value))
+			case RetryAtHeader:
+			default:
+				headers = append(headers, h)
+			}
+		}
+		if retries >= maxRetries {
+			exhausted = append(exhausted, msg)
+			continue
+		}
+		record := &kgo.Record{
+			Topic: string(c.cfg.RetryTopic),
+			Key:   msg.Key,
+			Value: msg.Value,
+			Headers: append(headers,
+				kgo.RecordHeader{Key: RetriesHeader, Value: []byte(strconv.Itoa(retries + 1))},
+				kgo.RecordHeader{Key: RetryAtHeader, Value: retryAt},
+			),
+		}
+		if err := c.produce(ctx, record); err != nil {
+			c.cfg.Logger.Error("failed producing record to retry topic",
 				zap.Error(err),
 				zap.String("topic", msg.Topic),
+				zap.String("retry_topic", record.Topic),
 				zap.Int64("offset", msg.Offset),
 				zap.Int32("partition", msg.Partition),
-				zap.Any("headers", meta),
 			)
+			exhausted = append(exhausted, msg)
+		}
+	}
+	if len(exhausted) > 0 {
+		c.giveUp(ctx, exhausted, attempts, err)
+	}
+}
+
+// giveUp records the number of attempts in the record headers, notifies the
+// configured OnGiveUp callback and dead letters the records.
+func (c *Consumer) giveUp(ctx context.Context, msgs []*kgo.Record, attempts int, err error) {
+	records := make([]*kgo.Record, len(msgs))
+	for i, msg := range msgs {
+		headers := make([]kgo.RecordHeader, 0, len(msg.Headers)+1)
+		for _, h := range msg.Headers {
+			if h.Key != AttemptsHeader {
+				headers = append(headers, h)
+			}
+		}
+		record := *msg
+		record.Headers = append(headers, kgo.RecordHeader{
+			Key:   AttemptsHeader,
+			Value: []byte(strconv.Itoa(attempts)),
+		})
+		records[i] = &record
+	}
+	if c.cfg.OnGiveUp != nil {
+		c.cfg.OnGiveUp(records, err)
+	}
+	for _, record := range records {
+		c.deadLetter(ctx, record, err)
+	}
+}
+
+// isBatchMarker returns true if msg is a batch marker record produced by a
+// Producer with EmitBatchMarker enabled.
+func isBatchMarker(msg *kgo.Record) bool {
+	for _, h := range msg.Headers {
+		if h.Key == BatchMarkerHeader {
+			return string(h.Value) == "true"
+		}
+	}
+	return false
+}
+
+// deadLetter produces the record to the topic returned by the configured
+// ErrorTopicRouter for err. The record is dropped when no topic is returned,
+// or with Shadow.
+func (c *Consumer) deadLetter(ctx context.Context, msg *kgo.Record, err error) {
+	if c.cfg.ErrorTopicRouter == nil || c.cfg.Shadow {
+		return
+	}
+	topic := c.cfg.ErrorTopicRouter(msg, err)
+	if topic == "" {
+		return
+	}
+	record := &kgo.Record{
+		Topic:   string(topic),
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: msg.Headers,
+	}
+	if err := c.produce(ctx, record); err != nil {
+		c.cfg.Logger.Error("failed producing record to dead letter topic",
+			zap.Error(err),
+			zap.String("topic", msg.Topic),
+			zap.String("dead_letter_topic", record.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", msg.Partition),
+		)
+	}
+}
+
+// Stats returns a snapshot of the consumer state. It is safe to call while
+// the consumer is running.
+func (c *Consumer) Stats() ConsumerStats {
+	stats := ConsumerStats{
+		Processed:  c.processed.Load(),
+		Committed:  make(map[apmqueue.Topic]map[int32]int64),
+		Assignment: c.Assignment(),
+	}
+	if c.cfg.OffsetStore != nil {
+		c.storedMu.Lock()
+		defer c.storedMu.Unlock()
+		for topic, partitions := range c.stored {
+			offsets := make(map[int32]int64, len(partitions))
+			for partition, offset := range partitions {
+				offsets[partition] = offset
+			}
+			stats.Committed[apmqueue.Topic(topic)] = offsets
+		}
+		return stats
+	}
+	for topic, partitions := range c.committedOffsets() {
+		offsets := make(map[int32]int64, len(partitions))
+		for partition, offset := range partitions {
+			offsets[partition] = offset.Offset
+		}
+		stats.Committed[apmqueue.Topic(topic)] = offsets
+	}
+	return stats
+}
+
+// Assignment returns the partitions currently assigned to the consumer. It is
+// safe to call while the consumer is running.
+func (c *Consumer) Assignment() map[apmqueue.Topic][]int32 {
+	c.assignmentMu.RLock()
+	defer c.assignmentMu.RUnlock()
+	assignment := make(map[apmqueue.Topic][]int32, len(c.assignment))
+	for topic, partitions := range c.assignment {
+		assignment[apmqueue.Topic(topic)] = append([]int32(nil), partitions...)
+	}
+	return assignment
+}
+
+// PartitionWorkers returns the index of the worker processing the records of
+// each assigned partition when PartitionAffinity is set, for debugging, or nil
+// otherwise. It is safe to call while the consumer is running.
+func (c *Consumer) PartitionWorkers() map[apmqueue.Topic]map[int32]int {
+	if !c.cfg.PartitionAffinity {
+		return nil
+	}
+	assignment := c.Assignment()
+	workers := make(map[apmqueue.Topic]map[int32]int, len(assignment))
+	for topic, partitions := range assignment {
+		workers[topic] = make(map[int32]int, len(partitions))
+		for _, partition := range partitions {
+			workers[topic][partition] = c.partitionWorker(string(topic), partition)
+		}
+	}
+	return workers
+}
+
+// assigned is called by the client when partitions are assigned to the
+// consumer as part of a group rebalance.
+func (c *Consumer) assigned(ctx context.Context, _ *kgo.Client, m map[string][]int32) {
+	c.assignmentMu.Lock()
+	for topic, partitions := range m {
+		c.assignment[topic] = append(c.assignment[topic], partitions...)
+	}
+	failed := c.assignErr != nil
+	start := c.rebalanceStart
+	c.rebalanceStart = time.Time{}
+	c.assignmentMu.Unlock()
+	c.rebalances.Add(ctx, 1)
+	if !start.IsZero() {
+		// The first assignment after joining the group has no duration.
+		c.rebalanceDuration.Record(ctx, time.Since(start).Milliseconds())
+	}
+	if c.cfg.OnPartitionsAssigned == nil || failed {
+		return
+	}
+	partitions := make(map[apmqueue.Topic][]int32, len(m))
+	for topic, p := range m {
+		partitions[apmqueue.Topic(topic)] = append([]int32(nil), p...)
+	}
+	// The client doesn't fetch the records of the assigned partitions until
+	// the callback returns.
+	if err := c.cfg.OnPartitionsAssigned(ctx, partitions); err != nil {
+		c.cfg.Logger.Error("partitions assigned callback failed, closing consumer",
+			zap.Error(err),
+		)
+		c.assignmentMu.Lock()
+		c.assignErr = fmt.Errorf("kafka: partitions assigned callback failed: %w", err)
+		c.assignmentMu.Unlock()
+		// Closing the client from its own callback would deadlock.
+		go c.client.Close()
+	}
+}
+
+// assignError returns the error returned by OnPartitionsAssigned, if any.
+func (c *Consumer) assignError() error {
+	c.assignmentMu.RLock()
+	defer c.assignmentMu.RUnlock()
+	return c.assignErr
+}
+
+// revoked is called by the client when partitions are revoked.
+func (c *Consumer) revoked(ctx context.Context, _ *kgo.Client, m map[string][]int32) {
+	if c.cfg.commitMode() == commitInBackground {
+		// Commit the offsets of the processed records before the partitions
+		// are reassigned, replacing the client's default revoke behavior.
+		c.commit(ctx)
+	}
+	c.lost(ctx, nil, m)
+}
+
+// lost is called by the client when partitions are lost, and after they
+// have been revoked, which starts a rebalance.
+func (c *Consumer) lost(_ context.Context, _ *kgo.Client, m map[string][]int32) {
+	// Wait for the prefetched records being processed to be committed.
+	c.prefetchMu.Lock()
+	defer c.prefetchMu.Unlock()
+	c.assignmentMu.Lock()
+	defer c.assignmentMu.Unlock()
+	if c.rebalanceStart.IsZero() {
+		c.rebalanceStart = time.Now()
+	}
+	for topic, partitions := range m {
+		for _, p := range partitions {
+			delete(c.lastConsumed[topic], p)
+		}
+		if len(c.lastConsumed[topic]) == 0 {
+			delete(c.lastConsumed, topic)
+		}
+		remaining := c.assignment[topic][:0]
+		for _, p := range c.assignment[topic] {
+			if !containsPartition(partitions, p) {
+				remaining = append(remaining, p)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(c.assignment, topic)
+			continue
+		}
+		c.assignment[topic] = remaining
+	}
+}
+
+// updateLastConsumed records the timestamp of the last record consumed from
+// each of the fetched partitions.
+func (c *Consumer) updateLastConsumed(fetches kgo.Fetches) {
+	c.assignmentMu.Lock()
+	defer c.assignmentMu.Unlock()
+	fetches.EachPartition(func(fp kgo.FetchTopicPartition) {
+		if len(fp.Records) == 0 {
 			return
 		}
+		if c.lastConsumed[fp.Topic] == nil {
+			c.lastConsumed[fp.Topic] = make(map[int32]time.Time)
+		}
+		c.lastConsumed[fp.Topic][fp.Partition] = fp.Records[len(fp.Records)-1].Timestamp
 	})
+}
+
+// observeTimeBehind observes the time elapsed since the timestamp of the last
+// record consumed from each partition.
+func (c *Consumer) observeTimeBehind(_ context.Context, o instrument.Int64Observer) error {
+	c.assignmentMu.RLock()
+	defer c.assignmentMu.RUnlock()
+	now := time.Now()
+	for topic, partitions := range c.lastConsumed {
+		for partition, ts := range partitions {
+			o.Observe(now.Sub(ts).Milliseconds(),
+				attribute.String("topic", topic),
+				attribute.Int("partition", int(partition)),
+			)
+		}
+	}
 	return nil
 }
 
+func containsPartition(partitions []int32, partition int32) bool {
+	for _, p := range partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
 // Healthy returns an error if the Kafka active broker length dips below 1.
 func (c *Consumer) Healthy() error {
 	if brokers := c.client.DiscoveredBrokers(); len(brokers) < 1 {
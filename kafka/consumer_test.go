@@ -18,12 +18,2219 @@
 package kafka
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kversion"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	codec "github.com/elastic/apm-queue/codec/json"
+	"github.com/elastic/apm-queue/queuecontext"
 )
 
 func TestNewConsumer(t *testing.T) {
 	_, err := NewConsumer(ConsumerConfig{})
 	assert.Error(t, err)
 }
+
+func TestConsumerCompression(t *testing.T) {
+	for name, codec := range map[string]struct {
+		codec kgo.CompressionCodec
+		// attributes is the compression codec in the batch attributes.
+		attributes int8
+	}{
+		"gzip":   {codec: kgo.GzipCompression(), attributes: 1},
+		"snappy": {codec: kgo.SnappyCompression(), attributes: 2},
+		"lz4":    {codec: kgo.Lz4Compression(), attributes: 3},
+		"zstd":   {codec: kgo.ZstdCompression(), attributes: 4},
+	} {
+		codec := codec
+		t.Run(name, func(t *testing.T) {
+			broker := newFakeBroker(t)
+			// zstd compressed batches are produced to Kafka 2.1 onwards.
+			broker.setVersions(kversion.V2_1_0())
+			producer := newTestProducer(t, ProducerConfig{
+				Broker:      broker.addr.String(),
+				Sync:        true,
+				Encoder:     messageEncoder{},
+				Compression: []kgo.CompressionCodec{codec.codec},
+			})
+			// Compressible events, since batches are only compressed when
+			// it makes them smaller.
+			produced := model.Batch{
+				{Message: strings.Repeat("a", 1000)},
+				{Message: strings.Repeat("b", 1000)},
+			}
+			require.NoError(t, producer.ProcessBatch(context.Background(), &produced))
+			require.Equal(t, []int8{codec.attributes}, broker.compressions())
+
+			var mu sync.Mutex
+			var messages []string
+			done := make(chan struct{})
+			consumer := newTestConsumer(t, ConsumerConfig{
+				Brokers: []string{broker.addr.String()},
+				Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+					mu.Lock()
+					defer mu.Unlock()
+					for _, event := range *b {
+						messages = append(messages, event.Message)
+					}
+					if len(messages) == len(produced) {
+						close(done)
+					}
+					return nil
+				}),
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			runErr := make(chan error, 1)
+			go func() { runErr <- consumer.Run(ctx) }()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the records to be consumed")
+			}
+			cancel()
+			<-runErr
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, []string{produced[0].Message, produced[1].Message}, messages)
+		})
+	}
+}
+
+func TestConsumerStats(t *testing.T) {
+	var processed int
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Decoder: codec.JSON{},
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			processed++
+			return nil
+		}),
+	})
+
+	consumer.assigned(context.Background(), nil, map[string][]int32{
+		"topic": {0, 1, 2},
+	})
+	const records = 10
+	for i := 0; i < records; i++ {
+		consumer.processRecord(context.Background(), &kgo.Record{
+			Topic:     "topic",
+			Partition: int32(i % 3),
+			Offset:    int64(i),
+			Value:     []byte(`{}`),
+		})
+	}
+	// Records which can't be decoded aren't counted as processed.
+	consumer.processRecord(context.Background(), &kgo.Record{Topic: "topic", Value: []byte(`{`)})
+
+	stats := consumer.Stats()
+	assert.Equal(t, records, processed)
+	assert.Equal(t, int64(records), stats.Processed)
+	assert.Equal(t, map[apmqueue.Topic][]int32{"topic": {0, 1, 2}}, stats.Assignment)
+	// No offsets are committed until the consumer has joined the group.
+	assert.Empty(t, stats.Committed)
+
+	consumer.revoked(context.Background(), nil, map[string][]int32{
+		"topic": {1},
+	})
+	assert.Equal(t, map[apmqueue.Topic][]int32{"topic": {0, 2}},
+		consumer.Stats().Assignment,
+	)
+}
+
+func TestConsumerStatsCommitted(t *testing.T) {
+	for name, store := range map[string]OffsetStore{
+		"group":        nil,
+		"offset store": newMemoryOffsetStore(),
+	} {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			broker := newFakeBroker(t)
+			broker.setPartitions(3)
+			producer := newTestProducer(t, ProducerConfig{
+				Broker:  broker.addr.String(),
+				Sync:    true,
+				Encoder: messageEncoder{},
+				// Spread the records across the partitions.
+				KeyEncoder: func(event model.APMEvent) ([]byte, error) {
+					return []byte(event.Message), nil
+				},
+			})
+			const records = 30
+			var batch model.Batch
+			for i := 0; i < records; i++ {
+				batch = append(batch, model.APMEvent{Message: strconv.Itoa(i)})
+			}
+			require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+			expected := map[apmqueue.Topic]map[int32]int64{"topic": {}}
+			for partition := int32(0); partition < 3; partition++ {
+				if offset := broker.highWatermark("topic", partition); offset > 0 {
+					expected["topic"][partition] = offset
+				}
+			}
+
+			consumer := newTestConsumer(t, ConsumerConfig{
+				Brokers:     []string{broker.addr.String()},
+				OffsetStore: store,
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			runErr := make(chan error, 1)
+			go func() { runErr <- consumer.Run(ctx) }()
+			assert.Eventually(t, func() bool {
+				return consumer.Stats().Processed == records
+			}, 10*time.Second, 10*time.Millisecond)
+			cancel()
+			<-runErr
+
+			// The offsets of the records processed are committed, before
+			// they're processed with AtMostOnceDeliveryType.
+			assert.Equal(t, expected, consumer.Stats().Committed)
+		})
+	}
+}
+
+func TestConsumerAssignment(t *testing.T) {
+	consumer := newTestConsumer(t, ConsumerConfig{Topics: []string{"a", "b"}})
+	assert.Empty(t, consumer.Assignment())
+
+	// Assignment is safe to call while the group rebalances.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			consumer.Assignment()
+		}
+	}()
+	consumer.assigned(context.Background(), nil, map[string][]int32{
+		"a": {0, 1, 2},
+		"b": {0},
+	})
+	<-done
+
+	assignment := consumer.Assignment()
+	assert.Equal(t, map[apmqueue.Topic][]int32{"a": {0, 1, 2}, "b": {0}}, assignment)
+	// The returned assignment is a copy.
+	assignment["a"][0] = 5
+	delete(assignment, "b")
+	assert.Equal(t, map[apmqueue.Topic][]int32{"a": {0, 1, 2}, "b": {0}}, consumer.Assignment())
+
+	consumer.lost(context.Background(), nil, map[string][]int32{"b": {0}})
+	assert.Equal(t, map[apmqueue.Topic][]int32{"a": {0, 1, 2}}, consumer.Assignment())
+}
+
+func TestConsumerKeyOrdering(t *testing.T) {
+	for _, concurrency := range []int{0, 1, 4} {
+		t.Run(fmt.Sprintf("concurrency=%d", concurrency), func(t *testing.T) {
+			var mu sync.Mutex
+			observed := make(map[string][]string)
+			consumer := newTestConsumer(t, ConsumerConfig{
+				Delivery:    apmqueue.AtLeastOnceDeliveryType,
+				Concurrency: concurrency,
+				Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+					mu.Lock()
+					defer mu.Unlock()
+					for _, event := range *b {
+						key, value, _ := strings.Cut(event.Message, ":")
+						observed[key] = append(observed[key], value)
+					}
+					return nil
+				}),
+			})
+
+			keys := []string{"a", "b", "c", "d", "e"}
+			expected := make(map[string][]string)
+			partitions := make([]kgo.FetchPartition, 2)
+			for i := 0; i < 100; i++ {
+				key := keys[i%len(keys)]
+				value := strconv.Itoa(i)
+				expected[key] = append(expected[key], value)
+				p := &partitions[len(key)%len(partitions)]
+				p.Partition = int32(len(key) % len(partitions))
+				p.Records = append(p.Records, &kgo.Record{
+					Key:       []byte(key),
+					Value:     []byte(key + ":" + value),
+					Topic:     "topic",
+					Partition: p.Partition,
+					Offset:    int64(len(p.Records)),
+				})
+			}
+			consumer.processFetches(context.Background(), kgo.Fetches{{Topics: []kgo.FetchTopic{{
+				Topic:      "topic",
+				Partitions: partitions,
+			}}}})
+			assert.Equal(t, expected, observed)
+		})
+	}
+}
+
+func TestConsumerMaxInFlightBatches(t *testing.T) {
+	const limit = 2
+	var inFlight, maxInFlight atomic.Int64
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Concurrency:        8,
+		MaxInFlightBatches: limit,
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				cur := maxInFlight.Load()
+				if n <= cur || maxInFlight.CompareAndSwap(cur, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		}),
+	})
+	var records []*kgo.Record
+	for i := 0; i < 200; i++ {
+		records = append(records, &kgo.Record{
+			Key:   []byte(strconv.Itoa(i)),
+			Value: []byte(strconv.Itoa(i)),
+		})
+	}
+	consumer.processFetches(context.Background(), kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic:      "topic",
+		Partitions: []kgo.FetchPartition{{Records: records}},
+	}}}})
+	assert.Equal(t, int64(len(records)), consumer.Stats().Processed)
+	assert.LessOrEqual(t, maxInFlight.Load(), int64(limit))
+	assert.Positive(t, maxInFlight.Load())
+
+	t.Run("cancelled", func(t *testing.T) {
+		// Exhaust the semaphore, waiters must be released once the context
+		// is cancelled without processing the records.
+		require.NoError(t, consumer.inFlight.Acquire(context.Background(), limit))
+		defer consumer.inFlight.Release(limit)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			consumer.processFetches(ctx, kgo.Fetches{{Topics: []kgo.FetchTopic{{
+				Topic: "topic",
+				Partitions: []kgo.FetchPartition{{
+					Records: []*kgo.Record{{Value: []byte("blocked")}},
+				}},
+			}}}})
+		}()
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the record to be released")
+		}
+		assert.Equal(t, int64(len(records)), consumer.Stats().Processed)
+	})
+}
+
+func TestConsumerMaxInFlightBatchesWeight(t *testing.T) {
+	const limit = 4
+	var consumer *Consumer
+	var available []int64
+	consumer = newTestConsumer(t, ConsumerConfig{
+		BatchMaxRecords:    10,
+		MaxInFlightBatches: limit,
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			// Find the weight left in the semaphore while the batch is
+			// processed.
+			n := int64(limit)
+			for ; n > 0; n-- {
+				if consumer.inFlight.TryAcquire(n) {
+					consumer.inFlight.Release(n)
+					break
+				}
+			}
+			available = append(available, n)
+			return nil
+		}),
+	})
+	newRecords := func(n int) []*kgo.Record {
+		records := make([]*kgo.Record, n)
+		for i := range records {
+			records[i] = &kgo.Record{Topic: "topic", Value: []byte(strconv.Itoa(i))}
+		}
+		return records
+	}
+	consumer.processRecords(context.Background(), newRecords(3))
+	// Batches larger than the limit weigh the limit, rather than blocking.
+	consumer.processRecords(context.Background(), newRecords(10))
+	assert.Equal(t, []int64{1, 0}, available)
+	assert.Equal(t, int64(13), consumer.Stats().Processed)
+}
+
+func TestConsumerMaxEventAge(t *testing.T) {
+	var processed []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		MaxEventAge: time.Hour,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed = append(processed, event.Message)
+			}
+			return nil
+		}),
+	})
+	now := time.Now()
+	for _, r := range []*kgo.Record{
+		{Value: []byte("stale"), Timestamp: now.Add(-2 * time.Hour)},
+		{Value: []byte("fresh"), Timestamp: now.Add(-time.Minute)},
+		{Value: []byte("expiring"), Timestamp: now.Add(-61 * time.Minute)},
+		{Value: []byte("new"), Timestamp: now},
+	} {
+		consumer.processRecord(context.Background(), r)
+	}
+	assert.Equal(t, []string{"fresh", "new"}, processed)
+}
+
+func TestConsumerEnforceRecordTTL(t *testing.T) {
+	var produced []*kgo.Record
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:    true,
+		Encoder: messageEncoder{},
+		RecordTTLFunc: func(event model.APMEvent) time.Duration {
+			switch event.Message {
+			case "expired":
+				return time.Millisecond
+			case "live":
+				return time.Hour
+			}
+			return 0
+		},
+	})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		produced = append(produced, r)
+		promise(r, nil)
+	}
+	batch := model.Batch{{Message: "expired"}, {Message: "live"}, {Message: "forever"}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	require.Len(t, produced, 3)
+	for i, r := range produced[:2] {
+		var expires []byte
+		for _, h := range r.Headers {
+			if h.Key == ExpiresHeader {
+				expires = h.Value
+			}
+		}
+		assert.NotEmpty(t, expires, "record %d", i)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	var processed []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Delivery:         apmqueue.AtLeastOnceDeliveryType,
+		EnforceRecordTTL: true,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed = append(processed, event.Message)
+			}
+			return nil
+		}),
+	})
+	var commits int
+	consumer.commitOffsets = func(context.Context) error {
+		commits++
+		return nil
+	}
+	consumer.consume(context.Background(), kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic:      "topic",
+		Partitions: []kgo.FetchPartition{{Records: produced}},
+	}}}})
+	// The expired record is skipped, and its offset committed.
+	assert.Equal(t, []string{"live", "forever"}, processed)
+	assert.Equal(t, 1, commits)
+}
+
+func TestConsumerSkipsBatchMarkers(t *testing.T) {
+	var processed []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed = append(processed, event.Message)
+			}
+			return nil
+		}),
+	})
+	marker := []kgo.RecordHeader{{Key: BatchMarkerHeader, Value: []byte("true")}}
+	for _, r := range []*kgo.Record{
+		{Value: []byte("a")},
+		{Value: []byte("b")},
+		{Headers: marker},
+	} {
+		consumer.processRecord(context.Background(), r)
+	}
+	assert.Equal(t, []string{"a", "b"}, processed)
+	assert.Equal(t, int64(2), consumer.Stats().Processed)
+}
+
+func TestConsumerNoCommit(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg             ConsumerConfig
+		expectedCommits int
+	}{
+		"at_most_once":  {cfg: ConsumerConfig{Delivery: apmqueue.AtMostOnceDeliveryType}, expectedCommits: 1},
+		"at_least_once": {cfg: ConsumerConfig{Delivery: apmqueue.AtLeastOnceDeliveryType}, expectedCommits: 1},
+		"no_commit":     {cfg: ConsumerConfig{NoCommit: true}},
+		"no_commit_at_least_once": {cfg: ConsumerConfig{
+			Delivery: apmqueue.AtLeastOnceDeliveryType,
+			NoCommit: true,
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var processed []string
+			tc.cfg.Processor = model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				for _, event := range *b {
+					processed = append(processed, event.Message)
+				}
+				return nil
+			})
+			consumer := newTestConsumer(t, tc.cfg)
+			var commits int
+			consumer.commitOffsets = func(context.Context) error {
+				commits++
+				return nil
+			}
+			consumer.consume(context.Background(), kgo.Fetches{{Topics: []kgo.FetchTopic{{
+				Topic: "topic",
+				Partitions: []kgo.FetchPartition{{Records: []*kgo.Record{
+					{Topic: "topic", Value: []byte("a"), Offset: 0},
+					{Topic: "topic", Value: []byte("b"), Offset: 1},
+				}}},
+			}}}})
+			assert.Equal(t, []string{"a", "b"}, processed)
+			assert.Equal(t, tc.expectedCommits, commits)
+		})
+	}
+}
+
+func TestConsumerShadow(t *testing.T) {
+	var processed []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Delivery:    apmqueue.AtLeastOnceDeliveryType,
+		Shadow:      true,
+		MaxAttempts: 3,
+		Backoff:     ConstantBackoff(time.Millisecond),
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed = append(processed, (*b)[0].Message)
+			return errors.New("always failing")
+		}),
+		ErrorTopicRouter: func(*kgo.Record, error) apmqueue.Topic { return "dead-letter" },
+	})
+	var commits, produced int
+	consumer.commitOffsets = func(context.Context) error {
+		commits++
+		return nil
+	}
+	consumer.produce = func(context.Context, *kgo.Record) error {
+		produced++
+		return nil
+	}
+	consumer.consume(context.Background(), kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic: "topic",
+		Partitions: []kgo.FetchPartition{{Records: []*kgo.Record{
+			{Topic: "topic", Value: []byte("a"), Offset: 0},
+			{Topic: "topic", Value: []byte("b"), Offset: 1},
+		}}},
+	}}}})
+	// The failures are ignored: the records are neither retried nor dead
+	// lettered, and the offsets aren't committed.
+	assert.Equal(t, []string{"a", "b"}, processed)
+	assert.Equal(t, int64(2), consumer.processed.Load())
+	assert.Zero(t, produced)
+	assert.Zero(t, commits)
+	assert.Equal(t, commitDisabled, consumer.cfg.commitMode())
+
+	cfg := consumer.cfg
+	cfg.OffsetStore = newMemoryOffsetStore()
+	assert.EqualError(t, cfg.Validate(), "kafka: offset store cannot be used with shadow")
+}
+
+func TestConsumerCommitMode(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg      ConsumerConfig
+		expected []string
+	}{
+		"at_most_once": {
+			cfg:      ConsumerConfig{Delivery: apmqueue.AtMostOnceDeliveryType},
+			expected: []string{"commit", "process a", "process b"},
+		},
+		"at_least_once": {
+			cfg:      ConsumerConfig{Delivery: apmqueue.AtLeastOnceDeliveryType},
+			expected: []string{"process a", "process b", "commit"},
+		},
+		"at_least_once_concurrency": {
+			cfg: ConsumerConfig{
+				Delivery:    apmqueue.AtLeastOnceDeliveryType,
+				Concurrency: 2,
+			},
+			expected: []string{"process a", "process b", "commit"},
+		},
+		"at_least_once_auto_commit": {
+			cfg: ConsumerConfig{
+				Delivery:           apmqueue.AtLeastOnceDeliveryType,
+				AutoCommitInterval: time.Minute,
+			},
+			expected: []string{"process a", "process b"},
+		},
+		"no_commit": {
+			cfg:      ConsumerConfig{NoCommit: true},
+			expected: []string{"process a", "process b"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var events []string
+			tc.cfg.Processor = model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, event := range *b {
+					events = append(events, "process "+event.Message)
+				}
+				return nil
+			})
+			consumer := newTestConsumer(t, tc.cfg)
+			consumer.commitOffsets = func(context.Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, "commit")
+				return nil
+			}
+			consumer.consume(context.Background(), kgo.Fetches{{Topics: []kgo.FetchTopic{{
+				Topic: "topic",
+				Partitions: []kgo.FetchPartition{{Records: []*kgo.Record{
+					{Topic: "topic", Key: []byte("a"), Value: []byte("a"), Offset: 0},
+					{Topic: "topic", Key: []byte("a"), Value: []byte("b"), Offset: 1},
+				}}},
+			}}}})
+			assert.Equal(t, tc.expected, events)
+		})
+	}
+}
+
+func TestConsumerCommitModeMisconfiguration(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg         ConsumerConfig
+		expectedErr string
+	}{
+		"auto_commit_at_most_once": {
+			cfg:         ConsumerConfig{AutoCommitInterval: time.Second},
+			expectedErr: "kafka: auto commit interval requires at least once delivery",
+		},
+		"auto_commit_no_commit": {
+			cfg: ConsumerConfig{
+				Delivery:           apmqueue.AtLeastOnceDeliveryType,
+				AutoCommitInterval: time.Second,
+				NoCommit:           true,
+			},
+			expectedErr: "kafka: auto commit interval cannot be set with no commit",
+		},
+		"offset_store_no_commit": {
+			cfg: ConsumerConfig{
+				OffsetStore: newMemoryOffsetStore(),
+				NoCommit:    true,
+			},
+			expectedErr: "kafka: offset store cannot be used with no commit",
+		},
+		"max_commit_attempts_no_commit": {
+			cfg:         ConsumerConfig{MaxCommitAttempts: 5, NoCommit: true},
+			expectedErr: "kafka: max commit attempts cannot be set with no commit",
+		},
+		"on_commit_error_no_commit": {
+			cfg:         ConsumerConfig{OnCommitError: func(error) {}, NoCommit: true},
+			expectedErr: "kafka: on commit error cannot be set with no commit",
+		},
+		"mirror_commit_group_no_commit": {
+			cfg:         ConsumerConfig{MirrorCommitGroup: "audit", NoCommit: true},
+			expectedErr: "kafka: mirror commit group cannot be used with no commit",
+		},
+		"mirror_commit_group_same_group": {
+			cfg:         ConsumerConfig{MirrorCommitGroup: "groupid"},
+			expectedErr: "kafka: mirror commit group must differ from group id",
+		},
+		"mirror_commit_group_offset_store": {
+			cfg: ConsumerConfig{
+				MirrorCommitGroup: "audit",
+				OffsetStore:       newMemoryOffsetStore(),
+			},
+			expectedErr: "kafka: mirror commit group cannot be used with an offset store",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.Brokers = []string{"127.0.0.1:1"}
+			cfg.Topics = []string{"topic"}
+			cfg.GroupID = "groupid"
+			cfg.Decoder = messageDecoder{}
+			cfg.Logger = zap.NewNop()
+			cfg.Processor = model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return nil
+			})
+			_, err := NewConsumer(cfg)
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestConsumerDecodersFallback(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	var processed []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Decoder:       codec.JSON{},
+		Decoders:      []Decoder{messageDecoder{}},
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed = append(processed, event.Message)
+			}
+			return nil
+		}),
+	})
+	encoded, err := codec.JSON{}.Encode(model.APMEvent{Message: "json"})
+	require.NoError(t, err)
+	for _, value := range [][]byte{encoded, []byte("plain")} {
+		consumer.processRecord(context.Background(), &kgo.Record{Value: value})
+	}
+	assert.Equal(t, []string{"json", "plain"}, processed)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	require.Len(t, rm.ScopeMetrics[0].Metrics, 1)
+	m := rm.ScopeMetrics[0].Metrics[0]
+	assert.Equal(t, "consumer.decoded", m.Name)
+	decoded := make(map[string]int64)
+	for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+		codec, _ := dp.Attributes.Value("codec")
+		decoded[codec.AsString()] = dp.Value
+	}
+	assert.Equal(t, map[string]int64{
+		"json.JSON":            1,
+		"kafka.messageDecoder": 1,
+	}, decoded)
+}
+
+func TestConsumerRawBytesProcessor(t *testing.T) {
+	var produced []*kgo.Record
+	producer := newTestProducer(t, ProducerConfig{
+		Mutators: []RecordMutator{recordCollector(&produced)},
+	})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		promise(r, nil)
+	}
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"a": "b"})
+	batch := model.Batch{{Message: "first"}, {Message: "second"}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	require.Len(t, produced, 2)
+
+	type raw struct {
+		topic    apmqueue.Topic
+		value    []byte
+		headers  []kgo.RecordHeader
+		metadata map[string]string
+	}
+	var received []raw
+	consumer := newTestConsumer(t, ConsumerConfig{
+		RawBytesProcessor: func(ctx context.Context, topic apmqueue.Topic, value []byte, headers []kgo.RecordHeader) error {
+			metadata, _ := queuecontext.MetadataFromContext(ctx)
+			received = append(received, raw{topic, value, headers, metadata})
+			return nil
+		},
+	})
+	for _, r := range produced {
+		consumer.processRecord(context.Background(), r)
+	}
+	require.Len(t, received, 2)
+	for i, r := range produced {
+		assert.Equal(t, apmqueue.Topic("topic"), received[i].topic)
+		assert.Equal(t, r.Value, received[i].value)
+		assert.Equal(t, r.Headers, received[i].headers)
+		assert.Equal(t, map[string]string{"a": "b"}, received[i].metadata)
+	}
+	assert.Equal(t, int64(2), consumer.Stats().Processed)
+}
+
+func TestConsumerVerifyChecksum(t *testing.T) {
+	var produced []*kgo.Record
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:        true,
+		Encoder:     messageEncoder{},
+		AddChecksum: true,
+	})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		produced = append(produced, r)
+		promise(r, nil)
+	}
+	batch := model.Batch{{Message: "intact"}, {Message: "tampered"}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	require.Len(t, produced, 2)
+	for _, r := range produced {
+		assert.Contains(t, r.Headers, kgo.RecordHeader{Key: ChecksumHeader, Value: checksum(r.Value)})
+	}
+	produced[1].Value = []byte("tamperex")
+
+	var processed []string
+	var gaveUp []*kgo.Record
+	var giveUpErr error
+	consumer := newTestConsumer(t, ConsumerConfig{
+		VerifyChecksum: true,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed = append(processed, event.Message)
+			}
+			return nil
+		}),
+		OnGiveUp: func(records []*kgo.Record, err error) {
+			gaveUp = append(gaveUp, records...)
+			giveUpErr = err
+		},
+	})
+	for _, r := range produced {
+		consumer.processRecord(context.Background(), r)
+	}
+	// Records without a checksum aren't verified.
+	consumer.processRecord(context.Background(), &kgo.Record{Topic: "topic", Value: []byte("unverified")})
+
+	assert.Equal(t, []string{"intact", "unverified"}, processed)
+	require.Len(t, gaveUp, 1)
+	assert.Equal(t, []byte("tamperex"), gaveUp[0].Value)
+	assert.ErrorContains(t, giveUpErr, "kafka: checksum mismatch")
+}
+
+func TestConsumerPoolDecodeTargets(t *testing.T) {
+	var processed []model.APMEvent
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Decoder:           codec.JSON{},
+		PoolDecodeTargets: true,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			// Pooled events must be copied to be retained.
+			processed = append(processed, (*b)...)
+			return nil
+		}),
+	})
+	consumer.processRecord(context.Background(), &kgo.Record{
+		Topic: "topic",
+		Value: []byte(`{"message":"first","service":{"name":"svc"}}`),
+	})
+	consumer.processRecord(context.Background(), &kgo.Record{
+		Topic: "topic",
+		Value: []byte(`{"message":"second"}`),
+	})
+	require.Len(t, processed, 2)
+	assert.Equal(t, "first", processed[0].Message)
+	assert.Equal(t, "second", processed[1].Message)
+	// The fields decoded from a record don't leak into the next one.
+	assert.Equal(t, "svc", processed[0].Service.Name)
+	assert.Empty(t, processed[1].Service.Name)
+}
+
+func BenchmarkConsumerProcessRecord(b *testing.B) {
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%t", pool), func(b *testing.B) {
+			consumer := newTestConsumer(b, ConsumerConfig{PoolDecodeTargets: pool})
+			record := &kgo.Record{Topic: "topic", Value: []byte("message")}
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				consumer.processRecord(ctx, record)
+			}
+		})
+	}
+}
+
+func TestConsumerCommitRetries(t *testing.T) {
+	errCommit := errors.New("commit failed")
+	for name, tc := range map[string]struct {
+		maxAttempts      int
+		failures         int
+		expectedAttempts int
+		expectedErr      error
+	}{
+		"success":           {expectedAttempts: 1},
+		"retried":           {failures: 2, expectedAttempts: 3},
+		"exhausted_default": {failures: 5, expectedAttempts: 3, expectedErr: errCommit},
+		"exhausted":         {maxAttempts: 5, failures: 5, expectedAttempts: 5, expectedErr: errCommit},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var commitErr error
+			consumer := newTestConsumer(t, ConsumerConfig{
+				Delivery:          apmqueue.AtLeastOnceDeliveryType,
+				Backoff:           ConstantBackoff(time.Millisecond),
+				MaxCommitAttempts: tc.maxAttempts,
+				OnCommitError:     func(err error) { commitErr = err },
+			})
+			var attempts int
+			consumer.commitOffsets = func(context.Context) error {
+				attempts++
+				if attempts <= tc.failures {
+					return errCommit
+				}
+				return nil
+			}
+			consumer.commit(context.Background())
+			assert.Equal(t, tc.expectedAttempts, attempts)
+			assert.Equal(t, tc.expectedErr, commitErr)
+		})
+	}
+}
+
+func TestConsumerOffsetStore(t *testing.T) {
+	store := newMemoryOffsetStore()
+	consumer := newTestConsumer(t, ConsumerConfig{OffsetStore: store})
+	require.NoError(t, consumer.storeOffsets(map[string]map[int32]kgo.EpochOffset{
+		"topic": {0: {Offset: 10}, 1: {Offset: 5}},
+	}))
+	require.NoError(t, consumer.storeOffsets(map[string]map[int32]kgo.EpochOffset{
+		"topic": {0: {Offset: 12}, 1: {Offset: 5}},
+	}))
+	// Unchanged offsets aren't stored again.
+	assert.Equal(t, 3, store.stores)
+	require.NoError(t, consumer.Close())
+
+	// A restarted consumer resumes from the stored offsets.
+	consumer = newTestConsumer(t, ConsumerConfig{OffsetStore: store})
+	offsets, err := consumer.loadOffsets(context.Background(), map[string]map[int32]kgo.Offset{
+		"topic": {0: kgo.NewOffset(), 1: kgo.NewOffset(), 2: kgo.NewOffset().AtStart()},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[int32]kgo.Offset{"topic": {
+		0: kgo.NewOffset().At(12),
+		1: kgo.NewOffset().At(5),
+		2: kgo.NewOffset().AtStart(),
+	}}, offsets)
+
+	store.err = errors.New("store unavailable")
+	_, err = consumer.loadOffsets(context.Background(), map[string]map[int32]kgo.Offset{
+		"topic": {0: kgo.NewOffset()},
+	})
+	assert.EqualError(t, err,
+		"failed to load offset of topic topic partition 0: store unavailable",
+	)
+}
+
+func TestConsumerErrorTopicRouter(t *testing.T) {
+	errValidation := errors.New("validation error")
+	errTransient := errors.New("transient error")
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			switch (*b)[0].Message {
+			case "invalid":
+				return fmt.Errorf("wrapped: %w", errValidation)
+			case "transient":
+				return errTransient
+			case "unknown":
+				return errors.New("unknown error")
+			}
+			return nil
+		}),
+		ErrorTopicRouter: func(_ *kgo.Record, err error) apmqueue.Topic {
+			switch {
+			case errors.Is(err, errValidation):
+				return "dlq-validation"
+			case errors.Is(err, errTransient):
+				return "dlq-transient"
+			}
+			return "" // Drop the record.
+		},
+	})
+	var deadLettered []*kgo.Record
+	consumer.produce = func(_ context.Context, r *kgo.Record) error {
+		deadLettered = append(deadLettered, r)
+		return nil
+	}
+	headers := []kgo.RecordHeader{{Key: "a", Value: []byte("b")}}
+	for _, value := range []string{"invalid", "ok", "transient", "unknown"} {
+		consumer.processRecord(context.Background(), &kgo.Record{
+			Topic:   "topic",
+			Key:     []byte("key-" + value),
+			Value:   []byte(value),
+			Headers: headers,
+		})
+	}
+	deadLetteredHeaders := append(headers[:1:1], kgo.RecordHeader{
+		Key: AttemptsHeader, Value: []byte("1"),
+	})
+	assert.Equal(t, []*kgo.Record{
+		{
+			Topic:   "dlq-validation",
+			Key:     []byte("key-invalid"),
+			Value:   []byte("invalid"),
+			Headers: deadLetteredHeaders,
+		},
+		{
+			Topic:   "dlq-transient",
+			Key:     []byte("key-transient"),
+			Value:   []byte("transient"),
+			Headers: deadLetteredHeaders,
+		},
+	}, deadLettered)
+}
+
+func TestConsumerRequiredHeaders(t *testing.T) {
+	for name, policy := range map[string]MissingHeaderPolicy{
+		"skip":        MissingHeaderSkip,
+		"dead_letter": MissingHeaderDeadLetter,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var processed []string
+			var routedErr error
+			consumer := newTestConsumer(t, ConsumerConfig{
+				RequiredHeaders:     []string{"tenant"},
+				MissingHeaderPolicy: policy,
+				Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+					processed = append(processed, (*b)[0].Message)
+					return nil
+				}),
+				ErrorTopicRouter: func(_ *kgo.Record, err error) apmqueue.Topic {
+					routedErr = err
+					return "quarantine"
+				},
+			})
+			var deadLettered []*kgo.Record
+			consumer.produce = func(_ context.Context, r *kgo.Record) error {
+				deadLettered = append(deadLettered, r)
+				return nil
+			}
+			tenant := []kgo.RecordHeader{{Key: "tenant", Value: []byte("a")}}
+			other := []kgo.RecordHeader{{Key: "other", Value: []byte("b")}}
+			consumer.processRecord(context.Background(), &kgo.Record{Topic: "topic", Value: []byte("with"), Headers: tenant})
+			consumer.processRecord(context.Background(), &kgo.Record{Topic: "topic", Value: []byte("without"), Headers: other})
+			assert.Equal(t, []string{"with"}, processed)
+
+			if policy == MissingHeaderSkip {
+				assert.Empty(t, deadLettered)
+				return
+			}
+			assert.Equal(t, []*kgo.Record{
+				{Topic: "quarantine", Value: []byte("without"), Headers: other},
+			}, deadLettered)
+			assert.ErrorIs(t, routedErr, ErrMissingHeader)
+			assert.EqualError(t, routedErr, "kafka: missing required header tenant")
+		})
+	}
+}
+
+func TestConsumerDebugHeader(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	consumer := newTestConsumer(t, ConsumerConfig{
+		DebugHeader: "debug",
+		TracerProvider: sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.NeverSample())),
+			sdktrace.WithSyncer(exporter),
+		),
+	})
+	// The upstream trace wasn't sampled.
+	upstream := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1},
+		SpanID:  trace.SpanID{2},
+	})
+	var traced []kgo.RecordHeader
+	propagation.TraceContext{}.Inject(
+		trace.ContextWithRemoteSpanContext(context.Background(), upstream),
+		headerCarrier{&traced},
+	)
+	debug := kgo.RecordHeader{Key: "debug", Value: []byte("true")}
+
+	consumer.processRecord(context.Background(), &kgo.Record{Topic: "topic", Value: []byte("a"), Headers: traced})
+	consumer.processRecord(context.Background(), &kgo.Record{Topic: "topic", Value: []byte("b")})
+	assert.Empty(t, exporter.GetSpans())
+
+	consumer.processRecord(context.Background(), &kgo.Record{
+		Topic: "topic", Offset: 1, Value: []byte("c"),
+		Headers: append([]kgo.RecordHeader{debug}, traced...),
+	})
+	consumer.processRecord(context.Background(), &kgo.Record{
+		Topic: "topic", Offset: 2, Value: []byte("d"), Headers: []kgo.RecordHeader{debug},
+	})
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	for _, span := range spans {
+		assert.Equal(t, "consumer.Process", span.Name)
+		assert.Equal(t, trace.SpanKindConsumer, span.SpanKind)
+		assert.True(t, span.SpanContext.IsSampled())
+	}
+	// The span continues the upstream trace when there's one.
+	assert.Equal(t, upstream.TraceID(), spans[0].SpanContext.TraceID())
+	assert.Equal(t, upstream.SpanID(), spans[0].Parent.SpanID())
+	assert.Contains(t, spans[0].Attributes, attribute.Int64("offset", 1))
+	assert.NotEqual(t, upstream.TraceID(), spans[1].SpanContext.TraceID())
+	assert.True(t, spans[1].Parent.IsRemote())
+}
+
+func TestConsumerOnGiveUp(t *testing.T) {
+	errProcess := errors.New("always failing")
+	var attempts int
+	var givenUp []*kgo.Record
+	var givenUpErr error
+	consumer := newTestConsumer(t, ConsumerConfig{
+		MaxAttempts: 3,
+		Backoff:     ConstantBackoff(time.Millisecond),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			attempts++
+			return errProcess
+		}),
+		OnGiveUp: func(records []*kgo.Record, err error) {
+			givenUp = append(givenUp, records...)
+			givenUpErr = err
+		},
+	})
+	consumer.processRecord(context.Background(), &kgo.Record{
+		Topic:     "topic",
+		Partition: 1,
+		Offset:    10,
+		Value:     []byte("value"),
+	})
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, errProcess, givenUpErr)
+	require.Len(t, givenUp, 1)
+	assert.Equal(t, "topic", givenUp[0].Topic)
+	assert.Equal(t, int32(1), givenUp[0].Partition)
+	assert.Equal(t, int64(10), givenUp[0].Offset)
+	assert.Equal(t, []byte("value"), givenUp[0].Value)
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: AttemptsHeader, Value: []byte("3")},
+	}, givenUp[0].Headers)
+	assert.Zero(t, consumer.Stats().Processed)
+}
+
+func TestConsumerBatching(t *testing.T) {
+	var events []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Delivery:           apmqueue.AtLeastOnceDeliveryType,
+		BatchMaxRecords:    1000,
+		BatchFlushInterval: 50 * time.Millisecond,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			events = append(events, fmt.Sprintf("process %d", len(*b)))
+			return nil
+		}),
+	})
+	consumer.commitOffsets = func(context.Context) error {
+		events = append(events, "commit")
+		return nil
+	}
+	var offset int64
+	var available int // Records available to the next polls.
+	consumer.pollRecords = func(ctx context.Context, max int) kgo.Fetches {
+		n := 300
+		if max > 0 && max < n {
+			n = max
+		}
+		if available < n {
+			n = available
+		}
+		if n == 0 {
+			<-ctx.Done()
+			return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+				Topic:      "topic",
+				Partitions: []kgo.FetchPartition{{Err: ctx.Err()}},
+			}}}}
+		}
+		available -= n
+		records := make([]*kgo.Record, n)
+		for i := range records {
+			records[i] = &kgo.Record{Topic: "topic", Value: []byte("a"), Offset: offset}
+			offset++
+		}
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic:      "topic",
+			Partitions: []kgo.FetchPartition{{Records: records}},
+		}}}}
+	}
+
+	ctx := context.Background()
+	available = 2500
+	for i := 0; i < 2; i++ {
+		fetches, err := consumer.fetch(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1000, fetches.NumRecords())
+	}
+	// The remaining records are flushed once the flush interval elapses.
+	start := time.Now()
+	fetches, err := consumer.fetch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 500, fetches.NumRecords())
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	assert.Equal(t, []string{
+		"process 1000", "commit",
+		"process 1000", "commit",
+		"process 500", "commit",
+	}, events)
+	assert.Equal(t, int64(2500), consumer.Stats().Processed)
+}
+
+func TestConsumerErrors(t *testing.T) {
+	consumer := newTestConsumer(t, ConsumerConfig{})
+	errFetch := errors.New("broker unavailable")
+	consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic: "topic",
+			Partitions: []kgo.FetchPartition{
+				{Partition: 0, Records: []*kgo.Record{{Topic: "topic", Value: []byte("a")}}},
+				{Partition: 1, Err: errFetch},
+			},
+		}}}}
+	}
+	_, err := consumer.fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), consumer.Stats().Processed)
+
+	select {
+	case err := <-consumer.Errors():
+		assert.ErrorIs(t, err, errFetch)
+		assert.Equal(t, &FetchError{Topic: "topic", Partition: 1, Err: errFetch}, err)
+		assert.EqualError(t, err, "kafka: failed to fetch topic topic partition 1: broker unavailable")
+	default:
+		t.Fatal("fetch error not delivered")
+	}
+
+	// The errors which don't fit in the buffer are dropped, without blocking
+	// the consumer.
+	for i := 0; i < fetchErrorsBuffer+1; i++ {
+		_, err := consumer.fetch(context.Background())
+		require.NoError(t, err)
+	}
+	assert.Len(t, consumer.Errors(), fetchErrorsBuffer)
+
+	// The channel is closed by Close, once its errors are drained.
+	require.NoError(t, consumer.Close())
+	var drained int
+	for range consumer.Errors() {
+		drained++
+	}
+	assert.Equal(t, fetchErrorsBuffer, drained)
+	require.NoError(t, consumer.Close())
+}
+
+func TestConsumerTimeBehind(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	consumer := newTestConsumer(t, ConsumerConfig{
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	})
+	now := time.Now()
+	consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic: "topic",
+			Partitions: []kgo.FetchPartition{
+				{Partition: 0, Records: []*kgo.Record{
+					{Topic: "topic", Partition: 0, Value: []byte("a"), Timestamp: now.Add(-time.Hour)},
+					{Topic: "topic", Partition: 0, Value: []byte("b"), Timestamp: now.Add(-time.Minute)},
+				}},
+				{Partition: 1, Records: []*kgo.Record{
+					{Topic: "topic", Partition: 1, Value: []byte("c"), Timestamp: now.Add(-5 * time.Minute)},
+				}},
+			},
+		}}}}
+	}
+	timeBehind := func() map[int64]int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(context.Background(), &rm))
+		behind := make(map[int64]int64)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != "consumer.time.behind" {
+					continue
+				}
+				for _, dp := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+					partition, _ := dp.Attributes.Value("partition")
+					behind[partition.AsInt64()] = dp.Value
+				}
+			}
+		}
+		return behind
+	}
+	assert.Empty(t, timeBehind())
+
+	_, err := consumer.fetch(context.Background())
+	require.NoError(t, err)
+	behind := timeBehind()
+	require.Len(t, behind, 2)
+	elapsed := time.Since(now)
+	assert.InDelta(t, time.Minute.Milliseconds(), behind[0], float64(elapsed.Milliseconds()+1))
+	assert.InDelta(t, (5 * time.Minute).Milliseconds(), behind[1], float64(elapsed.Milliseconds()+1))
+
+	// Lost partitions are no longer reported.
+	consumer.lost(context.Background(), nil, map[string][]int32{"topic": {1}})
+	behind = timeBehind()
+	assert.Len(t, behind, 1)
+	assert.Contains(t, behind, int64(0))
+}
+
+func TestConsumerRebalanceMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	consumer := newTestConsumer(t, ConsumerConfig{
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	})
+	rebalances := func() (count, durations int64, sum int64) {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(context.Background(), &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				switch m.Name {
+				case "consumer.rebalance.count":
+					for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+						count += dp.Value
+					}
+				case "consumer.rebalance.duration":
+					for _, dp := range m.Data.(metricdata.Histogram).DataPoints {
+						durations += int64(dp.Count)
+						sum += int64(dp.Sum)
+					}
+				}
+			}
+		}
+		return count, durations, sum
+	}
+	ctx := context.Background()
+
+	// Joining the group assigns partitions without a prior revocation.
+	consumer.assigned(ctx, nil, map[string][]int32{"topic": {0, 1}})
+	count, durations, _ := rebalances()
+	assert.Equal(t, int64(1), count)
+	assert.Zero(t, durations)
+
+	// A rebalance revokes partitions, and assigns them some time later.
+	consumer.revoked(ctx, nil, map[string][]int32{"topic": {0, 1}})
+	time.Sleep(20 * time.Millisecond)
+	consumer.assigned(ctx, nil, map[string][]int32{"topic": {1}})
+	count, durations, sum := rebalances()
+	assert.Equal(t, int64(2), count)
+	assert.Equal(t, int64(1), durations)
+	assert.GreaterOrEqual(t, sum, int64(20))
+	assert.Equal(t, map[apmqueue.Topic][]int32{"topic": {1}}, consumer.Stats().Assignment)
+}
+
+func TestConsumerOnPartitionsAssigned(t *testing.T) {
+	var events []string
+	errWarmUp := errors.New("cache unavailable")
+	var warmUpErr error
+	consumer := newTestConsumer(t, ConsumerConfig{
+		OnPartitionsAssigned: func(_ context.Context, m map[apmqueue.Topic][]int32) error {
+			events = append(events, fmt.Sprintf("assigned %v", m))
+			return warmUpErr
+		},
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				events = append(events, "process "+event.Message)
+			}
+			return nil
+		}),
+	})
+	consumer.commitOffsets = func(context.Context) error { return nil }
+	consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic: "topic",
+			Partitions: []kgo.FetchPartition{{Partition: 1, Records: []*kgo.Record{
+				{Topic: "topic", Partition: 1, Value: []byte("a")},
+			}}},
+		}}}}
+	}
+
+	consumer.assigned(context.Background(), nil, map[string][]int32{"topic": {1}})
+	_, err := consumer.fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"assigned map[topic:[1]]", "process a"}, events)
+
+	// Errors close the consumer, without processing the fetched records.
+	events = nil
+	warmUpErr = errWarmUp
+	consumer.assigned(context.Background(), nil, map[string][]int32{"topic": {2}})
+	_, err = consumer.fetch(context.Background())
+	assert.ErrorIs(t, err, errWarmUp)
+	assert.Equal(t, []string{"assigned map[topic:[2]]"}, events)
+}
+
+func TestConsumerRetryTopic(t *testing.T) {
+	failures := map[string]int{"retried": 1, "exhausted": 3}
+	var processed []string
+	var gaveUp []*kgo.Record
+	consumer := newTestConsumer(t, ConsumerConfig{
+		RetryTopic: "retry",
+		RetryDelay: 100 * time.Millisecond,
+		MaxRetries: 2,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			msg := (*b)[0].Message
+			if failures[msg] > 0 {
+				failures[msg]--
+				return errors.New("transient error")
+			}
+			processed = append(processed, msg)
+			return nil
+		}),
+		OnGiveUp: func(records []*kgo.Record, _ error) {
+			gaveUp = append(gaveUp, records...)
+		},
+	})
+	var retried []*kgo.Record
+	consumer.produce = func(_ context.Context, r *kgo.Record) error {
+		retried = append(retried, r)
+		return nil
+	}
+	consumer.commitOffsets = func(context.Context) error { return nil }
+	var rewound []kgo.EpochOffset
+	consumer.setOffsets = func(offsets map[string]map[int32]kgo.EpochOffset) {
+		rewound = append(rewound, offsets["retry"][0])
+	}
+	var paused []map[string][]int32
+	consumer.pausePartitions = func(partitions map[string][]int32) {
+		paused = append(paused, partitions)
+	}
+	resumed := make(chan map[string][]int32, 1)
+	consumer.resumePartitions = func(partitions map[string][]int32) {
+		resumed <- partitions
+	}
+	var offset int64
+	var polled []*kgo.Record
+	consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic:      "retry",
+			Partitions: []kgo.FetchPartition{{Partition: 0, Records: polled}},
+		}}}}
+	}
+	// consumeRetried consumes the records republished to the retry topic,
+	// which are deferred until the retry delay has passed.
+	consumeRetried := func() {
+		polled = retried
+		retried = nil
+		for _, r := range polled {
+			r.Offset = offset
+			offset++
+		}
+		_, err := consumer.fetch(context.Background())
+		require.NoError(t, err)
+		require.Len(t, paused, 1)
+		assert.Equal(t, map[string][]int32{"retry": {0}}, paused[0])
+		assert.Equal(t, []kgo.EpochOffset{{Offset: polled[0].Offset}}, rewound)
+		paused, rewound = nil, nil
+
+		select {
+		case partitions := <-resumed:
+			assert.Equal(t, map[string][]int32{"retry": {0}}, partitions)
+		case <-time.After(time.Second):
+			t.Fatal("retry partition wasn't resumed")
+		}
+		_, err = consumer.fetch(context.Background())
+		require.NoError(t, err)
+		assert.Empty(t, paused)
+	}
+	headerValue := func(r *kgo.Record, key string) string {
+		for _, h := range r.Headers {
+			if h.Key == key {
+				return string(h.Value)
+			}
+		}
+		return ""
+	}
+
+	for _, value := range []string{"ok", "retried", "exhausted"} {
+		consumer.processRecord(context.Background(), &kgo.Record{
+			Topic: "topic", Value: []byte(value),
+		})
+	}
+	assert.Equal(t, []string{"ok"}, processed)
+	require.Len(t, retried, 2)
+	for _, r := range retried {
+		assert.Equal(t, "retry", r.Topic)
+		assert.Equal(t, "1", headerValue(r, RetriesHeader))
+		assert.NotEmpty(t, headerValue(r, RetryAtHeader))
+	}
+
+	// The records consumed from the retry topic are processed once the
+	// retry delay has passed.
+	start := time.Now()
+	consumeRetried()
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	assert.Equal(t, []string{"ok", "retried"}, processed)
+	require.Len(t, retried, 1)
+	assert.Equal(t, []byte("exhausted"), retried[0].Value)
+	assert.Equal(t, "2", headerValue(retried[0], RetriesHeader))
+	assert.Empty(t, gaveUp)
+
+	// The consumer gives up on the records retried MaxRetries times.
+	consumeRetried()
+	assert.Empty(t, retried)
+	require.Len(t, gaveUp, 1)
+	assert.Equal(t, []byte("exhausted"), gaveUp[0].Value)
+	assert.Equal(t, []string{"ok", "retried"}, processed)
+}
+
+func TestConsumerRetryTopicNotDue(t *testing.T) {
+	const retryDelay = 500 * time.Millisecond
+	var mu sync.Mutex
+	var processed []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		RetryTopic: "retry",
+		RetryDelay: retryDelay,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, (*b)[0].Message)
+			return nil
+		}),
+	})
+	consumer.commitOffsets = func(context.Context) error { return nil }
+	consumer.setOffsets = func(map[string]map[int32]kgo.EpochOffset) {}
+	var paused int
+	consumer.pausePartitions = func(map[string][]int32) { paused++ }
+	resumed := make(chan struct{}, 1)
+	consumer.resumePartitions = func(map[string][]int32) { resumed <- struct{}{} }
+	due := strconv.FormatInt(time.Now().Add(retryDelay).UnixMilli(), 10)
+	retry := &kgo.Record{
+		Topic: "retry", Value: []byte("retry"),
+		Headers: []kgo.RecordHeader{{Key: RetryAtHeader, Value: []byte(due)}},
+	}
+	var offset int64
+	consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+		offset++
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic: "retry",
+			Partitions: []kgo.FetchPartition{{
+				Partition: 0, Records: []*kgo.Record{retry},
+			}},
+		}, {
+			Topic: "topic",
+			Partitions: []kgo.FetchPartition{{Partition: 0, Records: []*kgo.Record{{
+				Topic: "topic", Offset: offset, Value: []byte(strconv.FormatInt(offset, 10)),
+			}}}},
+		}}}}
+	}
+
+	// The main topic records keep being processed, each poll cycle, while
+	// the retry record isn't due, including once it's buffered again.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := consumer.fetch(context.Background())
+		require.NoError(t, err)
+	}
+	assert.Less(t, time.Since(start), retryDelay)
+	mu.Lock()
+	assert.Equal(t, []string{"1", "2", "3"}, processed)
+	mu.Unlock()
+	assert.Equal(t, 1, paused)
+
+	// The retry record is processed once the partition is resumed.
+	select {
+	case <-resumed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry partition wasn't resumed")
+	}
+	assert.GreaterOrEqual(t, time.Since(start), retryDelay-10*time.Millisecond)
+	_, err := consumer.fetch(context.Background())
+	require.NoError(t, err)
+	mu.Lock()
+	assert.Equal(t, []string{"1", "2", "3", "retry", "4"}, processed)
+	mu.Unlock()
+	assert.Equal(t, 1, paused)
+}
+
+func TestConsumerFetchProcessor(t *testing.T) {
+	var events []string
+	var received []kgo.Fetches
+	errProcess := errors.New("processing failed")
+	var fail bool
+	var givenUp []*kgo.Record
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Delivery:    apmqueue.AtLeastOnceDeliveryType,
+		MaxAttempts: 2,
+		Backoff:     ConstantBackoff(time.Millisecond),
+		FetchProcessor: func(_ context.Context, fetches kgo.Fetches) error {
+			received = append(received, fetches)
+			events = append(events, "processed")
+			if fail {
+				return errProcess
+			}
+			return nil
+		},
+		OnGiveUp: func(records []*kgo.Record, err error) {
+			assert.ErrorIs(t, err, errProcess)
+			givenUp = append(givenUp, records...)
+		},
+	})
+	var offset int64
+	consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+		offset += 2
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic: "topic",
+			Partitions: []kgo.FetchPartition{{Partition: 0, Records: []*kgo.Record{
+				{Topic: "topic", Offset: offset - 2, Value: []byte("a")},
+				{Topic: "topic", Offset: offset - 1, Value: []byte("b")},
+			}}},
+		}}}}
+	}
+	consumer.commitOffsets = func(context.Context) error {
+		events = append(events, "committed")
+		return nil
+	}
+
+	fetches, err := consumer.fetch(context.Background())
+	require.NoError(t, err)
+	require.Len(t, received, 1)
+	assert.Equal(t, fetches, received[0])
+	assert.Equal(t, []string{"processed", "committed"}, events)
+	assert.Equal(t, int64(2), consumer.Stats().Processed)
+
+	// The next fetches are processed, and retried before they're given up
+	// on when processing fails.
+	fail = true
+	_, err = consumer.fetch(context.Background())
+	require.NoError(t, err)
+	require.Len(t, received, 3)
+	assert.Equal(t, received[1], received[2])
+	assert.Equal(t, int64(2), received[1].Records()[0].Offset)
+	assert.Len(t, givenUp, 2)
+	assert.Equal(t, int64(2), consumer.Stats().Processed)
+}
+
+func TestConsumerProcessors(t *testing.T) {
+	// With BatchMaxRecords, the 6 records of the fetch are polled as a
+	// single batch, which is split per topic.
+	for _, batchMaxRecords := range []int{0, 6} {
+		t.Run(fmt.Sprintf("batch_max_records_%d", batchMaxRecords), func(t *testing.T) {
+			var mu sync.Mutex
+			processed := make(map[string][]string)
+			processor := func(name string) model.BatchProcessor {
+				return model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+					mu.Lock()
+					defer mu.Unlock()
+					for _, event := range *b {
+						processed[name] = append(processed[name], event.Message)
+					}
+					return nil
+				})
+			}
+			consumer := newTestConsumer(t, ConsumerConfig{
+				Topics:          []string{"a", "b", "c"},
+				BatchMaxRecords: batchMaxRecords,
+				Processor:       processor("default"),
+				Processors: map[apmqueue.Topic]model.BatchProcessor{
+					"a": processor("a"),
+					"b": processor("b"),
+				},
+			})
+			consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+				var topics []kgo.FetchTopic
+				for _, topic := range []string{"a", "b", "c"} {
+					topics = append(topics, kgo.FetchTopic{
+						Topic: topic,
+						Partitions: []kgo.FetchPartition{{Records: []*kgo.Record{
+							{Topic: topic, Value: []byte(topic + "1")},
+							{Topic: topic, Value: []byte(topic + "2")},
+						}}},
+					})
+				}
+				return kgo.Fetches{{Topics: topics}}
+			}
+			_, err := consumer.fetch(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, map[string][]string{
+				"a":       {"a1", "a2"},
+				"b":       {"b1", "b2"},
+				"default": {"c1", "c2"},
+			}, processed)
+		})
+	}
+}
+
+func TestConsumerEnrichFunc(t *testing.T) {
+	errEnrich := errors.New("metadata unavailable")
+	for name, tc := range map[string]struct {
+		delivery          apmqueue.DeliveryType
+		expectedProcessed []string
+		expectedAttempts  map[string]int
+	}{
+		"at_most_once": {
+			delivery:          apmqueue.AtMostOnceDeliveryType,
+			expectedProcessed: []string{"deployment-1/ok"},
+			expectedAttempts:  map[string]int{"ok": 1, "flaky": 1, "broken": 1},
+		},
+		"at_least_once": {
+			delivery:          apmqueue.AtLeastOnceDeliveryType,
+			expectedProcessed: []string{"deployment-1/ok", "deployment-1/flaky"},
+			expectedAttempts:  map[string]int{"ok": 1, "flaky": 2, "broken": 3},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The records are enriched when processed one by one and as a
+			// batch.
+			for _, batchMaxRecords := range []int{0, 10} {
+				attempts := make(map[string]int)
+				var processed, gaveUp []string
+				consumer := newTestConsumer(t, ConsumerConfig{
+					Delivery:        tc.delivery,
+					MaxAttempts:     3,
+					BatchMaxRecords: batchMaxRecords,
+					EnrichFunc: func(_ context.Context, event *model.APMEvent) error {
+						attempts[event.Message]++
+						switch {
+						case event.Message == "broken",
+							event.Message == "flaky" && attempts[event.Message] == 1:
+							return errEnrich
+						}
+						event.Service.Name = "deployment-1"
+						return nil
+					},
+					Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+						for _, event := range *b {
+							processed = append(processed, event.Service.Name+"/"+event.Message)
+						}
+						return nil
+					}),
+					OnGiveUp: func(records []*kgo.Record, err error) {
+						assert.ErrorIs(t, err, errEnrich)
+						for _, r := range records {
+							gaveUp = append(gaveUp, string(r.Value))
+						}
+					},
+				})
+				var records []*kgo.Record
+				for _, value := range []string{"ok", "flaky", "broken"} {
+					records = append(records, &kgo.Record{Topic: "topic", Value: []byte(value)})
+				}
+				consumer.processFetches(context.Background(), kgo.Fetches{{Topics: []kgo.FetchTopic{{
+					Topic:      "topic",
+					Partitions: []kgo.FetchPartition{{Records: records}},
+				}}}})
+				// The enrichment is visible to the processor.
+				assert.Equal(t, tc.expectedProcessed, processed)
+				assert.Equal(t, tc.expectedAttempts, attempts)
+				assert.Len(t, gaveUp, 3-len(tc.expectedProcessed))
+				assert.Contains(t, gaveUp, "broken")
+			}
+		})
+	}
+}
+
+func TestConsumerClassifyDecodeError(t *testing.T) {
+	errCorrupt := errors.New("corrupt")
+	errPartial := errors.New("partial")
+	errSchemaGone := errors.New("schema gone")
+	// failures holds the errors returned when decoding each record value,
+	// in order, before it's decoded successfully.
+	newConsumer := func(t *testing.T, failures map[string][]error) (*Consumer, *[]string, *[]*kgo.Record, *int) {
+		var processed []string
+		var gaveUp []*kgo.Record
+		var commits int
+		consumer := newTestConsumer(t, ConsumerConfig{
+			Delivery:    apmqueue.AtLeastOnceDeliveryType,
+			MaxAttempts: 3,
+			Decoder: decoderFunc(func(b []byte, event *model.APMEvent) error {
+				if errs := failures[string(b)]; len(errs) > 0 {
+					failures[string(b)] = errs[1:]
+					return errs[0]
+				}
+				event.Message = string(b)
+				return nil
+			}),
+			ClassifyDecodeError: func(err error) DecodeAction {
+				switch {
+				case errors.Is(err, errPartial):
+					return DecodeRetry
+				case errors.Is(err, errSchemaGone):
+					return DecodeFail
+				}
+				return DecodeSkip
+			},
+			Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				processed = append(processed, (*b)[0].Message)
+				return nil
+			}),
+			OnGiveUp: func(records []*kgo.Record, _ error) {
+				gaveUp = append(gaveUp, records...)
+			},
+		})
+		consumer.commitOffsets = func(context.Context) error {
+			commits++
+			return nil
+		}
+		consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+			var records []*kgo.Record
+			for i, value := range []string{"a", "b", "c"} {
+				records = append(records, &kgo.Record{
+					Topic: "topic", Offset: int64(i), Value: []byte(value),
+				})
+			}
+			return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+				Topic:      "topic",
+				Partitions: []kgo.FetchPartition{{Records: records}},
+			}}}}
+		}
+		return consumer, &processed, &gaveUp, &commits
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		consumer, processed, gaveUp, commits := newConsumer(t, map[string][]error{
+			"b": {errCorrupt, errCorrupt},
+		})
+		_, err := consumer.fetch(context.Background())
+		require.NoError(t, err)
+		// The record isn't retried.
+		assert.Equal(t, []string{"a", "c"}, *processed)
+		require.Len(t, *gaveUp, 1)
+		assert.Equal(t, []byte("b"), (*gaveUp)[0].Value)
+		assert.Equal(t, 1, *commits)
+	})
+	t.Run("retry", func(t *testing.T) {
+		consumer, processed, gaveUp, commits := newConsumer(t, map[string][]error{
+			"a": {errPartial, errPartial},
+			"b": {errPartial, errPartial, errPartial},
+		})
+		_, err := consumer.fetch(context.Background())
+		require.NoError(t, err)
+		// Records are given up on once decoding failed MaxAttempts times.
+		assert.Equal(t, []string{"a", "c"}, *processed)
+		require.Len(t, *gaveUp, 1)
+		assert.Equal(t, []byte("b"), (*gaveUp)[0].Value)
+		assert.Equal(t, 1, *commits)
+	})
+	t.Run("fail", func(t *testing.T) {
+		consumer, processed, gaveUp, commits := newConsumer(t, map[string][]error{
+			"b": {errSchemaGone},
+		})
+		_, err := consumer.fetch(context.Background())
+		assert.ErrorIs(t, err, errSchemaGone)
+		assert.EqualError(t, err, "kafka: failed to decode record topic-0-1: schema gone")
+		// The following records aren't processed, nor are the offsets
+		// committed.
+		assert.Equal(t, []string{"a"}, *processed)
+		assert.Empty(t, *gaveUp)
+		assert.Zero(t, *commits)
+
+		// The consumer doesn't poll any more records.
+		_, err = consumer.fetch(context.Background())
+		assert.ErrorIs(t, err, errSchemaGone)
+		assert.Equal(t, []string{"a"}, *processed)
+	})
+}
+
+func TestConsumerRecordID(t *testing.T) {
+	var ids []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		MaxAttempts: 2,
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			id, ok := queuecontext.RecordID(ctx)
+			require.True(t, ok)
+			ids = append(ids, id)
+			if (*b)[0].Message == "retried" && len(ids) < 4 {
+				return errors.New("transient error")
+			}
+			return nil
+		}),
+	})
+	for _, r := range []*kgo.Record{
+		{Topic: "topic", Partition: 0, Offset: 1, Value: []byte("a")},
+		{Topic: "topic", Partition: 1, Offset: 1, Value: []byte("b")},
+		{Topic: "topic", Partition: 1, Offset: 2, Value: []byte("retried")},
+	} {
+		consumer.processRecord(context.Background(), r)
+	}
+	assert.Equal(t, []string{"topic-0-1", "topic-1-1", "topic-1-2", "topic-1-2"}, ids)
+}
+
+func TestConsumerRecordMetadata(t *testing.T) {
+	var got []queuecontext.RecordMetadata
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			metadata, ok := queuecontext.RecordMetadataFromContext(ctx)
+			require.True(t, ok)
+			got = append(got, metadata)
+			return nil
+		}),
+	})
+	now := time.Now()
+	for _, r := range []*kgo.Record{
+		{Topic: "topic", Partition: 0, Offset: 1, Timestamp: now, Value: []byte("a")},
+		{Topic: "topic", Partition: 2, Offset: 7, Timestamp: now.Add(time.Second), Value: []byte("b")},
+	} {
+		consumer.processRecord(context.Background(), r)
+	}
+	assert.Equal(t, []queuecontext.RecordMetadata{
+		{Topic: "topic", Partition: 0, Offset: 1, Timestamp: now},
+		{Topic: "topic", Partition: 2, Offset: 7, Timestamp: now.Add(time.Second)},
+	}, got)
+}
+
+func TestConsumerRecordHighWatermark(t *testing.T) {
+	var mu sync.Mutex
+	watermarks := make(map[int32][]int64)
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Concurrency: 2,
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			metadata, ok := queuecontext.RecordMetadataFromContext(ctx)
+			require.True(t, ok)
+			mu.Lock()
+			defer mu.Unlock()
+			watermarks[metadata.Partition] = append(watermarks[metadata.Partition], metadata.HighWatermark)
+			return nil
+		}),
+	})
+	// The high watermark of each partition is the number of records
+	// produced to it.
+	produced := map[int32]int{0: 3, 1: 5}
+	var partitions []kgo.FetchPartition
+	for partition, n := range produced {
+		fp := kgo.FetchPartition{Partition: partition, HighWatermark: int64(n)}
+		for offset := 0; offset < n; offset++ {
+			fp.Records = append(fp.Records, &kgo.Record{
+				Topic: "topic", Partition: partition, Offset: int64(offset), Value: []byte("a"),
+			})
+		}
+		partitions = append(partitions, fp)
+	}
+	consumer.processFetches(context.Background(), kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic:      "topic",
+		Partitions: partitions,
+	}}}})
+	assert.Equal(t, map[int32][]int64{0: {3, 3, 3}, 1: {5, 5, 5, 5, 5}}, watermarks)
+}
+
+func TestConsumerWorkerStable(t *testing.T) {
+	consumer := newTestConsumer(t, ConsumerConfig{Concurrency: 8})
+	for _, key := range []string{"a", "b", "c"} {
+		r := &kgo.Record{Key: []byte(key), Partition: 1}
+		worker := consumer.worker(r)
+		for i := int32(0); i < 10; i++ {
+			assert.Equal(t, worker, consumer.worker(&kgo.Record{
+				Key: []byte(key), Partition: i,
+			}))
+		}
+	}
+}
+
+func TestConsumerPartitionAffinity(t *testing.T) {
+	const partitions = 8
+	var mu sync.Mutex
+	inFlight := make(map[int32]int)
+	observed := make(map[int32][]int64)
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Concurrency:       4,
+		PartitionAffinity: true,
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, _ *model.Batch) error {
+			meta, _ := queuecontext.RecordMetadataFromContext(ctx)
+			mu.Lock()
+			inFlight[meta.Partition]++
+			concurrent := inFlight[meta.Partition] > 1
+			observed[meta.Partition] = append(observed[meta.Partition], meta.Offset)
+			mu.Unlock()
+			assert.False(t, concurrent, "partition %d processed concurrently", meta.Partition)
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			inFlight[meta.Partition]--
+			mu.Unlock()
+			return nil
+		}),
+	})
+
+	fetched := make([]kgo.FetchPartition, partitions)
+	expected := make(map[int32][]int64)
+	for p := range fetched {
+		fetched[p].Partition = int32(p)
+		for offset := int64(0); offset < 10; offset++ {
+			// Records with different keys are still processed by the
+			// worker of their partition.
+			fetched[p].Records = append(fetched[p].Records, &kgo.Record{
+				Key:       []byte(fmt.Sprintf("key-%d-%d", p, offset)),
+				Value:     []byte("a"),
+				Topic:     "topic",
+				Partition: int32(p),
+				Offset:    offset,
+			})
+			expected[int32(p)] = append(expected[int32(p)], offset)
+		}
+		for _, r := range fetched[p].Records {
+			assert.Equal(t, consumer.partitionWorker("topic", int32(p)), consumer.worker(r))
+		}
+	}
+	consumer.processFetches(context.Background(), kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic:      "topic",
+		Partitions: fetched,
+	}}}})
+	assert.Equal(t, expected, observed)
+
+	consumer.assigned(context.Background(), nil, map[string][]int32{"topic": {0, 1, 2}})
+	workers := consumer.PartitionWorkers()
+	require.Len(t, workers["topic"], 3)
+	for partition, worker := range workers["topic"] {
+		assert.Equal(t, consumer.partitionWorker("topic", partition), worker)
+		assert.Less(t, worker, 4)
+	}
+}
+
+func TestConsumerConfigValidate(t *testing.T) {
+	valid := ConsumerConfig{
+		Brokers:   []string{"localhost:9092"},
+		Topics:    []string{"topic"},
+		GroupID:   "groupid",
+		Decoder:   codec.JSON{},
+		Logger:    zap.NewNop(),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+	}
+	assert.NoError(t, valid.Validate())
+
+	invalid := valid
+	invalid.Delivery = 100
+	assert.EqualError(t, invalid.Validate(), "kafka: delivery is not valid")
+
+	invalid = valid
+	invalid.Concurrency = -1
+	assert.EqualError(t, invalid.Validate(), "kafka: concurrency cannot be negative")
+
+	invalid = valid
+	invalid.MaxInFlightBatches = -1
+	assert.EqualError(t, invalid.Validate(), "kafka: max in flight batches cannot be negative")
+
+	invalid = valid
+	invalid.MaxAttempts = -1
+	assert.EqualError(t, invalid.Validate(), "kafka: max attempts cannot be negative")
+
+	invalid = valid
+	invalid.MaxCommitAttempts = -1
+	assert.EqualError(t, invalid.Validate(), "kafka: max commit attempts cannot be negative")
+
+	invalid = valid
+	invalid.RetryTopic = "retry"
+	invalid.RetryDelay = -time.Second
+	invalid.MaxRetries = -1
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: retry delay cannot be negative\nkafka: max retries cannot be negative",
+	)
+
+	invalid = valid
+	invalid.RetryDelay = time.Second
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: retry delay and max retries require retry topic",
+	)
+
+	invalid = valid
+	invalid.DedupWindow = -time.Second
+	invalid.DedupCapacity = -1
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: dedup window cannot be negative\nkafka: dedup capacity cannot be negative",
+	)
+
+	invalid = valid
+	invalid.DedupCapacity = 10
+	assert.EqualError(t, invalid.Validate(), "kafka: dedup capacity requires dedup window")
+
+	invalid = valid
+	invalid.MaxEventAge = -time.Second
+	assert.EqualError(t, invalid.Validate(), "kafka: max event age cannot be negative")
+
+	invalid = valid
+	invalid.AutoCommitInterval = -time.Second
+	invalid.Delivery = apmqueue.AtLeastOnceDeliveryType
+	assert.EqualError(t, invalid.Validate(), "kafka: auto commit interval cannot be negative")
+
+	invalid = valid
+	invalid.AutoCommitInterval = time.Second
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: auto commit interval requires at least once delivery",
+	)
+
+	invalid = valid
+	invalid.AutoCommitInterval = time.Second
+	invalid.Delivery = apmqueue.AtLeastOnceDeliveryType
+	invalid.NoCommit = true
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: auto commit interval cannot be set with no commit",
+	)
+
+	invalid = valid
+	invalid.RawBytesProcessor = func(context.Context, apmqueue.Topic, []byte, []kgo.RecordHeader) error {
+		return nil
+	}
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: processor and raw bytes processor are mutually exclusive",
+	)
+
+	invalid = valid
+	invalid.FetchProcessor = func(context.Context, kgo.Fetches) error { return nil }
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: fetch processor cannot be used with another processor",
+	)
+
+	raw := invalid
+	raw.Decoder = nil
+	raw.Processor = nil
+	assert.NoError(t, raw.Validate())
+
+	invalid = valid
+	invalid.MissingHeaderPolicy = MissingHeaderDeadLetter
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: missing header dead letter policy requires an error topic router",
+	)
+
+	processors := valid
+	processors.Processor = nil
+	processors.Processors = map[apmqueue.Topic]model.BatchProcessor{"topic": valid.Processor}
+	assert.NoError(t, processors.Validate())
+	processors.RetryTopic = "retry"
+	assert.EqualError(t, processors.Validate(),
+		"kafka: processor must be set for topic retry",
+	)
+
+	decoders := valid
+	decoders.Decoder = nil
+	decoders.Decoders = []Decoder{codec.JSON{}}
+	assert.NoError(t, decoders.Validate())
+	decoders.Decoders = nil
+	assert.EqualError(t, decoders.Validate(), "kafka: decoder must be set")
+
+	invalid = valid
+	invalid.Rack = " "
+	assert.EqualError(t, invalid.Validate(), "kafka: rack cannot be blank")
+
+	invalid = valid
+	invalid.BatchMaxRecords = -1
+	assert.EqualError(t, invalid.Validate(), "kafka: batch max records cannot be negative")
+
+	invalid = valid
+	invalid.BatchFlushInterval = time.Second
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: batch flush interval requires batch max records",
+	)
+
+	invalid = valid
+	invalid.BatchMaxRecords = 100
+	invalid.Concurrency = 2
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: batch max records cannot be used with concurrency",
+	)
+
+	autoCommit := valid
+	autoCommit.AutoCommitInterval = time.Second
+	autoCommit.Delivery = apmqueue.AtLeastOnceDeliveryType
+	assert.NoError(t, autoCommit.Validate())
+
+	invalid = valid
+	invalid.AutoCommitInterval = time.Second
+	invalid.Delivery = apmqueue.AtLeastOnceDeliveryType
+	invalid.OffsetStore = newMemoryOffsetStore()
+	assert.EqualError(t, invalid.Validate(),
+		"kafka: auto commit interval cannot be set with an offset store",
+	)
+
+	rack := valid
+	rack.Rack = "us-east-1a"
+	assert.NoError(t, rack.Validate())
+}
+
+func TestConsumerDialer(t *testing.T) {
+	dialed := make(chan string, 1)
+	newTestConsumer(t, ConsumerConfig{
+		Dialer: func(ctx context.Context, network, host string) (net.Conn, error) {
+			select {
+			case dialed <- host:
+			default:
+			}
+			return nil, errors.New("dial refused")
+		},
+	})
+	select {
+	case host := <-dialed:
+		assert.Equal(t, "127.0.0.1:1", host)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the dialer to be called")
+	}
+}
+
+// newTestConsumer returns a consumer with the required configuration set to
+// sensible defaults, pointing to an address where no broker is listening.
+func newTestConsumer(t testing.TB, cfg ConsumerConfig) *Consumer {
+	if len(cfg.Brokers) == 0 {
+		cfg.Brokers = []string{"127.0.0.1:1"}
+	}
+	if len(cfg.Topics) == 0 {
+		cfg.Topics = []string{"topic"}
+	}
+	if cfg.GroupID == "" {
+		cfg.GroupID = "groupid"
+	}
+	if cfg.Decoder == nil {
+		cfg.Decoder = messageDecoder{}
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop()
+	}
+	if cfg.Processor == nil && cfg.RawBytesProcessor == nil && cfg.AckProcessor == nil &&
+		cfg.FetchProcessor == nil {
+		cfg.Processor = model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			return nil
+		})
+	}
+	consumer, err := NewConsumer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	return consumer
+}
+
+// memoryOffsetStore is an OffsetStore which keeps the offsets in memory.
+type memoryOffsetStore struct {
+	mu      sync.Mutex
+	offsets map[string]int64
+	stores  int
+	err     error
+}
+
+func newMemoryOffsetStore() *memoryOffsetStore {
+	return &memoryOffsetStore{offsets: make(map[string]int64)}
+}
+
+func (s *memoryOffsetStore) Load(group string, topic apmqueue.Topic, partition int32) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	offset, ok := s.offsets[fmt.Sprintf("%s/%s/%d", group, topic, partition)]
+	if !ok {
+		return -1, nil
+	}
+	return offset, nil
+}
+
+func (s *memoryOffsetStore) Store(group string, topic apmqueue.Topic, partition int32, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.offsets[fmt.Sprintf("%s/%s/%d", group, topic, partition)] = offset
+	s.stores++
+	return nil
+}
+
+// decoderFunc is a Decoder implemented by a function.
+type decoderFunc func([]byte, *model.APMEvent) error
+
+func (f decoderFunc) Decode(b []byte, event *model.APMEvent) error {
+	return f(b, event)
+}
+
+// messageDecoder decodes the record value into the event message.
+type messageDecoder struct{}
+
+func (messageDecoder) Decode(b []byte, event *model.APMEvent) error {
+	event.Message = string(b)
+	return nil
+}
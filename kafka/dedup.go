@@ -0,0 +1,87 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// defaultDedupCapacity is the default maximum number of keys tracked by the
+// consumer deduplication.
+const defaultDedupCapacity = 10000
+
+// dedupCache tracks the record keys seen within a sliding window, up to a
+// maximum number of keys. It is safe for concurrent use.
+type dedupCache struct {
+	window   time.Duration
+	capacity int
+
+	mu sync.Mutex
+	// seen holds the tracked keys, and order holds their dedupEntry from the
+	// oldest to the newest.
+	seen  map[string]struct{}
+	order *list.List
+}
+
+// dedupEntry is a key tracked by a dedupCache, and the time it was seen.
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+func newDedupCache(window time.Duration, capacity int) *dedupCache {
+	if capacity <= 0 {
+		capacity = defaultDedupCapacity
+	}
+	return &dedupCache{
+		window:   window,
+		capacity: capacity,
+		seen:     make(map[string]struct{}),
+		order:    list.New(),
+	}
+}
+
+// duplicate returns true if key was seen within the window before now, and
+// tracks it otherwise, forgetting the oldest key when the cache is full.
+func (d *dedupCache) duplicate(key string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		if now.Sub(e.Value.(dedupEntry).seen) < d.window {
+			break
+		}
+		d.forget(e)
+	}
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	if d.order.Len() >= d.capacity {
+		d.forget(d.order.Front())
+	}
+	d.seen[key] = struct{}{}
+	d.order.PushBack(dedupEntry{key: key, seen: now})
+	return false
+}
+
+// forget stops tracking the key of e.
+func (d *dedupCache) forget(e *list.Element) {
+	d.order.Remove(e)
+	delete(d.seen, e.Value.(dedupEntry).key)
+}
@@ -0,0 +1,76 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestDedupCache(t *testing.T) {
+	now := time.Now()
+	d := newDedupCache(time.Minute, 2)
+	assert.False(t, d.duplicate("a", now))
+	assert.True(t, d.duplicate("a", now.Add(time.Second)))
+	assert.False(t, d.duplicate("b", now.Add(time.Second)))
+
+	// The oldest key is forgotten when the cache is full.
+	assert.False(t, d.duplicate("c", now.Add(2*time.Second)))
+	assert.False(t, d.duplicate("a", now.Add(3*time.Second)))
+	assert.True(t, d.duplicate("c", now.Add(3*time.Second)))
+
+	// Keys are forgotten once the window has passed since they were seen.
+	assert.False(t, d.duplicate("c", now.Add(2*time.Second+time.Minute)))
+	assert.True(t, d.duplicate("a", now.Add(2*time.Second+time.Minute)))
+}
+
+func TestConsumerDedupWindow(t *testing.T) {
+	var processed []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		DedupWindow: time.Minute,
+		RetryTopic:  "retry",
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed = append(processed, (*b)[0].Message)
+			return nil
+		}),
+	})
+	for i, r := range []struct{ topic, key, value string }{
+		{"topic", "a", "a1"},
+		{"topic", "b", "b1"},
+		{"topic", "a", "a2"},
+		{"topic", "", "no key 1"},
+		{"topic", "", "no key 2"},
+		{"topic", "b", "b2"},
+		{"retry", "a", "a retried"},
+		{"topic", "c", "c1"},
+	} {
+		consumer.processRecord(context.Background(), &kgo.Record{
+			Topic:  r.topic,
+			Key:    []byte(r.key),
+			Value:  []byte(r.value),
+			Offset: int64(i),
+		})
+	}
+	assert.Equal(t, []string{"a1", "b1", "no key 1", "no key 2", "a retried", "c1"}, processed)
+}
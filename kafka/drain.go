@@ -0,0 +1,65 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+)
+
+// DrainAndLeave stops the consumer from fetching records, waits for the
+// records being processed, commits their offsets and leaves the consumer
+// group, so that its partitions are reassigned to the other members of the
+// group right away, for example during a blue/green deployment. Run returns
+// nil once the consumer is drained, and doesn't fetch records anymore. The
+// consumer must still be closed.
+func (c *Consumer) DrainAndLeave(ctx context.Context) error {
+	c.drainOnce.Do(func() { close(c.draining) })
+	// Wait for the records being processed, the offsets of the processed
+	// records have been committed once they are, unless the client commits
+	// them in the background.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cfg.commitMode() == commitInBackground {
+		c.commit(ctx)
+	}
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		c.leaveGroup()
+	}()
+	select {
+	case <-left:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// untilDrained returns a context which is done once ctx is, or once
+// DrainAndLeave is called.
+func (c *Consumer) untilDrained(ctx context.Context) (context.Context, context.CancelFunc) {
+	stop, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.draining:
+			cancel()
+		case <-stop.Done():
+		}
+	}()
+	return stop, cancel
+}
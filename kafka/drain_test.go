@@ -0,0 +1,103 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerDrainAndLeave(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	processing := make(chan struct{})
+	release := make(chan struct{})
+	consumer := newTestConsumer(t, ConsumerConfig{
+		// The client commits the offsets in the background, so they are
+		// only committed by DrainAndLeave.
+		AutoCommitInterval: time.Hour,
+		Delivery:           apmqueue.AtLeastOnceDeliveryType,
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			close(processing)
+			<-release
+			record("processed")
+			return nil
+		}),
+	})
+	var polls atomic.Int64
+	consumer.pollRecords = func(ctx context.Context, _ int) kgo.Fetches {
+		if polls.Add(1) > 1 {
+			<-ctx.Done()
+			return nil
+		}
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic: "topic",
+			Partitions: []kgo.FetchPartition{{Partition: 0, Records: []*kgo.Record{
+				{Topic: "topic", Value: []byte("a")},
+			}}},
+		}}}}
+	}
+	consumer.commitOffsets = func(context.Context) error {
+		record("committed")
+		return nil
+	}
+	consumer.leaveGroup = func() { record("left") }
+
+	run := make(chan error, 1)
+	go func() { run <- consumer.Run(context.Background()) }()
+	<-processing
+
+	drained := make(chan error, 1)
+	go func() { drained <- consumer.DrainAndLeave(context.Background()) }()
+	select {
+	case <-drained:
+		t.Fatal("drained before the records were processed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	for _, ch := range []chan error{drained, run} {
+		select {
+		case err := <-ch:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the consumer to drain")
+		}
+	}
+	assert.Equal(t, []string{"processed", "committed", "left"}, events)
+
+	// The drained consumer doesn't fetch records anymore.
+	polled := polls.Load()
+	require.NoError(t, consumer.Run(context.Background()))
+	assert.Equal(t, polled, polls.Load())
+}
@@ -0,0 +1,44 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import "github.com/elastic/apm-data/model"
+
+// EventType returns the type of event, one of "transaction", "span",
+// "error", "metric" or "log", or "unknown" if it can't be classified. It's
+// used as the event.type attribute of the produced and decoded records
+// metrics.
+func EventType(event model.APMEvent) string {
+	if event.Processor.Event != "" {
+		return event.Processor.Event
+	}
+	// Spans and errors may reference their transaction, check them first.
+	switch {
+	case event.Error != nil:
+		return "error"
+	case event.Span != nil:
+		return "span"
+	case event.Transaction != nil:
+		return "transaction"
+	case event.Metricset != nil:
+		return "metric"
+	case event.Message != "":
+		return "log"
+	}
+	return "unknown"
+}
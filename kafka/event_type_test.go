@@ -0,0 +1,98 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestEventType(t *testing.T) {
+	for expected, event := range map[string]model.APMEvent{
+		"transaction": {Transaction: &model.Transaction{ID: "t"}},
+		"span":        {Span: &model.Span{ID: "s"}, Transaction: &model.Transaction{ID: "t"}},
+		"error":       {Error: &model.Error{ID: "e"}, Transaction: &model.Transaction{ID: "t"}},
+		"metric":      {Metricset: &model.Metricset{Name: "app"}},
+		"log":         {Message: "hello"},
+		"unknown":     {},
+	} {
+		assert.Equal(t, expected, EventType(event), expected)
+	}
+	// The processor event takes precedence.
+	assert.Equal(t, "span", EventType(model.APMEvent{
+		Processor:   model.SpanProcessor,
+		Transaction: &model.Transaction{ID: "t"},
+	}))
+}
+
+func TestEventTypeMetrics(t *testing.T) {
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "t1"}},
+		{Span: &model.Span{ID: "s1"}},
+		{Span: &model.Span{ID: "s2"}},
+		{Error: &model.Error{ID: "e1"}},
+		{Metricset: &model.Metricset{Name: "app"}},
+	}
+	expected := map[string]int64{"transaction": 1, "span": 2, "error": 1, "metric": 1}
+
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	producer := newTestProducer(t, ProducerConfig{Sync: true, MeterProvider: mp})
+	var records []*kgo.Record
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		records = append(records, r)
+		promise(r, nil)
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Decoder:       producer.cfg.Encoder.(Decoder),
+		MeterProvider: mp,
+	})
+	for _, r := range records {
+		consumer.processRecord(context.Background(), r)
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	byType := func(name string) map[string]int64 {
+		counts := make(map[string]int64)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != name {
+					continue
+				}
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					eventType, _ := dp.Attributes.Value("event.type")
+					counts[eventType.AsString()] += dp.Value
+				}
+			}
+		}
+		return counts
+	}
+	assert.Equal(t, expected, byType("producer.records.produced"))
+	assert.Equal(t, expected, byType("consumer.decoded"))
+}
@@ -0,0 +1,226 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// Lag queries the brokers for the end offset of every partition of the
+// consumer topics and the offsets committed by the consumer group, and
+// returns the difference between both for each topic partition.
+//
+// Partitions for which the group has not committed an offset report their
+// end offset as lag. Lag issues requests to the cluster, so it is better
+// suited to infrequent checks, such as readiness gates, than to hot paths.
+func (c *Consumer) Lag(ctx context.Context) (map[apmqueue.Topic]map[int32]int64, error) {
+	end, err := c.listOffsets(ctx, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list end offsets: %w", err)
+	}
+	committed, err := c.groupOffsets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch committed offsets: %w", err)
+	}
+	return calculateLag(end, committed), nil
+}
+
+// RunUntilCaughtUp executes the consumer in a blocking manner until it has
+// processed all the records which were in the consumer topics when it was
+// called, according to their end offsets at that time. It returns nil
+// immediately when the consumer group has no lag, for example when the
+// topics are empty.
+//
+// RunUntilCaughtUp is meant for batch jobs where the consumer is the only
+// member of its group; partitions assigned to other members never catch up
+// from the point of view of this consumer.
+func (c *Consumer) RunUntilCaughtUp(ctx context.Context) error {
+	end, err := c.listOffsets(ctx, -1)
+	if err != nil {
+		return fmt.Errorf("failed to list end offsets: %w", err)
+	}
+	committed, err := c.groupOffsets(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch committed offsets: %w", err)
+	}
+	pending := newCatchUp(end, committed)
+	for !pending.done() {
+		fetches, err := c.fetch(ctx)
+		if err != nil {
+			return err
+		}
+		pending.update(fetches)
+	}
+	return nil
+}
+
+// catchUp tracks the partitions which haven't been consumed up to their
+// target end offset.
+type catchUp map[string]map[int32]int64
+
+// newCatchUp returns the partitions whose committed offset is behind their
+// end offset, mapped to their end offset.
+func newCatchUp(end, committed map[string]map[int32]int64) catchUp {
+	pending := make(catchUp)
+	for topic, partitions := range calculateLag(end, committed) {
+		for partition, lag := range partitions {
+			if lag == 0 {
+				continue
+			}
+			if pending[string(topic)] == nil {
+				pending[string(topic)] = make(map[int32]int64)
+			}
+			pending[string(topic)][partition] = end[string(topic)][partition]
+		}
+	}
+	return pending
+}
+
+// update removes the partitions which were consumed up to their end offset.
+func (p catchUp) update(fetches kgo.Fetches) {
+	fetches.EachPartition(func(fp kgo.FetchTopicPartition) {
+		end, ok := p[fp.Topic][fp.Partition]
+		if !ok || len(fp.Records) == 0 {
+			return
+		}
+		if fp.Records[len(fp.Records)-1].Offset+1 >= end {
+			delete(p[fp.Topic], fp.Partition)
+			if len(p[fp.Topic]) == 0 {
+				delete(p, fp.Topic)
+			}
+		}
+	})
+}
+
+// done returns true when all the partitions have caught up.
+func (p catchUp) done() bool {
+	return len(p) == 0
+}
+
+// offsetsAt returns the offset of the first record whose timestamp, in
+// milliseconds, is at or after timestamp in every partition of the consumer
+// topics, or -1 for the partitions without such a record. A timestamp of -1
+// returns the end (high watermark) offsets.
+func (c *Consumer) offsetsAt(ctx context.Context, timestamp int64) (map[string]map[int32]int64, error) {
+	metaReq := kmsg.NewPtrMetadataRequest()
+	for _, topic := range c.cfg.Topics {
+		t := kmsg.NewMetadataRequestTopic()
+		t.Topic = kmsg.StringPtr(string(topic))
+		metaReq.Topics = append(metaReq.Topics, t)
+	}
+	metaResp, err := metaReq.RequestWith(ctx, c.client)
+	if err != nil {
+		return nil, err
+	}
+
+	listReq := kmsg.NewPtrListOffsetsRequest()
+	listReq.ReplicaID = -1
+	for _, topic := range metaResp.Topics {
+		var name string
+		if topic.Topic != nil {
+			name = *topic.Topic
+		}
+		if err := kerr.ErrorForCode(topic.ErrorCode); err != nil {
+			return nil, fmt.Errorf("topic %s: %w", name, err)
+		}
+		t := kmsg.NewListOffsetsRequestTopic()
+		t.Topic = name
+		for _, partition := range topic.Partitions {
+			p := kmsg.NewListOffsetsRequestTopicPartition()
+			p.Partition = partition.Partition
+			p.Timestamp = timestamp
+			t.Partitions = append(t.Partitions, p)
+		}
+		listReq.Topics = append(listReq.Topics, t)
+	}
+	listResp, err := listReq.RequestWith(ctx, c.client)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]map[int32]int64, len(listResp.Topics))
+	for _, topic := range listResp.Topics {
+		partitions := make(map[int32]int64, len(topic.Partitions))
+		for _, partition := range topic.Partitions {
+			if err := kerr.ErrorForCode(partition.ErrorCode); err != nil {
+				return nil, fmt.Errorf("topic %s partition %d: %w",
+					topic.Topic, partition.Partition, err,
+				)
+			}
+			partitions[partition.Partition] = partition.Offset
+		}
+		offsets[topic.Topic] = partitions
+	}
+	return offsets, nil
+}
+
+// groupOffsets returns the offsets committed by the consumer group.
+func (c *Consumer) groupOffsets(ctx context.Context) (map[string]map[int32]int64, error) {
+	req := kmsg.NewPtrOffsetFetchRequest()
+	req.Group = c.cfg.GroupID
+	resp, err := req.RequestWith(ctx, c.client)
+	if err != nil {
+		return nil, err
+	}
+	if err := kerr.ErrorForCode(resp.ErrorCode); err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]map[int32]int64, len(resp.Topics))
+	for _, topic := range resp.Topics {
+		partitions := make(map[int32]int64, len(topic.Partitions))
+		for _, partition := range topic.Partitions {
+			if err := kerr.ErrorForCode(partition.ErrorCode); err != nil {
+				return nil, fmt.Errorf("topic %s partition %d: %w",
+					topic.Topic, partition.Partition, err,
+				)
+			}
+			partitions[partition.Partition] = partition.Offset
+		}
+		offsets[topic.Topic] = partitions
+	}
+	return offsets, nil
+}
+
+// calculateLag returns the lag of every partition in end. Partitions without
+// a committed offset are assumed to be fully lagging.
+func calculateLag(end, committed map[string]map[int32]int64) map[apmqueue.Topic]map[int32]int64 {
+	lag := make(map[apmqueue.Topic]map[int32]int64, len(end))
+	for topic, partitions := range end {
+		topicLag := make(map[int32]int64, len(partitions))
+		for partition, endOffset := range partitions {
+			offset, ok := committed[topic][partition]
+			if !ok || offset < 0 {
+				offset = 0
+			}
+			if l := endOffset - offset; l > 0 {
+				topicLag[partition] = l
+			} else {
+				topicLag[partition] = 0
+			}
+		}
+		lag[apmqueue.Topic(topic)] = topicLag
+	}
+	return lag
+}
@@ -0,0 +1,114 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestCalculateLag(t *testing.T) {
+	testCases := map[string]struct {
+		end       map[string]map[int32]int64
+		committed map[string]map[int32]int64
+		expected  map[apmqueue.Topic]map[int32]int64
+	}{
+		"produced minus consumed": {
+			end:       map[string]map[int32]int64{"a": {0: 10, 1: 5}, "b": {0: 3}},
+			committed: map[string]map[int32]int64{"a": {0: 4, 1: 5}, "b": {0: 1}},
+			expected:  map[apmqueue.Topic]map[int32]int64{"a": {0: 6, 1: 0}, "b": {0: 2}},
+		},
+		"no committed offsets": {
+			end:       map[string]map[int32]int64{"a": {0: 10, 1: 0}},
+			committed: map[string]map[int32]int64{"a": {1: -1}},
+			expected:  map[apmqueue.Topic]map[int32]int64{"a": {0: 10, 1: 0}},
+		},
+		"committed ahead of end": {
+			end:       map[string]map[int32]int64{"a": {0: 2}},
+			committed: map[string]map[int32]int64{"a": {0: 5}},
+			expected:  map[apmqueue.Topic]map[int32]int64{"a": {0: 0}},
+		},
+		"committed topics not consumed are ignored": {
+			end:       map[string]map[int32]int64{"a": {0: 2}},
+			committed: map[string]map[int32]int64{"a": {0: 1}, "other": {0: 1}},
+			expected:  map[apmqueue.Topic]map[int32]int64{"a": {0: 1}},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, calculateLag(tc.end, tc.committed))
+		})
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	fetch := func(topic string, partition int32, offsets ...int64) kgo.Fetches {
+		var records []*kgo.Record
+		for _, offset := range offsets {
+			records = append(records, &kgo.Record{
+				Topic: topic, Partition: partition, Offset: offset,
+			})
+		}
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic: topic,
+			Partitions: []kgo.FetchPartition{{
+				Partition: partition,
+				Records:   records,
+			}},
+		}}}}
+	}
+
+	t.Run("empty topics", func(t *testing.T) {
+		pending := newCatchUp(map[string]map[int32]int64{"a": {0: 0, 1: 0}}, nil)
+		assert.True(t, pending.done())
+	})
+	t.Run("already caught up", func(t *testing.T) {
+		pending := newCatchUp(
+			map[string]map[int32]int64{"a": {0: 5}},
+			map[string]map[int32]int64{"a": {0: 5}},
+		)
+		assert.True(t, pending.done())
+	})
+	t.Run("finite backlog", func(t *testing.T) {
+		pending := newCatchUp(
+			map[string]map[int32]int64{"a": {0: 5, 1: 2}, "b": {0: 1}},
+			map[string]map[int32]int64{"a": {0: 2}},
+		)
+		assert.Equal(t, catchUp{"a": {0: 5, 1: 2}, "b": {0: 1}}, pending)
+
+		pending.update(fetch("a", 0, 2, 3))
+		pending.update(fetch("b", 0, 0))
+		assert.False(t, pending.done())
+		assert.Equal(t, catchUp{"a": {0: 5, 1: 2}}, pending)
+
+		pending.update(fetch("a", 1, 0, 1))
+		pending.update(fetch("a", 0))
+		assert.False(t, pending.done())
+
+		pending.update(fetch("a", 0, 4))
+		assert.True(t, pending.done())
+
+		// Records produced after the snapshot don't affect the result.
+		pending.update(fetch("a", 0, 5, 6))
+		assert.True(t, pending.done())
+	})
+}
@@ -0,0 +1,45 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/aggregation"
+)
+
+// processDurationName is the name of the histogram recording how long
+// Producer.ProcessBatch takes.
+const processDurationName = "producer.process.duration"
+
+// LatencyView returns an otel view which applies LatencyBuckets to the
+// producer.process.duration histogram, for the meter provider the producer
+// records its metrics to. When LatencyBuckets is empty, the view doesn't
+// match any instrument and the default boundaries are used.
+func (cfg ProducerConfig) LatencyView() sdkmetric.View {
+	if len(cfg.LatencyBuckets) == 0 {
+		return func(sdkmetric.Instrument) (sdkmetric.Stream, bool) {
+			return sdkmetric.Stream{}, false
+		}
+	}
+	return sdkmetric.NewView(
+		sdkmetric.Instrument{Name: processDurationName},
+		sdkmetric.Stream{Aggregation: aggregation.ExplicitBucketHistogram{
+			Boundaries: append([]float64(nil), cfg.LatencyBuckets...),
+		}},
+	)
+}
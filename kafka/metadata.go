@@ -0,0 +1,77 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// MetadataMode configures how the metadata of the produced records is
+// propagated to the consumers.
+type MetadataMode uint8
+
+const (
+	// MetadataHeaders adds the metadata as record headers. It is the
+	// default.
+	MetadataHeaders MetadataMode = iota
+	// MetadataEnvelope wraps the metadata and the encoded event in a JSON
+	// envelope, {"metadata": {...}, "payload": "..."}, stored as the record
+	// value, for downstream systems which can't read record headers. The
+	// payload is the base64 encoded event.
+	MetadataEnvelope
+)
+
+// valid returns an error if m isn't a known MetadataMode.
+func (m MetadataMode) valid() error {
+	switch m {
+	case MetadataHeaders, MetadataEnvelope:
+		return nil
+	}
+	return errors.New("kafka: metadata mode is not valid")
+}
+
+// envelope is the record value produced with MetadataEnvelope.
+type envelope struct {
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+// wrapEnvelope returns the envelope of the metadata and the encoded payload.
+func wrapEnvelope(metadata map[string]string, payload []byte) ([]byte, error) {
+	return json.Marshal(envelope{Metadata: metadata, Payload: payload})
+}
+
+// unwrapEnvelopes replaces the value of the fetched records produced with
+// MetadataEnvelope by their payload, adding their metadata as headers, as
+// if they had been produced with MetadataHeaders. The records whose value
+// isn't an envelope are left untouched.
+func unwrapEnvelopes(fetches kgo.Fetches) {
+	fetches.EachRecord(func(r *kgo.Record) {
+		var env envelope
+		if err := json.Unmarshal(r.Value, &env); err != nil || env.Payload == nil {
+			return
+		}
+		for k, v := range env.Metadata {
+			r.Headers = append(r.Headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+		}
+		r.Value = env.Payload
+	})
+}
@@ -0,0 +1,96 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestMetadataModeRoundTrip(t *testing.T) {
+	for name, mode := range map[string]MetadataMode{
+		"headers":  MetadataHeaders,
+		"envelope": MetadataEnvelope,
+	} {
+		t.Run(name, func(t *testing.T) {
+			producer := newTestProducer(t, ProducerConfig{
+				Sync:           true,
+				Encoder:        messageEncoder{},
+				MetadataMode:   mode,
+				StaticMetadata: map[string]string{"a": "b"},
+			})
+			var records []*kgo.Record
+			producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+				records = append(records, r)
+				promise(r, nil)
+			}
+			ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"c": "d"})
+			batch := model.Batch{{Message: "1"}, {Message: "2"}}
+			require.NoError(t, producer.ProcessBatch(ctx, &batch))
+			require.Len(t, records, 2)
+			for _, r := range records {
+				var keys []string
+				for _, h := range r.Headers {
+					keys = append(keys, h.Key)
+				}
+				if mode == MetadataEnvelope {
+					assert.NotContains(t, keys, "a")
+					assert.NotContains(t, keys, "c")
+				} else {
+					assert.Subset(t, keys, []string{"a", "c"})
+				}
+			}
+			if mode == MetadataEnvelope {
+				assert.JSONEq(t, `{"metadata":{"a":"b","c":"d"},"payload":"MQ=="}`, string(records[0].Value))
+			}
+
+			var processed []string
+			var metadata []map[string]string
+			consumer := newTestConsumer(t, ConsumerConfig{
+				MetadataMode: mode,
+				Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+					for _, event := range *b {
+						processed = append(processed, event.Message)
+					}
+					m, _ := queuecontext.MetadataFromContext(ctx)
+					metadata = append(metadata, m)
+					return nil
+				}),
+			})
+			consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+				return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+					Topic:      "topic",
+					Partitions: []kgo.FetchPartition{{Records: records}},
+				}}}}
+			}
+			_, err := consumer.fetch(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, []string{"1", "2"}, processed)
+			want := map[string]string{"a": "b", "c": "d"}
+			assert.Equal(t, []map[string]string{want, want}, metadata)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// topicOrder produces the records of a batch topic by topic, in the order of
+// OrderTopics, waiting for the records of a topic to be acknowledged before
+// the records of the next topic are produced.
+type topicOrder struct {
+	// ranks holds the position in OrderTopics of the topic of every event
+	// of the sorted batch.
+	ranks    []int
+	inFlight sync.WaitGroup
+}
+
+// orderTopics returns the events of batch sorted by the position of their
+// topic in OrderTopics, the events routed to other topics last, and the
+// topicOrder to produce them with. It returns batch and a nil topicOrder
+// when OrderTopics isn't set.
+func (p *Producer) orderTopics(batch model.Batch) (_ model.Batch, _ *topicOrder, err error) {
+	if len(p.cfg.OrderTopics) == 0 {
+		return batch, nil, nil
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			err = p.recovered(v)
+		}
+	}()
+	positions := make(map[string]int, len(p.cfg.OrderTopics))
+	for i, topic := range p.cfg.OrderTopics {
+		if _, ok := positions[string(topic)]; !ok {
+			positions[string(topic)] = i
+		}
+	}
+	type rankedEvent struct {
+		event model.APMEvent
+		rank  int
+	}
+	ranked := make([]rankedEvent, len(batch))
+	for i, event := range batch {
+		topic := p.cfg.TopicRouter(event)
+		if topic == "" && p.cfg.DefaultTopic != "" {
+			topic = p.cfg.DefaultTopic
+		}
+		rank, ok := positions[string(topic)]
+		if !ok {
+			rank = len(p.cfg.OrderTopics)
+		}
+		ranked[i] = rankedEvent{event: event, rank: rank}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].rank < ranked[j].rank
+	})
+	// The events are copied, so the caller's batch isn't reordered.
+	sorted := make(model.Batch, len(ranked))
+	order := topicOrder{ranks: make([]int, len(ranked))}
+	for i, e := range ranked {
+		sorted[i] = e.event
+		order.ranks[i] = e.rank
+	}
+	return sorted, &order, nil
+}
+
+// ready blocks until the records produced before the i-th event are
+// acknowledged when the event starts the records of the next topic. It
+// returns false if ctx is done first. It never blocks when o is nil.
+func (o *topicOrder) ready(ctx context.Context, i int) bool {
+	if o == nil || i == 0 || o.ranks[i] == o.ranks[i-1] {
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		o.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// promise wraps promise to track the records in flight. It returns promise
+// when o is nil.
+func (o *topicOrder) promise(promise func(*kgo.Record, error)) func(*kgo.Record, error) {
+	if o == nil {
+		return promise
+	}
+	o.inFlight.Add(1)
+	return func(r *kgo.Record, err error) {
+		defer o.inFlight.Done()
+		promise(r, err)
+	}
+}
@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestProducerOrderTopics(t *testing.T) {
+	producer := newTestProducer(t, ProducerConfig{
+		Encoder:     messageEncoder{},
+		Sync:        true,
+		OrderTopics: []apmqueue.Topic{"a", "b"},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(event.Service.Name)
+		},
+	})
+	var mu sync.Mutex
+	var events []string
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		mu.Lock()
+		events = append(events, "send "+string(r.Value))
+		mu.Unlock()
+		// The records are acknowledged asynchronously.
+		time.AfterFunc(10*time.Millisecond, func() {
+			mu.Lock()
+			events = append(events, "ack "+string(r.Value))
+			mu.Unlock()
+			promise(r, nil)
+		})
+	}
+	batch := model.Batch{
+		{Service: model.Service{Name: "c"}, Message: "c1"},
+		{Service: model.Service{Name: "b"}, Message: "b1"},
+		{Service: model.Service{Name: "a"}, Message: "a1"},
+		{Service: model.Service{Name: "b"}, Message: "b2"},
+		{Service: model.Service{Name: "a"}, Message: "a2"},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, events, 10)
+	// The records of a topic are acknowledged before the records of the next
+	// topic are sent, in the order of the batch, and the records of the
+	// topics which aren't ordered are sent last.
+	assert.Equal(t, []string{"send a1", "send a2"}, events[0:2])
+	assert.ElementsMatch(t, []string{"ack a1", "ack a2"}, events[2:4])
+	assert.Equal(t, []string{"send b1", "send b2"}, events[4:6])
+	assert.ElementsMatch(t, []string{"ack b1", "ack b2"}, events[6:8])
+	assert.Equal(t, []string{"send c1", "ack c1"}, events[8:10])
+
+	// The batch isn't reordered.
+	assert.Equal(t, "c1", batch[0].Message)
+	assert.Equal(t, "a2", batch[4].Message)
+}
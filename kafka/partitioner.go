@@ -0,0 +1,127 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"hash/crc32"
+	"hash/fnv"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// KeyHasher is the algorithm the keys of the produced records are hashed with
+// to select their partition.
+type KeyHasher uint8
+
+const (
+	// KeyHasherMurmur2 partitions the records by the murmur2 hash of their
+	// key, as the Java Kafka client does. It is the default.
+	KeyHasherMurmur2 KeyHasher = iota
+	// KeyHasherCRC32 partitions the records by the CRC-32 (IEEE) checksum
+	// of their key, as librdkafka's consistent partitioner does.
+	KeyHasherCRC32
+)
+
+// crc32Hash returns the partition of key among n partitions, as librdkafka's
+// consistent partitioner does.
+func crc32Hash(key []byte, n int) int {
+	return int(crc32.ChecksumIEEE(key) % uint32(n))
+}
+
+// partitioner returns the partitioner of the produced records, or nil to use
+// the Kafka client's default partitioner.
+func (cfg ProducerConfig) partitioner() kgo.Partitioner {
+	var partitioner kgo.Partitioner
+	switch {
+	case cfg.ConsistentHashing:
+		partitioner = kgo.StickyKeyPartitioner(consistentHash)
+	case cfg.KeyHasher == KeyHasherCRC32:
+		// The Kafka client's default partitioner, hashing the keys with
+		// crc32 rather than murmur2.
+		partitioner = kgo.UniformBytesPartitioner(64<<10, true, true, crc32Hash)
+	}
+	if !cfg.BestEffort {
+		return partitioner
+	}
+	if partitioner == nil {
+		// The Kafka client's default partitioner.
+		partitioner = kgo.UniformBytesPartitioner(64<<10, true, true, nil)
+	}
+	return bestEffortPartitioner{partitioner}
+}
+
+// bestEffortPartitioner partitions all the records, including the records
+// with a key, among the partitions whose leader is available, so that they
+// are produced rather than waiting for the partition they hash to.
+type bestEffortPartitioner struct {
+	kgo.Partitioner
+}
+
+func (p bestEffortPartitioner) ForTopic(topic string) kgo.TopicPartitioner {
+	tp := p.Partitioner.ForTopic(topic)
+	if bp, ok := tp.(kgo.TopicBackupPartitioner); ok {
+		return bestEffortBackupTopicPartitioner{bp}
+	}
+	return bestEffortTopicPartitioner{tp}
+}
+
+// bestEffortTopicPartitioner never requires consistency, and forwards the
+// new batches to the wrapped partitioner.
+type bestEffortTopicPartitioner struct {
+	kgo.TopicPartitioner
+}
+
+func (bestEffortTopicPartitioner) RequiresConsistency(*kgo.Record) bool { return false }
+
+func (p bestEffortTopicPartitioner) OnNewBatch() { onNewBatch(p.TopicPartitioner) }
+
+// bestEffortBackupTopicPartitioner is a bestEffortTopicPartitioner for the
+// partitioners which partition by the number of buffered records.
+type bestEffortBackupTopicPartitioner struct {
+	kgo.TopicBackupPartitioner
+}
+
+func (bestEffortBackupTopicPartitioner) RequiresConsistency(*kgo.Record) bool { return false }
+
+func (p bestEffortBackupTopicPartitioner) OnNewBatch() { onNewBatch(p.TopicBackupPartitioner) }
+
+// onNewBatch calls OnNewBatch on tp, if it implements it.
+func onNewBatch(tp kgo.TopicPartitioner) {
+	if nb, ok := tp.(kgo.TopicPartitionerOnNewBatch); ok {
+		nb.OnNewBatch()
+	}
+}
+
+// consistentHash returns the partition of key among n partitions with jump
+// consistent hashing. As n grows, a key either keeps its partition or moves to
+// one of the new partitions, and only 1/n of the keys move when a partition
+// is added.
+//
+// See "A Fast, Minimal Memory, Consistent Hash Algorithm", Lamping & Veach.
+func consistentHash(key []byte, n int) int {
+	h := fnv.New64a()
+	h.Write(key)
+	k := h.Sum64()
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,148 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsistentHash(t *testing.T) {
+	var moved int
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		before := consistentHash(key, 8)
+		assert.GreaterOrEqual(t, before, 0)
+		assert.Less(t, before, 8)
+		after := consistentHash(key, 12)
+		if after != before {
+			// Keys only move to the new partitions.
+			assert.GreaterOrEqual(t, after, 8)
+			moved++
+		}
+	}
+	// A third of the keys is expected to move to the 4 new partitions.
+	assert.InDelta(t, 333, moved, 60)
+}
+
+func TestProducerConsistentHashing(t *testing.T) {
+	broker := newFakeBroker(t)
+	broker.setPartitions(4)
+	producer := newTestProducer(t, ProducerConfig{
+		Broker:            broker.addr.String(),
+		Sync:              true,
+		Encoder:           messageEncoder{},
+		KeyEncoder:        func(event model.APMEvent) ([]byte, error) { return []byte(event.Message), nil },
+		Compression:       []kgo.CompressionCodec{kgo.NoCompression()},
+		ConsistentHashing: true,
+	})
+	var batch model.Batch
+	for i := 0; i < 100; i++ {
+		batch = append(batch, model.APMEvent{Message: fmt.Sprintf("key-%d", i)})
+	}
+	produce := func() map[string]int32 {
+		produced := len(broker.produced())
+		b := append(model.Batch(nil), batch...)
+		require.NoError(t, producer.ProcessBatch(context.Background(), &b))
+		partitions := make(map[string]int32)
+		for _, pb := range broker.produced()[produced:] {
+			for _, key := range pb.keys {
+				partitions[key] = pb.partition
+			}
+		}
+		require.Len(t, partitions, len(batch))
+		return partitions
+	}
+	before := produce()
+
+	broker.setPartitions(8)
+	producer.client.ForceMetadataRefresh()
+	require.Eventually(t, func() bool {
+		after := produce()
+		for _, partition := range after {
+			if partition >= 4 {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 50*time.Millisecond)
+
+	var moved int
+	for key, partition := range produce() {
+		if partition != before[key] {
+			assert.GreaterOrEqual(t, partition, int32(4), key)
+			moved++
+		}
+	}
+	assert.Less(t, moved, len(batch)/2+10)
+}
+
+func TestProducerKeyHasher(t *testing.T) {
+	// The partitions of the keys among 10 partitions, as computed by the
+	// Java Kafka client and by librdkafka's consistent partitioner.
+	for name, tc := range map[string]struct {
+		hasher     KeyHasher
+		partitions map[string]int32
+	}{
+		"murmur2": {
+			hasher: KeyHasherMurmur2,
+			// murmur2("21") = -973932308, murmur2("foobar") = -790332482,
+			// murmur2("abc") = 479470107, made positive.
+			partitions: map[string]int32{"21": 0, "foobar": 6, "abc": 7},
+		},
+		"crc32": {
+			hasher: KeyHasherCRC32,
+			// crc32("21") = 4252452532, crc32("foobar") = 2666930069,
+			// crc32("abc") = 891568578.
+			partitions: map[string]int32{"21": 2, "foobar": 9, "abc": 8},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			broker := newFakeBroker(t)
+			broker.setPartitions(10)
+			producer := newTestProducer(t, ProducerConfig{
+				Broker:      broker.addr.String(),
+				Sync:        true,
+				Encoder:     messageEncoder{},
+				KeyEncoder:  func(event model.APMEvent) ([]byte, error) { return []byte(event.Message), nil },
+				Compression: []kgo.CompressionCodec{kgo.NoCompression()},
+				KeyHasher:   tc.hasher,
+			})
+			batch := model.Batch{{Message: "21"}, {Message: "foobar"}, {Message: "abc"}}
+			require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+			partitions := make(map[string]int32)
+			for _, pb := range broker.produced() {
+				for _, key := range pb.keys {
+					partitions[key] = pb.partition
+				}
+			}
+			assert.Equal(t, tc.partitions, partitions)
+		})
+	}
+
+	err := ProducerConfig{KeyHasher: KeyHasherCRC32, ConsistentHashing: true}.Validate()
+	assert.ErrorContains(t, err, "kafka: crc32 key hasher and consistent hashing are mutually exclusive")
+}
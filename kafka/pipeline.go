@@ -0,0 +1,115 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Pipeline runs a Consumer whose Processor produces the transformed events
+// with a Producer, and coordinates their shutdown so that the records being
+// processed aren't lost when the pipeline is closed.
+type Pipeline struct {
+	consumer *Consumer
+	producer *Producer
+
+	stopCtx  context.Context
+	stop     context.CancelFunc
+	finished chan struct{}
+
+	mu      sync.Mutex
+	running bool
+}
+
+// NewPipeline returns a new Pipeline which consumes with consumer and
+// produces with producer. The consumer Processor is expected to produce the
+// transformed events with producer.
+func NewPipeline(consumer *Consumer, producer *Producer) *Pipeline {
+	stopCtx, stop := context.WithCancel(context.Background())
+	return &Pipeline{
+		consumer: consumer,
+		producer: producer,
+		stopCtx:  stopCtx,
+		stop:     stop,
+		finished: make(chan struct{}),
+	}
+}
+
+// Run executes the pipeline consumer in a blocking manner until ctx is done,
+// or until the pipeline is closed, in which case it returns nil. It must only
+// be called once.
+func (p *Pipeline) Run(ctx context.Context) error {
+	p.mu.Lock()
+	if p.running {
+		p.mu.Unlock()
+		return errors.New("kafka: pipeline is already running")
+	}
+	p.running = true
+	p.mu.Unlock()
+	defer close(p.finished)
+	for {
+		if _, err := p.consumer.fetchUntil(p.stopCtx, ctx); err != nil {
+			if p.stopCtx.Err() != nil && ctx.Err() == nil {
+				return nil // Pipeline closed.
+			}
+			return err
+		}
+	}
+}
+
+// Close stops consuming, waits for the records being processed to be
+// processed and committed, flushes the records buffered by the producer and
+// closes both the consumer and the producer. If ctx is done before the
+// in-flight records have been processed, the consumer client is closed
+// without waiting for them, their offsets aren't committed, and the context
+// error is returned.
+func (p *Pipeline) Close(ctx context.Context) error {
+	p.stop()
+	p.mu.Lock()
+	running := p.running
+	p.mu.Unlock()
+	var errs []error
+	drained := true
+	if running {
+		select {
+		case <-p.finished:
+		case <-ctx.Done():
+			drained = false
+			errs = append(errs, fmt.Errorf("failed to drain consumer: %w", ctx.Err()))
+		}
+	}
+	if err := p.producer.flush(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to flush producer: %w", err))
+	}
+	if drained {
+		if err := p.consumer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	} else {
+		// Consumer.Close would block until the in-flight records have been
+		// processed.
+		p.consumer.client.Close()
+	}
+	if err := p.producer.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
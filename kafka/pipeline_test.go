@@ -0,0 +1,117 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestPipelineClose(t *testing.T) {
+	var mu sync.Mutex
+	var produced []string
+	var committed int64 // Offset of the next record to be committed.
+	var offset int64    // Offset of the next record to be polled.
+
+	producer := newTestProducer(t, ProducerConfig{Sync: true, Encoder: messageEncoder{}})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		mu.Lock()
+		produced = append(produced, string(r.Value))
+		mu.Unlock()
+		promise(r, nil)
+	}
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Delivery: apmqueue.AtLeastOnceDeliveryType,
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			time.Sleep(time.Millisecond) // Simulate a transform.
+			return producer.ProcessBatch(ctx, b)
+		}),
+	})
+	consumer.commitOffsets = func(context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		committed = offset
+		return nil
+	}
+	polled := make(chan struct{}, 1)
+	consumer.pollRecords = func(ctx context.Context, max int) kgo.Fetches {
+		if ctx.Err() != nil {
+			return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+				Topic:      "topic",
+				Partitions: []kgo.FetchPartition{{Err: ctx.Err()}},
+			}}}}
+		}
+		select {
+		case polled <- struct{}{}:
+		default:
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		records := make([]*kgo.Record, 10)
+		for i := range records {
+			records[i] = &kgo.Record{
+				Topic:  "topic",
+				Value:  []byte(strconv.FormatInt(offset, 10)),
+				Offset: offset,
+			}
+			offset++
+		}
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic:      "topic",
+			Partitions: []kgo.FetchPartition{{Records: records}},
+		}}}}
+	}
+
+	pipeline := NewPipeline(consumer, producer)
+	runErr := make(chan error, 1)
+	go func() { runErr <- pipeline.Run(context.Background()) }()
+	for i := 0; i < 5; i++ {
+		<-polled
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, pipeline.Close(ctx))
+	require.NoError(t, <-runErr)
+
+	// Every record whose offset was committed has been produced.
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotZero(t, committed)
+	expected := make([]string, committed)
+	for i := range expected {
+		expected[i] = strconv.Itoa(i)
+	}
+	assert.Equal(t, expected, produced)
+}
+
+// messageEncoder encodes the event message as the record value.
+type messageEncoder struct{}
+
+func (messageEncoder) Encode(event model.APMEvent) ([]byte, error) {
+	return []byte(event.Message), nil
+}
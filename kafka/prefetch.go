@@ -0,0 +1,238 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+// prefetcher holds the fetches polled in the background by Run with
+// PrefetchBytes, until they are processed.
+type prefetcher struct {
+	limit int64
+	// ready is signaled when fetches are queued or polling failed, and
+	// freed when the bytes of processed fetches are released.
+	ready chan struct{}
+	freed chan struct{}
+
+	mu    sync.Mutex
+	queue []prefetched
+	// bytes is the size of the queued fetches, and of the fetches being
+	// processed.
+	bytes int64
+	err   error
+}
+
+// prefetched holds polled fetches and the size of their records.
+type prefetched struct {
+	fetches kgo.Fetches
+	bytes   int64
+}
+
+func newPrefetcher(limit int64) *prefetcher {
+	return &prefetcher{
+		limit: limit,
+		ready: make(chan struct{}, 1),
+		freed: make(chan struct{}, 1),
+	}
+}
+
+// run polls fetches with poll and queues them, pausing while the queued and
+// processed fetches hold limit bytes or more, until poll fails.
+func (p *prefetcher) run(ctx context.Context, poll func(context.Context) (kgo.Fetches, error)) {
+	for {
+		for p.full() {
+			select {
+			case <-p.freed:
+			case <-ctx.Done():
+				p.push(prefetched{}, ctx.Err())
+				return
+			}
+		}
+		fetches, err := poll(ctx)
+		p.push(prefetched{fetches: fetches, bytes: fetchesBytes(fetches)}, err)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *prefetcher) full() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bytes >= p.limit
+}
+
+// push queues f, or records err when polling failed.
+func (p *prefetcher) push(f prefetched, err error) {
+	p.mu.Lock()
+	if err != nil {
+		p.err = err
+	} else if len(f.fetches) > 0 {
+		// Fetches without records are queued too, since they block
+		// rebalances until they are processed.
+		p.queue = append(p.queue, f)
+		p.bytes += f.bytes
+	}
+	p.mu.Unlock()
+	notify(p.ready)
+}
+
+// next returns the next queued fetches, waiting for them to be polled. Once
+// polling failed, the error is returned rather than the queued fetches.
+func (p *prefetcher) next() (prefetched, error) {
+	for {
+		p.mu.Lock()
+		if err := p.err; err != nil {
+			p.mu.Unlock()
+			return prefetched{}, err
+		}
+		if len(p.queue) > 0 {
+			f := p.queue[0]
+			p.queue[0] = prefetched{}
+			p.queue = p.queue[1:]
+			p.mu.Unlock()
+			return f, nil
+		}
+		p.mu.Unlock()
+		<-p.ready
+	}
+}
+
+// release releases the bytes of fetches returned by next once processed.
+func (p *prefetcher) release(f prefetched) {
+	p.mu.Lock()
+	p.bytes -= f.bytes
+	p.mu.Unlock()
+	notify(p.freed)
+}
+
+// notify notifies ch without blocking, ch being buffered.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// fetchesBytes returns the size of the keys, values and headers of the
+// records of fetches.
+func fetchesBytes(fetches kgo.Fetches) int64 {
+	var n int64
+	fetches.EachRecord(func(r *kgo.Record) {
+		n += int64(len(r.Key) + len(r.Value))
+		for _, h := range r.Headers {
+			n += int64(len(h.Key) + len(h.Value))
+		}
+	})
+	return n
+}
+
+// runPrefetch is Run with PrefetchBytes: the next records are polled in the
+// background while the previously polled ones are processed.
+func (c *Consumer) runPrefetch(stop, ctx context.Context) error {
+	select {
+	case <-c.draining:
+		return nil
+	default:
+	}
+	p := newPrefetcher(int64(c.cfg.PrefetchBytes))
+	pollCtx, cancel := context.WithCancel(stop)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(pollCtx, c.pollPrefetch)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	for {
+		select {
+		case <-c.draining:
+			// The prefetched records aren't processed nor committed.
+			return nil
+		default:
+		}
+		f, err := p.next()
+		if err != nil {
+			return runError(stop, ctx, err)
+		}
+		err = c.processPrefetched(ctx, f.fetches)
+		p.release(f)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// pollPrefetch polls the next fetches in the background.
+func (c *Consumer) pollPrefetch(ctx context.Context) (kgo.Fetches, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pollChecked(ctx)
+}
+
+// processPrefetched processes and commits the prefetched fetches, dropping
+// the records of the partitions which were revoked since they were polled.
+func (c *Consumer) processPrefetched(ctx context.Context, fetches kgo.Fetches) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	// Allow rebalancing once the fetched records have been processed, and
+	// partitions can be revoked.
+	defer c.client.AllowRebalance()
+	c.prefetchMu.RLock()
+	defer c.prefetchMu.RUnlock()
+	return c.processPolled(ctx, c.assignedFetches(fetches))
+}
+
+// assignedFetches returns the fetches of the partitions currently assigned
+// to the consumer.
+func (c *Consumer) assignedFetches(fetches kgo.Fetches) kgo.Fetches {
+	c.assignmentMu.RLock()
+	defer c.assignmentMu.RUnlock()
+	assigned := make(kgo.Fetches, 0, len(fetches))
+	for _, fetch := range fetches {
+		topics := make([]kgo.FetchTopic, 0, len(fetch.Topics))
+		for _, topic := range fetch.Topics {
+			partitions := make([]kgo.FetchPartition, 0, len(topic.Partitions))
+			for _, partition := range topic.Partitions {
+				if !containsPartition(c.assignment[topic.Topic], partition.Partition) {
+					c.cfg.Logger.Debug("dropping prefetched records of revoked partition",
+						zap.String("topic", topic.Topic),
+						zap.Int32("partition", partition.Partition),
+						zap.Int("records", len(partition.Records)),
+					)
+					continue
+				}
+				partitions = append(partitions, partition)
+			}
+			if len(partitions) > 0 {
+				topics = append(topics, kgo.FetchTopic{Topic: topic.Topic, Partitions: partitions})
+			}
+		}
+		if len(topics) > 0 {
+			assigned = append(assigned, kgo.Fetch{Topics: topics})
+		}
+	}
+	return assigned
+}
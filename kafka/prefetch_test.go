@@ -0,0 +1,184 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerPrefetch(t *testing.T) {
+	processing := make(chan string)
+	release := make(chan struct{})
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Delivery: apmqueue.AtLeastOnceDeliveryType,
+		// Each record value is a single byte.
+		PrefetchBytes: 3,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processing <- (*b)[0].Message
+			<-release
+			return nil
+		}),
+	})
+	consumer.assigned(context.Background(), nil, map[string][]int32{"topic": {0, 1}})
+	records := []*kgo.Record{
+		{Topic: "topic", Partition: 0, Offset: 0, Value: []byte("a")},
+		{Topic: "topic", Partition: 0, Offset: 1, Value: []byte("b")},
+		{Topic: "topic", Partition: 0, Offset: 2, Value: []byte("c")},
+		{Topic: "topic", Partition: 0, Offset: 3, Value: []byte("d")},
+		{Topic: "topic", Partition: 1, Offset: 0, Value: []byte("e")},
+	}
+	var polls atomic.Int64
+	consumer.pollRecords = func(ctx context.Context, _ int) kgo.Fetches {
+		i := polls.Add(1) - 1
+		if i >= int64(len(records)) {
+			<-ctx.Done()
+			return nil
+		}
+		r := records[i]
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic: r.Topic,
+			Partitions: []kgo.FetchPartition{{
+				Partition: r.Partition,
+				Records:   []*kgo.Record{r},
+			}},
+		}}}}
+	}
+	var mu sync.Mutex
+	var committed []string
+	consumer.commitRecords = func(_ context.Context, rs ...*kgo.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, r := range rs {
+			committed = append(committed, fmt.Sprintf("%d/%d", r.Partition, r.Offset))
+		}
+		return nil
+	}
+	consumer.commitOffsets = func(context.Context) error {
+		t.Error("the offsets of the prefetched records must not be committed")
+		return nil
+	}
+	assertCommitted := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, want, committed)
+	}
+	assertProcessing := func(want string) {
+		t.Helper()
+		select {
+		case got := <-processing:
+			assert.Equal(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s to be processed", want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run := make(chan error, 1)
+	go func() { run <- consumer.Run(ctx) }()
+
+	// The next records are polled while the first one is processed, until
+	// the unprocessed records hold PrefetchBytes.
+	assertProcessing("a")
+	assert.Eventually(t, func() bool { return polls.Load() == 3 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(3), polls.Load())
+	assertCommitted()
+
+	// Once processed, only the offset of the processed record is committed,
+	// and the next record is polled.
+	release <- struct{}{}
+	assertProcessing("b")
+	assertCommitted("0/0")
+	assert.Eventually(t, func() bool { return polls.Load() == 4 }, time.Second, time.Millisecond)
+
+	// Partitions are revoked once the record being processed is committed,
+	// and the prefetched records of the revoked partitions are dropped.
+	lost := make(chan struct{})
+	go func() {
+		defer close(lost)
+		consumer.lost(context.Background(), nil, map[string][]int32{"topic": {0}})
+	}()
+	select {
+	case <-lost:
+		t.Fatal("partitions revoked while processing their records")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	<-lost
+	assertProcessing("e")
+	release <- struct{}{}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(committed) == 3
+	}, time.Second, time.Millisecond)
+	assertCommitted("0/0", "0/1", "1/0")
+
+	cancel()
+	select {
+	case err := <-run:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the consumer to stop")
+	}
+}
+
+func TestConsumerPrefetchValidate(t *testing.T) {
+	for _, tt := range []struct {
+		cfg ConsumerConfig
+		err string
+	}{
+		{
+			cfg: ConsumerConfig{PrefetchBytes: -1},
+			err: "kafka: prefetch bytes cannot be negative",
+		},
+		{
+			cfg: ConsumerConfig{
+				PrefetchBytes:      1,
+				Delivery:           apmqueue.AtLeastOnceDeliveryType,
+				AutoCommitInterval: time.Second,
+			},
+			err: "kafka: prefetch bytes cannot be used with auto commit interval",
+		},
+	} {
+		cfg := tt.cfg
+		cfg.Brokers = []string{"localhost:9092"}
+		cfg.Topics = []string{"topic"}
+		cfg.GroupID = "groupid"
+		cfg.Logger = zap.NewNop()
+		cfg.Decoder = messageDecoder{}
+		cfg.Processor = model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			return nil
+		})
+		assert.EqualError(t, cfg.Validate(), tt.err)
+	}
+}
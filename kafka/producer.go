@@ -21,28 +21,104 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/kversion"
 	"github.com/twmb/franz-go/plugin/kzap"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/elastic/apm-data/model"
 	apmqueue "github.com/elastic/apm-queue"
 	"github.com/elastic/apm-queue/queuecontext"
 )
 
+// BatchMarkerHeader is the header key set on the marker records produced at
+// the end of each batch when ProducerConfig.EmitBatchMarker is enabled.
+const BatchMarkerHeader = "batch-end"
+
+// ChecksumHeader is the header key holding the CRC-32C checksum of the record
+// value, hex encoded, set when ProducerConfig.AddChecksum is enabled.
+const ChecksumHeader = "checksum"
+
+// ExpiresHeader is the header key holding the time after which the record is
+// stale, in milliseconds since the Unix epoch, set when
+// ProducerConfig.RecordTTLFunc is used.
+const ExpiresHeader = "expires"
+
 // Encoder encodes a model.APMEvent to a []byte
 type Encoder interface {
 	// Encode accepts a model.APMEvent and returns the encoded representation.
 	Encode(model.APMEvent) ([]byte, error)
 }
 
+// BatchEncoder may be implemented by an Encoder to encode all the events of a
+// batch at once, for example to use framed or shared-dictionary formats. When
+// the configured Encoder implements it, ProcessBatch uses EncodeBatch instead
+// of Encode.
+type BatchEncoder interface {
+	// EncodeBatch accepts a model.Batch and returns the encoded
+	// representation of each event, in the same order.
+	EncodeBatch(model.Batch) ([][]byte, error)
+}
+
 // RecordMutator mutates the record associated with the model.APMEvent.
 // If the RecordMutator returns an error, it is considered fatal.
 type RecordMutator func(model.APMEvent, *kgo.Record) error
 
+// MirrorSink receives a copy of every record produced, for example to write
+// them to an audit log or a secondary cluster.
+type MirrorSink interface {
+	// Mirror is called with the topic and encoded value of each record
+	// before it is produced. If it returns an error, the record isn't
+	// produced.
+	Mirror(topic apmqueue.Topic, value []byte) error
+}
+
+// Acks configures how many acknowledgements the producer requires from the
+// Kafka brokers before considering a record produced.
+type Acks uint8
+
+const (
+	// AcksAll waits for all the in-sync replicas to acknowledge the records.
+	// It is the safest option and the default.
+	AcksAll Acks = iota
+	// AcksLeader only waits for the partition leader to acknowledge the
+	// records. Records may be lost if the leader fails before replicating.
+	AcksLeader
+	// AcksNone doesn't wait for any acknowledgement.
+	AcksNone
+)
+
+// kgoAcks returns the equivalent kgo.Acks.
+func (a Acks) kgoAcks() kgo.Acks {
+	switch a {
+	case AcksLeader:
+		return kgo.LeaderAck()
+	case AcksNone:
+		return kgo.NoAck()
+	}
+	return kgo.AllISRAcks()
+}
+
 // ProducerConfig holds configuration for publishing events to Kafka.
 type ProducerConfig struct {
 	// Broker holds the (host:port) address of the Kafka broker to which
@@ -55,6 +131,11 @@ type ProducerConfig struct {
 	// Version is the software version to use in the Kafka client. This is
 	// useful since it shows up in Kafka metrics and logs.
 	Version string
+	// MinKafkaVersion, when set, is the minimum Kafka version the brokers
+	// must support, for example kversion.V2_8_0(). NewProducer fails when a
+	// broker supports older request versions, and requests are never
+	// downgraded below it, rather than silently losing features.
+	MinKafkaVersion *kversion.Versions
 
 	// Logger is used for logging producer errors.
 	Logger *zap.Logger
@@ -62,16 +143,300 @@ type ProducerConfig struct {
 	// Encoder holds an encoding.Encoder for encoding events.
 	Encoder Encoder
 
+	// MaxBufferedRecords is the maximum number of records buffered by the
+	// client, waiting to be acknowledged. ProcessBatch blocks while the
+	// buffer is full. Defaults to the Kafka client's default (10000).
+	MaxBufferedRecords int
+	// MaxCloseWaitBytes, when set, makes Close wait for the buffered records
+	// to be delivered before closing the client, as long as their size is
+	// at most MaxCloseWaitBytes. When more bytes are buffered, Close returns
+	// promptly with an error reporting the undelivered records and bytes.
+	// Defaults to 0, Close doesn't wait and buffered records are dropped.
+	MaxCloseWaitBytes int64
+	// MaxCloseWait bounds the time Close waits for the buffered records to
+	// be delivered with MaxCloseWaitBytes, for example while the brokers
+	// are unavailable. Once it elapses, Close returns an error reporting
+	// the undelivered records and bytes. It also bounds the time Reconfigure
+	// waits for the records buffered by the previous client. Defaults to 10
+	// seconds.
+	MaxCloseWait time.Duration
+	// SpillDir, when set, is the directory where the records which can't be
+	// buffered, because MaxBufferedRecords records are already buffered,
+	// are written instead of blocking, for example during broker outages.
+	// Spilled records are reported as acknowledged, and are produced again
+	// by ReplaySpilled.
+	SpillDir string
+	// AdaptiveBatching, when set, flushes the buffered records once they've
+	// been buffered for a linger, or once their size reaches a batch size,
+	// and adapts both to the throttling reported by the brokers: throttled
+	// requests grow them, so that fewer and larger requests are issued
+	// within the broker quotas, while they shrink back once requests aren't
+	// throttled anymore. It can't be used with SpillDir.
+	AdaptiveBatching bool
+	// AutoTune, when set, limits the number of records in flight, waiting
+	// to be acknowledged, and adapts the limit to the acknowledgement
+	// latency: it shrinks when the latency rises above twice the lowest
+	// latency observed, backing off from overloaded brokers, and grows back
+	// while the latency stays low. ProcessBatch blocks while the limit is
+	// reached. The limit is at most MaxBufferedRecords.
+	AutoTune bool
+
+	// Acks is the number of acknowledgements required for a record to be
+	// considered produced. Defaults to AcksAll.
+	Acks Acks
+	// DisableIdempotentWrite disables idempotent writes, which are enabled
+	// by default and require AcksAll.
+	DisableIdempotentWrite bool
+	// Compression holds the codecs used to compress the record batches, in
+	// order of preference. Defaults to the Kafka client's default (snappy).
+	Compression []kgo.CompressionCodec
+	// Linger is how long the client waits for more records before producing
+	// a batch to a partition. Defaults to the Kafka client's default, which
+	// doesn't linger. It can't be used with AdaptiveBatching.
+	Linger time.Duration
+	// BatchMaxBytes is the maximum size of the record batches produced to a
+	// partition, which the brokers reject when it exceeds their
+	// message.max.bytes. The records are split into as many batches, and
+	// produce requests, as needed. Defaults to the Kafka client's default
+	// (1MB).
+	BatchMaxBytes int32
+	// AutoSplitBatches, when set, lowers BatchMaxBytes to the
+	// message.max.bytes of the brokers, requested when creating the
+	// producer, when BatchMaxBytes is unset or larger. The records are then
+	// split into batches the brokers accept, rather than failing as too
+	// large.
+	AutoSplitBatches bool
+	// EagerConnect, when set, makes NewProducer fetch the cluster metadata
+	// and connect to all the brokers with Warmup, failing when it can't,
+	// so that the first ProcessBatch doesn't pay the connection latency.
+	EagerConnect bool
+	// BestEffort, when set, produces the records to the partitions which are
+	// available when some brokers are down, rather than waiting for the
+	// ones which aren't: the records with a key are then partitioned among
+	// the available partitions too, losing their partition affinity while
+	// their partition is unavailable. The records which still fail, such as
+	// the ones buffered for a partition which becomes unavailable, fail
+	// after BestEffortTimeout instead of being retried until the context of
+	// ProcessBatch is done, and are reported to OnRecordError.
+	BestEffort bool
+	// BestEffortTimeout is the time the records are retried for before
+	// failing with BestEffort. Defaults to 10s.
+	BestEffortTimeout time.Duration
+	// OnRecordError, when set, is called with every record which fails to be
+	// produced, and the error, after it has been logged. It's called from
+	// the Kafka client goroutines, so it needs to be safe for concurrent use
+	// and must not block.
+	OnRecordError func(record *kgo.Record, err error)
+
 	// Sync can be used to indicate whether production should be synchronous.
+	// When set, ProcessBatch waits until all the records have been
+	// acknowledged or the passed context is done, whichever happens first.
 	Sync bool
 
 	// TopicRouter returns the topic where an event should be produced.
 	TopicRouter apmqueue.TopicRouter
+	// DefaultTopic, when set, is the topic where the events for which the
+	// TopicRouter returns an empty topic are produced. The number of such
+	// events is recorded in the batch.defaulted span attribute. When empty,
+	// the records of those events fail to be produced.
+	DefaultTopic apmqueue.Topic
+
+	// ValidateEvent, when set, is called with every event before it is
+	// encoded. Events for which it returns an error aren't produced, while
+	// the valid events of the batch still are, and ProcessBatch returns the
+	// validation errors. The number of invalid events is recorded in the
+	// batch.invalid span attribute.
+	ValidateEvent func(model.APMEvent) error
+	// DedupKeyFunc, when set, returns the deduplication key of every event.
+	// ProcessBatch only produces the first event of the batch with a given
+	// key, skipping the duplicates, for example when an upstream retry
+	// resent the events. Events with an empty key are always produced. The
+	// number of skipped events is recorded in the batch.deduplicated span
+	// attribute.
+	DedupKeyFunc func(model.APMEvent) string
+	// SkipEmptyEvents, when set, skips the empty events of the batch instead
+	// of encoding and producing them. An event is empty when it's the zero
+	// value of model.APMEvent, with no field set. The number of skipped
+	// events is recorded in the batch.empty span attribute.
+	SkipEmptyEvents bool
+	// EncodeCacheKeyFunc, when set, returns the identity of every event.
+	// The events of a batch with the same identity are only encoded once,
+	// the following ones reusing the encoded value, for example when the
+	// same event is produced to multiple topics. Events with an empty
+	// identity are always encoded. It's ignored with a BatchEncoder.
+	EncodeCacheKeyFunc func(model.APMEvent) string
 
 	// Mutators holds the list of RecordMutator applied to all the records sent
 	// by the producer. If any errors are returned, the producer will not
 	// produce and return the error in ProcessBatch.
 	Mutators []RecordMutator
+
+	// OnPanic, when set, is called with the value recovered from a panic in
+	// the TopicRouter, the KeyEncoder, the Mutators or the Encoder. The
+	// panic is logged and ProcessBatch returns an error instead of crashing
+	// the process.
+	OnPanic func(v any)
+
+	// BeforeProduce, when set, is called by ProcessBatch and
+	// ProcessBatchAsync with the batch before it's produced, for cross
+	// cutting concerns such as auditing or enriching the trace. ctx holds
+	// the producer span, and the returned context is used to produce the
+	// batch, so the metadata it holds is propagated with the records.
+	BeforeProduce func(ctx context.Context, batch model.Batch) context.Context
+	// AfterProduce, when set, is called with the context returned by
+	// BeforeProduce, the batch and the error ProcessBatch or
+	// ProcessBatchAsync returns for it, nil on success, once the batch has
+	// been produced.
+	AfterProduce func(ctx context.Context, batch model.Batch, err error)
+
+	// StaticMetadata is added as headers to every record produced. Metadata
+	// set in the ProcessBatch context with queuecontext.WithMetadata takes
+	// precedence over StaticMetadata for the same keys.
+	StaticMetadata map[string]string
+	// MetadataAllowList, when set, restricts the metadata keys which are
+	// added as record headers to the listed keys.
+	MetadataAllowList []string
+	// MetadataDenyList holds metadata keys which are never added as record
+	// headers, for example because their values are sensitive. It takes
+	// precedence over MetadataAllowList. KeyFromMetadata may still name a
+	// denied key.
+	MetadataDenyList []string
+	// MetadataMode configures how the metadata is propagated with the
+	// records, as headers by default, or wrapped with the encoded event in
+	// the record value with MetadataEnvelope. The consumers must be
+	// configured with the same ConsumerConfig.MetadataMode.
+	MetadataMode MetadataMode
+
+	// KeyFromMetadata names a metadata key whose value is used as the key of
+	// the produced records, for example a tenant ID, so that all the records
+	// with the same value are produced to the same partition. When the key
+	// isn't present in the metadata, the records are produced without a key,
+	// unless it is set by one of the Mutators.
+	KeyFromMetadata string
+	// KeyEncoder, when set, returns the key of the record produced for each
+	// event, allowing structured keys, such as Protobuf or composite keys.
+	// If it returns an error, only the record of the event fails, like a
+	// record which fails to be produced, and ProcessBatch returns an
+	// *UnackedError holding the event once the other records are produced.
+	// It is mutually exclusive with KeyFromMetadata.
+	KeyEncoder func(model.APMEvent) ([]byte, error)
+	// ConsistentHashing, when set, assigns the records with a key to the
+	// partitions with consistent hashing, rather than with the hash of the
+	// key modulo the number of partitions. When partitions are added to a
+	// topic, a key either stays on its partition or moves to one of the new
+	// partitions, so the records of most keys keep being produced in order
+	// to the same partition. Records without a key are unaffected.
+	ConsistentHashing bool
+	// KeyHasher is the algorithm the keys of the records are hashed with to
+	// select their partition, so that the records with a key are produced
+	// to the same partitions as other producers'. Defaults to
+	// KeyHasherMurmur2. KeyHasherCRC32 is mutually exclusive with
+	// ConsistentHashing.
+	KeyHasher KeyHasher
+
+	// TimestampFunc, when set, returns the timestamp of the record produced
+	// for each event, for example the event time when backfilling. Defaults
+	// to the time the record is produced.
+	TimestampFunc func(model.APMEvent) time.Time
+	// RecordTTLFunc, when set, returns for how long the record produced for
+	// each event remains relevant once produced. The expiry time is stored
+	// in the ExpiresHeader header, and consumers with EnforceRecordTTL set
+	// skip the expired records. Records are produced without an expiry when
+	// it returns a duration which isn't positive.
+	RecordTTLFunc func(model.APMEvent) time.Duration
+	// ClampTimestampsMonotonic clamps the timestamp of the records produced
+	// by ProcessBatch to the latest timestamp produced to the same topic, so
+	// that timestamps never go backwards, for topics whose brokers reject
+	// out-of-order timestamps. Since the partition of a record is only known
+	// once it's produced, timestamps are tracked per topic, which keeps them
+	// monotonic in every partition of the topic. The records of a topic are
+	// clamped and produced one at a time across concurrent ProcessBatch
+	// calls, without holding up the records of other topics.
+	ClampTimestampsMonotonic bool
+
+	// EmitBatchMarker produces a marker record after the records of each
+	// ProcessBatch call to every topic the batch was routed to, so that
+	// downstream processors can tell batch boundaries apart. Marker records
+	// have no value and the BatchMarkerHeader header set to "true". They
+	// aren't tracked as part of the batch, failures are only logged.
+	EmitBatchMarker bool
+	// OrderTopics, when set, orders the records produced by ProcessBatch by
+	// topic: the records routed to each topic are produced, and their
+	// acknowledgement awaited, before the records routed to the next topic
+	// are produced, for downstream joins relying on cross-topic ordering.
+	// Records routed to topics which aren't listed are produced last. The
+	// events are routed, and their order within a topic preserved, before
+	// they're produced.
+	OrderTopics []apmqueue.Topic
+	// SummaryTopic, when set, is the topic a summary record is produced to
+	// after the records of each ProcessBatch call, for auditing purposes.
+	// Its value is the JSON encoded BatchSummary of the produced records.
+	// Summary records aren't tracked as part of the batch, failures are
+	// only logged.
+	SummaryTopic apmqueue.Topic
+
+	// Mirror, when set, synchronously receives the topic and encoded value
+	// of every record before it's produced by ProcessBatch, ProcessRecords
+	// or ProduceRaw. When mirroring fails, the record and the rest of the
+	// batch aren't produced, and a *MirrorError is returned.
+	Mirror MirrorSink
+
+	// AddChecksum adds the checksum of the encoded value of the records
+	// produced by ProcessBatch in the ChecksumHeader header, so consumers
+	// can verify the records weren't corrupted with
+	// ConsumerConfig.VerifyChecksum.
+	AddChecksum bool
+
+	// TracerProvider allows specifying a custom otel tracer provider.
+	// Defaults to the global one.
+	TracerProvider trace.TracerProvider
+	// LinkEventTraces, when set, links the producer.ProcessBatch spans to
+	// the upstream trace of each event, so fan-in workloads can be followed
+	// back to the traces their events originate from. Events in the same
+	// trace share a single link, to the span, transaction or parent of the
+	// first of them, and events without a trace aren't linked.
+	LinkEventTraces bool
+	// PerTopicSpans, when set, creates a producer.Topic child span of the
+	// producer.ProcessBatch span for each topic the batch is produced to,
+	// with the number of records produced to the topic as its batch.size.
+	// The spans end once all the records produced to their topic have been
+	// acknowledged or failed.
+	PerTopicSpans bool
+	// MeterProvider allows specifying a custom otel meter provider.
+	// Defaults to the global one.
+	MeterProvider metric.MeterProvider
+	// LatencyBuckets are the increasing bucket boundaries, in milliseconds,
+	// of the producer.process.duration histogram. Instruments can't select
+	// their own boundaries, so they're applied by the view returned by
+	// LatencyView, which must be registered with the MeterProvider.
+	LatencyBuckets []float64
+
+	// AutoCreateTopics creates the topics the records are produced to, when
+	// they don't exist, the first time the producer produces to them.
+	AutoCreateTopics bool
+	// DefaultPartitions is the number of partitions of the topics created
+	// by AutoCreateTopics. Defaults to the brokers' default.
+	DefaultPartitions int32
+	// DefaultReplication is the replication factor of the topics created by
+	// AutoCreateTopics. Defaults to the brokers' default.
+	DefaultReplication int16
+
+	// Backoff determines how long to wait between retries of failed
+	// requests. Defaults to the Kafka client's backoff.
+	Backoff Backoff
+
+	// Dialer is used to open the connections to the Kafka brokers, for
+	// example to connect through a proxy. Defaults to a TCP dialer.
+	Dialer func(ctx context.Context, network, host string) (net.Conn, error)
+
+	// ConnIdleTimeout is the duration after which idle connections to the
+	// brokers are closed. Defaults to the Kafka client's default (20s).
+	ConnIdleTimeout time.Duration
+	// KeepAlive is the interval between TCP keep-alive probes sent on the
+	// connections to the brokers, which prevents load balancers from
+	// dropping long lived connections. Defaults to the net package default
+	// (15s). It can't be combined with a custom Dialer.
+	KeepAlive time.Duration
 }
 
 // Validate checks that cfg is valid, and returns an error otherwise.
@@ -89,13 +454,288 @@ func (cfg ProducerConfig) Validate() error {
 	if cfg.TopicRouter == nil {
 		err = append(err, errors.New("kafka: topic router must be set"))
 	}
+	switch cfg.Acks {
+	case AcksAll, AcksLeader, AcksNone:
+		if cfg.Acks != AcksAll && !cfg.DisableIdempotentWrite {
+			err = append(err, errors.New("kafka: idempotent writes require AcksAll"))
+		}
+	default:
+		err = append(err, errors.New("kafka: acks is not valid"))
+	}
+	if mmErr := cfg.MetadataMode.valid(); mmErr != nil {
+		err = append(err, mmErr)
+	}
+	if cfg.KeyEncoder != nil && cfg.KeyFromMetadata != "" {
+		err = append(err, errors.New(
+			"kafka: key encoder and key from metadata are mutually exclusive",
+		))
+	}
+	if cfg.MaxBufferedRecords < 0 {
+		err = append(err, errors.New("kafka: max buffered records cannot be negative"))
+	}
+	if cfg.AdaptiveBatching && cfg.SpillDir != "" {
+		err = append(err, errors.New(
+			"kafka: adaptive batching cannot be used with spill dir",
+		))
+	}
+	if cfg.BatchMaxBytes < 0 {
+		err = append(err, errors.New("kafka: batch max bytes cannot be negative"))
+	}
+	if cfg.Linger < 0 {
+		err = append(err, errors.New("kafka: linger cannot be negative"))
+	}
+	if cfg.Linger > 0 && cfg.AdaptiveBatching {
+		err = append(err, errors.New("kafka: linger cannot be used with adaptive batching"))
+	}
+	if cfg.MaxCloseWaitBytes < 0 {
+		err = append(err, errors.New("kafka: max close wait bytes cannot be negative"))
+	}
+	if cfg.MaxCloseWait < 0 {
+		err = append(err, errors.New("kafka: max close wait cannot be negative"))
+	}
+	if cfg.DefaultPartitions < 0 {
+		err = append(err, errors.New("kafka: default partitions cannot be negative"))
+	}
+	if cfg.DefaultReplication < 0 {
+		err = append(err, errors.New("kafka: default replication cannot be negative"))
+	}
+	if (cfg.DefaultPartitions > 0 || cfg.DefaultReplication > 0) && !cfg.AutoCreateTopics {
+		err = append(err, errors.New(
+			"kafka: default partitions and replication require auto create topics",
+		))
+	}
+	if cfg.ConnIdleTimeout < 0 {
+		err = append(err, errors.New("kafka: conn idle timeout cannot be negative"))
+	}
+	if cfg.KeepAlive < 0 {
+		err = append(err, errors.New("kafka: keep alive cannot be negative"))
+	}
+	switch cfg.KeyHasher {
+	case KeyHasherMurmur2:
+	case KeyHasherCRC32:
+		if cfg.ConsistentHashing {
+			err = append(err, errors.New(
+				"kafka: crc32 key hasher and consistent hashing are mutually exclusive",
+			))
+		}
+	default:
+		err = append(err, errors.New("kafka: key hasher is not valid"))
+	}
+	if cfg.BestEffortTimeout < 0 {
+		err = append(err, errors.New("kafka: best effort timeout cannot be negative"))
+	}
+	if cfg.KeepAlive > 0 && cfg.Dialer != nil {
+		err = append(err, errors.New("kafka: keep alive cannot be set with a custom dialer"))
+	}
+	for i := 1; i < len(cfg.LatencyBuckets); i++ {
+		if cfg.LatencyBuckets[i] <= cfg.LatencyBuckets[i-1] {
+			err = append(err, errors.New("kafka: latency buckets must be increasing"))
+			break
+		}
+	}
+	return errors.Join(err...)
+}
+
+// reconfigurable returns an error for each field which next changes and which
+// Reconfigure can't apply to a running producer.
+func (cfg ProducerConfig) reconfigurable(next ProducerConfig) error {
+	if cfg.AdaptiveBatching {
+		return errors.New("kafka: producers with adaptive batching cannot be reconfigured")
+	}
+	var err []error
+	for _, field := range []struct {
+		name    string
+		changed bool
+	}{
+		{"broker", cfg.Broker != next.Broker},
+		{"client id", cfg.ClientID != next.ClientID},
+		{"version", cfg.Version != next.Version},
+		{"acks", cfg.Acks != next.Acks},
+		{"disable idempotent write", cfg.DisableIdempotentWrite != next.DisableIdempotentWrite},
+		{"max buffered records", cfg.MaxBufferedRecords != next.MaxBufferedRecords},
+		{"spill dir", cfg.SpillDir != next.SpillDir},
+		{"adaptive batching", cfg.AdaptiveBatching != next.AdaptiveBatching},
+		{"auto tune", cfg.AutoTune != next.AutoTune},
+		{"conn idle timeout", cfg.ConnIdleTimeout != next.ConnIdleTimeout},
+		{"keep alive", cfg.KeepAlive != next.KeepAlive},
+	} {
+		if field.changed {
+			err = append(err, fmt.Errorf("kafka: %s cannot be reconfigured", field.name))
+		}
+	}
 	return errors.Join(err...)
 }
 
+// clientOpts returns the options of the Kafka client, except the ones used by
+// adaptive batching.
+func (cfg ProducerConfig) clientOpts() []kgo.Opt {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Broker),
+		kgo.WithLogger(kzap.New(cfg.Logger)),
+		kgo.RequiredAcks(cfg.Acks.kgoAcks()),
+	}
+	if cfg.DisableIdempotentWrite {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	if len(cfg.Compression) > 0 {
+		opts = append(opts, kgo.ProducerBatchCompression(cfg.Compression...))
+	}
+	if cfg.Linger > 0 {
+		opts = append(opts, kgo.ProducerLinger(cfg.Linger))
+	}
+	if cfg.BatchMaxBytes > 0 {
+		opts = append(opts, kgo.ProducerBatchMaxBytes(cfg.BatchMaxBytes))
+	}
+	if cfg.Backoff != nil {
+		opts = append(opts, kgo.RetryBackoffFn(cfg.Backoff.NextBackoff))
+	}
+	if cfg.MaxBufferedRecords > 0 {
+		opts = append(opts, kgo.MaxBufferedRecords(cfg.MaxBufferedRecords))
+	}
+	if dialer := cfg.dialer(); dialer != nil {
+		opts = append(opts, kgo.Dialer(dialer))
+	}
+	if cfg.ConnIdleTimeout > 0 {
+		opts = append(opts, kgo.ConnIdleTimeout(cfg.ConnIdleTimeout))
+	}
+	if cfg.MinKafkaVersion != nil {
+		opts = append(opts, kgo.MinVersions(cfg.MinKafkaVersion))
+	}
+	if partitioner := cfg.partitioner(); partitioner != nil {
+		opts = append(opts, kgo.RecordPartitioner(partitioner))
+	}
+	if cfg.BestEffort {
+		timeout := cfg.BestEffortTimeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		opts = append(opts, kgo.RecordDeliveryTimeout(timeout))
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+		if cfg.Version != "" {
+			opts = append(opts, kgo.SoftwareNameAndVersion(
+				cfg.ClientID, cfg.Version,
+			))
+		}
+	}
+	return opts
+}
+
+// dialer returns the function used to dial the brokers, or nil to use the
+// Kafka client's default dialer.
+func (cfg ProducerConfig) dialer() func(ctx context.Context, network, host string) (net.Conn, error) {
+	if cfg.Dialer != nil {
+		return cfg.Dialer
+	}
+	if cfg.KeepAlive > 0 {
+		// Match the Kafka client's default dial timeout.
+		d := net.Dialer{Timeout: 10 * time.Second, KeepAlive: cfg.KeepAlive}
+		return d.DialContext
+	}
+	return nil
+}
+
+// UnackedError is returned by ProcessBatch and ProcessRecords in Sync mode
+// when the context is done before all the records have been acknowledged by
+// Kafka, and by ProcessBatchAsync when records fail to be produced.
+type UnackedError struct {
+	// Err is the context error which caused ProcessBatch to return, or the
+	// first produce error for ProcessBatchAsync.
+	Err error
+	// Events holds the events whose records weren't acknowledged. Only set
+	// by ProcessBatch and ProcessBatchAsync.
+	Events model.Batch
+	// Records holds the records which weren't acknowledged. Only set by
+	// ProcessRecords.
+	Records []*kgo.Record
+}
+
+func (e *UnackedError) Error() string {
+	return fmt.Sprintf("kafka: %d records not acknowledged: %s",
+		len(e.Events)+len(e.Records), e.Err,
+	)
+}
+
+// Unwrap returns the context error.
+func (e *UnackedError) Unwrap() error {
+	return e.Err
+}
+
+// ErrProducerFenced is wrapped by the errors of the records which fail to be
+// produced because a producer with the same producer ID and a newer epoch
+// fenced this one. The producer can't recover from it, and must be
+// recreated, or reconfigured, which creates a new client. The underlying
+// kerr.ProducerFenced or kerr.InvalidProducerEpoch error is wrapped too.
+var ErrProducerFenced = errors.New("kafka: producer fenced")
+
+// MirrorError is returned by ProcessBatch, ProcessRecords and ProduceRaw when
+// a record fails to be mirrored to the configured MirrorSink.
+type MirrorError struct {
+	// Topic is the topic of the record which failed to be mirrored.
+	Topic apmqueue.Topic
+	// Err is the error returned by the MirrorSink.
+	Err error
+}
+
+func (e *MirrorError) Error() string {
+	return fmt.Sprintf("kafka: failed to mirror record for topic %s: %s", e.Topic, e.Err)
+}
+
+// Unwrap returns the MirrorSink error.
+func (e *MirrorError) Unwrap() error {
+	return e.Err
+}
+
 // Producer is a model.BatchProcessor that publishes events to Kafka.
 type Producer struct {
 	cfg    ProducerConfig
 	client *kgo.Client
+	tracer trace.Tracer
+	// produced counts the acknowledged records by topic and partition.
+	produced instrument.Int64Counter
+	// processDuration records how long ProcessBatch takes.
+	processDuration instrument.Float64Histogram
+	// produce asynchronously produces a record, calling promise once it has
+	// been acknowledged or has failed.
+	produce func(context.Context, *kgo.Record, func(*kgo.Record, error))
+
+	// createTopics issues a request creating topics, used by
+	// AutoCreateTopics.
+	createTopics func(context.Context, *kmsg.CreateTopicsRequest) (*kmsg.CreateTopicsResponse, error)
+	// topicsMu guards topics, which holds the topics known to exist when
+	// AutoCreateTopics is set.
+	topicsMu sync.Mutex
+	topics   map[string]struct{}
+
+	// timestampsMu guards timestamps, which holds the latest timestamp
+	// produced to each topic when ClampTimestampsMonotonic is set.
+	timestampsMu sync.Mutex
+	timestamps   map[string]*topicTimestamp
+
+	// bufferedRecords and bufferedBytes track the records produced which
+	// haven't been acknowledged or failed yet, used by Close.
+	bufferedRecords atomic.Int64
+	bufferedBytes   atomic.Int64
+
+	// fenced is set once a record fails with ErrProducerFenced, until
+	// Reconfigure replaces the client.
+	fenced atomic.Bool
+
+	// spill holds the records spilled to SpillDir, nil when not set.
+	// replayMu serializes ReplaySpilled calls.
+	spill    *spill
+	replayMu sync.Mutex
+
+	// adaptive adapts the batching to the brokers throttling, nil unless
+	// AdaptiveBatching is set. stopFlusher stops its flusher, and
+	// flusherDone is closed once it has stopped.
+	adaptive    *adaptiveBatching
+	stopFlusher context.CancelFunc
+	flusherDone chan struct{}
+
+	// autoTune limits the records in flight, nil unless AutoTune is set.
+	autoTune *autoTune
 
 	mu sync.RWMutex
 }
@@ -106,17 +746,35 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 		return nil, fmt.Errorf("invalid producer config: %w", err)
 	}
 
-	opts := []kgo.Opt{
-		kgo.SeedBrokers(cfg.Broker),
-		kgo.WithLogger(kzap.New(cfg.Logger)),
+	opts := cfg.clientOpts()
+	var adaptive *adaptiveBatching
+	if cfg.AdaptiveBatching {
+		adaptive = newAdaptiveBatching(cfg.MaxBufferedRecords)
+		// Records are flushed by the adaptive batching flusher. Produce fails
+		// rather than blocking when the buffer is full while flushing
+		// manually, so the buffered records are limited by the producer.
+		opts = append(opts,
+			kgo.ManualFlushing(),
+			kgo.MaxBufferedRecords(math.MaxInt32),
+			kgo.WithHooks(adaptive),
+		)
 	}
-	if cfg.ClientID != "" {
-		opts = append(opts, kgo.ClientID(cfg.ClientID))
-		if cfg.Version != "" {
-			opts = append(opts, kgo.SoftwareNameAndVersion(
-				cfg.ClientID, cfg.Version,
-			))
-		}
+	mp := cfg.MeterProvider
+	if mp == nil {
+		mp = global.MeterProvider()
+	}
+	produced, err := mp.Meter("kafka").Int64Counter("producer.records.produced",
+		instrument.WithDescription("The number of records acknowledged by the brokers"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	processDuration, err := mp.Meter("kafka").Float64Histogram(processDurationName,
+		instrument.WithDescription("The time taken by ProcessBatch to produce a batch"),
+		instrument.WithUnit("ms"),
+	)
+	if err != nil {
+		return nil, err
 	}
 	// TODO(marclop) block on re-balances, auto-commit high watermarks.
 	client, err := kgo.NewClient(opts...)
@@ -126,21 +784,293 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 	// Issue a metadata refresh request on construction, so the broker list is
 	// populated.
 	client.ForceMetadataRefresh()
+	if cfg.MinKafkaVersion != nil {
+		if err := checkMinVersion(context.Background(), client, cfg.MinKafkaVersion); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed creating producer: %w", err)
+		}
+	}
+	if cfg.AutoSplitBatches {
+		maxBytes, err := brokerMaxMessageBytes(context.Background(), client)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed creating producer: %w", err)
+		}
+		if cfg.BatchMaxBytes == 0 || maxBytes < cfg.BatchMaxBytes {
+			// The client options can't be changed once it's created.
+			client.Close()
+			cfg.BatchMaxBytes = maxBytes
+			opts = append(opts, kgo.ProducerBatchMaxBytes(maxBytes))
+			if client, err = kgo.NewClient(opts...); err != nil {
+				return nil, fmt.Errorf("failed creating producer: %w", err)
+			}
+			client.ForceMetadataRefresh()
+		}
+	}
+	if cfg.EagerConnect {
+		ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout)
+		err := warmup(ctx, client)
+		cancel()
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed creating producer: %w", err)
+		}
+	}
+
+	tp := cfg.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	p := &Producer{
+		cfg:             cfg,
+		client:          client,
+		tracer:          tp.Tracer("kafka"),
+		produced:        produced,
+		processDuration: processDuration,
+		topics:          make(map[string]struct{}),
+		timestamps:      make(map[string]*topicTimestamp),
+	}
+	p.createTopics = func(ctx context.Context, req *kmsg.CreateTopicsRequest) (*kmsg.CreateTopicsResponse, error) {
+		return req.RequestWith(ctx, p.client)
+	}
+	p.produce = p.trackBuffered(p.clientProduce)
+	if cfg.SpillDir != "" {
+		if p.spill, err = newSpill(cfg.SpillDir); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed creating spill dir: %w", err)
+		}
+		p.produce = p.trackBuffered(p.spillOnFull(p.clientTryProduce))
+	}
+	if adaptive != nil {
+		p.adaptive = adaptive
+		p.produce = p.trackBuffered(p.adaptiveProduce(client.Produce))
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stopFlusher, p.flusherDone = cancel, make(chan struct{})
+		go func() {
+			defer close(p.flusherDone)
+			adaptive.run(ctx, client.Flush)
+		}()
+	}
+	if cfg.AutoTune {
+		p.autoTune = newAutoTune(cfg.MaxBufferedRecords)
+		p.produce = p.autoTuneProduce(p.produce)
+	}
+	return p, nil
+}
+
+// clientProduce produces r through the current client, which Reconfigure may
+// replace. It must be called with p.mu held.
+func (p *Producer) clientProduce(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+	p.client.Produce(ctx, r, p.fencingPromise(promise))
+}
+
+// clientTryProduce is like clientProduce, but fails the record with
+// kgo.ErrMaxBuffered rather than blocking when the client buffer is full.
+func (p *Producer) clientTryProduce(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+	p.client.TryProduce(ctx, r, p.fencingPromise(promise))
+}
+
+// fencingPromise wraps promise to wrap the fencing errors of the client with
+// ErrProducerFenced, and report the producer as fenced.
+func (p *Producer) fencingPromise(promise func(*kgo.Record, error)) func(*kgo.Record, error) {
+	return func(r *kgo.Record, err error) {
+		if errors.Is(err, kerr.ProducerFenced) || errors.Is(err, kerr.InvalidProducerEpoch) {
+			p.fenced.Store(true)
+			err = fmt.Errorf("%w: %w", ErrProducerFenced, err)
+		}
+		promise(r, err)
+	}
+}
+
+// Reconfigure applies the Compression and Linger of cfg to the producer
+// without losing the buffered records: the records produced from then on are
+// buffered by a new client, while the records buffered by the previous one are
+// delivered before it's closed. It waits for them up to MaxCloseWait, when the
+// previous client is closed and its undelivered records fail. It returns an
+// error when cfg changes fields, such as Broker, which require creating a new
+// producer, and ignores the other changes.
+func (p *Producer) Reconfigure(cfg ProducerConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid producer config: %w", err)
+	}
+	p.mu.Lock()
+	if err := p.cfg.reconfigurable(cfg); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	next := p.cfg
+	next.Compression, next.Linger = cfg.Compression, cfg.Linger
+	client, err := kgo.NewClient(next.clientOpts()...)
+	if err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("failed reconfiguring producer: %w", err)
+	}
+	client.ForceMetadataRefresh()
+	prev := p.client
+	// Only the fields read when creating the client are updated, since the
+	// others may be read concurrently by the records promises.
+	p.cfg.Compression, p.cfg.Linger = next.Compression, next.Linger
+	p.client = client
+	p.fenced.Store(false)
+	p.mu.Unlock()
 
-	return &Producer{
-		cfg:    cfg,
-		client: client,
-	}, nil
+	defer prev.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.maxCloseWait())
+	defer cancel()
+	if err := prev.Flush(ctx); err != nil {
+		return fmt.Errorf("failed to flush records buffered before reconfiguring: %w", err)
+	}
+	return nil
 }
 
-// Close stops the producer
+// flush waits for the buffered records to be acknowledged or to fail.
+func (p *Producer) flush(ctx context.Context) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.client.Flush(ctx)
+}
+
+// Close stops the producer. When MaxCloseWaitBytes is set, it first waits up
+// to MaxCloseWait for the buffered records to be delivered, unless they
+// exceed it.
 func (p *Producer) Close() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	var err error
+	if p.cfg.MaxCloseWaitBytes > 0 {
+		err = p.drain()
+	}
+	if p.adaptive != nil {
+		p.stopFlusher()
+		<-p.flusherDone
+	}
 	p.client.Close()
+	if p.spill != nil {
+		if spillErr := p.spill.close(); spillErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close spill file: %w", spillErr))
+		}
+	}
+	return err
+}
+
+// drain waits up to MaxCloseWait for the buffered records to be delivered
+// when their size is within MaxCloseWaitBytes, and returns an error reporting
+// the undelivered records otherwise.
+func (p *Producer) drain() error {
+	records, bytes := p.bufferedRecords.Load(), p.bufferedBytes.Load()
+	if bytes > p.cfg.MaxCloseWaitBytes {
+		return fmt.Errorf(
+			"kafka: closing with %d undelivered records (%d bytes), exceeding max close wait bytes (%d)",
+			records, bytes, p.cfg.MaxCloseWaitBytes,
+		)
+	}
+	wait := p.cfg.maxCloseWait()
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	if err := p.client.Flush(ctx); err != nil {
+		records, bytes := p.bufferedRecords.Load(), p.bufferedBytes.Load()
+		return fmt.Errorf(
+			"kafka: closing with %d undelivered records (%d bytes), exceeding max close wait (%s)",
+			records, bytes, wait,
+		)
+	}
 	return nil
 }
 
+// defaultMaxCloseWait is the time Close waits for the buffered records to be
+// delivered when MaxCloseWait isn't set.
+const defaultMaxCloseWait = 10 * time.Second
+
+// maxCloseWait returns MaxCloseWait, or its default when it isn't set.
+func (cfg ProducerConfig) maxCloseWait() time.Duration {
+	if cfg.MaxCloseWait == 0 {
+		return defaultMaxCloseWait
+	}
+	return cfg.MaxCloseWait
+}
+
+// trackBuffered wraps produce, keeping track of the number and size of the
+// records which are waiting to be acknowledged.
+func (p *Producer) trackBuffered(
+	produce func(context.Context, *kgo.Record, func(*kgo.Record, error)),
+) func(context.Context, *kgo.Record, func(*kgo.Record, error)) {
+	return func(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		size := recordSize(r)
+		p.bufferedRecords.Add(1)
+		p.bufferedBytes.Add(size)
+		produce(ctx, r, func(r *kgo.Record, err error) {
+			p.bufferedRecords.Add(-1)
+			p.bufferedBytes.Add(-size)
+			promise(r, err)
+		})
+	}
+}
+
+// recordSize returns the size of the key, value and headers of r.
+func recordSize(r *kgo.Record) int64 {
+	size := len(r.Key) + len(r.Value)
+	for _, h := range r.Headers {
+		size += len(h.Key) + len(h.Value)
+	}
+	return int64(size)
+}
+
+// spanOptions returns the options of the span covering the production of
+// batch, linking it to the traces of the events when LinkEventTraces is set.
+func (p *Producer) spanOptions(batch model.Batch) []trace.SpanStartOption {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.Int("batch.size", len(batch))),
+	}
+	if p.cfg.LinkEventTraces {
+		opts = append(opts, trace.WithLinks(eventLinks(batch)...))
+	}
+	return opts
+}
+
+// eventLinks returns a link to each distinct trace of the events in batch.
+func eventLinks(batch model.Batch) []trace.Link {
+	var links []trace.Link
+	var seen map[trace.TraceID]struct{}
+	for _, event := range batch {
+		traceID, err := trace.TraceIDFromHex(event.Trace.ID)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[traceID]; ok {
+			continue
+		}
+		spanID, err := trace.SpanIDFromHex(eventSpanID(event))
+		if err != nil {
+			continue
+		}
+		if seen == nil {
+			seen = make(map[trace.TraceID]struct{})
+		}
+		seen[traceID] = struct{}{}
+		links = append(links, trace.Link{
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID: traceID,
+				SpanID:  spanID,
+				Remote:  true,
+			}),
+		})
+	}
+	return links
+}
+
+// eventSpanID returns the ID of the span or transaction described by event,
+// or the ID of its parent for other events, such as errors.
+func eventSpanID(event model.APMEvent) string {
+	switch {
+	case event.Span != nil && event.Span.ID != "":
+		return event.Span.ID
+	case event.Transaction != nil && event.Transaction.ID != "":
+		return event.Transaction.ID
+	}
+	return event.Parent.ID
+}
+
 // ProcessBatch publishes the events in batch to the specified Kafka topic.
 func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 	// Take a read lock to prevent Close from closing the client
@@ -148,52 +1078,863 @@ func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	var headers []kgo.RecordHeader
-	if m, ok := queuecontext.MetadataFromContext(ctx); ok {
-		for k, v := range m {
-			headers = append(headers, kgo.RecordHeader{
-				Key:   k,
-				Value: []byte(v),
+	ctx, span := p.tracer.Start(ctx, "producer.ProcessBatch", p.spanOptions(*batch)...)
+	defer span.End()
+	defer func(start time.Time) {
+		p.processDuration.Record(ctx, float64(time.Since(start))/float64(time.Millisecond))
+	}(time.Now())
+
+	ctx = p.beforeProduce(ctx, *batch)
+	return p.afterProduce(ctx, *batch, p.processBatch(ctx, span, batch))
+}
+
+// processBatch produces the batch for ProcessBatch, waiting for the records
+// to be acknowledged when Sync is set.
+func (p *Producer) processBatch(ctx context.Context, span trace.Span, batch *model.Batch) error {
+	pb, err := p.produceBatch(ctx, span, *batch)
+	if err != nil {
+		return spanError(span, err)
+	}
+	if !p.cfg.Sync {
+		if pb.produced < len(pb.events) {
+			return batchError(span, pb.invalid, &UnackedError{
+				Err:    ctx.Err(),
+				Events: append(pb.eventsAt(pb.unkeyed), pb.events[pb.produced:]...),
 			})
 		}
+		return batchError(span, pb.invalid, pb.keyError())
+	}
+	if unacked := pb.acks.wait(ctx); len(unacked) > 0 {
+		return batchError(span, pb.invalid, &UnackedError{
+			Err:    ctx.Err(),
+			Events: pb.eventsAt(unacked),
+		})
+	}
+	return batchError(span, pb.invalid, pb.keyError())
+}
+
+// ProcessBatchAsync encodes, routes and produces the events in batch like
+// ProcessBatch, regardless of Sync, and returns a channel which receives a
+// single value once all the records have been acknowledged, failed, or ctx
+// is done: nil on success, or the error. When records fail to be produced,
+// the error is an *UnackedError holding the failed events and the first
+// produce error. Errors which stop the batch from being produced, such as
+// encoding errors, are sent before ProcessBatchAsync returns.
+func (p *Producer) ProcessBatchAsync(ctx context.Context, batch *model.Batch) <-chan error {
+	result := make(chan error, 1)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ctx, span := p.tracer.Start(ctx, "producer.ProcessBatchAsync", p.spanOptions(*batch)...)
+	events := *batch
+	ctx = p.beforeProduce(ctx, events)
+	pb, err := p.produceBatch(ctx, span, events)
+	if err != nil {
+		result <- p.afterProduce(ctx, events, spanError(span, err))
+		span.End()
+		return result
+	}
+	if pb.produced < len(pb.events) {
+		result <- p.afterProduce(ctx, events, batchError(span, pb.invalid, &UnackedError{
+			Err:    ctx.Err(),
+			Events: append(pb.eventsAt(pb.unkeyed), pb.events[pb.produced:]...),
+		}))
+		span.End()
+		return result
+	}
+	go func() {
+		defer span.End()
+		if unacked := pb.acks.wait(ctx); len(unacked) > 0 {
+			result <- p.afterProduce(ctx, events, batchError(span, pb.invalid, &UnackedError{
+				Err:    ctx.Err(),
+				Events: pb.eventsAt(unacked),
+			}))
+			return
+		}
+		if failed, err := pb.acks.failed(); len(failed) > 0 {
+			result <- p.afterProduce(ctx, events, batchError(span, pb.invalid, &UnackedError{
+				Err:    err,
+				Events: pb.eventsAt(failed),
+			}))
+			return
+		}
+		result <- p.afterProduce(ctx, events, batchError(span, pb.invalid, nil))
+	}()
+	return result
+}
+
+// beforeProduce calls BeforeProduce with the batch, if set, and returns the
+// context to produce the batch with.
+func (p *Producer) beforeProduce(ctx context.Context, batch model.Batch) context.Context {
+	if p.cfg.BeforeProduce == nil {
+		return ctx
 	}
+	return p.cfg.BeforeProduce(ctx, batch)
+}
+
+// afterProduce calls AfterProduce with the batch and its error, if set, and
+// returns the error.
+func (p *Producer) afterProduce(ctx context.Context, batch model.Batch, err error) error {
+	if p.cfg.AfterProduce != nil {
+		p.cfg.AfterProduce(ctx, batch, err)
+	}
+	return err
+}
 
-	var wg sync.WaitGroup
-	wg.Add(len(*batch))
-	for _, event := range *batch {
-		record := &kgo.Record{
-			Headers: headers,
-			Topic:   string(p.cfg.TopicRouter(event)),
+// producedBatch holds the state of the records produced for a batch.
+type producedBatch struct {
+	// events holds the valid events of the batch.
+	events model.Batch
+	// invalid holds the validation errors of the invalid events.
+	invalid []error
+	// acks tracks the acknowledgement of the records of events.
+	acks *ackTracker
+	// produced is the number of events whose records were produced, or
+	// failed to be keyed, which is lower than the number of events if the
+	// context was done.
+	produced int
+	// unkeyed holds the indices of the events whose KeyEncoder failed, and
+	// keyErr the first of the errors.
+	unkeyed []int
+	keyErr  error
+	// defaulted is the number of events produced to the DefaultTopic.
+	defaulted int
+}
+
+// keyError returns an *UnackedError holding the events whose KeyEncoder
+// failed, or nil if none did.
+func (pb *producedBatch) keyError() error {
+	if len(pb.unkeyed) == 0 {
+		return nil
+	}
+	return &UnackedError{Err: pb.keyErr, Events: pb.eventsAt(pb.unkeyed)}
+}
+
+// eventsAt returns the events at the given indices.
+func (pb *producedBatch) eventsAt(indices []int) model.Batch {
+	events := make(model.Batch, 0, len(indices))
+	for _, i := range indices {
+		events = append(events, pb.events[i])
+	}
+	return events
+}
+
+// produceBatch validates, encodes and asynchronously produces the events in
+// batch, until ctx is done.
+func (p *Producer) produceBatch(ctx context.Context, span trace.Span, batch model.Batch) (*producedBatch, error) {
+	var headers []kgo.RecordHeader
+	var key []byte
+	var metadata map[string]string
+	for k, v := range p.metadata(ctx) {
+		if p.cfg.KeyFromMetadata != "" && k == p.cfg.KeyFromMetadata {
+			key = []byte(v)
+		}
+		if !p.propagateMetadata(k) {
+			continue
 		}
-		for _, rm := range p.cfg.Mutators {
-			if err := rm(event, record); err != nil {
-				return fmt.Errorf("failed to apply record mutator: %w", err)
+		if p.cfg.MetadataMode == MetadataEnvelope {
+			if metadata == nil {
+				metadata = make(map[string]string)
 			}
+			metadata[k] = v
+			continue
+		}
+		headers = append(headers, kgo.RecordHeader{
+			Key:   k,
+			Value: []byte(v),
+		})
+	}
+	// Only propagate the trace context when the span is sampled, otherwise
+	// the consumers would create spans for traces which aren't kept.
+	if span.SpanContext().IsSampled() {
+		propagation.TraceContext{}.Inject(ctx, headerCarrier{&headers})
+	}
+
+	pb := producedBatch{}
+	pb.events, pb.invalid = p.validate(span, p.skipEmpty(span, batch))
+	pb.events = p.deduplicate(span, pb.events)
+	var order *topicOrder
+	var err error
+	if pb.events, order, err = p.orderTopics(pb.events); err != nil {
+		return nil, err
+	}
+
+	// Events are encoded and produced one at a time, so a large batch isn't
+	// encoded up front. Produce blocks while the client has MaxBufferedRecords
+	// buffered, which bounds the memory used by the encoded records. Only a
+	// BatchEncoder encodes the whole batch up front.
+	var values [][]byte
+	if encoder, ok := p.cfg.Encoder.(BatchEncoder); ok {
+		if values, err = p.encodeBatch(encoder, pb.events); err != nil {
+			return nil, err
+		}
+	}
+	var encoded map[string][]byte
+	if p.cfg.EncodeCacheKeyFunc != nil && values == nil {
+		encoded = make(map[string][]byte)
+	}
+	pb.acks = newAckTracker(len(pb.events))
+	spans := p.newTopicSpans(ctx)
+	defer spans.done()
+	var topics []string
+	var summary *BatchSummary
+	if p.cfg.SummaryTopic != "" {
+		summary = &BatchSummary{EventTypes: make(map[string]int)}
+	}
+	for i, event := range pb.events {
+		if ctx.Err() != nil {
+			// Stop producing once the context is done, the remaining events
+			// are reported as not acknowledged.
+			break
+		}
+		if !order.ready(ctx, i) {
+			// The context is done while the records of the previous topic
+			// are produced.
+			break
+		}
+		var value []byte
+		var identity string
+		if values != nil {
+			value = values[i]
+		} else if encoded != nil {
+			if identity = p.cfg.EncodeCacheKeyFunc(event); identity != "" {
+				value = encoded[identity]
+			}
+		}
+		record, defaulted, err := p.newRecord(event, value, key, headers)
+		var keyErr *keyError
+		if errors.As(err, &keyErr) {
+			// Only the record of the event fails, like when it fails to
+			// be produced, rather than the whole batch.
+			p.promise(pb.acks, i, EventType(event))(&kgo.Record{Topic: keyErr.topic}, err)
+			if pb.keyErr == nil {
+				pb.keyErr = err
+			}
+			pb.unkeyed = append(pb.unkeyed, i)
+			pb.produced++
+			continue
 		}
-		encoded, err := p.cfg.Encoder.Encode(event)
 		if err != nil {
-			return fmt.Errorf("failed to encode event: %w", err)
+			return nil, err
+		}
+		if identity != "" && value == nil {
+			encoded[identity] = record.Value
+		}
+		if p.cfg.MetadataMode == MetadataEnvelope {
+			if record.Value, err = wrapEnvelope(metadata, record.Value); err != nil {
+				return nil, fmt.Errorf("failed to wrap event: %w", err)
+			}
+		}
+		if defaulted {
+			pb.defaulted++
+		}
+		if err := p.ensureTopic(ctx, record.Topic); err != nil {
+			return nil, err
+		}
+		if err := p.mirror(record); err != nil {
+			return nil, err
+		}
+		eventType := EventType(event)
+		promise := spans.promise(record.Topic,
+			order.promise(p.promise(pb.acks, i, eventType)),
+		)
+		if p.cfg.ClampTimestampsMonotonic {
+			p.produceClamped(ctx, record, promise)
+		} else {
+			p.produce(ctx, record, promise)
+		}
+		pb.produced++
+		if summary != nil {
+			summary.add(eventType, record)
+		}
+		if p.cfg.EmitBatchMarker && !containsString(topics, record.Topic) {
+			topics = append(topics, record.Topic)
+		}
+	}
+	// The events which weren't produced because the context is done are
+	// finished, so waiting for the acknowledgements doesn't block forever.
+	for i := pb.produced; i < len(pb.events); i++ {
+		pb.acks.done(i, ctx.Err())
+	}
+	if p.cfg.DefaultTopic != "" {
+		span.SetAttributes(attribute.Int("batch.defaulted", pb.defaulted))
+	}
+	if pb.produced == len(pb.events) {
+		for _, topic := range topics {
+			p.produce(ctx, &kgo.Record{
+				Topic: topic,
+				Headers: append(headers[:len(headers):len(headers)], kgo.RecordHeader{
+					Key:   BatchMarkerHeader,
+					Value: []byte("true"),
+				}),
+			}, p.markerPromise)
+		}
+		if summary != nil {
+			p.produceSummary(ctx, summary, headers)
+		}
+	}
+	return &pb, nil
+}
+
+// skipEmpty returns the events of batch which aren't empty, when
+// SkipEmptyEvents is set.
+func (p *Producer) skipEmpty(span trace.Span, batch model.Batch) model.Batch {
+	if !p.cfg.SkipEmptyEvents {
+		return batch
+	}
+	events := make(model.Batch, 0, len(batch))
+	for i := range batch {
+		if emptyEvent(&batch[i]) {
+			continue
+		}
+		events = append(events, batch[i])
+	}
+	span.SetAttributes(attribute.Int("batch.empty", len(batch)-len(events)))
+	return events
+}
+
+// emptyEvent returns whether event is the zero value of model.APMEvent.
+func emptyEvent(event *model.APMEvent) bool {
+	return reflect.ValueOf(event).Elem().IsZero()
+}
+
+// validate returns the events of batch which are valid according to
+// ValidateEvent, and the validation errors of the invalid ones.
+func (p *Producer) validate(span trace.Span, batch model.Batch) (model.Batch, []error) {
+	if p.cfg.ValidateEvent == nil {
+		return batch, nil
+	}
+	valid := make(model.Batch, 0, len(batch))
+	var invalid []error
+	for _, event := range batch {
+		if err := p.cfg.ValidateEvent(event); err != nil {
+			invalid = append(invalid, fmt.Errorf("kafka: invalid event: %w", err))
+			continue
+		}
+		valid = append(valid, event)
+	}
+	span.SetAttributes(attribute.Int("batch.invalid", len(invalid)))
+	return valid, invalid
+}
+
+// deduplicate returns the events of batch whose DedupKeyFunc key didn't
+// appear in a previous event of the batch.
+func (p *Producer) deduplicate(span trace.Span, batch model.Batch) model.Batch {
+	if p.cfg.DedupKeyFunc == nil {
+		return batch
+	}
+	seen := make(map[string]struct{}, len(batch))
+	unique := make(model.Batch, 0, len(batch))
+	for _, event := range batch {
+		if key := p.cfg.DedupKeyFunc(event); key != "" {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+		}
+		unique = append(unique, event)
+	}
+	span.SetAttributes(attribute.Int("batch.deduplicated", len(batch)-len(unique)))
+	return unique
+}
+
+// batchError returns the validation errors of the batch joined with err, if
+// any, and records them in the span.
+func batchError(span trace.Span, invalid []error, err error) error {
+	if err != nil {
+		invalid = append(invalid, err)
+	}
+	switch len(invalid) {
+	case 0:
+		return nil
+	case 1:
+		return spanError(span, invalid[0])
+	}
+	return spanError(span, errors.Join(invalid...))
+}
+
+// encodeBatch encodes the events with encoder, making sure it returns a
+// value for every event. Panics in EncodeBatch are recovered and returned as
+// errors.
+func (p *Producer) encodeBatch(encoder BatchEncoder, events model.Batch) (values [][]byte, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			values, err = nil, p.recovered(v)
+		}
+	}()
+	if values, err = encoder.EncodeBatch(events); err != nil {
+		return nil, fmt.Errorf("failed to encode batch: %w", err)
+	}
+	if len(values) != len(events) {
+		return nil, fmt.Errorf("failed to encode batch: encoded %d of %d events",
+			len(values), len(events),
+		)
+	}
+	for i, value := range values {
+		if value == nil {
+			// nil tells newRecord to encode the event itself.
+			values[i] = []byte{}
+		}
+	}
+	return values, nil
+}
+
+// keyError is returned by newRecord when the KeyEncoder fails, which only
+// fails the record of the event.
+type keyError struct {
+	topic string
+	err   error
+}
+
+func (e *keyError) Error() string {
+	return fmt.Sprintf("failed to encode key: %s", e.err)
+}
+
+func (e *keyError) Unwrap() error {
+	return e.err
+}
+
+// newRecord routes, keys, timestamps, mutates and encodes event into a new
+// record, and reports whether it was routed to the DefaultTopic. When encoded
+// is not nil, it's used as the record value instead of encoding event. Panics
+// in the user supplied TopicRouter, KeyEncoder, Mutators and Encoder are
+// recovered and returned as errors. KeyEncoder errors are *keyError.
+func (p *Producer) newRecord(event model.APMEvent, encoded, key []byte, headers []kgo.RecordHeader) (record *kgo.Record, defaulted bool, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			record, defaulted, err = nil, false, p.recovered(v)
+		}
+	}()
+	topic := p.cfg.TopicRouter(event)
+	if topic == "" && p.cfg.DefaultTopic != "" {
+		topic, defaulted = p.cfg.DefaultTopic, true
+	}
+	record = &kgo.Record{
+		Key:     key,
+		Headers: headers,
+		Topic:   string(topic),
+	}
+	if p.cfg.KeyEncoder != nil {
+		if record.Key, err = p.cfg.KeyEncoder(event); err != nil {
+			return nil, false, &keyError{topic: record.Topic, err: err}
+		}
+	}
+	if p.cfg.TimestampFunc != nil {
+		record.Timestamp = p.cfg.TimestampFunc(event)
+	}
+	if p.cfg.RecordTTLFunc != nil {
+		if ttl := p.cfg.RecordTTLFunc(event); ttl > 0 {
+			expires := time.Now().Add(ttl).UnixMilli()
+			// The headers are shared by all the records of the batch.
+			record.Headers = append(record.Headers[:len(record.Headers):len(record.Headers)],
+				kgo.RecordHeader{Key: ExpiresHeader, Value: []byte(strconv.FormatInt(expires, 10))},
+			)
+		}
+	}
+	for _, rm := range p.cfg.Mutators {
+		if err := rm(event, record); err != nil {
+			return nil, false, fmt.Errorf("failed to apply record mutator: %w", err)
+		}
+	}
+	if encoded == nil {
+		if encoded, err = p.cfg.Encoder.Encode(event); err != nil {
+			return nil, false, fmt.Errorf("failed to encode event: %w", err)
+		}
+	}
+	record.Value = encoded
+	if p.cfg.AddChecksum {
+		// The headers are shared by all the records of the batch.
+		record.Headers = append(record.Headers[:len(record.Headers):len(record.Headers)],
+			kgo.RecordHeader{Key: ChecksumHeader, Value: checksum(encoded)},
+		)
+	}
+	return record, defaulted, nil
+}
+
+// castagnoli is the CRC-32C table used to compute the record checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the hex encoded CRC-32C checksum of value.
+func checksum(value []byte) []byte {
+	sum := crc32.Checksum(value, castagnoli)
+	return []byte(fmt.Sprintf("%08x", sum))
+}
+
+// recovered logs the value v recovered from a panic in a producer callback,
+// passes it to OnPanic, and returns it as an error.
+func (p *Producer) recovered(v any) error {
+	p.cfg.Logger.Error("recovered from panic in producer callback",
+		zap.Any("panic", v),
+		zap.Stack("stack"),
+	)
+	if p.cfg.OnPanic != nil {
+		p.cfg.OnPanic(v)
+	}
+	return fmt.Errorf("kafka: panic in producer callback: %v", v)
+}
+
+// topicTimestamp holds the latest timestamp produced to a topic. Its mutex
+// is held while clamping and producing a record to the topic.
+type topicTimestamp struct {
+	mu     sync.Mutex
+	latest time.Time
+}
+
+// produceClamped sets the timestamp of record to the latest timestamp
+// produced to its topic when it's older, or records it as the latest
+// otherwise, and produces it. Both happen while holding the mutex of the
+// topic, so concurrent batches can't produce their clamped records out of
+// order, while Produce blocking on a full buffer only holds up the topic.
+func (p *Producer) produceClamped(ctx context.Context, record *kgo.Record, promise func(*kgo.Record, error)) {
+	if record.Timestamp.IsZero() {
+		// The client would set it when producing the record.
+		record.Timestamp = time.Now()
+	}
+	p.timestampsMu.Lock()
+	ts, ok := p.timestamps[record.Topic]
+	if !ok {
+		ts = &topicTimestamp{}
+		p.timestamps[record.Topic] = ts
+	}
+	p.timestampsMu.Unlock()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if record.Timestamp.Before(ts.latest) {
+		record.Timestamp = ts.latest
+	} else {
+		ts.latest = record.Timestamp
+	}
+	p.produce(ctx, record, promise)
+}
+
+// ProcessRecords produces the records as they are, without encoding nor
+// routing them, which allows forwarding records between topics. The topic of
+// every record must be set. The key, value, headers and timestamp of the
+// records are preserved. In Sync mode, it waits for the records to be
+// acknowledged in the same way as ProcessBatch.
+func (p *Producer) ProcessRecords(ctx context.Context, records []*kgo.Record) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ctx, span := p.tracer.Start(ctx, "producer.ProcessRecords",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.Int("records.size", len(records))),
+	)
+	defer span.End()
+
+	for _, r := range records {
+		if r.Topic == "" {
+			return spanError(span, errors.New("kafka: record topic must be set"))
 		}
-		record.Value = encoded
-		p.client.Produce(ctx, record, func(msg *kgo.Record, err error) {
-			defer wg.Done()
+	}
+	for _, r := range records {
+		if err := p.ensureTopic(ctx, r.Topic); err != nil {
+			return spanError(span, err)
+		}
+		if err := p.mirror(r); err != nil {
+			return spanError(span, err)
+		}
+	}
+	acks := newAckTracker(len(records))
+	produced := make([]*kgo.Record, len(records))
+	for i, r := range records {
+		// Copy the record since the client sets the partition and offset of
+		// the produced records, which may have been fetched by a consumer.
+		produced[i] = &kgo.Record{
+			Key:       r.Key,
+			Value:     r.Value,
+			Headers:   r.Headers,
+			Timestamp: r.Timestamp,
+			Topic:     r.Topic,
+		}
+		p.produce(ctx, produced[i], p.promise(acks, i, ""))
+	}
+	if !p.cfg.Sync {
+		return nil
+	}
+	if unacked := acks.wait(ctx); len(unacked) > 0 {
+		failed := make([]*kgo.Record, 0, len(unacked))
+		for _, i := range unacked {
+			failed = append(failed, produced[i])
+		}
+		return spanError(span, &UnackedError{Err: ctx.Err(), Records: failed})
+	}
+	return nil
+}
+
+// ProduceRaw produces a record with the given key, value and headers to
+// topic, skipping the TopicRouter, the Mutators and the Encoder, for callers
+// which already hold encoded events. In Sync mode, it waits for the record to
+// be acknowledged in the same way as ProcessBatch.
+func (p *Producer) ProduceRaw(ctx context.Context, topic apmqueue.Topic, key, value []byte, headers ...kgo.RecordHeader) error {
+	return p.ProcessRecords(ctx, []*kgo.Record{{
+		Topic:   string(topic),
+		Key:     key,
+		Value:   value,
+		Headers: headers,
+	}})
+}
+
+// ensureTopic creates topic when AutoCreateTopics is set, unless the producer
+// already knows it exists.
+func (p *Producer) ensureTopic(ctx context.Context, topic string) error {
+	if !p.cfg.AutoCreateTopics {
+		return nil
+	}
+	p.topicsMu.Lock()
+	_, ok := p.topics[topic]
+	p.topicsMu.Unlock()
+	if ok {
+		return nil
+	}
+	req := kmsg.NewPtrCreateTopicsRequest()
+	req.TimeoutMillis = 10000
+	t := kmsg.NewCreateTopicsRequestTopic()
+	t.Topic = topic
+	t.NumPartitions = -1 // Brokers' default.
+	if p.cfg.DefaultPartitions > 0 {
+		t.NumPartitions = p.cfg.DefaultPartitions
+	}
+	t.ReplicationFactor = -1 // Brokers' default.
+	if p.cfg.DefaultReplication > 0 {
+		t.ReplicationFactor = p.cfg.DefaultReplication
+	}
+	req.Topics = append(req.Topics, t)
+	resp, err := p.createTopics(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to create topic %s: %w", topic, err)
+	}
+	for _, t := range resp.Topics {
+		err := kerr.ErrorForCode(t.ErrorCode)
+		if err != nil && !errors.Is(err, kerr.TopicAlreadyExists) {
+			return fmt.Errorf("failed to create topic %s: %w", topic, err)
+		}
+	}
+	p.topicsMu.Lock()
+	p.topics[topic] = struct{}{}
+	p.topicsMu.Unlock()
+	return nil
+}
+
+// brokerMaxMessageBytes returns the message.max.bytes of one of the brokers,
+// the maximum size of the record batches it accepts.
+func brokerMaxMessageBytes(ctx context.Context, client *kgo.Client) (int32, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	metaReq := kmsg.NewPtrMetadataRequest()
+	metaResp, err := metaReq.RequestWith(ctx, client)
+	if err != nil {
+		return 0, fmt.Errorf("failed to request metadata: %w", err)
+	}
+	if len(metaResp.Brokers) == 0 {
+		return 0, errors.New("kafka: no brokers to request message.max.bytes from")
+	}
+	req := kmsg.NewPtrDescribeConfigsRequest()
+	resource := kmsg.NewDescribeConfigsRequestResource()
+	resource.ResourceType = kmsg.ConfigResourceTypeBroker
+	resource.ResourceName = strconv.Itoa(int(metaResp.Brokers[0].NodeID))
+	resource.ConfigNames = []string{"message.max.bytes"}
+	req.Resources = append(req.Resources, resource)
+	resp, err := req.RequestWith(ctx, client)
+	if err != nil {
+		return 0, fmt.Errorf("failed to describe broker configs: %w", err)
+	}
+	for _, r := range resp.Resources {
+		if err := kerr.ErrorForCode(r.ErrorCode); err != nil {
+			return 0, fmt.Errorf("failed to describe broker configs: %w", err)
+		}
+		for _, c := range r.Configs {
+			if c.Name != "message.max.bytes" || c.Value == nil {
+				continue
+			}
+			maxBytes, err := strconv.ParseInt(*c.Value, 10, 32)
 			if err != nil {
-				p.cfg.Logger.Error("failed producing message",
-					zap.Error(err),
-					zap.String("topic", msg.Topic),
-				)
+				return 0, fmt.Errorf("invalid broker message.max.bytes: %w", err)
 			}
-		})
+			return int32(maxBytes), nil
+		}
 	}
-	if p.cfg.Sync {
-		wg.Wait()
+	return 0, errors.New("kafka: broker message.max.bytes not found")
+}
+
+// mirror sends the record to the configured MirrorSink, if any.
+func (p *Producer) mirror(record *kgo.Record) error {
+	if p.cfg.Mirror == nil {
+		return nil
+	}
+	topic := apmqueue.Topic(record.Topic)
+	if err := p.cfg.Mirror.Mirror(topic, record.Value); err != nil {
+		return &MirrorError{Topic: topic, Err: err}
 	}
 	return nil
 }
 
+// promise returns the produce promise for the i-th record tracked by acks.
+// The records produced from events are counted by their event type, which
+// is empty for records produced as they are.
+func (p *Producer) promise(acks *ackTracker, i int, eventType string) func(*kgo.Record, error) {
+	return func(msg *kgo.Record, err error) {
+		if err != nil {
+			p.cfg.Logger.Error("failed producing message",
+				zap.Error(err),
+				zap.String("topic", msg.Topic),
+			)
+			if p.cfg.OnRecordError != nil {
+				p.cfg.OnRecordError(msg, err)
+			}
+		} else {
+			// The partition is only known once the record has been produced.
+			attrs := []attribute.KeyValue{
+				attribute.String("topic", msg.Topic),
+				attribute.Int("partition", int(msg.Partition)),
+			}
+			if eventType != "" {
+				attrs = append(attrs, attribute.String("event.type", eventType))
+			}
+			p.produced.Add(context.Background(), 1, attrs...)
+		}
+		acks.done(i, err)
+	}
+}
+
+// markerPromise is the produce promise of the batch marker records.
+func (p *Producer) markerPromise(msg *kgo.Record, err error) {
+	if err != nil {
+		p.cfg.Logger.Error("failed producing batch marker",
+			zap.Error(err),
+			zap.String("topic", msg.Topic),
+		)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// metadata returns the producer's static metadata merged with the metadata
+// stored in ctx, which takes precedence.
+func (p *Producer) metadata(ctx context.Context) map[string]string {
+	m, _ := queuecontext.MetadataFromContext(ctx)
+	if len(p.cfg.StaticMetadata) == 0 {
+		return m
+	}
+	merged := make(map[string]string, len(p.cfg.StaticMetadata)+len(m))
+	for k, v := range p.cfg.StaticMetadata {
+		merged[k] = v
+	}
+	for k, v := range m {
+		merged[k] = v
+	}
+	return merged
+}
+
+// propagateMetadata returns true if the metadata key is allowed to be added
+// as a record header.
+func (p *Producer) propagateMetadata(key string) bool {
+	if containsString(p.cfg.MetadataDenyList, key) {
+		return false
+	}
+	return len(p.cfg.MetadataAllowList) == 0 ||
+		containsString(p.cfg.MetadataAllowList, key)
+}
+
+// Healthy returns an error when the producer hasn't discovered any broker,
+// or when it's been fenced, as ErrProducerFenced.
 func (p *Producer) Healthy() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	if brokers := p.client.DiscoveredBrokers(); len(brokers) < 1 {
 		return fmt.Errorf("number of active brokers below 1")
 	}
+	if p.fenced.Load() {
+		return ErrProducerFenced
+	}
 	return nil
 }
+
+// ackTracker tracks the acknowledgement of the records produced in a single
+// call.
+type ackTracker struct {
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	acked []bool
+	errs  []error
+}
+
+func newAckTracker(n int) *ackTracker {
+	a := ackTracker{acked: make([]bool, n), errs: make([]error, n)}
+	a.wg.Add(n)
+	return &a
+}
+
+// done marks the i-th record as finished. The record is acknowledged when err
+// is nil.
+func (a *ackTracker) done(i int, err error) {
+	defer a.wg.Done()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		a.errs[i] = err
+		return
+	}
+	a.acked[i] = true
+}
+
+// failed returns the indices of the records which failed to be produced,
+// and the first error.
+func (a *ackTracker) failed() ([]int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var failed []int
+	var first error
+	for i, err := range a.errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		failed = append(failed, i)
+	}
+	return failed, first
+}
+
+// wait blocks until all the records have finished or ctx is done, whichever
+// happens first. When ctx is done, it returns the indices of the records which
+// haven't been acknowledged.
+func (a *ackTracker) wait(ctx context.Context) []int {
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	if ctx.Err() == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var unacked []int
+	for i, ok := range a.acked {
+		if !ok {
+			unacked = append(unacked, i)
+		}
+	}
+	return unacked
+}
+
+// spanError records err in the span, marks it as failed and returns err.
+func spanError(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
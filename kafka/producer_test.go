@@ -0,0 +1,2172 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/kversion"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	codec "github.com/elastic/apm-queue/codec/json"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestNewProducer(t *testing.T) {
+	_, err := NewProducer(ProducerConfig{})
+	assert.Error(t, err)
+}
+
+func TestProducerAcks(t *testing.T) {
+	tests := []struct {
+		acks    Acks
+		noIdemp bool
+		want    kgo.Acks
+		err     string
+	}{
+		{acks: AcksAll, want: kgo.AllISRAcks()},
+		{acks: AcksAll, noIdemp: true, want: kgo.AllISRAcks()},
+		{acks: AcksLeader, noIdemp: true, want: kgo.LeaderAck()},
+		{acks: AcksNone, noIdemp: true, want: kgo.NoAck()},
+		{acks: AcksLeader, err: "kafka: idempotent writes require AcksAll"},
+		{acks: AcksNone, err: "kafka: idempotent writes require AcksAll"},
+		{acks: 10, noIdemp: true, err: "kafka: acks is not valid"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("acks=%d,idempotent=%v", tt.acks, !tt.noIdemp), func(t *testing.T) {
+			cfg := ProducerConfig{
+				Broker:                 "localhost:9092",
+				Logger:                 zap.NewNop(),
+				Encoder:                codec.JSON{},
+				TopicRouter:            func(model.APMEvent) apmqueue.Topic { return "" },
+				Acks:                   tt.acks,
+				DisableIdempotentWrite: tt.noIdemp,
+			}
+			if tt.err != "" {
+				assert.EqualError(t, cfg.Validate(), tt.err)
+				return
+			}
+			assert.NoError(t, cfg.Validate())
+			assert.Equal(t, tt.want, tt.acks.kgoAcks())
+			producer := newTestProducer(t, cfg)
+			assert.NotNil(t, producer)
+		})
+	}
+}
+
+func TestProducerConnectionSettings(t *testing.T) {
+	customDialer := func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("not implemented")
+	}
+	tests := map[string]struct {
+		cfg        ProducerConfig
+		err        string
+		wantDialer bool
+	}{
+		"default":           {},
+		"conn_idle_timeout": {cfg: ProducerConfig{ConnIdleTimeout: time.Minute}},
+		"keep_alive":        {cfg: ProducerConfig{KeepAlive: time.Second}, wantDialer: true},
+		"custom_dialer":     {cfg: ProducerConfig{Dialer: customDialer}, wantDialer: true},
+		"negative_conn_idle_timeout": {
+			cfg: ProducerConfig{ConnIdleTimeout: -time.Second},
+			err: "kafka: conn idle timeout cannot be negative",
+		},
+		"negative_keep_alive": {
+			cfg: ProducerConfig{KeepAlive: -time.Second},
+			err: "kafka: keep alive cannot be negative",
+		},
+		"keep_alive_custom_dialer": {
+			cfg: ProducerConfig{KeepAlive: time.Second, Dialer: customDialer},
+			err: "kafka: keep alive cannot be set with a custom dialer",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Broker = stalledBroker(t)
+			cfg.Logger = zap.NewNop()
+			cfg.Encoder = codec.JSON{}
+			cfg.TopicRouter = func(model.APMEvent) apmqueue.Topic { return "" }
+			if tt.err != "" {
+				assert.EqualError(t, cfg.Validate(), tt.err)
+				return
+			}
+			require.NoError(t, cfg.Validate())
+			dialer := cfg.dialer()
+			assert.Equal(t, tt.wantDialer, dialer != nil)
+			if cfg.KeepAlive > 0 {
+				conn, err := dialer(context.Background(), "tcp", cfg.Broker)
+				require.NoError(t, err)
+				conn.Close()
+			}
+			assert.NotNil(t, newTestProducer(t, cfg))
+		})
+	}
+}
+
+func TestProducerSyncDeadline(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Broker:  stalledBroker(t),
+		Logger:  zap.NewNop(),
+		Encoder: codec.JSON{},
+		Sync:    true,
+		TopicRouter: func(model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Transaction: &model.Transaction{ID: "2"}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = producer.ProcessBatch(ctx, &batch)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	var unacked *UnackedError
+	require.True(t, errors.As(err, &unacked))
+	assert.Equal(t, batch, unacked.Events)
+}
+
+// stalledBroker returns the address of a listener which accepts connections
+// but never replies to any requests.
+func stalledBroker(t testing.TB) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		lis.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+// fakeBroker is a Kafka broker which leads all the partitions of every topic,
+// coordinates a single member consumer group and serves the produced batches
+// to fetches. It advertises the requests versions of Kafka 0.11 by default,
+// which don't use flexible encoding.
+type fakeBroker struct {
+	addr *net.TCPAddr
+
+	mu         sync.Mutex
+	conns      []net.Conn
+	versions   *kversion.Versions
+	partitions int32
+	batches    []fakeBatch
+	// logs holds the record batches produced to each partition of a topic,
+	// with their offsets assigned, and committed the committed offsets.
+	logs      map[string]map[int32]*fakeLog
+	committed map[string]map[int32]int64
+	// maxMessageBytes is the broker message.max.bytes, the batches larger
+	// than it are rejected.
+	maxMessageBytes int32
+	// produceErr, when set, fails every produced batch, and partitionErrs
+	// the batches produced to a partition.
+	produceErr    *kerr.Error
+	partitionErrs map[int32]*kerr.Error
+	// unavailable holds the partitions without an available leader.
+	unavailable map[int32]bool
+	// requests counts the requests received by key.
+	requests map[int16]int
+}
+
+// fakeBatch is a record batch produced to a fakeBroker.
+type fakeBatch struct {
+	partition int32
+	// compression is the compression codec of the batch, as encoded in the
+	// batch attributes: 0 for none, 1 for gzip.
+	compression int8
+	// keys holds the keys of the records of uncompressed batches.
+	keys []string
+}
+
+// fakeLog is the log of a partition of a fakeBroker.
+type fakeLog struct {
+	batches       []byte
+	highWatermark int64
+}
+
+// newFakeBroker starts a fakeBroker whose topics have a single partition.
+func newFakeBroker(t testing.TB) *fakeBroker {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	b := &fakeBroker{
+		addr:            lis.Addr().(*net.TCPAddr),
+		versions:        kversion.V0_11_0(),
+		partitions:      1,
+		maxMessageBytes: 1048588, // Kafka's default.
+		requests:        make(map[int16]int),
+		partitionErrs:   make(map[int32]*kerr.Error),
+		unavailable:     make(map[int32]bool),
+		logs:            make(map[string]map[int32]*fakeLog),
+		committed:       make(map[string]map[int32]int64),
+	}
+	t.Cleanup(func() {
+		lis.Close()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, conn := range b.conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// setVersions sets the requests versions advertised by the broker, which the
+// clients discover when they connect.
+func (b *fakeBroker) setVersions(v *kversion.Versions) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.versions = v
+}
+
+// setPartitions sets the number of partitions of every topic, which the
+// clients discover when they refresh their metadata.
+func (b *fakeBroker) setPartitions(n int32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.partitions = n
+}
+
+// compressions returns the compression codec of each produced batch.
+func (b *fakeBroker) compressions() []int8 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	compressions := make([]int8, len(b.batches))
+	for i, batch := range b.batches {
+		compressions[i] = batch.compression
+	}
+	return compressions
+}
+
+// setMaxMessageBytes sets the broker message.max.bytes.
+func (b *fakeBroker) setMaxMessageBytes(n int32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.maxMessageBytes = n
+}
+
+// setProduceError fails every batch produced from then on with err, or
+// accepts them again when err is nil.
+func (b *fakeBroker) setProduceError(err *kerr.Error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.produceErr = err
+}
+
+// setPartitionProduceError fails every batch produced to partition from then
+// on with err.
+func (b *fakeBroker) setPartitionProduceError(partition int32, err *kerr.Error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.partitionErrs[partition] = err
+}
+
+// setUnavailable reports the partitions as having no available leader, which
+// the clients discover when they refresh their metadata.
+func (b *fakeBroker) setUnavailable(partitions ...int32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, p := range partitions {
+		b.unavailable[p] = true
+	}
+}
+
+// requested returns the number of requests of the given key received.
+func (b *fakeBroker) requested(key kmsg.Key) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.requests[int16(key)]
+}
+
+// highWatermark returns the offset of the next record produced to the
+// partition of the topic.
+func (b *fakeBroker) highWatermark(topic string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if log := b.logs[topic][partition]; log != nil {
+		return log.highWatermark
+	}
+	return 0
+}
+
+// produced returns the batches produced to the broker.
+func (b *fakeBroker) produced() []fakeBatch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]fakeBatch(nil), b.batches...)
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		// Request header: key, version, correlation ID and client ID,
+		// followed by the tagged fields of flexible requests.
+		req := kmsg.RequestForKey(int16(binary.BigEndian.Uint16(buf)))
+		if req == nil {
+			return
+		}
+		req.SetVersion(int16(binary.BigEndian.Uint16(buf[2:])))
+		correlationID := buf[4:8]
+		body := buf[10:]
+		if n := int16(binary.BigEndian.Uint16(buf[8:])); n > 0 {
+			body = body[n:]
+		}
+		if req.IsFlexible() {
+			body = body[1:]
+		}
+		if err := req.ReadFrom(body); err != nil {
+			return
+		}
+		resp := b.handle(req)
+		if resp == nil {
+			return
+		}
+		if fetch, ok := resp.(*kmsg.FetchResponse); ok && fetchedNothing(fetch) {
+			// Like a real broker waiting up to the fetch max wait, don't
+			// let the clients poll in a busy loop.
+			time.Sleep(10 * time.Millisecond)
+		}
+		out := append(make([]byte, 4), correlationID...)
+		if resp.IsFlexible() && resp.Key() != int16(kmsg.ApiVersions) {
+			out = append(out, 0)
+		}
+		out = resp.AppendTo(out)
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) handle(req kmsg.Request) kmsg.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests[req.Key()]++
+	switch req := req.(type) {
+	case *kmsg.ApiVersionsRequest:
+		resp := req.ResponseKind().(*kmsg.ApiVersionsResponse)
+		b.versions.EachMaxKeyVersion(func(key, version int16) {
+			k := kmsg.NewApiVersionsResponseApiKey()
+			k.ApiKey, k.MaxVersion = key, version
+			resp.ApiKeys = append(resp.ApiKeys, k)
+		})
+		return resp
+	case *kmsg.MetadataRequest:
+		resp := req.ResponseKind().(*kmsg.MetadataResponse)
+		broker := kmsg.NewMetadataResponseBroker()
+		broker.Host, broker.Port = b.addr.IP.String(), int32(b.addr.Port)
+		resp.Brokers = append(resp.Brokers, broker)
+		for _, rt := range req.Topics {
+			topic := kmsg.NewMetadataResponseTopic()
+			topic.Topic = rt.Topic
+			for i := int32(0); i < b.partitions; i++ {
+				partition := kmsg.NewMetadataResponseTopicPartition()
+				partition.Partition = i
+				partition.Replicas, partition.ISR = []int32{0}, []int32{0}
+				if b.unavailable[i] {
+					partition.ErrorCode = kerr.LeaderNotAvailable.Code
+					partition.Leader = -1
+				}
+				topic.Partitions = append(topic.Partitions, partition)
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		return resp
+	case *kmsg.DescribeConfigsRequest:
+		resp := req.ResponseKind().(*kmsg.DescribeConfigsResponse)
+		for _, rr := range req.Resources {
+			resource := kmsg.NewDescribeConfigsResponseResource()
+			resource.ResourceType, resource.ResourceName = rr.ResourceType, rr.ResourceName
+			config := kmsg.NewDescribeConfigsResponseResourceConfig()
+			config.Name = "message.max.bytes"
+			config.Value = kmsg.StringPtr(strconv.Itoa(int(b.maxMessageBytes)))
+			resource.Configs = append(resource.Configs, config)
+			resp.Resources = append(resp.Resources, resource)
+		}
+		return resp
+	case *kmsg.InitProducerIDRequest:
+		resp := req.ResponseKind().(*kmsg.InitProducerIDResponse)
+		resp.ProducerID = 1
+		return resp
+	case *kmsg.ProduceRequest:
+		resp := req.ResponseKind().(*kmsg.ProduceResponse)
+		for _, rt := range req.Topics {
+			topic := kmsg.NewProduceResponseTopic()
+			topic.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				partition := kmsg.NewProduceResponseTopicPartition()
+				partition.Partition = rp.Partition
+				topic.Partitions = append(topic.Partitions, partition)
+				if err := b.produceErr; err != nil || b.partitionErrs[rp.Partition] != nil {
+					if err == nil {
+						err = b.partitionErrs[rp.Partition]
+					}
+					topic.Partitions[len(topic.Partitions)-1].ErrorCode = err.Code
+					continue
+				}
+				if len(rp.Records) > int(b.maxMessageBytes) {
+					topic.Partitions[len(topic.Partitions)-1].ErrorCode = kerr.MessageTooLarge.Code
+					continue
+				}
+				batch, err := readFakeBatch(rp.Records)
+				if err != nil {
+					return nil
+				}
+				batch.partition = rp.Partition
+				b.batches = append(b.batches, batch)
+				topic.Partitions[len(topic.Partitions)-1].BaseOffset = b.appendLog(
+					rt.Topic, rp.Partition, rp.Records,
+				)
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		return resp
+	case *kmsg.FindCoordinatorRequest:
+		resp := req.ResponseKind().(*kmsg.FindCoordinatorResponse)
+		resp.Host, resp.Port = b.addr.IP.String(), int32(b.addr.Port)
+		return resp
+	case *kmsg.JoinGroupRequest:
+		// The only member of the group leads it, and balances the
+		// partitions with the first protocol it supports.
+		resp := req.ResponseKind().(*kmsg.JoinGroupResponse)
+		resp.Generation = 1
+		resp.ProtocolType = kmsg.StringPtr(req.ProtocolType)
+		resp.Protocol = kmsg.StringPtr(req.Protocols[0].Name)
+		resp.LeaderID, resp.MemberID = "member", "member"
+		member := kmsg.NewJoinGroupResponseMember()
+		member.MemberID = resp.MemberID
+		member.ProtocolMetadata = req.Protocols[0].Metadata
+		resp.Members = append(resp.Members, member)
+		return resp
+	case *kmsg.SyncGroupRequest:
+		resp := req.ResponseKind().(*kmsg.SyncGroupResponse)
+		for _, assignment := range req.GroupAssignment {
+			if assignment.MemberID == req.MemberID {
+				resp.MemberAssignment = assignment.MemberAssignment
+			}
+		}
+		return resp
+	case *kmsg.HeartbeatRequest:
+		return req.ResponseKind()
+	case *kmsg.LeaveGroupRequest:
+		return req.ResponseKind()
+	case *kmsg.OffsetFetchRequest:
+		resp := req.ResponseKind().(*kmsg.OffsetFetchResponse)
+		for _, rt := range req.Topics {
+			topic := kmsg.NewOffsetFetchResponseTopic()
+			topic.Topic = rt.Topic
+			for _, p := range rt.Partitions {
+				partition := kmsg.NewOffsetFetchResponseTopicPartition()
+				partition.Partition = p
+				partition.Offset = -1
+				if offset, ok := b.committed[rt.Topic][p]; ok {
+					partition.Offset = offset
+				}
+				topic.Partitions = append(topic.Partitions, partition)
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		return resp
+	case *kmsg.OffsetCommitRequest:
+		resp := req.ResponseKind().(*kmsg.OffsetCommitResponse)
+		for _, rt := range req.Topics {
+			topic := kmsg.NewOffsetCommitResponseTopic()
+			topic.Topic = rt.Topic
+			if b.committed[rt.Topic] == nil {
+				b.committed[rt.Topic] = make(map[int32]int64)
+			}
+			for _, rp := range rt.Partitions {
+				b.committed[rt.Topic][rp.Partition] = rp.Offset
+				partition := kmsg.NewOffsetCommitResponseTopicPartition()
+				partition.Partition = rp.Partition
+				topic.Partitions = append(topic.Partitions, partition)
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		return resp
+	case *kmsg.ListOffsetsRequest:
+		resp := req.ResponseKind().(*kmsg.ListOffsetsResponse)
+		for _, rt := range req.Topics {
+			topic := kmsg.NewListOffsetsResponseTopic()
+			topic.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				partition := kmsg.NewListOffsetsResponseTopicPartition()
+				partition.Partition = rp.Partition
+				partition.Timestamp = -1
+				// Timestamp -2 requests the start offset and -1 the end
+				// offset, every other timestamp is served the end offset.
+				if rp.Timestamp != -2 {
+					if log := b.logs[rt.Topic][rp.Partition]; log != nil {
+						partition.Offset = log.highWatermark
+					}
+				}
+				partition.OldStyleOffsets = []int64{partition.Offset}
+				topic.Partitions = append(topic.Partitions, partition)
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		return resp
+	case *kmsg.FetchRequest:
+		// Every fetch is served the whole log of the partitions, the
+		// clients discard the records before the fetch offset.
+		resp := req.ResponseKind().(*kmsg.FetchResponse)
+		for _, rt := range req.Topics {
+			topic := kmsg.NewFetchResponseTopic()
+			topic.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				partition := kmsg.NewFetchResponseTopicPartition()
+				partition.Partition = rp.Partition
+				if log := b.logs[rt.Topic][rp.Partition]; log != nil {
+					partition.HighWatermark = log.highWatermark
+					partition.LastStableOffset = log.highWatermark
+					if rp.FetchOffset < log.highWatermark {
+						partition.RecordBatches = log.batches
+					}
+				}
+				topic.Partitions = append(topic.Partitions, partition)
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		return resp
+	}
+	return nil
+}
+
+// appendLog appends the record batch to the log of the partition, assigning
+// the offsets of its records, and returns the offset of the first record.
+func (b *fakeBroker) appendLog(topic string, partition int32, batch []byte) int64 {
+	if b.logs[topic] == nil {
+		b.logs[topic] = make(map[int32]*fakeLog)
+	}
+	log := b.logs[topic][partition]
+	if log == nil {
+		log = &fakeLog{}
+		b.logs[topic][partition] = log
+	}
+	// The first offset heads the batch and isn't covered by its CRC, the
+	// last offset delta follows the length, leader epoch, magic, CRC and
+	// attributes.
+	baseOffset := log.highWatermark
+	start := len(log.batches)
+	log.batches = append(log.batches, batch...)
+	binary.BigEndian.PutUint64(log.batches[start:], uint64(baseOffset))
+	lastOffsetDelta := int32(binary.BigEndian.Uint32(batch[23:]))
+	log.highWatermark += int64(lastOffsetDelta) + 1
+	return baseOffset
+}
+
+// fetchedNothing returns true if the fetch response holds no record batches.
+func fetchedNothing(resp *kmsg.FetchResponse) bool {
+	for _, topic := range resp.Topics {
+		for _, partition := range topic.Partitions {
+			if len(partition.RecordBatches) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// readFakeBatch reads the compression codec of the record batch encoded in
+// src, and the keys of its records when it's uncompressed.
+func readFakeBatch(src []byte) (fakeBatch, error) {
+	var rb kmsg.RecordBatch
+	if err := rb.ReadFrom(src); err != nil {
+		return fakeBatch{}, err
+	}
+	batch := fakeBatch{compression: int8(rb.Attributes & 0x07)}
+	if batch.compression != 0 {
+		return batch, nil
+	}
+	records := rb.Records
+	for i := int32(0); i < rb.NumRecords; i++ {
+		length, n := binary.Varint(records)
+		if n <= 0 || int(length) > len(records[n:]) {
+			return fakeBatch{}, errors.New("invalid record length")
+		}
+		var r kmsg.Record
+		if err := r.ReadFrom(records[:n+int(length)]); err != nil {
+			return fakeBatch{}, err
+		}
+		batch.keys = append(batch.keys, string(r.Key))
+		records = records[n+int(length):]
+	}
+	return batch, nil
+}
+
+func TestProducerTraceContextSampling(t *testing.T) {
+	var records []*kgo.Record
+	producer := newTestProducer(t, ProducerConfig{
+		Mutators: []RecordMutator{recordCollector(&records)},
+	})
+
+	traceparent := func(r *kgo.Record) string {
+		return headerCarrier{&r.Headers}.Get("traceparent")
+	}
+	for _, sampled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("sampled=%v", sampled), func(t *testing.T) {
+			records = records[:0]
+			cfg := trace.SpanContextConfig{
+				TraceID: trace.TraceID{1},
+				SpanID:  trace.SpanID{1},
+				Remote:  true,
+			}
+			if sampled {
+				cfg.TraceFlags = trace.FlagsSampled
+			}
+			ctx := trace.ContextWithSpanContext(context.Background(),
+				trace.NewSpanContext(cfg),
+			)
+			batch := model.Batch{{}, {}}
+			require.NoError(t, producer.ProcessBatch(ctx, &batch))
+			require.Len(t, records, len(batch))
+			for _, r := range records {
+				if sampled {
+					assert.Equal(t,
+						"00-01000000000000000000000000000000-0100000000000000-01",
+						traceparent(r),
+					)
+				} else {
+					assert.Empty(t, traceparent(r))
+				}
+			}
+		})
+	}
+}
+
+func TestProducerStaticMetadata(t *testing.T) {
+	var records []*kgo.Record
+	producer := newTestProducer(t, ProducerConfig{
+		StaticMetadata: map[string]string{
+			"environment": "production",
+			"region":      "us-east-1",
+		},
+		Mutators: []RecordMutator{recordCollector(&records)},
+	})
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+		"region":  "eu-west-1",
+		"project": "apm",
+	})
+	batch := model.Batch{{}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	require.Len(t, records, 1)
+
+	headers := make(map[string]string)
+	for _, h := range records[0].Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	assert.Equal(t, map[string]string{
+		"environment": "production",
+		"region":      "eu-west-1",
+		"project":     "apm",
+	}, headers)
+}
+
+func TestProducerMetadataFilter(t *testing.T) {
+	metadata := map[string]string{
+		"project": "apm",
+		"region":  "eu-west-1",
+		"token":   "secret",
+	}
+	for name, tc := range map[string]struct {
+		allow, deny []string
+		expected    []string
+	}{
+		"all":        {expected: []string{"project", "region", "token"}},
+		"allow":      {allow: []string{"project", "token"}, expected: []string{"project", "token"}},
+		"deny":       {deny: []string{"token"}, expected: []string{"project", "region"}},
+		"deny_first": {allow: []string{"project", "token"}, deny: []string{"token"}, expected: []string{"project"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var records []*kgo.Record
+			producer := newTestProducer(t, ProducerConfig{
+				StaticMetadata:    map[string]string{"region": "eu-west-1"},
+				MetadataAllowList: tc.allow,
+				MetadataDenyList:  tc.deny,
+				Mutators:          []RecordMutator{recordCollector(&records)},
+			})
+			ctx := queuecontext.WithMetadata(context.Background(), metadata)
+			batch := model.Batch{{}}
+			require.NoError(t, producer.ProcessBatch(ctx, &batch))
+			require.Len(t, records, 1)
+			var keys []string
+			for _, h := range records[0].Headers {
+				keys = append(keys, h.Key)
+				assert.Equal(t, metadata[h.Key], string(h.Value))
+			}
+			assert.ElementsMatch(t, tc.expected, keys)
+		})
+	}
+}
+
+func TestProducerKeyFromMetadata(t *testing.T) {
+	var records []*kgo.Record
+	producer := newTestProducer(t, ProducerConfig{
+		KeyFromMetadata: "tenant",
+		Mutators:        []RecordMutator{recordCollector(&records)},
+	})
+	batch := model.Batch{{}, {}}
+
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+		"tenant": "tenant-a",
+	})
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	require.Len(t, records, 2)
+	for _, r := range records {
+		assert.Equal(t, []byte("tenant-a"), r.Key)
+	}
+
+	records = records[:0]
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	require.Len(t, records, 2)
+	for _, r := range records {
+		assert.Nil(t, r.Key)
+	}
+}
+
+func TestProducerEmitBatchMarker(t *testing.T) {
+	producer := newTestProducer(t, ProducerConfig{
+		EmitBatchMarker: true,
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(event.Service.Name)
+		},
+	})
+	var produced []*kgo.Record
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		produced = append(produced, r)
+		promise(r, nil)
+	}
+	batch := model.Batch{
+		{Service: model.Service{Name: "a"}},
+		{Service: model.Service{Name: "b"}},
+		{Service: model.Service{Name: "a"}},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	type result struct {
+		topic  string
+		marker bool
+	}
+	var results []result
+	for _, r := range produced {
+		results = append(results, result{topic: r.Topic, marker: isBatchMarker(r)})
+		if isBatchMarker(r) {
+			assert.Nil(t, r.Value)
+		}
+	}
+	assert.Equal(t, []result{
+		{topic: "a"}, {topic: "b"}, {topic: "a"},
+		{topic: "a", marker: true}, {topic: "b", marker: true},
+	}, results)
+}
+
+func TestProducerPanicRecovery(t *testing.T) {
+	var panics []any
+	var records []*kgo.Record
+	producer := newTestProducer(t, ProducerConfig{
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			if event.Message == "router" {
+				panic("router panic")
+			}
+			return "topic"
+		},
+		Mutators: []RecordMutator{
+			func(event model.APMEvent, _ *kgo.Record) error {
+				if event.Message == "mutator" {
+					panic(errors.New("mutator panic"))
+				}
+				return nil
+			},
+			recordCollector(&records),
+		},
+		OnPanic: func(v any) { panics = append(panics, v) },
+	})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		promise(r, nil)
+	}
+
+	batch := model.Batch{{Message: "router"}}
+	assert.EqualError(t, producer.ProcessBatch(context.Background(), &batch),
+		"kafka: panic in producer callback: router panic",
+	)
+	batch = model.Batch{{Message: "mutator"}}
+	assert.EqualError(t, producer.ProcessBatch(context.Background(), &batch),
+		"kafka: panic in producer callback: mutator panic",
+	)
+	assert.Equal(t, []any{"router panic", errors.New("mutator panic")}, panics)
+	assert.Empty(t, records)
+
+	// The producer is still usable after recovering.
+	batch = model.Batch{{Message: "ok"}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Len(t, records, 1)
+}
+
+func TestProducerPartitionMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:          true,
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		Mutators: []RecordMutator{func(event model.APMEvent, r *kgo.Record) error {
+			r.Key = []byte(event.Message)
+			return nil
+		}},
+	})
+	// Assign the partitions by key, like the default partitioner would.
+	partitions := map[string]int32{"a": 0, "b": 1, "c": 2}
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		r.Partition = partitions[string(r.Key)]
+		var err error
+		if string(r.Key) == "c" {
+			err = errors.New("not produced")
+		}
+		promise(r, err)
+	}
+	batch := model.Batch{
+		{Message: "a"}, {Message: "b"}, {Message: "a"}, {Message: "c"}, {Message: "a"},
+	}
+	producer.ProcessBatch(context.Background(), &batch)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	m := findMetric(t, rm.ScopeMetrics[0].Metrics, "producer.records.produced")
+	produced := make(map[int64]int64)
+	for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+		topic, _ := dp.Attributes.Value("topic")
+		assert.Equal(t, "topic", topic.AsString())
+		partition, _ := dp.Attributes.Value("partition")
+		produced[partition.AsInt64()] = dp.Value
+	}
+	// Records which failed to be produced aren't counted.
+	assert.Equal(t, map[int64]int64{0: 3, 1: 1}, produced)
+}
+
+func TestProducerLatencyBuckets(t *testing.T) {
+	buckets := []float64{1, 10, 100}
+	cfg := ProducerConfig{LatencyBuckets: buckets}
+	reader := sdkmetric.NewManualReader()
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:           true,
+		LatencyBuckets: buckets,
+		MeterProvider: sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(reader),
+			sdkmetric.WithView(cfg.LatencyView()),
+		),
+	})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		promise(r, nil)
+	}
+	batch := model.Batch{{Message: "a"}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	m := findMetric(t, rm.ScopeMetrics[0].Metrics, "producer.process.duration")
+	assert.Equal(t, "ms", string(m.Unit))
+	dps := m.Data.(metricdata.Histogram).DataPoints
+	require.Len(t, dps, 1)
+	assert.Equal(t, buckets, dps[0].Bounds)
+	assert.Len(t, dps[0].BucketCounts, len(buckets)+1)
+	assert.Equal(t, uint64(2), dps[0].Count)
+
+	err := ProducerConfig{
+		Broker:         "localhost:9092",
+		Logger:         zap.NewNop(),
+		Encoder:        messageEncoder{},
+		TopicRouter:    func(model.APMEvent) apmqueue.Topic { return "topic" },
+		LatencyBuckets: []float64{1, 10, 10},
+	}.Validate()
+	assert.EqualError(t, err, "kafka: latency buckets must be increasing")
+}
+
+// findMetric returns the metric with the given name.
+func findMetric(t testing.TB, metrics []metricdata.Metrics, name string) metricdata.Metrics {
+	t.Helper()
+	for _, m := range metrics {
+		if m.Name == name {
+			return m
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return metricdata.Metrics{}
+}
+
+func TestProducerKeyEncoder(t *testing.T) {
+	var records []*kgo.Record
+	producer := newTestProducer(t, ProducerConfig{
+		KeyEncoder: func(event model.APMEvent) ([]byte, error) {
+			if event.Service.Name == "" {
+				return nil, errors.New("missing service name")
+			}
+			return []byte(event.Service.Name + "/" + event.Message), nil
+		},
+		Mutators: []RecordMutator{recordCollector(&records)},
+	})
+	batch := model.Batch{
+		{Service: model.Service{Name: "a"}, Message: "1"},
+		{Service: model.Service{Name: "b"}, Message: "2"},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	require.Len(t, records, 2)
+	assert.Equal(t, []byte("a/1"), records[0].Key)
+	assert.Equal(t, []byte("b/2"), records[1].Key)
+
+	// Only the events whose key fails to be encoded aren't produced.
+	records = records[:0]
+	batch = model.Batch{
+		{Message: "3"},
+		{Service: model.Service{Name: "c"}, Message: "4"},
+		{Message: "5"},
+	}
+	err := producer.ProcessBatch(context.Background(), &batch)
+	assert.EqualError(t, err,
+		"kafka: 2 records not acknowledged: failed to encode key: missing service name",
+	)
+	var unacked *UnackedError
+	require.ErrorAs(t, err, &unacked)
+	assert.Equal(t, model.Batch{batch[0], batch[2]}, unacked.Events)
+	require.Len(t, records, 1)
+	assert.Equal(t, []byte("c/4"), records[0].Key)
+
+	// With Sync and ProcessBatchAsync, the events are reported once the
+	// other records are acknowledged.
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		promise(r, nil)
+	}
+	producer.cfg.Sync = true
+	err = producer.ProcessBatch(context.Background(), &batch)
+	require.ErrorAs(t, err, &unacked)
+	assert.Equal(t, model.Batch{batch[0], batch[2]}, unacked.Events)
+	producer.cfg.Sync = false
+	err = <-producer.ProcessBatchAsync(context.Background(), &batch)
+	require.ErrorAs(t, err, &unacked)
+	assert.Equal(t, model.Batch{batch[0], batch[2]}, unacked.Events)
+
+	cfg := producer.cfg
+	cfg.KeyFromMetadata = "tenant"
+	assert.EqualError(t, cfg.Validate(),
+		"kafka: key encoder and key from metadata are mutually exclusive",
+	)
+}
+
+func TestProducerTimestamps(t *testing.T) {
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	batch := model.Batch{
+		{Timestamp: base.Add(2 * time.Second), Message: "a"},
+		{Timestamp: base, Message: "b"},
+		{Timestamp: base.Add(3 * time.Second), Message: "c"},
+		{Timestamp: base.Add(time.Second), Message: "d"},
+		{Timestamp: base.Add(time.Second), Message: "x"},
+	}
+	for name, tc := range map[string]struct {
+		clamp    bool
+		expected []time.Time
+	}{
+		"event_time": {expected: []time.Time{
+			base.Add(2 * time.Second), base, base.Add(3 * time.Second),
+			base.Add(time.Second), base.Add(time.Second),
+		}},
+		"clamped": {clamp: true, expected: []time.Time{
+			base.Add(2 * time.Second), base.Add(2 * time.Second),
+			base.Add(3 * time.Second), base.Add(3 * time.Second),
+			// Timestamps are clamped per topic.
+			base.Add(time.Second),
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var records []*kgo.Record
+			producer := newTestProducer(t, ProducerConfig{
+				TimestampFunc: func(event model.APMEvent) time.Time {
+					return event.Timestamp
+				},
+				ClampTimestampsMonotonic: tc.clamp,
+				TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+					if event.Message == "x" {
+						return "other"
+					}
+					return "topic"
+				},
+				Mutators: []RecordMutator{recordCollector(&records)},
+			})
+			producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+				promise(r, nil)
+			}
+			b := append(model.Batch(nil), batch...)
+			require.NoError(t, producer.ProcessBatch(context.Background(), &b))
+			timestamps := make([]time.Time, len(records))
+			for i, r := range records {
+				timestamps[i] = r.Timestamp
+			}
+			assert.Equal(t, tc.expected, timestamps)
+		})
+	}
+}
+
+func TestProducerClampTimestampsConcurrent(t *testing.T) {
+	base := time.Unix(1000, 0)
+	producer := newTestProducer(t, ProducerConfig{
+		TimestampFunc: func(event model.APMEvent) time.Time {
+			return event.Timestamp
+		},
+		ClampTimestampsMonotonic: true,
+	})
+	var mu sync.Mutex
+	var timestamps []time.Time
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		mu.Lock()
+		timestamps = append(timestamps, r.Timestamp)
+		mu.Unlock()
+		promise(r, nil)
+	}
+	const goroutines, events = 8, 100
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			batch := make(model.Batch, events)
+			for i := range batch {
+				// Every goroutine produces timestamps going back and forth.
+				batch[i].Timestamp = base.Add(time.Duration((i*7+g)%13) * time.Second)
+			}
+			assert.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+		}(g)
+	}
+	wg.Wait()
+
+	// The records reach the client in timestamp order.
+	require.Len(t, timestamps, goroutines*events)
+	for i := 1; i < len(timestamps); i++ {
+		assert.False(t, timestamps[i].Before(timestamps[i-1]),
+			"timestamp %d went backwards", i,
+		)
+	}
+}
+
+func TestProducerClampTimestampsBlockedTopic(t *testing.T) {
+	producer := newTestProducer(t, ProducerConfig{
+		ClampTimestampsMonotonic: true,
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(event.Message)
+		},
+	})
+	blocked, unblock := make(chan struct{}), make(chan struct{})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		if r.Topic == "slow" {
+			// Produce blocks, as when the buffer is full.
+			close(blocked)
+			<-unblock
+		}
+		promise(r, nil)
+	}
+	slow := make(chan error, 1)
+	go func() {
+		batch := model.Batch{{Message: "slow"}}
+		slow <- producer.ProcessBatch(context.Background(), &batch)
+	}()
+	<-blocked
+
+	// The records of other topics are clamped and produced meanwhile.
+	fast := make(chan error, 1)
+	go func() {
+		batch := model.Batch{{Message: "fast"}, {Message: "fast"}}
+		fast <- producer.ProcessBatch(context.Background(), &batch)
+	}()
+	select {
+	case err := <-fast:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("records of other topics blocked by a blocked topic")
+	}
+	close(unblock)
+	assert.NoError(t, <-slow)
+}
+
+func TestProducerValidateEvent(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	producer := newTestProducer(t, ProducerConfig{
+		Sync: true,
+		ValidateEvent: func(event model.APMEvent) error {
+			if event.Message == "" {
+				return errors.New("empty message")
+			}
+			return nil
+		},
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+	})
+	var produced []string
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		var event model.APMEvent
+		require.NoError(t, codec.JSON{}.Decode(r.Value, &event))
+		produced = append(produced, event.Message)
+		promise(r, nil)
+	}
+	batch := model.Batch{{Message: "a"}, {}, {Message: "b"}, {}}
+	err := producer.ProcessBatch(context.Background(), &batch)
+	assert.EqualError(t, err,
+		"kafka: invalid event: empty message\nkafka: invalid event: empty message",
+	)
+	assert.Equal(t, []string{"a", "b"}, produced)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Contains(t, spans[0].Attributes, attribute.Int("batch.invalid", 2))
+}
+
+func TestProducerDefaultTopic(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:    true,
+		Encoder: messageEncoder{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			if event.Transaction != nil {
+				return "transactions"
+			}
+			return "" // Unclassified.
+		},
+		DefaultTopic:   "unclassified",
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+	})
+	topics := make(map[string]string)
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		topics[string(r.Value)] = r.Topic
+		promise(r, nil)
+	}
+	batch := model.Batch{
+		{Message: "tx", Transaction: &model.Transaction{ID: "1"}},
+		{Message: "unknown"},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, map[string]string{
+		"tx":      "transactions",
+		"unknown": "unclassified",
+	}, topics)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Contains(t, spans[0].Attributes, attribute.Int("batch.defaulted", 1))
+}
+
+func TestProducerDedupKeyFunc(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:    true,
+		Encoder: messageEncoder{},
+		DedupKeyFunc: func(event model.APMEvent) string {
+			if event.Transaction == nil {
+				return ""
+			}
+			return event.Transaction.ID
+		},
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+	})
+	var produced []string
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		produced = append(produced, string(r.Value))
+		promise(r, nil)
+	}
+	batch := model.Batch{
+		{Message: "a", Transaction: &model.Transaction{ID: "1"}},
+		{Message: "b", Transaction: &model.Transaction{ID: "2"}},
+		{Message: "a retried", Transaction: &model.Transaction{ID: "1"}},
+		{Message: "no key"},
+		{Message: "no key"},
+		{Message: "a retried again", Transaction: &model.Transaction{ID: "1"}},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, []string{"a", "b", "no key", "no key"}, produced)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Contains(t, spans[0].Attributes, attribute.Int("batch.deduplicated", 2))
+}
+
+func TestProducerSkipEmptyEvents(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:            true,
+		Encoder:         messageEncoder{},
+		SkipEmptyEvents: true,
+		TracerProvider:  sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+	})
+	var produced []string
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		produced = append(produced, string(r.Value))
+		promise(r, nil)
+	}
+	batch := model.Batch{
+		{},
+		{Message: "a"},
+		{},
+		// An event with any field set isn't empty.
+		{Timestamp: time.Unix(1, 0)},
+		{Message: "b"},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, []string{"a", "", "b"}, produced)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Contains(t, spans[0].Attributes, attribute.Int("batch.empty", 2))
+}
+
+func TestProducerEncodeCacheKeyFunc(t *testing.T) {
+	var encodes int
+	producer := newTestProducer(t, ProducerConfig{
+		Sync: true,
+		Encoder: encoderFunc(func(event model.APMEvent) ([]byte, error) {
+			encodes++
+			return []byte(fmt.Sprintf("%s %d", event.Message, encodes)), nil
+		}),
+		EncodeCacheKeyFunc: func(event model.APMEvent) string {
+			if event.Transaction == nil {
+				return ""
+			}
+			return event.Transaction.ID
+		},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(event.Service.Name)
+		},
+	})
+	type result struct{ topic, value string }
+	var produced []result
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		produced = append(produced, result{topic: r.Topic, value: string(r.Value)})
+		promise(r, nil)
+	}
+	batch := model.Batch{
+		{Message: "a", Service: model.Service{Name: "x"}, Transaction: &model.Transaction{ID: "1"}},
+		{Message: "a", Service: model.Service{Name: "y"}, Transaction: &model.Transaction{ID: "1"}},
+		{Message: "b", Service: model.Service{Name: "x"}, Transaction: &model.Transaction{ID: "2"}},
+		{Message: "c", Service: model.Service{Name: "x"}},
+		{Message: "c", Service: model.Service{Name: "y"}},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, []result{
+		{topic: "x", value: "a 1"},
+		{topic: "y", value: "a 1"},
+		{topic: "x", value: "b 2"},
+		// Events without an identity are always encoded.
+		{topic: "x", value: "c 3"},
+		{topic: "y", value: "c 4"},
+	}, produced)
+
+	// The cache is scoped to the batch.
+	produced = nil
+	batch = batch[:1]
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, []result{{topic: "x", value: "a 5"}}, produced)
+}
+
+func BenchmarkProducerEncodeCache(b *testing.B) {
+	for _, cache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%t", cache), func(b *testing.B) {
+			cfg := ProducerConfig{
+				TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+					return apmqueue.Topic(event.Service.Name)
+				},
+			}
+			if cache {
+				cfg.EncodeCacheKeyFunc = func(event model.APMEvent) string {
+					return event.Transaction.ID
+				}
+			}
+			producer := newTestProducer(b, cfg)
+			producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+				promise(r, nil)
+			}
+			// Every event is produced to 4 topics.
+			batch := make(model.Batch, 0, 100)
+			for i := 0; i < cap(batch); i++ {
+				batch = append(batch, model.APMEvent{
+					Message:     strings.Repeat("message ", 32),
+					Service:     model.Service{Name: fmt.Sprintf("topic-%d", i%4)},
+					Transaction: &model.Transaction{ID: strconv.Itoa(i / 4)},
+				})
+			}
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := producer.ProcessBatch(ctx, &batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestProducerReconfigure(t *testing.T) {
+	broker := newFakeBroker(t)
+	producer := newTestProducer(t, ProducerConfig{
+		Broker:      broker.addr.String(),
+		Sync:        true,
+		Encoder:     messageEncoder{},
+		Compression: []kgo.CompressionCodec{kgo.NoCompression()},
+	})
+	// Compressible events, since batches are only compressed when it makes
+	// them smaller.
+	produce := func() {
+		batch := model.Batch{{Message: strings.Repeat("a", 1000)}}
+		require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	}
+	produce()
+
+	cfg := producer.cfg
+	cfg.Compression = []kgo.CompressionCodec{kgo.GzipCompression()}
+	cfg.Linger = time.Millisecond
+	require.NoError(t, producer.Reconfigure(cfg))
+	produce()
+	assert.Equal(t, []int8{0, 1}, broker.compressions())
+
+	cfg.Broker = "127.0.0.1:1"
+	cfg.ClientID = "client"
+	assert.EqualError(t, producer.Reconfigure(cfg),
+		"kafka: broker cannot be reconfigured\nkafka: client id cannot be reconfigured",
+	)
+	cfg = producer.cfg
+	cfg.Linger = -time.Second
+	assert.Error(t, producer.Reconfigure(cfg))
+
+	produce()
+	assert.Equal(t, []int8{0, 1, 1}, broker.compressions())
+}
+
+func TestProducerReconfigureStalled(t *testing.T) {
+	// The broker never acknowledges the records buffered before
+	// reconfiguring, Reconfigure gives up once MaxCloseWait elapses.
+	producer := newTestProducer(t, ProducerConfig{
+		MaxCloseWait: 100 * time.Millisecond,
+	})
+	batch := model.Batch{{Transaction: &model.Transaction{ID: "1"}}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	cfg := producer.cfg
+	cfg.Linger = time.Millisecond
+	reconfigured := make(chan error, 1)
+	go func() { reconfigured <- producer.Reconfigure(cfg) }()
+	select {
+	case err := <-reconfigured:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Reconfigure to return")
+	}
+	assert.Equal(t, time.Millisecond, producer.cfg.Linger)
+}
+
+func TestProducerLinkEventTraces(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:            true,
+		LinkEventTraces: true,
+		TracerProvider:  sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+	})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		promise(r, nil)
+	}
+	const (
+		trace1 = "0af7651916cd43dd8448eb211c80319c"
+		trace2 = "4bf92f3577b34da6a3ce929d0e0e4736"
+	)
+	batch := model.Batch{
+		{Trace: model.Trace{ID: trace1}, Transaction: &model.Transaction{ID: "b7ad6b7169203331"}},
+		{Trace: model.Trace{ID: trace1}, Span: &model.Span{ID: "00f067aa0ba902b7"}},
+		{Trace: model.Trace{ID: trace2}, Parent: model.Parent{ID: "53995c3f42cd8ad8"}},
+		{Message: "no trace"},
+		{Trace: model.Trace{ID: "invalid"}, Parent: model.Parent{ID: "53995c3f42cd8ad8"}},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	var links []string
+	for _, link := range spans[0].Links {
+		links = append(links, link.SpanContext.TraceID().String()+"-"+link.SpanContext.SpanID().String())
+	}
+	assert.Equal(t, []string{
+		trace1 + "-b7ad6b7169203331",
+		trace2 + "-53995c3f42cd8ad8",
+	}, links)
+}
+
+func TestProducerPerTopicSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:           true,
+		PerTopicSpans:  true,
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(event.Service.Name)
+		},
+	})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		if r.Topic == "b" {
+			promise(r, errors.New("boom"))
+			return
+		}
+		promise(r, nil)
+	}
+	batch := model.Batch{
+		{Service: model.Service{Name: "a"}},
+		{Service: model.Service{Name: "b"}},
+		{Service: model.Service{Name: "a"}},
+		{Service: model.Service{Name: "a"}},
+	}
+	producer.ProcessBatch(context.Background(), &batch)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	parent := spans[len(spans)-1]
+	assert.Equal(t, "producer.ProcessBatch", parent.Name)
+	records := make(map[string]int64)
+	for _, span := range spans[:len(spans)-1] {
+		assert.Equal(t, "producer.Topic", span.Name)
+		assert.Equal(t, parent.SpanContext.SpanID(), span.Parent.SpanID())
+		var topic string
+		for _, attr := range span.Attributes {
+			switch attr.Key {
+			case "topic":
+				topic = attr.Value.AsString()
+			case "batch.size":
+				records[topic] = attr.Value.AsInt64()
+			}
+		}
+		if topic == "b" {
+			assert.Equal(t, codes.Error, span.Status.Code)
+		} else {
+			assert.Equal(t, codes.Unset, span.Status.Code)
+		}
+	}
+	assert.Equal(t, map[string]int64{"a": 3, "b": 1}, records)
+}
+
+func TestProducerProduceHooks(t *testing.T) {
+	type produced struct {
+		batch model.Batch
+		err   error
+		audit string
+	}
+	var before []model.Batch
+	var after []produced
+	errMutate := errors.New("mutate failed")
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:    true,
+		Encoder: messageEncoder{},
+		Mutators: []RecordMutator{func(event model.APMEvent, _ *kgo.Record) error {
+			if event.Message == "fail" {
+				return errMutate
+			}
+			return nil
+		}},
+		BeforeProduce: func(ctx context.Context, batch model.Batch) context.Context {
+			before = append(before, batch)
+			return queuecontext.WithMetadata(ctx, map[string]string{"audit": "1"})
+		},
+		AfterProduce: func(ctx context.Context, batch model.Batch, err error) {
+			m, _ := queuecontext.MetadataFromContext(ctx)
+			after = append(after, produced{batch: batch, err: err, audit: m["audit"]})
+		},
+	})
+	var headers [][]kgo.RecordHeader
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		headers = append(headers, r.Headers)
+		promise(r, nil)
+	}
+
+	ok := model.Batch{{Message: "ok"}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &ok))
+	failed := model.Batch{{Message: "fail"}}
+	err := producer.ProcessBatch(context.Background(), &failed)
+	require.Error(t, err)
+
+	assert.Equal(t, []model.Batch{ok, failed}, before)
+	require.Len(t, after, 2)
+	assert.Equal(t, produced{batch: ok, audit: "1"}, after[0])
+	assert.Equal(t, failed, after[1].batch)
+	assert.Equal(t, err, after[1].err)
+	assert.ErrorIs(t, after[1].err, errMutate)
+	// The metadata of the context returned by BeforeProduce is propagated.
+	for _, h := range headers {
+		assert.Contains(t, h, kgo.RecordHeader{Key: "audit", Value: []byte("1")})
+	}
+}
+
+func TestProducerBestEffort(t *testing.T) {
+	broker := newFakeBroker(t)
+	broker.setPartitions(3)
+	// Partition 2 is down, and partition 1 rejects the records.
+	broker.setUnavailable(2)
+	broker.setPartitionProduceError(1, kerr.InvalidRecord)
+	var mu sync.Mutex
+	var failed []*kgo.Record
+	producer := newTestProducer(t, ProducerConfig{
+		Broker:      broker.addr.String(),
+		Sync:        true,
+		BestEffort:  true,
+		Encoder:     messageEncoder{},
+		Compression: []kgo.CompressionCodec{kgo.NoCompression()},
+		KeyEncoder: func(event model.APMEvent) ([]byte, error) {
+			return []byte(event.Message), nil
+		},
+		OnRecordError: func(r *kgo.Record, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.ErrorIs(t, err, kerr.InvalidRecord)
+			failed = append(failed, r)
+		},
+	})
+	var batch model.Batch
+	for i := 0; i < 20; i++ {
+		batch = append(batch, model.APMEvent{Message: strconv.Itoa(i)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	// The records with a key hashing to the unavailable partition are
+	// produced to the available ones, and the records rejected by partition
+	// 1 are reported, while the others are produced.
+	var keys []string
+	for _, b := range broker.produced() {
+		assert.Equal(t, int32(0), b.partition)
+		keys = append(keys, b.keys...)
+	}
+	assert.NotEmpty(t, keys)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotEmpty(t, failed)
+	for _, r := range failed {
+		keys = append(keys, string(r.Key))
+	}
+	var want []string
+	for _, event := range batch {
+		want = append(want, event.Message)
+	}
+	assert.ElementsMatch(t, want, keys)
+}
+
+func TestProducerAutoSplitBatches(t *testing.T) {
+	var batch model.Batch
+	for i := 0; i < 20; i++ {
+		batch = append(batch, model.APMEvent{Message: strings.Repeat(strconv.Itoa(i), 1000)})
+	}
+	newProducer := func(t *testing.T, autoSplit bool) (*Producer, *fakeBroker) {
+		broker := newFakeBroker(t)
+		broker.setMaxMessageBytes(4096)
+		return newTestProducer(t, ProducerConfig{
+			Broker:           broker.addr.String(),
+			Encoder:          messageEncoder{},
+			Compression:      []kgo.CompressionCodec{kgo.NoCompression()},
+			AutoSplitBatches: autoSplit,
+		}), broker
+	}
+	t.Run("auto_split", func(t *testing.T) {
+		producer, broker := newProducer(t, true)
+		assert.Equal(t, int32(4096), producer.cfg.BatchMaxBytes)
+
+		b := append(model.Batch(nil), batch...)
+		require.NoError(t, <-producer.ProcessBatchAsync(context.Background(), &b))
+		produced := broker.produced()
+		assert.Greater(t, len(produced), 1)
+		var records int
+		for _, pb := range produced {
+			records += len(pb.keys)
+		}
+		assert.Equal(t, len(batch), records)
+	})
+	t.Run("too_large", func(t *testing.T) {
+		producer, broker := newProducer(t, false)
+		b := append(model.Batch(nil), batch...)
+		err := <-producer.ProcessBatchAsync(context.Background(), &b)
+		assert.ErrorIs(t, err, kerr.MessageTooLarge)
+		assert.Empty(t, broker.produced())
+	})
+}
+
+func TestProducerFenced(t *testing.T) {
+	broker := newFakeBroker(t)
+	cfg := ProducerConfig{
+		Broker:  broker.addr.String(),
+		Encoder: messageEncoder{},
+	}
+	producer := newTestProducer(t, cfg)
+	produce := func() error {
+		batch := model.Batch{{Message: "a"}}
+		return <-producer.ProcessBatchAsync(context.Background(), &batch)
+	}
+	require.NoError(t, produce())
+	require.NoError(t, producer.Healthy())
+
+	// A producer with the same producer ID and a newer epoch fenced this one.
+	broker.setProduceError(kerr.ProducerFenced)
+	err := produce()
+	assert.ErrorIs(t, err, ErrProducerFenced)
+	assert.ErrorIs(t, err, kerr.ProducerFenced)
+	var unacked *UnackedError
+	require.ErrorAs(t, err, &unacked)
+	assert.Len(t, unacked.Events, 1)
+	assert.ErrorIs(t, producer.Healthy(), ErrProducerFenced)
+
+	// Other produce errors aren't fencing errors.
+	broker.setProduceError(kerr.InvalidRecord)
+	err = produce()
+	assert.ErrorIs(t, err, kerr.InvalidRecord)
+	assert.NotErrorIs(t, err, ErrProducerFenced)
+
+	// Reconfiguring the producer creates a new client.
+	broker.setProduceError(nil)
+	require.NoError(t, producer.Reconfigure(producer.cfg))
+	require.NoError(t, produce())
+	require.NoError(t, producer.Healthy())
+}
+
+func TestProducerProcessBatchAsync(t *testing.T) {
+	encoder := &countingEncoder{}
+	producer := newTestProducer(t, ProducerConfig{Encoder: encoder})
+	errProduce := errors.New("broker down")
+	release := make(chan struct{})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		var event model.APMEvent
+		require.NoError(t, codec.JSON{}.Decode(r.Value, &event))
+		go func() {
+			<-release
+			if event.Message == "fail" {
+				promise(r, errProduce)
+				return
+			}
+			promise(r, nil)
+		}()
+	}
+
+	batch := model.Batch{{Message: "a"}, {Message: "b"}}
+	result := producer.ProcessBatchAsync(context.Background(), &batch)
+	// The events are encoded before ProcessBatchAsync returns.
+	assert.Equal(t, int64(2), encoder.count.Load())
+	select {
+	case err := <-result:
+		t.Fatalf("unexpected result before the records were acknowledged: %v", err)
+	default:
+	}
+	close(release)
+	assert.NoError(t, <-result)
+
+	batch = model.Batch{{Message: "a"}, {Message: "fail"}}
+	err := <-producer.ProcessBatchAsync(context.Background(), &batch)
+	var unacked *UnackedError
+	require.True(t, errors.As(err, &unacked))
+	assert.ErrorIs(t, err, errProduce)
+	assert.Equal(t, model.Batch{{Message: "fail"}}, unacked.Events)
+}
+
+func TestProducerProcessRecords(t *testing.T) {
+	producer := newTestProducer(t, ProducerConfig{Sync: true})
+	consumed := []*kgo.Record{
+		{
+			Topic:     "source",
+			Partition: 3,
+			Offset:    100,
+			Key:       []byte("key-1"),
+			Value:     []byte("value-1"),
+			Headers:   []kgo.RecordHeader{{Key: "route", Value: []byte("a")}},
+		},
+		{
+			Topic:     "source",
+			Partition: 1,
+			Offset:    200,
+			Key:       []byte("key-2"),
+			Value:     []byte("value-2"),
+			Headers:   []kgo.RecordHeader{{Key: "route", Value: []byte("b")}},
+		},
+	}
+	forward := make([]*kgo.Record, 0, len(consumed))
+	for _, r := range consumed {
+		fwd := *r
+		fwd.Topic = "dest-" + string(r.Headers[0].Value)
+		forward = append(forward, &fwd)
+	}
+
+	// The broker never replies, so the records are returned as unacked.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := producer.ProcessRecords(ctx, forward)
+	var unacked *UnackedError
+	require.True(t, errors.As(err, &unacked))
+	require.Len(t, unacked.Records, len(forward))
+	for i, r := range unacked.Records {
+		assert.Equal(t, forward[i].Topic, r.Topic)
+		assert.Equal(t, consumed[i].Key, r.Key)
+		assert.Equal(t, consumed[i].Value, r.Value)
+		assert.Equal(t, consumed[i].Headers, r.Headers)
+		assert.NotSame(t, forward[i], r)
+	}
+
+	err = producer.ProcessRecords(ctx, []*kgo.Record{{Value: []byte("a")}})
+	assert.EqualError(t, err, "kafka: record topic must be set")
+}
+
+func TestProducerProduceRaw(t *testing.T) {
+	encoder := &countingEncoder{}
+	producer := newTestProducer(t, ProducerConfig{Sync: true, Encoder: encoder})
+	var produced []*kgo.Record
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		produced = append(produced, r)
+		promise(r, nil)
+	}
+	value := []byte(`{"message":"encoded"}`)
+	headers := []kgo.RecordHeader{{Key: "tenant", Value: []byte("a")}}
+	require.NoError(t, producer.ProduceRaw(context.Background(),
+		"raw", []byte("key"), value, headers...,
+	))
+	require.Len(t, produced, 1)
+	assert.Equal(t, "raw", produced[0].Topic)
+	assert.Equal(t, []byte("key"), produced[0].Key)
+	assert.Equal(t, value, produced[0].Value)
+	assert.Equal(t, headers, produced[0].Headers)
+	assert.Zero(t, encoder.count.Load())
+
+	assert.EqualError(t, producer.ProduceRaw(context.Background(), "", nil, value),
+		"kafka: record topic must be set",
+	)
+}
+
+func TestProducerMirror(t *testing.T) {
+	mirror := &memoryMirror{}
+	producer := newTestProducer(t, ProducerConfig{Sync: true, Mirror: mirror})
+	var produced []*kgo.Record
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		produced = append(produced, r)
+		promise(r, nil)
+	}
+	batch := model.Batch{{Message: "a"}, {Message: "b"}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, producer.ProduceRaw(context.Background(), "raw", nil, []byte("c")))
+	require.Len(t, produced, 3)
+	require.Len(t, mirror.values, 3)
+	for i, r := range produced {
+		assert.Equal(t, apmqueue.Topic(r.Topic), mirror.topics[i])
+		assert.Equal(t, r.Value, mirror.values[i])
+	}
+
+	errMirror := errors.New("sink unavailable")
+	mirror.err = errMirror
+	produced = nil
+	err := producer.ProcessBatch(context.Background(), &batch)
+	var mirrorErr *MirrorError
+	require.True(t, errors.As(err, &mirrorErr))
+	assert.Equal(t, apmqueue.Topic("topic"), mirrorErr.Topic)
+	assert.ErrorIs(t, err, errMirror)
+	assert.Empty(t, produced)
+}
+
+func TestProducerAutoCreateTopics(t *testing.T) {
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:               true,
+		AutoCreateTopics:   true,
+		DefaultPartitions:  8,
+		DefaultReplication: 3,
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(event.Message)
+		},
+	})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		promise(r, nil)
+	}
+	var created []kmsg.CreateTopicsRequestTopic
+	producer.createTopics = func(_ context.Context, req *kmsg.CreateTopicsRequest) (*kmsg.CreateTopicsResponse, error) {
+		created = append(created, req.Topics...)
+		resp := kmsg.NewPtrCreateTopicsResponse()
+		for _, t := range req.Topics {
+			rt := kmsg.NewCreateTopicsResponseTopic()
+			rt.Topic = t.Topic
+			if t.Topic == "existing" {
+				rt.ErrorCode = kerr.TopicAlreadyExists.Code
+			}
+			resp.Topics = append(resp.Topics, rt)
+		}
+		return resp, nil
+	}
+	batch := model.Batch{{Message: "new"}, {Message: "existing"}, {Message: "new"}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	// Topics are only created once.
+	require.Len(t, created, 2)
+	for i, topic := range []string{"new", "existing"} {
+		assert.Equal(t, topic, created[i].Topic)
+		assert.Equal(t, int32(8), created[i].NumPartitions)
+		assert.Equal(t, int16(3), created[i].ReplicationFactor)
+	}
+
+	cfg := producer.cfg
+	cfg.DefaultPartitions = -1
+	assert.EqualError(t, cfg.Validate(), "kafka: default partitions cannot be negative")
+	cfg = producer.cfg
+	cfg.AutoCreateTopics = false
+	assert.EqualError(t, cfg.Validate(),
+		"kafka: default partitions and replication require auto create topics",
+	)
+}
+
+func TestProducerStreamingEncode(t *testing.T) {
+	const maxBuffered = 10
+	encoder := &countingEncoder{}
+	producer := newTestProducer(t, ProducerConfig{
+		Encoder:            encoder,
+		MaxBufferedRecords: maxBuffered,
+	})
+	batch := make(model.Batch, 1000)
+
+	// The broker never replies, so ProcessBatch blocks once the buffer is
+	// full, until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := producer.ProcessBatch(ctx, &batch)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	var unacked *UnackedError
+	require.True(t, errors.As(err, &unacked))
+	// Only the events which fit in the buffer, plus the one blocked in
+	// Produce, have been encoded.
+	assert.LessOrEqual(t, encoder.count.Load(), int64(maxBuffered+1))
+	assert.Len(t, unacked.Events, len(batch)-int(encoder.count.Load()))
+}
+
+func TestProducerStreamingEncodeMemory(t *testing.T) {
+	const maxBuffered, events, size = 10, 1000, 64 << 10
+	var encoded atomic.Int64
+	producer := newTestProducer(t, ProducerConfig{
+		Encoder: encoderFunc(func(model.APMEvent) ([]byte, error) {
+			encoded.Add(1)
+			return make([]byte, size), nil
+		}),
+		MaxBufferedRecords: maxBuffered,
+	})
+	batch := make(model.Batch, events)
+
+	var before, during runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- producer.ProcessBatch(ctx, &batch) }()
+	// The broker never replies, so ProcessBatch blocks once the buffer is
+	// full. Measure the memory held by the encoded events meanwhile.
+	require.Eventually(t, func() bool {
+		return encoded.Load() > maxBuffered
+	}, 5*time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	runtime.GC()
+	runtime.ReadMemStats(&during)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	// Encoding the whole batch up front would hold events*size bytes, about
+	// 64MiB, while streaming holds the buffered records only.
+	held := int64(during.HeapAlloc) - int64(before.HeapAlloc)
+	assert.Less(t, held, int64(events*size/8),
+		"%d bytes held while producing %d events of %d bytes", held, events, size,
+	)
+}
+
+func TestProducerCancelledMidBatch(t *testing.T) {
+	producer := newTestProducer(t, ProducerConfig{Sync: true})
+	var cancelBatch context.CancelFunc
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		// The context is done once the first record is produced.
+		cancelBatch()
+		promise(r, nil)
+	}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelBatch = cancel
+		batch := model.Batch{{Message: "a"}, {Message: "b"}, {Message: "c"}}
+		err := producer.ProcessBatch(ctx, &batch)
+		cancel()
+		var unacked *UnackedError
+		require.ErrorAs(t, err, &unacked)
+		assert.Len(t, unacked.Events, 2)
+	}
+	// No goroutine is left waiting for the records which weren't produced.
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= before+5
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestProducerBatchEncoder(t *testing.T) {
+	encoder := &framingEncoder{}
+	producer := newTestProducer(t, ProducerConfig{Sync: true, Encoder: encoder})
+	var produced []*kgo.Record
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		produced = append(produced, r)
+		promise(r, nil)
+	}
+	batch := model.Batch{{Message: "a"}, {Message: "b"}, {Message: "c"}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Zero(t, encoder.count.Load(), "Encode should not be called")
+	require.Len(t, produced, 3)
+	for i, want := range []string{"0/3:a", "1/3:b", "2/3:c"} {
+		assert.Equal(t, want, string(produced[i].Value))
+	}
+
+	// Batch encoders must return a value for every event.
+	encoder.drop = true
+	produced = nil
+	err := producer.ProcessBatch(context.Background(), &batch)
+	assert.EqualError(t, err, "failed to encode batch: encoded 2 of 3 events")
+	assert.Empty(t, produced)
+}
+
+func TestProducerDialer(t *testing.T) {
+	broker := stalledBroker(t)
+	dialed := make(chan string, 1)
+	newTestProducer(t, ProducerConfig{
+		Broker: broker,
+		Dialer: func(ctx context.Context, network, host string) (net.Conn, error) {
+			select {
+			case dialed <- host:
+			default:
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, host)
+		},
+	})
+	select {
+	case host := <-dialed:
+		assert.Equal(t, broker, host)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the dialer to be called")
+	}
+}
+
+func TestProducerMaxCloseWaitBytes(t *testing.T) {
+	t.Run("within budget", func(t *testing.T) {
+		producer := newTestProducer(t, ProducerConfig{MaxCloseWaitBytes: 1024})
+		assert.NoError(t, producer.Close())
+	})
+	t.Run("exceeding budget", func(t *testing.T) {
+		producer := newTestProducer(t, ProducerConfig{MaxCloseWaitBytes: 10})
+		batch := model.Batch{
+			{Transaction: &model.Transaction{ID: "1"}},
+			{Transaction: &model.Transaction{ID: "2"}},
+		}
+		require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+		closed := make(chan error, 1)
+		go func() { closed <- producer.Close() }()
+		select {
+		case err := <-closed:
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "closing with 2 undelivered records")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for Close to return")
+		}
+		// Closing the client fails the buffered records.
+		assert.Eventually(t, func() bool {
+			return producer.bufferedRecords.Load() == 0 && producer.bufferedBytes.Load() == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+	t.Run("stalled within budget", func(t *testing.T) {
+		// The broker never acknowledges the records, Close gives up once
+		// MaxCloseWait elapses.
+		producer := newTestProducer(t, ProducerConfig{
+			MaxCloseWaitBytes: 1 << 20,
+			MaxCloseWait:      100 * time.Millisecond,
+		})
+		batch := model.Batch{
+			{Transaction: &model.Transaction{ID: "1"}},
+			{Transaction: &model.Transaction{ID: "2"}},
+		}
+		require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+		bytes := producer.bufferedBytes.Load()
+
+		closed := make(chan error, 1)
+		go func() { closed <- producer.Close() }()
+		select {
+		case err := <-closed:
+			assert.EqualError(t, err, fmt.Sprintf(
+				"kafka: closing with 2 undelivered records (%d bytes), exceeding max close wait (100ms)",
+				bytes,
+			))
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for Close to return")
+		}
+	})
+	t.Run("negative", func(t *testing.T) {
+		err := ProducerConfig{MaxCloseWaitBytes: -1}.Validate()
+		assert.ErrorContains(t, err, "kafka: max close wait bytes cannot be negative")
+		err = ProducerConfig{MaxCloseWait: -1}.Validate()
+		assert.ErrorContains(t, err, "kafka: max close wait cannot be negative")
+	})
+}
+
+// newTestProducer returns a producer with the required configuration set to
+// sensible defaults, connected to a broker which never replies.
+func newTestProducer(t testing.TB, cfg ProducerConfig) *Producer {
+	if cfg.Broker == "" {
+		cfg.Broker = stalledBroker(t)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop()
+	}
+	if cfg.Encoder == nil {
+		cfg.Encoder = codec.JSON{}
+	}
+	if cfg.TopicRouter == nil {
+		cfg.TopicRouter = func(model.APMEvent) apmqueue.Topic {
+			return "topic"
+		}
+	}
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+	return producer
+}
+
+// recordCollector returns a RecordMutator which appends the records to rs.
+func recordCollector(rs *[]*kgo.Record) RecordMutator {
+	return func(_ model.APMEvent, r *kgo.Record) error {
+		*rs = append(*rs, r)
+		return nil
+	}
+}
+
+// memoryMirror is a MirrorSink which keeps the mirrored records in memory.
+type memoryMirror struct {
+	topics []apmqueue.Topic
+	values [][]byte
+	err    error
+}
+
+func (m *memoryMirror) Mirror(topic apmqueue.Topic, value []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.topics = append(m.topics, topic)
+	m.values = append(m.values, value)
+	return nil
+}
+
+// framingEncoder is a BatchEncoder which frames the message of each event
+// with its position in the batch. When drop is set, it omits the last event.
+type framingEncoder struct {
+	countingEncoder
+	drop bool
+}
+
+func (e *framingEncoder) EncodeBatch(batch model.Batch) ([][]byte, error) {
+	values := make([][]byte, 0, len(batch))
+	for i, event := range batch {
+		values = append(values, []byte(fmt.Sprintf("%d/%d:%s", i, len(batch), event.Message)))
+	}
+	if e.drop {
+		values = values[:len(values)-1]
+	}
+	return values, nil
+}
+
+// countingEncoder counts the number of encoded events.
+type countingEncoder struct {
+	codec.JSON
+	count atomic.Int64
+}
+
+func (e *countingEncoder) Encode(event model.APMEvent) ([]byte, error) {
+	e.count.Add(1)
+	return e.JSON.Encode(event)
+}
+
+// encoderFunc is an Encoder implemented by a function.
+type encoderFunc func(model.APMEvent) ([]byte, error)
+
+func (f encoderFunc) Encode(event model.APMEvent) ([]byte, error) {
+	return f(event)
+}
@@ -0,0 +1,166 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// RunRange executes the consumer in a blocking manner to replay the records
+// whose timestamp is between from and to, inclusive. Every partition of the
+// consumer topics is sought to its first record at or after from, and
+// RunRange returns once the records up to the first record after to have
+// been consumed in every partition, which were in the partitions when it
+// was called. The records outside of the range, which records with
+// out-of-order timestamps may be, aren't processed. It returns nil
+// immediately when no record is in the range.
+//
+// RunRange is meant for targeted replays with a consumer group dedicated to
+// them, where the consumer is the only member of its group; partitions
+// assigned to other members never complete from the point of view of this
+// consumer. The offsets of the replayed records are committed as usual.
+func (c *Consumer) RunRange(ctx context.Context, from, to time.Time) error {
+	if to.Before(from) {
+		return errors.New("kafka: range end cannot be before its start")
+	}
+	end, err := c.listOffsets(ctx, -1)
+	if err != nil {
+		return fmt.Errorf("failed to list end offsets: %w", err)
+	}
+	start, err := c.listOffsets(ctx, from.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to list range start offsets: %w", err)
+	}
+	// The range stops at the first record after to.
+	stop, err := c.listOffsets(ctx, to.UnixMilli()+1)
+	if err != nil {
+		return fmt.Errorf("failed to list range stop offsets: %w", err)
+	}
+	for _, offsets := range []map[string]map[int32]int64{start, stop} {
+		for topic, partitions := range offsets {
+			for partition, offset := range partitions {
+				if offset < 0 {
+					// No record after the timestamp, up to the end offset.
+					partitions[partition] = end[topic][partition]
+				}
+			}
+		}
+	}
+	pending := newCatchUp(stop, start)
+	if pending.done() {
+		return nil
+	}
+	c.startRange(start, &backfillRange{from: from, to: to, stop: stop})
+	defer c.stopRange()
+	for !pending.done() {
+		fetches, err := c.fetch(ctx)
+		if err != nil {
+			return err
+		}
+		pending.update(fetches)
+	}
+	return nil
+}
+
+// backfillRange holds the range of the records processed by RunRange.
+type backfillRange struct {
+	from, to time.Time
+	// stop holds the offset of the first record after to, in every
+	// partition.
+	stop map[string]map[int32]int64
+}
+
+// skip returns true if msg is outside of the range. It returns false for
+// every record when r is nil.
+func (r *backfillRange) skip(msg *kgo.Record) bool {
+	if r == nil {
+		return false
+	}
+	if msg.Timestamp.Before(r.from) || msg.Timestamp.After(r.to) {
+		return true
+	}
+	stop, ok := r.stop[msg.Topic][msg.Partition]
+	return ok && msg.Offset >= stop
+}
+
+// startRange sets the range processed by RunRange, and seeks the partitions
+// to the start offsets: the assigned partitions immediately, the others once
+// they're assigned.
+func (c *Consumer) startRange(start map[string]map[int32]int64, r *backfillRange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backfill = r
+
+	c.assignmentMu.Lock()
+	c.seeks = make(map[string]map[int32]int64, len(start))
+	for topic, partitions := range start {
+		c.seeks[topic] = make(map[int32]int64, len(partitions))
+		for partition, offset := range partitions {
+			c.seeks[topic][partition] = offset
+		}
+	}
+	assigned := make(map[string]map[int32]kgo.EpochOffset)
+	for topic, partitions := range c.assignment {
+		for _, partition := range partitions {
+			offset, ok := c.seeks[topic][partition]
+			if !ok {
+				continue
+			}
+			delete(c.seeks[topic], partition)
+			if assigned[topic] == nil {
+				assigned[topic] = make(map[int32]kgo.EpochOffset)
+			}
+			assigned[topic][partition] = kgo.EpochOffset{Epoch: -1, Offset: offset}
+		}
+	}
+	c.assignmentMu.Unlock()
+	c.setOffsets(assigned)
+}
+
+// stopRange clears the range processed by RunRange.
+func (c *Consumer) stopRange() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backfill = nil
+	c.assignmentMu.Lock()
+	c.seeks = nil
+	c.assignmentMu.Unlock()
+}
+
+// seekAssigned replaces the fetch offsets of the newly assigned partitions
+// which haven't been sought to the start of the RunRange range yet.
+func (c *Consumer) seekAssigned(offsets map[string]map[int32]kgo.Offset) map[string]map[int32]kgo.Offset {
+	c.assignmentMu.Lock()
+	defer c.assignmentMu.Unlock()
+	for topic, partitions := range offsets {
+		for partition := range partitions {
+			offset, ok := c.seeks[topic][partition]
+			if !ok {
+				continue
+			}
+			delete(c.seeks[topic], partition)
+			partitions[partition] = kgo.NewOffset().At(offset)
+		}
+	}
+	return offsets
+}
@@ -0,0 +1,159 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsumerRunRange(t *testing.T) {
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Partition 0 holds a record every minute, partition 1 every two
+	// minutes, with a record out of order.
+	log := map[int32][]*kgo.Record{}
+	for i := 0; i < 10; i++ {
+		log[0] = append(log[0], &kgo.Record{
+			Topic: "topic", Partition: 0, Offset: int64(i),
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+		})
+		log[1] = append(log[1], &kgo.Record{
+			Topic: "topic", Partition: 1, Offset: int64(i),
+			Timestamp: base.Add(time.Duration(2*i) * time.Minute),
+		})
+	}
+	log[1][3].Timestamp = base
+	for _, records := range log {
+		for _, r := range records {
+			r.Value = []byte(r.Timestamp.Format("15:04"))
+		}
+	}
+
+	var mu sync.Mutex
+	var processed []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, (*b)[0].Message)
+			return nil
+		}),
+	})
+	consumer.commitOffsets = func(context.Context) error { return nil }
+	consumer.listOffsets = func(_ context.Context, timestamp int64) (map[string]map[int32]int64, error) {
+		offsets := map[string]map[int32]int64{"topic": {}}
+		for partition, records := range log {
+			offset := int64(len(records))
+			if timestamp >= 0 {
+				offset = -1
+				for _, r := range records {
+					if r.Timestamp.UnixMilli() >= timestamp {
+						offset = r.Offset
+						break
+					}
+				}
+			}
+			offsets["topic"][partition] = offset
+		}
+		return offsets, nil
+	}
+	// The consumer starts at the end of the partitions.
+	cursors := map[int32]int64{0: 10, 1: 10}
+	consumer.setOffsets = func(offsets map[string]map[int32]kgo.EpochOffset) {
+		for partition, offset := range offsets["topic"] {
+			cursors[partition] = offset.Offset
+		}
+	}
+	consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+		var partitions []kgo.FetchPartition
+		for partition, records := range log {
+			// Fetch up to 2 records per partition.
+			fetched := records[cursors[partition]:]
+			if len(fetched) > 2 {
+				fetched = fetched[:2]
+			}
+			cursors[partition] += int64(len(fetched))
+			partitions = append(partitions, kgo.FetchPartition{
+				Partition: partition, Records: fetched,
+			})
+		}
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic: "topic", Partitions: partitions,
+		}}}}
+	}
+	consumer.assigned(context.Background(), nil, map[string][]int32{"topic": {0, 1}})
+
+	err := consumer.RunRange(context.Background(),
+		base.Add(3*time.Minute), base.Add(8*time.Minute),
+	)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"00:03", "00:04", "00:05", "00:06", "00:07", "00:08", // Partition 0.
+		"00:04", "00:08", // Partition 1, without the out of order record.
+	}, processed)
+	// The records after the range aren't processed once it completes.
+	assert.Less(t, cursors[0], int64(len(log[0])))
+
+	// Empty ranges return immediately.
+	processed = nil
+	err = consumer.RunRange(context.Background(),
+		base.Add(time.Minute+time.Second), base.Add(2*time.Minute-time.Second),
+	)
+	require.NoError(t, err)
+	assert.Empty(t, processed)
+
+	err = consumer.RunRange(context.Background(), base, base.Add(-time.Second))
+	assert.EqualError(t, err, "kafka: range end cannot be before its start")
+}
+
+func TestConsumerRangeAdjustOffsets(t *testing.T) {
+	consumer := newTestConsumer(t, ConsumerConfig{})
+	consumer.setOffsets = func(map[string]map[int32]kgo.EpochOffset) {}
+	consumer.startRange(map[string]map[int32]int64{"topic": {0: 3, 1: 5}}, &backfillRange{})
+
+	// The partitions assigned while RunRange runs are sought to the range
+	// start once.
+	offsets, err := consumer.adjustOffsets(context.Background(), map[string]map[int32]kgo.Offset{
+		"topic": {1: kgo.NewOffset(), 2: kgo.NewOffset()},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[int32]kgo.Offset{
+		"topic": {1: kgo.NewOffset().At(5), 2: kgo.NewOffset()},
+	}, offsets)
+	offsets, err = consumer.adjustOffsets(context.Background(), map[string]map[int32]kgo.Offset{
+		"topic": {1: kgo.NewOffset()},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[int32]kgo.Offset{"topic": {1: kgo.NewOffset()}}, offsets)
+
+	// The offsets aren't adjusted once RunRange returns.
+	consumer.stopRange()
+	offsets, err = consumer.adjustOffsets(context.Background(), map[string]map[int32]kgo.Offset{
+		"topic": {0: kgo.NewOffset()},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[int32]kgo.Offset{"topic": {0: kgo.NewOffset()}}, offsets)
+}
@@ -0,0 +1,111 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// cachedRouterSize is the maximum number of routing decisions cached by the
+// TopicRouter returned by CachedRouter.
+const cachedRouterSize = 1024
+
+// CachedRouter returns an apmqueue.TopicRouter which caches the topics
+// returned by inner by the key returned by keyFunc, so that inner is only
+// called once for each distinct key. keyFunc must be cheaper to compute than
+// inner, and events with the same key must be routed to the same topic. The
+// least recently used keys are evicted once more than 1024 keys are cached.
+// The returned router is safe for concurrent use.
+func CachedRouter(keyFunc func(model.APMEvent) string, inner apmqueue.TopicRouter) apmqueue.TopicRouter {
+	c := routerCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	return func(event model.APMEvent) apmqueue.Topic {
+		key := keyFunc(event)
+		if topic, ok := c.get(key); ok {
+			return topic
+		}
+		topic := inner(event)
+		c.add(key, topic)
+		return topic
+	}
+}
+
+// SizeBasedRouter returns an apmqueue.TopicRouter which routes the events
+// whose size is larger than threshold bytes to large, and the other events
+// to small, for example to configure a different retention for each topic.
+// The size of an event is the length of its encoding by enc, which should
+// be the producer Encoder so the size matches the produced record value.
+// Routed events are encoded once more. Events which fail to be encoded are
+// routed to small, and are reported by the producer once its Encoder fails
+// to encode them too.
+func SizeBasedRouter(threshold int, small, large apmqueue.Topic, enc Encoder) apmqueue.TopicRouter {
+	return func(event model.APMEvent) apmqueue.Topic {
+		b, err := enc.Encode(event)
+		if err != nil || len(b) <= threshold {
+			return small
+		}
+		return large
+	}
+}
+
+// routerCache is a least recently used cache of topics by routing key.
+type routerCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds the cached entries, from the most to the least recently
+	// used.
+	lru *list.List
+}
+
+type routerCacheEntry struct {
+	key   string
+	topic apmqueue.Topic
+}
+
+func (c *routerCache) get(key string) (apmqueue.Topic, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*routerCacheEntry).topic, true
+}
+
+func (c *routerCache) add(key string, topic apmqueue.Topic) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		// Routed concurrently by another goroutine.
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&routerCacheEntry{key: key, topic: topic})
+	if c.lru.Len() > cachedRouterSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*routerCacheEntry).key)
+	}
+}
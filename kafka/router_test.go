@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestCachedRouter(t *testing.T) {
+	calls := make(map[string]int)
+	router := CachedRouter(
+		func(event model.APMEvent) string { return event.Service.Name },
+		func(event model.APMEvent) apmqueue.Topic {
+			calls[event.Service.Name]++
+			return apmqueue.Topic("apm-" + event.Service.Name)
+		},
+	)
+	for _, name := range []string{"a", "b", "a", "c", "b", "a"} {
+		event := model.APMEvent{Service: model.Service{Name: name}}
+		assert.Equal(t, apmqueue.Topic("apm-"+name), router(event))
+	}
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1}, calls)
+}
+
+func TestCachedRouterEviction(t *testing.T) {
+	var calls int
+	router := CachedRouter(
+		func(event model.APMEvent) string { return event.Message },
+		func(event model.APMEvent) apmqueue.Topic {
+			calls++
+			return apmqueue.Topic(event.Message)
+		},
+	)
+	router(model.APMEvent{Message: "first"})
+	for i := 0; i < cachedRouterSize; i++ {
+		router(model.APMEvent{Message: fmt.Sprint(i)})
+	}
+	// The most recently used keys are still cached.
+	router(model.APMEvent{Message: fmt.Sprint(cachedRouterSize - 1)})
+	assert.Equal(t, cachedRouterSize+1, calls)
+	// The least recently used key was evicted.
+	router(model.APMEvent{Message: "first"})
+	assert.Equal(t, cachedRouterSize+2, calls)
+}
+
+func TestSizeBasedRouter(t *testing.T) {
+	var records []*kgo.Record
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:        true,
+		Encoder:     messageEncoder{},
+		TopicRouter: SizeBasedRouter(10, "small", "large", messageEncoder{}),
+	})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		records = append(records, r)
+		promise(r, nil)
+	}
+	batch := model.Batch{
+		{Message: "small"},
+		{Message: strings.Repeat("large", 1024)},
+		{Message: strings.Repeat("x", 10)},
+		{Message: strings.Repeat("y", 11)},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	topics := make(map[string]string)
+	for _, r := range records {
+		topics[string(r.Value)] = r.Topic
+	}
+	assert.Equal(t, map[string]string{
+		"small":                       "small",
+		strings.Repeat("large", 1024): "large",
+		strings.Repeat("x", 10):       "small",
+		strings.Repeat("y", 11):       "large",
+	}, topics)
+}
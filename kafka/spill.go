@@ -0,0 +1,326 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// spillExt is the extension of the spill files.
+const spillExt = ".spill"
+
+// spill persists records to files in a directory, from which they can be
+// replayed. Each file holds a sequence of frames made of the length of the
+// encoded record, as a big endian uint32, followed by the record.
+type spill struct {
+	dir string
+
+	mu   sync.Mutex
+	file *os.File
+	seq  int
+}
+
+func newSpill(dir string) (*spill, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &spill{dir: dir}, nil
+}
+
+// write appends r to the current spill file, creating it if needed.
+func (s *spill) write(r *kgo.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		// Names sort in the order the files were created.
+		s.seq++
+		name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq, spillExt)
+		f, err := os.OpenFile(filepath.Join(s.dir, name),
+			os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create spill file: %w", err)
+		}
+		s.file = f
+	}
+	if _, err := s.file.Write(appendSpillFrame(nil, r)); err != nil {
+		return fmt.Errorf("failed to spill record: %w", err)
+	}
+	return nil
+}
+
+// rotate closes the current spill file, so that the records spilled from then
+// on are written to a new file, and returns the paths of all the spill files
+// which aren't written to anymore, oldest first.
+func (s *spill) rotate() ([]string, error) {
+	if err := s.close(); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+spillExt))
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		// A record was spilled since the file was closed.
+		current := s.file.Name()
+		for i, path := range paths {
+			if path == current {
+				paths = append(paths[:i], paths[i+1:]...)
+				break
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// close syncs and closes the current spill file, if any.
+func (s *spill) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	f := s.file
+	s.file = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReplaySpilled produces the records spilled to SpillDir, removing each spill
+// file once all its records have been acknowledged. Records which fail to be
+// produced, or are spilled again because the buffer is still full, are
+// written to a new spill file. When ctx is done before all the records of a
+// file have been acknowledged, the file is kept and its records are produced
+// again by the next call.
+//
+// It should be called on startup, to produce the records spilled by previous
+// processes, and once the brokers have recovered from an outage.
+func (p *Producer) ReplaySpilled(ctx context.Context) error {
+	if p.spill == nil {
+		return errors.New("kafka: spill dir is not set")
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	// Replaying the same file concurrently would duplicate its records.
+	p.replayMu.Lock()
+	defer p.replayMu.Unlock()
+
+	paths, err := p.spill.rotate()
+	if err != nil {
+		return fmt.Errorf("failed to rotate spill file: %w", err)
+	}
+	for _, path := range paths {
+		if err := p.replay(ctx, path); err != nil {
+			return fmt.Errorf("failed to replay %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// replay produces the records of the spill file at path, and removes it.
+func (p *Producer) replay(ctx context.Context, path string) error {
+	records, err := readSpillFile(path)
+	if err != nil {
+		return err
+	}
+	acks := newAckTracker(len(records))
+	for i, r := range records {
+		p.produce(ctx, r, p.promise(acks, i, ""))
+	}
+	if unacked := acks.wait(ctx); len(unacked) > 0 {
+		return ctx.Err()
+	}
+	failed, _ := acks.failed()
+	for _, i := range failed {
+		if err := p.spill.write(records[i]); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// spillOnFull wraps tryProduce, which fails the records with
+// kgo.ErrMaxBuffered when the client buffer is full, writing those records to
+// the spill instead. Spilled records are reported as acknowledged.
+func (p *Producer) spillOnFull(
+	tryProduce func(context.Context, *kgo.Record, func(*kgo.Record, error)),
+) func(context.Context, *kgo.Record, func(*kgo.Record, error)) {
+	return func(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		tryProduce(ctx, r, func(r *kgo.Record, err error) {
+			if errors.Is(err, kgo.ErrMaxBuffered) {
+				err = p.spill.write(r)
+			}
+			promise(r, err)
+		})
+	}
+}
+
+// appendSpillFrame appends the frame of r to b. Nil keys and values are
+// encoded with a negative length.
+func appendSpillFrame(b []byte, r *kgo.Record) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0) // Frame length, set below.
+	b = binary.AppendUvarint(b, uint64(len(r.Topic)))
+	b = append(b, r.Topic...)
+	b = appendSpillBytes(b, r.Key)
+	b = appendSpillBytes(b, r.Value)
+	var ts int64
+	if !r.Timestamp.IsZero() {
+		ts = r.Timestamp.UnixNano()
+	}
+	b = binary.AppendVarint(b, ts)
+	b = binary.AppendUvarint(b, uint64(len(r.Headers)))
+	for _, h := range r.Headers {
+		b = binary.AppendUvarint(b, uint64(len(h.Key)))
+		b = append(b, h.Key...)
+		b = appendSpillBytes(b, h.Value)
+	}
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
+
+func appendSpillBytes(b, v []byte) []byte {
+	if v == nil {
+		return binary.AppendVarint(b, -1)
+	}
+	b = binary.AppendVarint(b, int64(len(v)))
+	return append(b, v...)
+}
+
+// readSpillFile returns the records of the spill file at path. A truncated
+// last frame, left by a process which crashed while spilling, is ignored.
+func readSpillFile(path string) ([]*kgo.Record, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var records []*kgo.Record
+	for len(b) >= 4 {
+		n := int(binary.BigEndian.Uint32(b))
+		if len(b)-4 < n {
+			break
+		}
+		r, err := decodeSpillRecord(b[4 : 4+n])
+		if err != nil {
+			return nil, fmt.Errorf("corrupt record at frame %d: %w", len(records), err)
+		}
+		records = append(records, r)
+		b = b[4+n:]
+	}
+	return records, nil
+}
+
+// decodeSpillRecord decodes a record encoded by appendSpillFrame.
+func decodeSpillRecord(b []byte) (*kgo.Record, error) {
+	d := spillDecoder{b: b}
+	r := &kgo.Record{Topic: string(d.bytes(d.uvarint()))}
+	r.Key = d.nullableBytes()
+	r.Value = d.nullableBytes()
+	if ts := d.varint(); ts != 0 {
+		r.Timestamp = time.Unix(0, ts)
+	}
+	if n := d.uvarint(); n > 0 && d.err == nil {
+		r.Headers = make([]kgo.RecordHeader, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			key := string(d.bytes(d.uvarint()))
+			r.Headers = append(r.Headers, kgo.RecordHeader{
+				Key: key, Value: d.nullableBytes(),
+			})
+		}
+	}
+	if d.err == nil && len(d.b) > 0 {
+		d.err = errors.New("trailing bytes")
+	}
+	return r, d.err
+}
+
+// spillDecoder decodes the fields of a spilled record, keeping the first
+// error.
+type spillDecoder struct {
+	b   []byte
+	err error
+}
+
+var errShortSpillRecord = errors.New("short record")
+
+func (d *spillDecoder) uvarint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 || v > uint64(len(d.b)) {
+		d.err = errShortSpillRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return int(v)
+}
+
+func (d *spillDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errShortSpillRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *spillDecoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.b) {
+		d.err = errShortSpillRecord
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *spillDecoder) nullableBytes() []byte {
+	n := d.varint()
+	if d.err != nil || n < 0 {
+		return nil
+	}
+	if n > int64(len(d.b)) {
+		d.err = errShortSpillRecord
+		return nil
+	}
+	return d.bytes(int(n))
+}
@@ -0,0 +1,137 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestProducerSpill(t *testing.T) {
+	dir := t.TempDir()
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:     true,
+		Encoder:  messageEncoder{},
+		SpillDir: dir,
+	})
+
+	// The broker accepts records only while it's up, otherwise the client
+	// buffer is full.
+	var mu sync.Mutex
+	var up bool
+	var delivered []string
+	producer.produce = producer.trackBuffered(producer.spillOnFull(
+		func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+			mu.Lock()
+			if !up {
+				mu.Unlock()
+				promise(r, kgo.ErrMaxBuffered)
+				return
+			}
+			delivered = append(delivered, string(r.Value))
+			mu.Unlock()
+			promise(r, nil)
+		},
+	))
+	setUp := func(v bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		up = v
+	}
+	ctx := context.Background()
+
+	// During the outage, the records are spilled rather than blocking.
+	batch := model.Batch{{Message: "a"}, {Message: "b"}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	require.NoError(t, producer.ProduceRaw(ctx, "topic", nil, []byte("c")))
+	assert.Empty(t, delivered)
+	assert.Len(t, spillFiles(t, dir), 1)
+
+	// Replaying while the outage lasts spills the records again.
+	require.NoError(t, producer.ReplaySpilled(ctx))
+	assert.Empty(t, delivered)
+	assert.Len(t, spillFiles(t, dir), 1)
+
+	// Once recovered, replaying produces all the spilled records.
+	setUp(true)
+	require.NoError(t, producer.ProduceRaw(ctx, "topic", nil, []byte("d")))
+	require.NoError(t, producer.ReplaySpilled(ctx))
+	assert.Equal(t, []string{"d", "a", "b", "c"}, delivered)
+	assert.Empty(t, spillFiles(t, dir))
+}
+
+func TestProducerReplaySpilledNotConfigured(t *testing.T) {
+	producer := newTestProducer(t, ProducerConfig{})
+	assert.EqualError(t, producer.ReplaySpilled(context.Background()),
+		"kafka: spill dir is not set",
+	)
+}
+
+func TestSpillFormat(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newSpill(dir)
+	require.NoError(t, err)
+	records := []*kgo.Record{
+		{
+			Topic:     "topic",
+			Key:       []byte("key"),
+			Value:     []byte("value"),
+			Timestamp: time.Unix(0, 1234567890),
+			Headers: []kgo.RecordHeader{
+				{Key: "a", Value: []byte("b")},
+				{Key: "empty", Value: []byte{}},
+			},
+		},
+		{Topic: "other", Value: []byte{}},
+	}
+	for _, r := range records {
+		require.NoError(t, s.write(r))
+	}
+	paths, err := s.rotate()
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+
+	// A truncated last frame is ignored.
+	f, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	frame := appendSpillFrame(nil, &kgo.Record{Topic: "truncated"})
+	_, err = f.Write(frame[:len(frame)-1])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	read, err := readSpillFile(paths[0])
+	require.NoError(t, err)
+	assert.Equal(t, records, read)
+}
+
+// spillFiles returns the spill files in dir.
+func spillFiles(t testing.TB, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+spillExt))
+	require.NoError(t, err)
+	return paths
+}
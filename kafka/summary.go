@@ -0,0 +1,75 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+// BatchSummary is the JSON encoded value of the summary records produced to
+// ProducerConfig.SummaryTopic for each ProcessBatch call.
+type BatchSummary struct {
+	// Events is the number of events produced.
+	Events int `json:"events"`
+	// EventTypes holds the number of events produced by EventType.
+	EventTypes map[string]int `json:"event_types"`
+	// Bytes is the total size of the encoded values of the produced records.
+	Bytes int `json:"bytes"`
+}
+
+// add accounts for the record produced for an event of eventType.
+func (s *BatchSummary) add(eventType string, record *kgo.Record) {
+	s.Events++
+	s.EventTypes[eventType]++
+	s.Bytes += len(record.Value)
+}
+
+// produceSummary produces summary to the SummaryTopic with the batch headers.
+// Failures are only logged.
+func (p *Producer) produceSummary(ctx context.Context, summary *BatchSummary, headers []kgo.RecordHeader) {
+	topic := string(p.cfg.SummaryTopic)
+	value, err := json.Marshal(summary)
+	if err == nil {
+		err = p.ensureTopic(ctx, topic)
+	}
+	if err != nil {
+		p.cfg.Logger.Error("failed producing batch summary",
+			zap.Error(err),
+			zap.String("topic", topic),
+		)
+		return
+	}
+	p.produce(ctx, &kgo.Record{
+		Topic:   topic,
+		Value:   value,
+		Headers: headers[:len(headers):len(headers)],
+	}, p.summaryPromise)
+}
+
+func (p *Producer) summaryPromise(msg *kgo.Record, err error) {
+	if err != nil {
+		p.cfg.Logger.Error("failed producing batch summary",
+			zap.Error(err),
+			zap.String("topic", msg.Topic),
+		)
+	}
+}
@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestProducerSummaryTopic(t *testing.T) {
+	producer := newTestProducer(t, ProducerConfig{
+		Encoder:      messageEncoder{},
+		SummaryTopic: "summary",
+	})
+	var produced []*kgo.Record
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		produced = append(produced, r)
+		promise(r, nil)
+	}
+	batch := model.Batch{
+		{Message: "log"},
+		{Message: "span-1", Span: &model.Span{ID: "s1"}},
+		{Message: "transaction", Transaction: &model.Transaction{ID: "t"}},
+		{Message: "span-2", Span: &model.Span{ID: "s2"}},
+		{Message: "metric", Metricset: &model.Metricset{Name: "app"}},
+	}
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"a": "b"})
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	// The summary is produced after the records of the batch.
+	require.Len(t, produced, len(batch)+1)
+	for _, r := range produced[:len(batch)] {
+		assert.Equal(t, "topic", r.Topic)
+	}
+	summary := produced[len(batch)]
+	assert.Equal(t, "summary", summary.Topic)
+	assert.Equal(t, []kgo.RecordHeader{{Key: "a", Value: []byte("b")}}, summary.Headers)
+	var decoded BatchSummary
+	require.NoError(t, json.Unmarshal(summary.Value, &decoded))
+	assert.Equal(t, BatchSummary{
+		Events: 5,
+		EventTypes: map[string]int{
+			"log": 1, "span": 2, "transaction": 1, "metric": 1,
+		},
+		Bytes: len("log") + len("span-1") + len("transaction") + len("span-2") + len("metric"),
+	}, decoded)
+}
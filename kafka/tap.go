@@ -0,0 +1,53 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// WithRecordTap calls tap with every record produced by p, before it's sent
+// to the client, and returns p. It's meant for tests asserting on the raw
+// records, such as their keys and headers, without consuming them from
+// Kafka. The record must not be modified. WithRecordTap must be called
+// before the producer is used, and has no cost when it isn't called.
+func (p *Producer) WithRecordTap(tap func(*kgo.Record)) *Producer {
+	produce := p.produce
+	p.produce = func(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		tap(r)
+		produce(ctx, r, promise)
+	}
+	return p
+}
+
+// WithRecordTap calls tap with every record fetched by c, before it's
+// processed, and returns c. It's meant for tests asserting on the raw
+// records, such as their keys and headers. The record must not be modified.
+// WithRecordTap must be called before the consumer is run, and has no cost
+// when it isn't called.
+func (c *Consumer) WithRecordTap(tap func(*kgo.Record)) *Consumer {
+	pollRecords := c.pollRecords
+	c.pollRecords = func(ctx context.Context, max int) kgo.Fetches {
+		fetches := pollRecords(ctx, max)
+		fetches.EachRecord(tap)
+		return fetches
+	}
+	return c
+}
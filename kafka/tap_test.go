@@ -0,0 +1,98 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestProducerRecordTap(t *testing.T) {
+	producer := newTestProducer(t, ProducerConfig{
+		Sync:            true,
+		KeyFromMetadata: "tenant",
+	})
+	producer.produce = func(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+		promise(r, nil)
+	}
+	var tapped []*kgo.Record
+	producer.WithRecordTap(func(r *kgo.Record) { tapped = append(tapped, r) })
+
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"tenant": "a"})
+	batch := model.Batch{{Message: "1"}, {Message: "2"}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	require.NoError(t, producer.ProduceRaw(context.Background(), "raw", []byte("b"), nil,
+		kgo.RecordHeader{Key: "h", Value: []byte("v")},
+	))
+
+	require.Len(t, tapped, 3)
+	for _, r := range tapped[:2] {
+		assert.Equal(t, "topic", r.Topic)
+		assert.Equal(t, []byte("a"), r.Key)
+		assert.Equal(t, []kgo.RecordHeader{{Key: "tenant", Value: []byte("a")}}, r.Headers)
+	}
+	assert.Equal(t, "raw", tapped[2].Topic)
+	assert.Equal(t, []byte("b"), tapped[2].Key)
+	assert.Equal(t, []kgo.RecordHeader{{Key: "h", Value: []byte("v")}}, tapped[2].Headers)
+}
+
+func TestConsumerRecordTap(t *testing.T) {
+	var processed []string
+	consumer := newTestConsumer(t, ConsumerConfig{
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed = append(processed, event.Message)
+			}
+			return nil
+		}),
+	})
+	consumer.commitOffsets = func(context.Context) error { return nil }
+	consumer.pollRecords = func(context.Context, int) kgo.Fetches {
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic: "topic",
+			Partitions: []kgo.FetchPartition{{Records: []*kgo.Record{
+				{
+					Topic:   "topic",
+					Key:     []byte("k"),
+					Value:   []byte("a"),
+					Headers: []kgo.RecordHeader{{Key: "tenant", Value: []byte("x")}},
+				},
+			}}},
+		}}}}
+	}
+	var tapped []*kgo.Record
+	consumer.WithRecordTap(func(r *kgo.Record) {
+		// Records are tapped before they are processed.
+		assert.Empty(t, processed)
+		tapped = append(tapped, r)
+	})
+	_, err := consumer.fetch(context.Background())
+	require.NoError(t, err)
+
+	require.Len(t, tapped, 1)
+	assert.Equal(t, []byte("k"), tapped[0].Key)
+	assert.Equal(t, []kgo.RecordHeader{{Key: "tenant", Value: []byte("x")}}, tapped[0].Headers)
+	assert.Equal(t, []string{"a"}, processed)
+}
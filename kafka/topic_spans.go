@@ -0,0 +1,126 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// topicSpans traces the records of a batch produced to each topic with a
+// child span of the batch span, when PerTopicSpans is set. A topic span
+// starts when the first record of the batch is produced to the topic, and
+// ends once all the records of the batch produced to it have been
+// acknowledged or failed.
+type topicSpans struct {
+	ctx    context.Context
+	tracer trace.Tracer
+
+	mu        sync.Mutex
+	spans     map[string]*topicSpan
+	producing bool
+}
+
+// topicSpan holds the state of the span of a topic.
+type topicSpan struct {
+	span trace.Span
+	// records is the number of records produced to the topic, and pending
+	// the number of them which haven't been acknowledged or failed yet.
+	records int
+	pending int
+	err     error
+}
+
+// newTopicSpans returns the topicSpans of a batch traced by the span in ctx,
+// or nil when PerTopicSpans isn't set. done must be called once all the
+// records of the batch have been produced.
+func (p *Producer) newTopicSpans(ctx context.Context) *topicSpans {
+	if !p.cfg.PerTopicSpans {
+		return nil
+	}
+	return &topicSpans{
+		ctx:       ctx,
+		tracer:    p.tracer,
+		spans:     make(map[string]*topicSpan),
+		producing: true,
+	}
+}
+
+// promise wraps the promise of a record produced to topic to track it in
+// the topic span. It returns promise when s is nil.
+func (s *topicSpans) promise(topic string, promise func(*kgo.Record, error)) func(*kgo.Record, error) {
+	if s == nil {
+		return promise
+	}
+	s.mu.Lock()
+	ts, ok := s.spans[topic]
+	if !ok {
+		_, span := s.tracer.Start(s.ctx, "producer.Topic",
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(attribute.String("topic", topic)),
+		)
+		ts = &topicSpan{span: span}
+		s.spans[topic] = ts
+	}
+	ts.records++
+	ts.pending++
+	s.mu.Unlock()
+	return func(r *kgo.Record, err error) {
+		promise(r, err)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		ts.pending--
+		if err != nil && ts.err == nil {
+			ts.err = err
+		}
+		if !s.producing && ts.pending == 0 {
+			ts.end()
+		}
+	}
+}
+
+// done is called once all the records of the batch have been produced, and
+// ends the spans of the topics whose records have all been acknowledged or
+// failed.
+func (s *topicSpans) done() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.producing = false
+	for _, ts := range s.spans {
+		if ts.pending == 0 {
+			ts.end()
+		}
+	}
+}
+
+// end records the number of records produced to the topic, and the first
+// error, and ends the span.
+func (ts *topicSpan) end() {
+	ts.span.SetAttributes(attribute.Int("batch.size", ts.records))
+	if ts.err != nil {
+		spanError(ts.span, ts.err)
+	}
+	ts.span.End()
+}
@@ -0,0 +1,102 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"crypto/rand"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ propagation.TextMapCarrier = headerCarrier{}
+
+// headerCarrier adapts a set of Kafka record headers to the
+// propagation.TextMapCarrier interface.
+type headerCarrier struct {
+	headers *[]kgo.RecordHeader
+}
+
+// Get returns the value associated with the passed key.
+func (c headerCarrier) Get(key string) string {
+	for _, h := range *c.headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Set stores the key-value pair, replacing any existing value for the key.
+func (c headerCarrier) Set(key, value string) {
+	for i, h := range *c.headers {
+		if h.Key == key {
+			(*c.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.headers = append(*c.headers, kgo.RecordHeader{
+		Key:   key,
+		Value: []byte(value),
+	})
+}
+
+// Keys lists the keys stored in this carrier.
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.headers))
+	for _, h := range *c.headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// startSpan starts the consumer.Process span of msg, as a child of the trace
+// context propagated in its headers. When msg carries the DebugHeader, the
+// parent trace context is marked as sampled so the span is sampled too.
+func (c *Consumer) startSpan(ctx context.Context, msg *kgo.Record) (context.Context, trace.Span) {
+	ctx = propagation.TraceContext{}.Extract(ctx, headerCarrier{&msg.Headers})
+	if c.cfg.DebugHeader != "" && hasHeader(msg, c.cfg.DebugHeader) {
+		ctx = forceSampled(ctx)
+	}
+	return c.tracer.Start(ctx, "consumer.Process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("topic", msg.Topic),
+			attribute.Int64("partition", int64(msg.Partition)),
+			attribute.Int64("offset", msg.Offset),
+		),
+	)
+}
+
+// forceSampled returns a copy of ctx whose remote trace context is sampled.
+// When ctx has no trace context, a remote one is generated, since samplers
+// can only be overridden through the parent sampling decision.
+func forceSampled(ctx context.Context) context.Context {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		var cfg trace.SpanContextConfig
+		rand.Read(cfg.TraceID[:])
+		rand.Read(cfg.SpanID[:])
+		sc = trace.NewSpanContext(cfg)
+	}
+	sc = sc.WithTraceFlags(sc.TraceFlags().WithSampled(true))
+	return trace.ContextWithRemoteSpanContext(ctx, sc)
+}
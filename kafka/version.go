@@ -0,0 +1,65 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/kversion"
+)
+
+// minVersionTimeout is the time allowed for checking the broker versions
+// against MinKafkaVersion when creating a producer or consumer.
+const minVersionTimeout = 10 * time.Second
+
+// checkMinVersion requests the API versions supported by a broker through r
+// and returns an error when the broker supports a lower version of any of the
+// requests than min. Requests the broker doesn't advertise at all, such as the
+// inter broker requests which KRaft brokers don't expose, are ignored.
+func checkMinVersion(ctx context.Context, r kmsg.Requestor, min *kversion.Versions) error {
+	ctx, cancel := context.WithTimeout(ctx, minVersionTimeout)
+	defer cancel()
+	req := kmsg.NewPtrApiVersionsRequest()
+	resp, err := req.RequestWith(ctx, r)
+	if err != nil {
+		return fmt.Errorf("failed to request api versions: %w", err)
+	}
+	if err := kerr.ErrorForCode(resp.ErrorCode); err != nil {
+		return fmt.Errorf("failed to request api versions: %w", err)
+	}
+	supported := make(map[int16]int16, len(resp.ApiKeys))
+	for _, k := range resp.ApiKeys {
+		supported[k.ApiKey] = k.MaxVersion
+	}
+	var tooOld error
+	min.EachMaxKeyVersion(func(key, version int16) {
+		max, ok := supported[key]
+		if tooOld != nil || !ok || max >= version {
+			return
+		}
+		tooOld = fmt.Errorf(
+			"kafka: broker supports %s up to version %d, below version %d required by min kafka version",
+			kmsg.NameForKey(key), max, version,
+		)
+	})
+	return tooOld
+}
@@ -0,0 +1,80 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/kversion"
+)
+
+// apiVersionsRequestor answers ApiVersions requests with the request
+// versions of a Kafka version.
+type apiVersionsRequestor struct {
+	versions  *kversion.Versions
+	errorCode int16
+	err       error
+}
+
+func (r apiVersionsRequestor) Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	resp := req.ResponseKind().(*kmsg.ApiVersionsResponse)
+	resp.ErrorCode = r.errorCode
+	r.versions.EachMaxKeyVersion(func(key, version int16) {
+		k := kmsg.NewApiVersionsResponseApiKey()
+		k.ApiKey = key
+		k.MaxVersion = version
+		resp.ApiKeys = append(resp.ApiKeys, k)
+	})
+	return resp, nil
+}
+
+func TestCheckMinVersion(t *testing.T) {
+	broker := apiVersionsRequestor{versions: kversion.V2_8_0()}
+	ctx := context.Background()
+
+	assert.NoError(t, checkMinVersion(ctx, broker, kversion.V2_8_0()))
+	assert.NoError(t, checkMinVersion(ctx, broker, kversion.V2_1_0()))
+
+	err := checkMinVersion(ctx, broker, kversion.V3_0_0())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "required by min kafka version")
+
+	// Requests the broker doesn't advertise are ignored.
+	versions := kversion.V2_8_0()
+	versions.SetMaxKeyVersion(int16(kmsg.LeaderAndISR), -1)
+	assert.NoError(t, checkMinVersion(ctx, apiVersionsRequestor{versions: versions}, kversion.V2_8_0()))
+
+	err = checkMinVersion(ctx, apiVersionsRequestor{
+		versions:  kversion.V2_8_0(),
+		errorCode: kerr.UnsupportedVersion.Code,
+	}, kversion.V2_8_0())
+	assert.ErrorIs(t, err, kerr.UnsupportedVersion)
+
+	errRequest := errors.New("connection refused")
+	err = checkMinVersion(ctx, apiVersionsRequestor{err: errRequest}, kversion.V2_8_0())
+	assert.ErrorIs(t, err, errRequest)
+}
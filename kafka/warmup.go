@@ -0,0 +1,65 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// warmupTimeout bounds the time NewProducer waits for the connections to the
+// brokers to be established with EagerConnect.
+const warmupTimeout = 10 * time.Second
+
+// Warmup fetches the cluster metadata and establishes the connections to all
+// the brokers, so that the first ProcessBatch doesn't pay the connection
+// latency. The metadata of the topics is still loaded the first time records
+// are produced to them. It can be called again after Reconfigure, which
+// creates new connections.
+func (p *Producer) Warmup(ctx context.Context) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return warmup(ctx, p.client)
+}
+
+// warmup requests the brokers of the cluster from the seed brokers, then
+// requests them from every broker to connect to them.
+func warmup(ctx context.Context, client *kgo.Client) error {
+	resp, err := metadataRequest().RequestWith(ctx, client)
+	if err != nil {
+		return fmt.Errorf("failed to request metadata: %w", err)
+	}
+	for _, b := range resp.Brokers {
+		broker := client.Broker(int(b.NodeID))
+		if _, err := broker.Request(ctx, metadataRequest()); err != nil {
+			return fmt.Errorf("failed to connect to broker %d: %w", b.NodeID, err)
+		}
+	}
+	return nil
+}
+
+// metadataRequest returns a metadata request which only lists the brokers.
+func metadataRequest() *kmsg.MetadataRequest {
+	req := kmsg.NewPtrMetadataRequest()
+	req.Topics = []kmsg.MetadataRequestTopic{}
+	return req
+}
@@ -0,0 +1,42 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func TestProducerEagerConnect(t *testing.T) {
+	broker := newFakeBroker(t)
+	producer := newTestProducer(t, ProducerConfig{
+		Broker:       broker.addr.String(),
+		EagerConnect: true,
+	})
+	// The metadata is requested from the seed broker, then from the broker
+	// it lists, before the first produce.
+	assert.GreaterOrEqual(t, broker.requested(kmsg.Metadata), 2)
+	assert.Empty(t, broker.produced())
+	assert.NoError(t, producer.Healthy())
+
+	require.NoError(t, producer.Warmup(context.Background()))
+}
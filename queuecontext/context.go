@@ -19,10 +19,20 @@
 // accessing a stored metadata.
 package queuecontext
 
-import "context"
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
 
 type metadataKey struct{}
 
+type recordIDKey struct{}
+
+type recordMetadataKey struct{}
+
 // WithMetadata enriches a context with metadata.
 func WithMetadata(ctx context.Context, metadata map[string]string) context.Context {
 	return context.WithValue(ctx, metadataKey{}, metadata)
@@ -37,3 +47,59 @@ func MetadataFromContext(ctx context.Context) (map[string]string, bool) {
 	}
 	return nil, false
 }
+
+// FromHeaders enriches a context with the metadata stored in the Kafka record
+// headers. Only the headers whose key starts with prefix are added to the
+// metadata, with the prefix trimmed from the key. An empty prefix adds all the
+// headers.
+func FromHeaders(ctx context.Context, headers []kgo.RecordHeader, prefix string) context.Context {
+	metadata := make(map[string]string, len(headers))
+	for _, h := range headers {
+		if !strings.HasPrefix(h.Key, prefix) {
+			continue
+		}
+		metadata[strings.TrimPrefix(h.Key, prefix)] = string(h.Value)
+	}
+	return WithMetadata(ctx, metadata)
+}
+
+// WithRecordID enriches a context with the ID of the record being processed.
+func WithRecordID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, recordIDKey{}, id)
+}
+
+// RecordID returns the ID of the record being processed from the passed
+// context and a bool indicating whether the value is present or not. The ID
+// is unique to the record and stable across processing attempts, so it can
+// be used as an idempotency key by downstream systems.
+func RecordID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(recordIDKey{}).(string)
+	return id, ok
+}
+
+// RecordMetadata holds the Kafka metadata of the record being processed.
+type RecordMetadata struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Timestamp time.Time
+	// HighWatermark is the high watermark of the partition when the record
+	// was fetched, the offset of the next record produced to it, so that
+	// HighWatermark-Offset-1 records had been produced after the record. It
+	// is zero when unknown.
+	HighWatermark int64
+}
+
+// WithRecordMetadata enriches a context with the Kafka metadata of the record
+// being processed.
+func WithRecordMetadata(ctx context.Context, metadata RecordMetadata) context.Context {
+	return context.WithValue(ctx, recordMetadataKey{}, metadata)
+}
+
+// RecordMetadataFromContext returns the Kafka metadata of the record being
+// processed from the passed context and a bool indicating whether the value
+// is present or not.
+func RecordMetadataFromContext(ctx context.Context) (RecordMetadata, bool) {
+	metadata, ok := ctx.Value(recordMetadataKey{}).(RecordMetadata)
+	return metadata, ok
+}
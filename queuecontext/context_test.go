@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package queuecontext
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestFromHeaders(t *testing.T) {
+	metadata := map[string]string{
+		"a": "b",
+		"c": "d",
+	}
+	tests := []struct {
+		name   string
+		prefix string
+	}{
+		{name: "no prefix"},
+		{name: "prefix", prefix: "meta."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := []kgo.RecordHeader{
+				{Key: "traceparent", Value: []byte("00-1-1-01")},
+			}
+			for k, v := range metadata {
+				headers = append(headers, kgo.RecordHeader{
+					Key:   tt.prefix + k,
+					Value: []byte(v),
+				})
+			}
+			ctx := FromHeaders(context.Background(), headers, tt.prefix)
+			got, ok := MetadataFromContext(ctx)
+			assert.True(t, ok)
+			if tt.prefix == "" {
+				assert.Equal(t, map[string]string{
+					"a": "b", "c": "d", "traceparent": "00-1-1-01",
+				}, got)
+			} else {
+				assert.Equal(t, metadata, got)
+			}
+		})
+	}
+}
+
+func TestRecordID(t *testing.T) {
+	_, ok := RecordID(context.Background())
+	assert.False(t, ok)
+
+	ctx := WithRecordID(context.Background(), "topic-1-42")
+	id, ok := RecordID(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "topic-1-42", id)
+}
+
+func TestRecordMetadata(t *testing.T) {
+	_, ok := RecordMetadataFromContext(context.Background())
+	assert.False(t, ok)
+
+	want := RecordMetadata{
+		Topic:     "topic",
+		Partition: 1,
+		Offset:    42,
+		Timestamp: time.Unix(1, 0),
+	}
+	got, ok := RecordMetadataFromContext(WithRecordMetadata(context.Background(), want))
+	assert.True(t, ok)
+	assert.Equal(t, want, got)
+}